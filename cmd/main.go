@@ -1,14 +1,21 @@
 package main
 
 import (
+	"os"
+
 	"github.com/jdrew153/controllers"
 	"github.com/jdrew153/lib"
+	"github.com/jdrew153/migrations"
 	"github.com/jdrew153/server"
 	"github.com/jdrew153/services"
 	"go.uber.org/fx"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(migrate(os.Args[2:]))
+	}
+
 	fx.New(
 		fx.Provide(
 			controllers.NewTranscoderController,
@@ -16,12 +23,15 @@ func main() {
 			services.NewTranscoderService,
 			services.NewMediaService,
 			services.NewSploaderService,
+			services.NewRateLimiter,
+			services.NewOriginService,
 			lib.CreatePusherClient,
 			lib.CreateRedisClient,
 			lib.CreateCache,
 			lib.CreateDBConnection,
+			lib.CreateRepositories,
 			
 		),
-		fx.Invoke(server.NewMuxServer),
+		fx.Invoke(migrations.RequireCurrentSchema, server.NewMuxServer),
 	).Run()
 }
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/jdrew153/lib"
+	"github.com/jdrew153/migrations"
+	"github.com/jdrew153/repositories"
+	"github.com/jdrew153/services"
+)
+
+const migrateUsage = "usage: migrate up | down [steps] | status | api-keys | admin-key <applicationId> <userId>"
+
+// migrate runs the migrate command against the DSN database and returns the
+// exit code.
+func migrate(args []string) int {
+
+	if len(args) == 0 {
+		fmt.Println(migrateUsage)
+		return 2
+	}
+
+	if args[0] == "api-keys" {
+		return migrateAPIKeys()
+	}
+
+	if args[0] == "admin-key" {
+		if len(args) != 3 {
+			fmt.Println(migrateUsage)
+			return 2
+		}
+
+		return createAdminKey(args[1], args[2])
+	}
+
+	db, err := lib.OpenDB()
+
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	defer db.Close()
+
+	dialect, err := repositories.DialectFor(lib.DBDriver())
+
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	migrator, err := migrations.NewMigrator(db, migrations.DirFor(dialect))
+
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	switch args[0] {
+	case "up":
+		applied, err := migrator.Up(ctx)
+
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+
+		fmt.Printf("Applied %d migrations\n", len(applied))
+	case "down":
+		steps := 1
+
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+
+			if err != nil || steps < 1 {
+				fmt.Println(migrateUsage)
+				return 2
+			}
+		}
+
+		reverted, err := migrator.Down(ctx, steps)
+
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+
+		fmt.Printf("Reverted %d migrations\n", len(reverted))
+	case "status":
+		status, err := migrator.Status(ctx)
+
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+
+		for _, migration := range status {
+
+			applied := "pending"
+
+			if migration.AppliedAt > 0 {
+				applied = time.UnixMilli(migration.AppliedAt).UTC().Format(time.RFC3339)
+			}
+
+			fmt.Printf("%04d_%-28s %s\n", migration.Version, migration.Name, applied)
+		}
+	default:
+		fmt.Println(migrateUsage)
+		return 2
+	}
+
+	return 0
+}
+
+// migrateAPIKeys moves the API keys stored raw in Redis, from before keys
+// were hashed, to hashed storage.
+func migrateAPIKeys() int {
+
+	client, err := lib.OpenRedis()
+
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	media := &services.MediaService{Redis: client}
+
+	migrated, err := media.MigrateLegacyAPIKeys(ctx)
+
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	fmt.Printf("Migrated %d API keys\n", migrated)
+
+	return 0
+}
+
+// createAdminKey creates the first admin key of an application, the API only
+// lets admin keys create keys and migrated keys have no admin scope.
+func createAdminKey(applicationId string, userId string) int {
+
+	db, err := lib.OpenDB()
+
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	defer db.Close()
+
+	dialect, err := repositories.DialectFor(lib.DBDriver())
+
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err = repositories.New(db, dialect).Applications.SubscriptionType(ctx, applicationId)
+
+	if err == sql.ErrNoRows {
+		log.Printf("Application %s not found", applicationId)
+		return 1
+	}
+
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	client, err := lib.OpenRedis()
+
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	defer client.Close()
+
+	media := &services.MediaService{Redis: client}
+
+	apiKey, record, err := media.CreateAPIKey(services.ValidUserIDAndAppIDModel{
+		ApplicationId: applicationId,
+		UserId:        userId,
+		Scopes:        []string{services.ScopeAdmin},
+	})
+
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	fmt.Printf("Created admin key %s for application %s, it is only shown once:\n%s\n", record.Prefix, applicationId, apiKey)
+
+	return 0
+}
@@ -0,0 +1,451 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/jdrew153/services"
+)
+
+type CreateAPIKeyRequest struct {
+	Name           string   `json:"name"`
+	Scopes         []string `json:"scopes"`
+	AllowedOrigins []string `json:"allowedOrigins"`
+	AllowedIps     []string `json:"allowedIps"`
+	ExpiresAt      int64    `json:"expiresAt"`
+	MaxUploadSize  int64    `json:"maxUploadSize"`
+}
+
+type RotateAPIKeyRequest struct {
+	Id string `json:"id"`
+	// GraceSeconds is how long the old key keeps working, a day when unset.
+	GraceSeconds *int64 `json:"graceSeconds"`
+}
+
+// APIKeyResponse carries a new key, which is only ever returned here.
+type APIKeyResponse struct {
+	Key    string                            `json:"key"`
+	Record services.ValidUserIDAndAppIDModel `json:"record"`
+}
+
+// APIKeysController manages the keys of the caller's application: GET lists
+// them, POST creates one and DELETE revokes the one given by the id query
+// parameter. It needs the admin scope.
+func (c *MediaController) APIKeysController(w http.ResponseWriter, r *http.Request) {
+
+	authModel, ok := services.APIKeyFromContext(r.Context())
+
+	if !ok {
+		http.Error(w, "Invalid API key", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		c.listAPIKeys(w, authModel)
+	case http.MethodPost:
+		c.createAPIKey(w, r, authModel)
+	case http.MethodDelete:
+		c.revokeAPIKey(w, r, authModel)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (c *MediaController) listAPIKeys(w http.ResponseWriter, authModel services.ValidUserIDAndAppIDModel) {
+
+	keys, err := c.Service.ListAPIKeys(authModel.ApplicationId)
+
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
+
+func (c *MediaController) createAPIKey(w http.ResponseWriter, r *http.Request, authModel services.ValidUserIDAndAppIDModel) {
+
+	var body CreateAPIKeyRequest
+
+	err := json.NewDecoder(r.Body).Decode(&body)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if body.ExpiresAt != 0 && body.ExpiresAt <= time.Now().UnixMilli() {
+		http.Error(w, "expiresAt must be in the future", http.StatusBadRequest)
+		return
+	}
+
+	scopes := body.Scopes
+
+	if len(scopes) == 0 {
+		scopes = services.LegacyScopes
+	}
+
+	for _, scope := range scopes {
+		if !services.ValidScope(scope) {
+			http.Error(w, "Unknown scope "+scope, http.StatusBadRequest)
+			return
+		}
+	}
+
+	record := services.ValidUserIDAndAppIDModel{
+		Name:           body.Name,
+		UserId:         authModel.UserId,
+		ApplicationId:  authModel.ApplicationId,
+		Scopes:         scopes,
+		AllowedOrigins: body.AllowedOrigins,
+		AllowedIps:     body.AllowedIps,
+		ExpiresAt:      body.ExpiresAt,
+		MaxUploadSize:  body.MaxUploadSize,
+	}
+
+	err = record.ValidateRestrictions()
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	key, record, err := c.Service.CreateAPIKey(record)
+
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Created API key %s for application %s", record.Prefix, record.ApplicationId)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(APIKeyResponse{Key: key, Record: record})
+}
+
+func (c *MediaController) revokeAPIKey(w http.ResponseWriter, r *http.Request, authModel services.ValidUserIDAndAppIDModel) {
+
+	err := c.Service.RevokeAPIKey(authModel.ApplicationId, r.URL.Query().Get("id"))
+
+	if errors.Is(err, services.ErrAPIKeyNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RotateAPIKeyController replaces a key with a new one having the same
+// restrictions, the old key keeps working until the grace period ends.
+func (c *MediaController) RotateAPIKeyController(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	authModel, ok := services.APIKeyFromContext(r.Context())
+
+	if !ok {
+		http.Error(w, "Invalid API key", http.StatusUnauthorized)
+		return
+	}
+
+	var body RotateAPIKeyRequest
+
+	err := json.NewDecoder(r.Body).Decode(&body)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	grace := services.DefaultRotationGrace
+
+	if body.GraceSeconds != nil {
+		grace = time.Duration(*body.GraceSeconds) * time.Second
+	}
+
+	if grace < 0 || grace > services.MaxRotationGrace {
+		http.Error(w, "graceSeconds is out of range", http.StatusBadRequest)
+		return
+	}
+
+	key, record, err := c.Service.RotateAPIKey(authModel.ApplicationId, body.Id, grace)
+
+	if errors.Is(err, services.ErrAPIKeyNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if errors.Is(err, services.ErrAPIKeyRotated) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Rotated API key %s of application %s to %s", body.Id, record.ApplicationId, record.Prefix)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(APIKeyResponse{Key: key, Record: record})
+}
+
+type UploadTokenRequest struct {
+	MaxSize   int64    `json:"maxSize"`
+	MimeTypes []string `json:"mimeTypes"`
+	Folder    string   `json:"folder"`
+	// FileId binds the token to one upload, see services.UploadTokenClaims.
+	FileId     string `json:"fileId"`
+	TtlSeconds int    `json:"ttlSeconds"`
+}
+
+type UploadTokenResponse struct {
+	Token     string `json:"token"`
+	ExpiresAt int64  `json:"expiresAt"`
+}
+
+// UploadTokenController mints a short lived upload token for a browser, it
+// is sent as the uploadToken form field of chunked uploads instead of the
+// API key. The token never allows more than the minting key and uploads a
+// single file.
+func (c *MediaController) UploadTokenController(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	authModel, ok := services.APIKeyFromContext(r.Context())
+
+	if !ok {
+		http.Error(w, "Invalid API key", http.StatusUnauthorized)
+		return
+	}
+
+	var body UploadTokenRequest
+
+	err := json.NewDecoder(r.Body).Decode(&body)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ttl := services.DefaultUploadTokenTtl
+
+	if body.TtlSeconds != 0 {
+		ttl = time.Duration(body.TtlSeconds) * time.Second
+	}
+
+	if ttl <= 0 || ttl > services.MaxUploadTokenTtl {
+		http.Error(w, "ttlSeconds is out of range", http.StatusBadRequest)
+		return
+	}
+
+	expiresAt := time.Now().Add(ttl).UnixMilli()
+
+	if authModel.ExpiresAt > 0 && authModel.ExpiresAt < expiresAt {
+		expiresAt = authModel.ExpiresAt
+	}
+
+	maxSize := body.MaxSize
+
+	if maxSize < 0 {
+		http.Error(w, "maxSize must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	if authModel.MaxUploadSize > 0 && (maxSize == 0 || maxSize > authModel.MaxUploadSize) {
+		maxSize = authModel.MaxUploadSize
+	}
+
+	token, err := services.NewUploadToken(services.UploadTokenClaims{
+		ApplicationId:  authModel.ApplicationId,
+		UserId:         authModel.UserId,
+		MaxSize:        maxSize,
+		MimeTypes:      body.MimeTypes,
+		Folder:         body.Folder,
+		AllowedOrigins: authModel.AllowedOrigins,
+		FileId:         body.FileId,
+		ExpiresAt:      expiresAt,
+	})
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(UploadTokenResponse{Token: token, ExpiresAt: expiresAt})
+}
+
+type ApplicationOriginRequest struct {
+	Origin string `json:"origin"`
+}
+
+// ApplicationOriginsController manages the origins of the caller's
+// application: GET lists them, POST adds one and DELETE removes the one
+// given by the origin query parameter. It needs the admin scope.
+func (c *MediaController) ApplicationOriginsController(w http.ResponseWriter, r *http.Request) {
+
+	authModel, ok := services.APIKeyFromContext(r.Context())
+
+	if !ok {
+		http.Error(w, "Invalid API key", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		c.listApplicationOrigins(w, authModel)
+	case http.MethodPost:
+		c.addApplicationOrigin(w, r, authModel)
+	case http.MethodDelete:
+		c.removeApplicationOrigin(w, r, authModel)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (c *MediaController) listApplicationOrigins(w http.ResponseWriter, authModel services.ValidUserIDAndAppIDModel) {
+
+	origins, err := c.Sploader.ApplicationOrigins(authModel.ApplicationId)
+
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(origins)
+}
+
+func (c *MediaController) addApplicationOrigin(w http.ResponseWriter, r *http.Request, authModel services.ValidUserIDAndAppIDModel) {
+
+	var body ApplicationOriginRequest
+
+	err := json.NewDecoder(r.Body).Decode(&body)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = services.ValidateOrigin(body.Origin)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = c.Sploader.AddApplicationOrigin(authModel.ApplicationId, body.Origin)
+
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	c.Origins.InvalidatePolicy(authModel.ApplicationId)
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (c *MediaController) removeApplicationOrigin(w http.ResponseWriter, r *http.Request, authModel services.ValidUserIDAndAppIDModel) {
+
+	err := c.Sploader.RemoveApplicationOrigin(authModel.ApplicationId, r.URL.Query().Get("origin"))
+
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	c.Origins.InvalidatePolicy(authModel.ApplicationId)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HotlinkProtectionController manages the hotlink protection of the caller's
+// application: GET returns it and PUT replaces it. It needs the admin scope.
+func (c *MediaController) HotlinkProtectionController(w http.ResponseWriter, r *http.Request) {
+
+	authModel, ok := services.APIKeyFromContext(r.Context())
+
+	if !ok {
+		http.Error(w, "Invalid API key", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		c.getHotlinkProtection(w, authModel)
+	case http.MethodPut:
+		c.setHotlinkProtection(w, r, authModel)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (c *MediaController) getHotlinkProtection(w http.ResponseWriter, authModel services.ValidUserIDAndAppIDModel) {
+
+	var policy services.HotlinkPolicy
+
+	_, err := c.Sploader.GetApplicationSetting(authModel.ApplicationId, services.HotlinkSetting, &policy)
+
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(policy)
+}
+
+func (c *MediaController) setHotlinkProtection(w http.ResponseWriter, r *http.Request, authModel services.ValidUserIDAndAppIDModel) {
+
+	var policy services.HotlinkPolicy
+
+	err := json.NewDecoder(r.Body).Decode(&policy)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = c.Sploader.SetApplicationSetting(authModel.ApplicationId, services.HotlinkSetting, policy)
+
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	c.Origins.InvalidatePolicy(authModel.ApplicationId)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(policy)
+}
@@ -3,30 +3,36 @@ package controllers
 import (
 	"bytes"
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/jdrew153/repositories"
 	"github.com/jdrew153/services"
 )
 
 type MediaController struct {
 	Service *services.MediaService
 	Sploader *services.SploaderService
+	Origins *services.OriginService
 }
 
-func NewMediaController(s *services.MediaService, sploader *services.SploaderService) *MediaController {
+func NewMediaController(s *services.MediaService, sploader *services.SploaderService, origins *services.OriginService) *MediaController {
 	return &MediaController{
 		Service: s,
 		Sploader: sploader,
+		Origins: origins,
 	}
 }
 
@@ -40,6 +46,27 @@ func (c *MediaController) ServeContent(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	allowed, err := c.allowMediaRequest(w, r, filePath)
+
+	// without the policy the file is not served, it could be protected
+	if err != nil {
+		log.Println("Error applying the media origin policy:", err)
+		http.Error(w, "Media policy unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	if !allowed {
+		http.Error(w, "Hotlinking not allowed", http.StatusForbidden)
+		return
+	}
+
+	// blobs are only reached through the upload paths linking to them, and
+	// the source of an encrypted video would undo its encryption
+	if !c.servesPublicly(filePath) {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
 	if strings.Contains(filePath, ".mp4") || strings.Contains(filePath, ".m3u8") {
 
 		http.ServeFile(w,r, "./" + filePath)
@@ -69,6 +96,60 @@ func (c *MediaController) ServeContent(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// allowMediaRequest applies the origin policy of the application owning a
+// media file: browsers on other origins cannot read it and, with hotlink
+// protection, pages on other origins cannot embed it. Errors resolving the
+// policy are returned for the request to fail closed.
+func (c *MediaController) allowMediaRequest(w http.ResponseWriter, r *http.Request, filePath string) (bool, error) {
+
+	applicationId, err := c.Origins.MediaApplicationId(filePath)
+
+	if err != nil {
+		return false, err
+	}
+
+	if applicationId == "" {
+		return true, nil
+	}
+
+	policy, err := c.Origins.Policy(applicationId)
+
+	if err != nil {
+		return false, err
+	}
+
+	origin := r.Header.Get("Origin")
+
+	if !policy.AllowsOrigin(origin) {
+		w.Header().Del("Access-Control-Allow-Origin")
+	}
+
+	if policy.Hotlink.Enabled {
+		w.Header().Add("Vary", "Referer")
+	}
+
+	return policy.AllowsEmbedding(origin, r.Referer()), nil
+}
+
+// servesPublicly fails closed, a lookup error keeps the file back.
+func (c *MediaController) servesPublicly(filePath string) bool {
+
+	cleaned := path.Clean(filePath)
+
+	if cleaned == "media/blobs" || strings.HasPrefix(cleaned, "media/blobs/") {
+		return false
+	}
+
+	encrypted, err := c.Service.IsEncryptedSource(cleaned)
+
+	if err != nil {
+		log.Println("Error checking for an encrypted source:", err)
+		return false
+	}
+
+	return !encrypted
+}
+
 func (c *MediaController) DownloadContent(w http.ResponseWriter, r *http.Request) {
 	log.SetOutput(os.Stderr)
 	log.Println("Download request received")
@@ -85,20 +166,15 @@ func (c *MediaController) DownloadContent(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	apiKey := r.MultipartForm.Value["apiKey"][0]
+	// authenticated by the auth middleware, from the apiKey form field or an
+	// upload token constraining the file type and folder
+	authModel, _ := services.APIKeyFromContext(r.Context())
+	uploadToken, tokenUpload := services.UploadTokenFromContext(r.Context())
 
 	var done = make(chan bool)
 
 	go func(r *http.Request) {
 
-		authModel, err := c.Service.APIKeyCheck(apiKey)
-
-		if err != nil {
-			log.Println(err)
-		}
-		
-		log.Println("API Key: ", apiKey)
-
 		ext := r.URL.Query().Get("ext")
 		currChunk, _ := strconv.Atoi(r.URL.Query().Get("currChunk"))
 		totalChunks, _ := strconv.Atoi(r.URL.Query().Get("totalChunks"))
@@ -112,6 +188,46 @@ func (c *MediaController) DownloadContent(w http.ResponseWriter, r *http.Request
 
 		sentFileSize, _ := strconv.Atoi(r.URL.Query().Get("totalSize"))
 
+		folder := r.URL.Query().Get("folder")
+
+		if tokenUpload {
+			folder, err = uploadToken.UploadFolder(folder)
+
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				done <- true
+				return
+			}
+
+			if !uploadToken.AllowsMimeType(services.UploadMimeType(ext)) {
+				http.Error(w, services.ErrMimeTypeDenied.Error(), http.StatusUnsupportedMediaType)
+				done <- true
+				return
+			}
+		}
+
+		// tags and metadata to store with the upload, checked on every chunk
+		// so a bad value fails before the file is assembled
+		annotations, err := services.ParseUploadAnnotations(r.FormValue("tags"), r.FormValue("metadata"))
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			done <- true
+			return
+		}
+
+		finalFileName, err := services.SafeUploadPath(folder, fmt.Sprintf("%s.%s", baseFileName, ext))
+
+		if err == nil {
+			_, err = services.SafeUploadPath("", fileId)
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			done <- true
+			return
+		}
+
 		// header needs to be random
 		file, header, err := r.FormFile("file")
 
@@ -146,6 +262,24 @@ func (c *MediaController) DownloadContent(w http.ResponseWriter, r *http.Request
 			return
 		}
 
+		// the size limit holds for the chunks received so far, not only for
+		// the assembled file
+		received, err := chunksSize(dir)
+
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if !authModel.AllowsUploadSize(received) {
+			os.RemoveAll(dir)
+
+			http.Error(w, services.ErrUploadSizeExceeded.Error(), http.StatusRequestEntityTooLarge)
+			done <- true
+			return
+		}
+
 		if currChunk < totalChunks {
 
 			w.WriteHeader(http.StatusPartialContent)
@@ -154,7 +288,42 @@ func (c *MediaController) DownloadContent(w http.ResponseWriter, r *http.Request
 
 		} else {
 			// Create the final file
-			finalFileName := fmt.Sprintf("%s.%s", baseFileName, ext)
+			os.MkdirAll(filepath.Join("./media", folder), os.ModePerm)
+
+			// only a file of the caller's application outside of any upload may
+			// be replaced, never the file of a stored upload
+			_, existingId, err := c.Service.OwnedMediaUpload(finalFileName, authModel.ApplicationId)
+
+			if errors.Is(err, services.ErrMediaNotFound) || (err == nil && existingId != "") {
+				os.RemoveAll(dir)
+
+				http.Error(w, "File already exists", http.StatusConflict)
+				done <- true
+				return
+			}
+
+			if err != nil {
+				log.Println(err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			// the final chunk ends the token, it cannot start another upload
+			if tokenUpload {
+				if err := c.Service.SpendUploadToken(uploadToken); err != nil {
+					log.Println("Error spending upload token:", err)
+				}
+			}
+
+			// a stored upload is a symlink to its shared blob, creating the file
+			// in place would truncate the blob through it
+			err = os.Remove(fmt.Sprintf("./media/%s", finalFileName))
+
+			if err != nil && !os.IsNotExist(err) {
+				log.Println(err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
 
 			finalFile, err := os.Create(fmt.Sprintf("./media/%s", finalFileName))
 
@@ -219,36 +388,146 @@ func (c *MediaController) DownloadContent(w http.ResponseWriter, r *http.Request
 				return
 			}
 
+			if !authModel.AllowsUploadSize(totalSize) {
+				os.Remove(fmt.Sprintf("./media/%s", finalFileName))
+
+				http.Error(w, services.ErrUploadSizeExceeded.Error(), http.StatusRequestEntityTooLarge)
+				done <- true
+				return
+			}
+
+			if tokenUpload && !c.tokenAllowsContent(uploadToken, fmt.Sprintf("./media/%s", finalFileName)) {
+				os.Remove(fmt.Sprintf("./media/%s", finalFileName))
+
+				http.Error(w, services.ErrMimeTypeDenied.Error(), http.StatusUnsupportedMediaType)
+				done <- true
+				return
+			}
+
+			var uploadId string
 
 			remoteBool, _ := strconv.ParseBool(remote)
 
 			log.Printf("remote bool: %t", remoteBool)
 
+			_, imageErr := services.ImageFormatForExtension(ext)
+			isImage := imageErr == nil
+
+			var imageHash int64
+			var duplicateOf string
+			hashed := false
+
+			if isImage && remoteBool && authModel.ApplicationId != "" {
+
+				imageHash, duplicateOf, err = c.checkDuplicateUpload(authModel.ApplicationId, fmt.Sprintf("./media/%s", finalFileName))
+
+				if err == errDuplicateRejected {
+					os.Remove(fmt.Sprintf("./media/%s", finalFileName))
+
+					w.Header().Set("Content-Type", "application/json")
+					w.WriteHeader(http.StatusConflict)
+					json.NewEncoder(w).Encode(map[string]string{"error": err.Error(), "duplicateOf": duplicateOf})
+					done <- true
+					return
+				}
+
+				if err != nil {
+					log.Println("Error checking for duplicates:", err)
+				}
+
+				hashed = err == nil
+			}
+
 			if remoteBool {
 
 				log.Println("Remote upload detected")
 				log.Println("Application ID sent to service", authModel)
 
 		
+				originalFilename := r.URL.Query().Get("originalFilename")
+
+				if originalFilename == "" {
+					originalFilename = header.Filename
+				}
+
 				newUploadModel := services.NewUploadModel{
-					Url: fmt.Sprintf("https://kaykatjd.com/media/joshie_%s.%s", fileId, ext),
+					Url: fmt.Sprintf("https://kaykatjd.com/media/%s", path.Join(folder, fmt.Sprintf("joshie_%s.%s", fileId, ext))),
 					FileType: ext,
-					Size: strconv.Itoa(int(totalSize)),
+					Size: totalSize,
 					ApplicationId: authModel.ApplicationId,
 					UserId: authModel.UserId,
+					Status: repositories.UploadProcessing,
+					OriginalFilename: filepath.Base(originalFilename),
+					UploadAnnotations: annotations,
 				}
 	
-				err = c.Service.WriteNewUploadsToDB([]services.NewUploadModel{newUploadModel})
+				ids, err := c.Service.WriteNewUploadsToDB([]services.NewUploadModel{newUploadModel})
 
 				if err != nil {
 					log.Println(err)
 					w.WriteHeader(http.StatusInternalServerError)
 					return
 				}
+
+				uploadId = ids[0]
+
+				if hashed {
+					err = c.Service.WritePerceptualHashToDB(uploadId, imageHash, duplicateOf)
+
+					if err != nil {
+						log.Println(err)
+					}
+				}
+			}
+
+			if isImage {
+
+				policy, err := c.applicationMetadataPolicy(authModel.ApplicationId)
+
+				if err != nil {
+					log.Println(err)
+				} else if err := c.Service.ProcessImageMetadata(finalFileName, uploadId, policy); err != nil {
+					log.Println("Error processing image metadata:", err)
+				}
+
+				_, err = c.Service.GenerateImagePlaceholders(fmt.Sprintf("./media/%s", finalFileName), uploadId)
+
+				if err != nil {
+					log.Println("Error generating placeholders:", err)
+				}
 			}
 
+			if uploadId != "" {
+				// last step, everything above may still rewrite the file in place
+				_, err = c.Service.StoreBlob(fmt.Sprintf("./media/%s", finalFileName), uploadId)
+
+				status := repositories.UploadReady
+
+				if err != nil {
+					log.Println("Error storing blob:", err)
+					status = repositories.UploadFailed
+				}
+
+				err = c.Service.SetUploadStatus(uploadId, status)
+
+				if err != nil {
+					log.Println(err)
+				}
+
+				upload, err := c.Service.GetUpload(uploadId)
+
+				if err != nil {
+					log.Println(err)
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
 
-			w.WriteHeader(http.StatusCreated)
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusCreated)
+				json.NewEncoder(w).Encode(upload)
+			} else {
+				w.WriteHeader(http.StatusCreated)
+			}
 		}
 
 	
@@ -268,6 +547,52 @@ func (c *MediaController) DownloadContent(w http.ResponseWriter, r *http.Request
 	}
 }
 
+// tokenAllowsContent sniffs an uploaded file, the extension alone is checked
+// before the upload starts. Types the sniffer does not know are let through.
+func (c *MediaController) tokenAllowsContent(uploadToken services.UploadTokenClaims, filePath string) bool {
+
+	file, err := os.Open(filePath)
+
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+
+	defer file.Close()
+
+	head := make([]byte, 512)
+
+	n, _ := io.ReadFull(file, head)
+
+	sniffed, _, _ := strings.Cut(http.DetectContentType(head[:n]), ";")
+
+	return sniffed == "application/octet-stream" || uploadToken.AllowsMimeType(sniffed)
+}
+
+// chunksSize is the size of the chunks received for an upload.
+func chunksSize(dir string) (int64, error) {
+
+	entries, err := os.ReadDir(dir)
+
+	if err != nil {
+		return 0, err
+	}
+
+	var size int64
+
+	for _, entry := range entries {
+		info, err := entry.Info()
+
+		if err != nil {
+			return 0, err
+		}
+
+		size += info.Size()
+	}
+
+	return size, nil
+}
+
 type MyFile struct {
 	Name        string
 	NumericPart int64
@@ -314,7 +639,7 @@ func SetCacheHeaders(w http.ResponseWriter, r *http.Request, filePath string) {
 	ext := filepath.Ext(filePath)
 
 	switch ext {
-	case ".jpg", ".jpeg", ".png", ".gif":
+	case ".jpg", ".jpeg", ".png", ".gif", ".webp":
 		w.Header().Set("Cache-Control", "public, max-age=86400")
 	case ".mp4", ".mov", ".avi", ".webm":
 		w.Header().Set("Cache-Control", "public, max-age=604800")
@@ -325,7 +650,9 @@ func SetCacheHeaders(w http.ResponseWriter, r *http.Request, filePath string) {
 
 
 type ResizeImagesRequest struct {
-	FilePath string `json:"filePath"`
+	FilePath string                         `json:"filePath"`
+	UploadId string                         `json:"uploadId"`
+	Profiles []services.ImageVariantProfile `json:"profiles"`
 }
 
 
@@ -340,13 +667,129 @@ func (c *MediaController) ResizeImagesController(w http.ResponseWriter, r *http.
 		return
 	}
 
-	newFiles, err := c.Service.ResizeImages(body.FilePath)
+	authModel, ok := services.APIKeyFromContext(r.Context())
+
+	if !ok {
+		http.Error(w, "Invalid API key", http.StatusUnauthorized)
+		return
+	}
+
+	var focal *services.FocalPoint
+
+	uploadId := body.UploadId
+
+	if uploadId != "" {
+		upload, err := c.Service.GetUpload(uploadId)
+
+		if err == sql.ErrNoRows || (err == nil && upload.ApplicationId != authModel.ApplicationId) {
+			http.Error(w, "Upload not found", http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		uploadPath := strings.TrimPrefix(services.MediaPathFromUrl(upload.Url), "./media/")
+
+		if body.FilePath != "" && filepath.Clean(body.FilePath) != uploadPath {
+			http.Error(w, "filePath is not the file of the upload", http.StatusBadRequest)
+			return
+		}
+
+		body.FilePath = uploadPath
+
+		if upload.FocalX != nil && upload.FocalY != nil {
+			focal = &services.FocalPoint{X: *upload.FocalX, Y: *upload.FocalY}
+		}
+	} else {
+		body.FilePath, uploadId, err = c.Service.OwnedMediaUpload(body.FilePath, authModel.ApplicationId)
+
+		if errors.Is(err, services.ErrInvalidMediaPath) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if errors.Is(err, services.ErrMediaNotFound) {
+			http.Error(w, "Upload not found", http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if uploadId != "" {
+			upload, err := c.Service.GetUpload(uploadId)
+
+			if err != nil {
+				log.Println(err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			if upload.FocalX != nil && upload.FocalY != nil {
+				focal = &services.FocalPoint{X: *upload.FocalX, Y: *upload.FocalY}
+			}
+		}
+	}
+
+	profiles := body.Profiles
+
+	if len(profiles) == 0 {
+		profiles, err = c.applicationImageProfiles(authModel.ApplicationId)
+
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	policy, err := c.applicationMetadataPolicy(authModel.ApplicationId)
+
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	watermark, err := c.Sploader.ApplicationWatermark(authModel.ApplicationId)
+
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	newFiles, err := c.Service.ResizeImages(body.FilePath, services.ResizeImagesOptions{
+		Profiles:  profiles,
+		Policy:    policy,
+		Watermark: watermark,
+		Focal:     focal,
+	})
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-    /// TODO - add resize images to db
+
+	if uploadId != "" {
+		// the original is already the upload row itself
+		err = c.Service.WriteVariantsToDB(uploadId, "image", newFiles[:len(newFiles)-1])
+
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	} else {
+		log.Printf("No upload found for %s, variants not recorded", body.FilePath)
+	}
 
 	bytes, err := json.Marshal(newFiles)
 
@@ -358,4 +801,378 @@ func (c *MediaController) ResizeImagesController(w http.ResponseWriter, r *http.
 
 	w.Write([]byte(bytes))
 
-}
\ No newline at end of file
+}
+
+// applicationImageProfiles returns the variant profiles configured for the
+// application, falling back to the defaults.
+func (c *MediaController) applicationImageProfiles(applicationId string) ([]services.ImageVariantProfile, error) {
+
+	var profiles []services.ImageVariantProfile
+
+	ok, err := c.Sploader.GetApplicationSetting(applicationId, "imageProfiles", &profiles)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok || len(profiles) == 0 {
+		return services.DefaultImageVariantProfiles, nil
+	}
+
+	return profiles, nil
+}
+
+func (c *MediaController) applicationMetadataPolicy(applicationId string) (services.MetadataPolicy, error) {
+
+	policy := services.DefaultMetadataPolicy
+
+	if applicationId == "" {
+		return policy, nil
+	}
+
+	_, err := c.Sploader.GetApplicationSetting(applicationId, "metadataPolicy", &policy)
+
+	if err != nil {
+		return services.DefaultMetadataPolicy, err
+	}
+
+	if err := policy.Validate(); err != nil {
+		return services.DefaultMetadataPolicy, err
+	}
+
+	return policy, nil
+}
+
+func (c *MediaController) UploadsController(w http.ResponseWriter, r *http.Request) {
+
+	authModel, ok := services.APIKeyFromContext(r.Context())
+
+	if !ok {
+		http.Error(w, "Invalid API key", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		c.listUploads(w, r, authModel)
+	case http.MethodPatch:
+		c.patchUpload(w, r, authModel)
+	case http.MethodDelete:
+		c.deleteUpload(w, r, authModel)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (c *MediaController) listUploads(w http.ResponseWriter, r *http.Request, authModel services.ValidUserIDAndAppIDModel) {
+
+	if parentId := r.URL.Query().Get("parentId"); parentId != "" {
+		c.listUploadChildren(w, parentId, authModel)
+		return
+	}
+
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+
+	if err != nil || limit <= 0 || limit > 200 {
+		limit = 50
+	}
+
+	offset, err := strconv.Atoi(r.URL.Query().Get("offset"))
+
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+
+	filter, err := services.UploadFilterFromQuery(r.URL.Query())
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	uploads, err := c.Service.ListUploads(authModel.ApplicationId, filter, limit, offset)
+
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(uploads)
+}
+
+// listUploadChildren lists the uploads derived from one of the application's
+// uploads, like its renditions.
+func (c *MediaController) listUploadChildren(w http.ResponseWriter, parentId string, authModel services.ValidUserIDAndAppIDModel) {
+
+	parent, err := c.Service.GetUpload(parentId)
+
+	if err == sql.ErrNoRows || (err == nil && parent.ApplicationId != authModel.ApplicationId) {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	uploads, err := c.Service.ListUploadChildren(parentId)
+
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(uploads)
+}
+
+// maxAnnotationsBody bounds PATCH bodies, generously above the limits of the
+// annotations themselves.
+const maxAnnotationsBody = 64 << 10
+
+// patchUpload replaces the tags and metadata of an upload with the fields
+// present in the body.
+func (c *MediaController) patchUpload(w http.ResponseWriter, r *http.Request, authModel services.ValidUserIDAndAppIDModel) {
+
+	uploadId := r.URL.Query().Get("id")
+
+	var annotations services.UploadAnnotations
+
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAnnotationsBody)).Decode(&annotations)
+
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	err = annotations.Validate()
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	upload, err := c.Service.GetUpload(uploadId)
+
+	if err == sql.ErrNoRows || (err == nil && upload.ApplicationId != authModel.ApplicationId) {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = c.Service.SetUploadAnnotations(uploadId, annotations)
+
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	upload, err = c.Service.GetUpload(uploadId)
+
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(upload)
+}
+
+func (c *MediaController) deleteUpload(w http.ResponseWriter, r *http.Request, authModel services.ValidUserIDAndAppIDModel) {
+
+	uploadId := r.URL.Query().Get("id")
+
+	upload, err := c.Service.GetUpload(uploadId)
+
+	if err == sql.ErrNoRows || (err == nil && upload.ApplicationId != authModel.ApplicationId) {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = c.Service.DeleteUpload(uploadId)
+
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+var errDuplicateRejected = errors.New("upload is a near-duplicate of an existing upload")
+
+// checkDuplicateUpload hashes a finalized image and applies the application's
+// duplicate policy. It returns errDuplicateRejected when the upload must be refused.
+func (c *MediaController) checkDuplicateUpload(applicationId string, filePath string) (int64, string, error) {
+
+	hash, err := c.Service.ComputeImageHash(filePath)
+
+	if err != nil {
+		return 0, "", err
+	}
+
+	policy := services.DefaultDuplicatePolicy
+
+	_, err = c.Sploader.GetApplicationSetting(applicationId, "duplicatePolicy", &policy)
+
+	if err != nil {
+		return hash, "", err
+	}
+
+	if err := policy.Validate(); err != nil {
+		return hash, "", err
+	}
+
+	if policy.Mode == services.DuplicatesOff {
+		return hash, "", nil
+	}
+
+	duplicates, err := c.Service.FindNearDuplicates(applicationId, hash, policy.MaxDistance, "")
+
+	if err != nil || len(duplicates) == 0 {
+		return hash, "", err
+	}
+
+	log.Printf("Upload %s is a near-duplicate of %s (distance %d)", filePath, duplicates[0].Upload.Id, duplicates[0].Distance)
+
+	if policy.Mode == services.DuplicatesReject {
+		return hash, duplicates[0].Upload.Id, errDuplicateRejected
+	}
+
+	return hash, duplicates[0].Upload.Id, nil
+}
+
+func (c *MediaController) FindDuplicatesController(w http.ResponseWriter, r *http.Request) {
+
+	authModel, ok := services.APIKeyFromContext(r.Context())
+
+	if !ok {
+		http.Error(w, "Invalid API key", http.StatusUnauthorized)
+		return
+	}
+
+	uploadId := r.URL.Query().Get("uploadId")
+
+	upload, err := c.Service.GetUpload(uploadId)
+
+	if err == sql.ErrNoRows || (err == nil && upload.ApplicationId != authModel.ApplicationId) {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	distance, err := strconv.Atoi(r.URL.Query().Get("distance"))
+
+	if err != nil || distance < 0 || distance > 64 {
+		distance = services.DefaultDuplicatePolicy.MaxDistance
+	}
+
+	hash, err := c.Service.GetUploadHash(uploadId)
+
+	if err == sql.ErrNoRows {
+		http.Error(w, "Upload has no perceptual hash", http.StatusUnprocessableEntity)
+		return
+	}
+
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	duplicates, err := c.Service.FindNearDuplicates(authModel.ApplicationId, hash, distance, uploadId)
+
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(duplicates)
+}
+
+type FocalPointRequest struct {
+	UploadId   string               `json:"uploadId"`
+	FocalPoint *services.FocalPoint `json:"focalPoint"`
+}
+
+// FocalPointController sets or, with a null focalPoint, clears the focal point
+// used when cropping an upload's thumbnails and cover variants.
+func (c *MediaController) FocalPointController(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	authModel, ok := services.APIKeyFromContext(r.Context())
+
+	if !ok {
+		http.Error(w, "Invalid API key", http.StatusUnauthorized)
+		return
+	}
+
+	var body FocalPointRequest
+
+	err := json.NewDecoder(r.Body).Decode(&body)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if body.FocalPoint != nil {
+		if err := body.FocalPoint.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	upload, err := c.Service.GetUpload(body.UploadId)
+
+	if err == sql.ErrNoRows || (err == nil && upload.ApplicationId != authModel.ApplicationId) {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = c.Service.SetFocalPoint(body.UploadId, body.FocalPoint)
+
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
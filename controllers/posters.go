@@ -0,0 +1,213 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/jdrew153/models"
+	"github.com/jdrew153/services"
+)
+
+type PostersResponse struct {
+	PosterUrl  string                 `json:"posterUrl"`
+	Candidates []models.UploadVariant `json:"candidates"`
+	Variants   []models.UploadVariant `json:"variants"`
+}
+
+type SelectPosterRequest struct {
+	UploadId string                         `json:"uploadId"`
+	PosterId string                         `json:"posterId"`
+	Profiles []services.ImageVariantProfile `json:"profiles"`
+}
+
+// PostersController lists the poster candidates of a video upload on GET and
+// makes one of them the canonical poster on POST.
+func (c *MediaController) PostersController(w http.ResponseWriter, r *http.Request) {
+
+	authModel, ok := services.APIKeyFromContext(r.Context())
+
+	if !ok {
+		http.Error(w, "Invalid API key", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		c.listPosters(w, r, authModel)
+	case http.MethodPost:
+		c.selectPoster(w, r, authModel)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (c *MediaController) postersResponse(uploadId string) (PostersResponse, error) {
+
+	var response PostersResponse
+
+	upload, err := c.Service.GetUpload(uploadId)
+
+	if err != nil {
+		return response, err
+	}
+
+	response.PosterUrl = upload.PosterUrl
+
+	response.Candidates, err = c.Service.ListVariants(uploadId, "poster")
+
+	if err != nil {
+		return response, err
+	}
+
+	response.Variants, err = c.Service.ListVariants(uploadId, "poster-image")
+
+	return response, err
+}
+
+func (c *MediaController) listPosters(w http.ResponseWriter, r *http.Request, authModel services.ValidUserIDAndAppIDModel) {
+
+	uploadId := r.URL.Query().Get("uploadId")
+
+	upload, err := c.Service.GetUpload(uploadId)
+
+	if err == sql.ErrNoRows || (err == nil && upload.ApplicationId != authModel.ApplicationId) {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response, err := c.postersResponse(uploadId)
+
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// selectPoster makes a candidate the canonical poster and runs it through the
+// application's image variant pipeline, replacing the previous poster's variants.
+func (c *MediaController) selectPoster(w http.ResponseWriter, r *http.Request, authModel services.ValidUserIDAndAppIDModel) {
+
+	var body SelectPosterRequest
+
+	err := json.NewDecoder(r.Body).Decode(&body)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	upload, err := c.Service.GetUpload(body.UploadId)
+
+	if err == sql.ErrNoRows || (err == nil && upload.ApplicationId != authModel.ApplicationId) {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	poster, err := c.Service.GetVariant(body.PosterId)
+
+	if err == sql.ErrNoRows || (err == nil && (poster.UploadId != body.UploadId || poster.Kind != "poster")) {
+		http.Error(w, "Poster candidate not found", http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	profiles := body.Profiles
+
+	if len(profiles) == 0 {
+		profiles, err = c.applicationImageProfiles(authModel.ApplicationId)
+
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	watermark, err := c.Sploader.ApplicationWatermark(authModel.ApplicationId)
+
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var focal *services.FocalPoint
+
+	if upload.FocalX != nil && upload.FocalY != nil {
+		focal = &services.FocalPoint{X: *upload.FocalX, Y: *upload.FocalY}
+	}
+
+	posterPath := services.MediaPathFromUrl(poster.Url)
+
+	// frames grabbed by ffmpeg carry no metadata worth keeping
+	newFiles, err := c.Service.ResizeImages(strings.TrimPrefix(posterPath, "./media/"), services.ResizeImagesOptions{
+		Profiles:  profiles,
+		Policy:    services.MetadataPolicy{Mode: services.MetadataStrip},
+		Watermark: watermark,
+		Focal:     focal,
+	})
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// the original is the candidate itself, variants of the previous poster
+	// are only dropped once the new ones exist
+	err = c.Service.ReplaceVariants(body.UploadId, "poster-image", newFiles[:len(newFiles)-1])
+
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = c.Service.SetPoster(body.UploadId, poster.Url)
+
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	_, err = c.Service.GenerateImagePlaceholders(posterPath, body.UploadId)
+
+	if err != nil {
+		log.Println("Error generating poster placeholders:", err)
+	}
+
+	response, err := c.postersResponse(body.UploadId)
+
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -1,30 +1,43 @@
 package controllers
 
 import (
+	"database/sql"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"time"
 
+	"github.com/jdrew153/models"
 	"github.com/jdrew153/services"
 )
 
 type TranscoderController struct {
 	Service *services.TranscoderService
+	Sploader *services.SploaderService
 }
 
-func NewTranscoderController(service *services.TranscoderService) *TranscoderController {
+func NewTranscoderController(service *services.TranscoderService, sploader *services.SploaderService) *TranscoderController {
 	return &TranscoderController{
 		Service: service,
+		Sploader: sploader,
 	}
 }
 
 type TranscodeRequest struct {
 	InputPath string `json:"inputPath"`
 	Resolutions []string `json:"resolutions"`
+	Watermark bool `json:"watermark"`
+	Preview *services.PreviewOptions `json:"preview"`
+	AudioPresets []services.AudioPreset `json:"audioPresets"`
+	ExtractAudio bool `json:"extractAudio"`
+	Waveform *services.WaveformOptions `json:"waveform"`
+	Loudness *services.LoudnessOptions `json:"loudness"`
+	Encryption *services.HlsEncryption `json:"encryption"`
 }
 
 
@@ -32,16 +45,99 @@ func (c *TranscoderController) Transcode(w http.ResponseWriter, r *http.Request)
 
 	log.Println("Transcode request received")
 
-	header := r.Header.Get("x-api-key")
-
-	fmt.Printf("Received header %s\n", header)
-
 	var body TranscodeRequest
 
 	err := json.NewDecoder(r.Body).Decode(&body)
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	authModel, _ := services.APIKeyFromContext(r.Context())
+
+	// renditions change the status and derived uploads of the source, only
+	// the application's own registered uploads can be transcoded
+	inputPath, uploadId, err := c.Service.Media.OwnedMediaUpload(body.InputPath, authModel.ApplicationId)
+
+	if errors.Is(err, services.ErrInvalidMediaPath) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if errors.Is(err, services.ErrMediaNotFound) || (err == nil && uploadId == "") {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	body.InputPath = inputPath
+
+	if body.Preview != nil {
+		if err := body.Preview.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if body.Waveform != nil {
+		if err := body.Waveform.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if body.Loudness != nil {
+		if err := body.Loudness.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if body.Encryption != nil {
+		if err := body.Encryption.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	audioPresets := body.AudioPresets
+
+	if len(audioPresets) == 0 {
+		audioPresets, err = c.applicationAudioPresets(authModel.ApplicationId)
+
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := services.ValidateAudioPresets(audioPresets); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var watermark *services.WatermarkConfig
+
+	if body.Watermark {
+		watermark, err = c.Sploader.ApplicationWatermark(authModel.ApplicationId)
+
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if watermark == nil {
+			http.Error(w, "No watermark configured for this application", http.StatusBadRequest)
+			return
+		}
 	}
 
 	log.Println("Transcoding " + fmt.Sprintf("./media/%s", body.InputPath))
@@ -49,7 +145,15 @@ func (c *TranscoderController) Transcode(w http.ResponseWriter, r *http.Request)
 	result := c.Service.Transcode(services.TranscodeRequest{
 		InputPath: fmt.Sprintf("./media/%s", body.InputPath),
 		Resolutions: body.Resolutions,
-		ApiKey: header,
+		ApiKeyId: authModel.Id,
+		ApplicationId: authModel.ApplicationId,
+		Watermark: watermark,
+		Preview: body.Preview,
+		AudioPresets: audioPresets,
+		ExtractAudio: body.ExtractAudio,
+		Waveform: body.Waveform,
+		Loudness: body.Loudness,
+		Encryption: body.Encryption,
 	})
 
 	if result != 1 {
@@ -59,6 +163,18 @@ func (c *TranscoderController) Transcode(w http.ResponseWriter, r *http.Request)
 	w.Write([]byte("Transcode complete"))
 }
 
+// applicationAudioPresets returns the "audioPresets" setting of the
+// application, nil when nothing is configured so the transcoder falls back
+// to the defaults.
+func (c *TranscoderController) applicationAudioPresets(applicationId string) ([]services.AudioPreset, error) {
+
+	var presets []services.AudioPreset
+
+	_, err := c.Sploader.GetApplicationSetting(applicationId, "audioPresets", &presets)
+
+	return presets, err
+}
+
 func (c *TranscoderController) ThumbnailFileReceiver(w http.ResponseWriter, r *http.Request) {
 
 	file, header, err := r.FormFile("file")
@@ -201,4 +317,416 @@ func (c *TranscoderController) WriteNewM3U8FileFromMP4(w http.ResponseWriter, r
 
 	w.WriteHeader(http.StatusCreated)
 	w.Write([]byte("M3U8 file created"))
-}
\ No newline at end of file
+}
+
+type WaveformRequest struct {
+	UploadId string `json:"uploadId"`
+	Options services.WaveformOptions `json:"options"`
+}
+
+// WaveformController (re)generates the waveform of an existing audio or
+// video upload and returns the created files.
+func (c *TranscoderController) WaveformController(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	authModel, ok := services.APIKeyFromContext(r.Context())
+
+	if !ok {
+		http.Error(w, "Invalid API key", http.StatusUnauthorized)
+		return
+	}
+
+	var body WaveformRequest
+
+	err := json.NewDecoder(r.Body).Decode(&body)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := body.Options.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	upload, err := c.Service.Media.GetUpload(body.UploadId)
+
+	if err == sql.ErrNoRows || (err == nil && upload.ApplicationId != authModel.ApplicationId) {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	outputs, err := c.Service.GenerateWaveform(services.MediaPathFromUrl(upload.Url), body.Options)
+
+	if err == services.ErrNoAudioStream {
+		http.Error(w, "Upload has no audio track", http.StatusUnprocessableEntity)
+		return
+	}
+
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(outputs)
+}
+
+// CaptionsController lists (GET), adds or replaces (POST, multipart with
+// uploadId, language, label, default and file) and removes (DELETE) the
+// caption tracks of a video upload.
+func (c *TranscoderController) CaptionsController(w http.ResponseWriter, r *http.Request) {
+
+	authModel, ok := services.APIKeyFromContext(r.Context())
+
+	if !ok {
+		http.Error(w, "Invalid API key", http.StatusUnauthorized)
+		return
+	}
+
+	var uploadId string
+
+	switch r.Method {
+	case http.MethodGet, http.MethodDelete:
+		uploadId = r.URL.Query().Get("uploadId")
+	case http.MethodPost:
+		err := r.ParseMultipartForm(5 << 20)
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		uploadId = r.FormValue("uploadId")
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	upload, err := c.Service.Media.GetUpload(uploadId)
+
+	if err == sql.ErrNoRows || (err == nil && upload.ApplicationId != authModel.ApplicationId) {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	inputPath := services.MediaPathFromUrl(upload.Url)
+
+	switch r.Method {
+	case http.MethodGet:
+		captions, err := c.Service.ListCaptions(uploadId)
+
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(captions)
+
+	case http.MethodDelete:
+		found, err := c.Service.RemoveCaptions(uploadId, inputPath, r.URL.Query().Get("language"))
+
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if !found {
+			http.Error(w, "Caption track not found", http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodPost:
+		language := r.FormValue("language")
+
+		if err := services.ValidateCaptionLanguage(language); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		file, _, err := r.FormFile("file")
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		defer file.Close()
+
+		data, err := io.ReadAll(file)
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		label := r.FormValue("label")
+
+		if label == "" {
+			label = language
+		}
+
+		caption, err := c.Service.AddCaptions(uploadId, inputPath, language, label, r.FormValue("default") == "true", data)
+
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(caption)
+	}
+}
+
+type EditRequest struct {
+	Type string `json:"type"`
+	SourceId string `json:"sourceId"`
+	SourceIds []string `json:"sourceIds"`
+	Clip services.ClipRange `json:"clip"`
+	Clips []services.ClipRange `json:"clips"`
+	Transcode bool `json:"transcode"`
+	Resolutions []string `json:"resolutions"`
+}
+
+type EditedUpload struct {
+	models.Upload
+	Sources []models.UploadSource `json:"sources"`
+}
+
+// EditController runs a trim, clips or concat job and returns the uploads it
+// created. With transcode set they go through the rendition pipeline in the
+// background.
+func (c *TranscoderController) EditController(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	authModel, ok := services.APIKeyFromContext(r.Context())
+
+	if !ok {
+		http.Error(w, "Invalid API key", http.StatusUnauthorized)
+		return
+	}
+
+	var body EditRequest
+
+	err := json.NewDecoder(r.Body).Decode(&body)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	for _, resolution := range body.Resolutions {
+		if resolution != services.HIGH && resolution != services.MEDIUM && resolution != services.LOW {
+			http.Error(w, fmt.Sprintf("Invalid resolution %s", resolution), http.StatusBadRequest)
+			return
+		}
+	}
+
+	options := services.EditOptions{
+		ApplicationId: authModel.ApplicationId,
+		UserId: authModel.UserId,
+		ApiKeyId: authModel.Id,
+		Transcode: body.Transcode,
+		Resolutions: body.Resolutions,
+	}
+
+	var uploads []models.Upload
+
+	switch body.Type {
+	case services.EditTrim:
+		var upload models.Upload
+
+		upload, err = c.Service.TrimVideo(body.SourceId, body.Clip, options)
+		uploads = append(uploads, upload)
+	case services.EditClips:
+		uploads, err = c.Service.ExtractClips(body.SourceId, body.Clips, options)
+	case services.EditConcat:
+		var upload models.Upload
+
+		upload, err = c.Service.ConcatVideos(body.SourceIds, options)
+		uploads = append(uploads, upload)
+	default:
+		http.Error(w, fmt.Sprintf("Unknown edit type %q", body.Type), http.StatusBadRequest)
+		return
+	}
+
+	if errors.Is(err, services.ErrEditSourceNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if errors.Is(err, services.ErrInvalidEdit) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	edited := []EditedUpload{}
+
+	for _, upload := range uploads {
+		sources, err := c.Service.Media.ListUploadSources(upload.Id)
+
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		edited = append(edited, EditedUpload{Upload: upload, Sources: sources})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(edited)
+}
+
+// HlsKeyController delivers the AES-128 key of an encrypted video to callers
+// holding an API key of the owning application or a token from HlsKeyTokenController.
+func (c *TranscoderController) HlsKeyController(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	key, err := c.Service.Media.GetHlsKey(r.URL.Query().Get("id"))
+
+	if err == sql.ErrNoRows {
+		http.Error(w, "Key not found", http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if token := r.URL.Query().Get("token"); token != "" {
+		err = services.VerifyHlsKeyToken(token, key.UploadId)
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	} else {
+		authModel, ok := services.APIKeyFromContext(r.Context())
+
+		if !ok {
+			http.Error(w, "Missing API key or token", http.StatusUnauthorized)
+			return
+		}
+
+		upload, err := c.Service.Media.GetUpload(key.UploadId)
+
+		if err != nil || upload.ApplicationId != authModel.ApplicationId {
+			http.Error(w, "Key not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Write(key.Key)
+}
+
+type HlsKeyTokenRequest struct {
+	UploadId string `json:"uploadId"`
+	TtlSeconds int `json:"ttlSeconds"`
+}
+
+type HlsKeyTokenResponse struct {
+	Token string `json:"token"`
+	ExpiresAt int64 `json:"expiresAt"`
+}
+
+// HlsKeyTokenController signs a short lived token for the keys of one upload,
+// players append it to the key urls as the token query parameter.
+func (c *TranscoderController) HlsKeyTokenController(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	authModel, ok := services.APIKeyFromContext(r.Context())
+
+	if !ok {
+		http.Error(w, "Invalid API key", http.StatusUnauthorized)
+		return
+	}
+
+	var body HlsKeyTokenRequest
+
+	err := json.NewDecoder(r.Body).Decode(&body)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	upload, err := c.Service.Media.GetUpload(body.UploadId)
+
+	if err == sql.ErrNoRows || (err == nil && upload.ApplicationId != authModel.ApplicationId) {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ttl := time.Duration(body.TtlSeconds) * time.Second
+
+	if ttl <= 0 || ttl > 24*time.Hour {
+		ttl = time.Hour
+	}
+
+	token, expiresAt, err := services.NewHlsKeyToken(body.UploadId, ttl)
+
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(HlsKeyTokenResponse{Token: token, ExpiresAt: expiresAt})
+}
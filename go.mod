@@ -3,16 +3,20 @@ module github.com/jdrew153
 go 1.20
 
 require (
-	
+	github.com/buckket/go-blurhash v1.1.0
+	github.com/corona10/goimagehash v1.1.0
 	github.com/go-sql-driver/mysql v1.7.1
 	github.com/hashicorp/golang-lru/v2 v2.0.4
+	github.com/mattn/go-sqlite3 v1.14.17
 	github.com/redis/go-redis/v9 v9.0.5
-	github.com/rs/cors v1.9.0
+	github.com/rwcarlsen/goexif v0.0.0-20190401172101-9e8deecbddbd
+	golang.org/x/image v0.9.0
 )
 
 require (
 	github.com/cespare/xxhash/v2 v2.2.0 // indirect
 	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+	golang.org/x/text v0.11.0 // indirect
 )
 
 require (
@@ -7,12 +7,41 @@ import (
 
 	"go.uber.org/fx"
 	_ "github.com/go-sql-driver/mysql"
+	"github.com/jdrew153/repositories"
 )
 
 
+// DBDriver is the database/sql driver of the DSN, MySQL unless DB_DRIVER
+// selects SQLite for small deployments.
+func DBDriver() string {
+
+	if os.Getenv("DB_DRIVER") == "sqlite3" {
+		return repositories.SQLiteDriver
+	}
+
+	return "mysql"
+}
+
+// OpenDB opens the database of the DSN environment variable.
+func OpenDB() (*sql.DB, error) {
+	return sql.Open(DBDriver(), os.Getenv("DSN"))
+}
+
+// CreateRepositories returns the repositories matching the database driver.
+func CreateRepositories(db *sql.DB) (*repositories.Repositories, error) {
+
+	dialect, err := repositories.DialectFor(DBDriver())
+
+	if err != nil {
+		return nil, err
+	}
+
+	return repositories.New(db, dialect), nil
+}
+
 func CreateDBConnection(lc fx.Lifecycle) *sql.DB {
 
-	db, err := sql.Open("mysql", os.Getenv("DSN"))
+	db, err := OpenDB()
 
 
 	lc.Append(fx.Hook{
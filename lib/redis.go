@@ -8,6 +8,18 @@ import (
 	"go.uber.org/fx"
 )
 
+// OpenRedis connects to the Redis of the REDIS_URL environment variable.
+func OpenRedis() (*redis.Client, error) {
+
+	opts, err := redis.ParseURL(os.Getenv("REDIS_URL"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return redis.NewClient(opts), nil
+}
+
 func CreateRedisClient(lc fx.Lifecycle) *redis.Client {
 	opts, _ := redis.ParseURL(os.Getenv("REDIS_URL"))
 	client := redis.NewClient(opts)
@@ -0,0 +1,370 @@
+// Package migrations holds the versioned database schema of the service and
+// applies it. Migrations are embedded SQL files named
+// "<version>_<name>.up.sql" with a matching ".down.sql".
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jdrew153/repositories"
+	"go.uber.org/fx"
+)
+
+//go:embed mysql/*.sql sqlite/*.sql
+var files embed.FS
+
+// Directories of the migrations of each database in the embedded files.
+const (
+	MySQL  = "mysql"
+	SQLite = "sqlite"
+)
+
+// DirFor returns the migrations directory of a dialect.
+func DirFor(dialect repositories.Dialect) string {
+
+	if dialect.Name == repositories.SQLite.Name {
+		return SQLite
+	}
+
+	return MySQL
+}
+
+var ErrSchemaBehind = errors.New("database schema is behind, run the migrate up command")
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+type MigrationStatus struct {
+	Migration
+	// AppliedAt is in unix ms, 0 while pending.
+	AppliedAt int64
+}
+
+var migrationFile = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Load reads the migrations of a directory ordered by version.
+func Load(fsys fs.FS, dir string) ([]Migration, error) {
+
+	entries, err := fs.ReadDir(fsys, dir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*Migration{}
+
+	for _, entry := range entries {
+
+		match := migrationFile.FindStringSubmatch(entry.Name())
+
+		if match == nil {
+			return nil, fmt.Errorf("unexpected migration file %s", entry.Name())
+		}
+
+		version, _ := strconv.Atoi(match[1])
+
+		data, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+
+		if err != nil {
+			return nil, err
+		}
+
+		migration, ok := byVersion[version]
+
+		if !ok {
+			migration = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = migration
+		}
+
+		if migration.Name != match[2] {
+			return nil, fmt.Errorf("migration %d has two names, %s and %s", version, migration.Name, match[2])
+		}
+
+		if match[3] == "up" {
+			migration.Up = string(data)
+		} else {
+			migration.Down = string(data)
+		}
+	}
+
+	var migrations []Migration
+
+	for _, migration := range byVersion {
+
+		if migration.Up == "" || migration.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s needs an up and a down file", migration.Version, migration.Name)
+		}
+
+		migrations = append(migrations, *migration)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+// statements splits a migration into the statements it holds, drivers do
+// not all run several statements in one Exec.
+func statements(script string) []string {
+
+	var result []string
+
+	for _, statement := range strings.Split(script, ";\n") {
+
+		var lines []string
+
+		for _, line := range strings.Split(statement, "\n") {
+			if !strings.HasPrefix(strings.TrimSpace(line), "--") {
+				lines = append(lines, line)
+			}
+		}
+
+		statement = strings.TrimSuffix(strings.TrimSpace(strings.Join(lines, "\n")), ";")
+
+		if statement != "" {
+			result = append(result, statement)
+		}
+	}
+
+	return result
+}
+
+type Migrator struct {
+	Db         *sql.DB
+	Migrations []Migration
+}
+
+// NewMigrator returns a migrator of the embedded migrations in dir.
+func NewMigrator(db *sql.DB, dir string) (*Migrator, error) {
+
+	migrations, err := Load(files, dir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Migrator{
+		Db:         db,
+		Migrations: migrations,
+	}, nil
+}
+
+func (m *Migrator) ensureTable(ctx context.Context) error {
+
+	_, err := m.Db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+    version INT NOT NULL PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    appliedAt BIGINT NOT NULL
+)`)
+
+	return err
+}
+
+// applied returns the applied versions with their time of application.
+func (m *Migrator) applied(ctx context.Context) (map[int]int64, error) {
+
+	err := m.ensureTable(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := m.Db.QueryContext(ctx, "SELECT version, appliedAt FROM schema_migrations")
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	applied := map[int]int64{}
+
+	for rows.Next() {
+
+		var version int
+		var appliedAt int64
+
+		err = rows.Scan(&version, &appliedAt)
+
+		if err != nil {
+			return nil, err
+		}
+
+		applied[version] = appliedAt
+	}
+
+	return applied, rows.Err()
+}
+
+// Status lists every migration with when it was applied.
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+
+	applied, err := m.applied(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var status []MigrationStatus
+
+	for _, migration := range m.Migrations {
+		status = append(status, MigrationStatus{Migration: migration, AppliedAt: applied[migration.Version]})
+	}
+
+	return status, nil
+}
+
+// Pending returns the migrations not applied yet, in order.
+func (m *Migrator) Pending(ctx context.Context) ([]Migration, error) {
+
+	status, err := m.Status(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []Migration
+
+	for _, migration := range status {
+		if migration.AppliedAt == 0 {
+			pending = append(pending, migration.Migration)
+		}
+	}
+
+	return pending, nil
+}
+
+func (m *Migrator) run(ctx context.Context, script string) error {
+
+	for _, statement := range statements(script) {
+
+		_, err := m.Db.ExecContext(ctx, statement)
+
+		if err != nil {
+			return fmt.Errorf("%w in %q", err, statement)
+		}
+	}
+
+	return nil
+}
+
+// Up applies the pending migrations in order and returns them. MySQL commits
+// schema changes at once, a failing migration is left half applied and
+// unrecorded.
+func (m *Migrator) Up(ctx context.Context) ([]Migration, error) {
+
+	pending, err := m.Pending(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var done []Migration
+
+	for _, migration := range pending {
+
+		err = m.run(ctx, migration.Up)
+
+		if err != nil {
+			return done, fmt.Errorf("migration %d_%s: %w", migration.Version, migration.Name, err)
+		}
+
+		_, err = m.Db.ExecContext(ctx, "INSERT INTO schema_migrations (version, name, appliedAt) VALUES (?, ?, ?)",
+			migration.Version, migration.Name, time.Now().UnixMilli())
+
+		if err != nil {
+			return done, err
+		}
+
+		log.Printf("Applied migration %d_%s", migration.Version, migration.Name)
+
+		done = append(done, migration)
+	}
+
+	return done, nil
+}
+
+// Down reverts the last steps applied migrations and returns them.
+func (m *Migrator) Down(ctx context.Context, steps int) ([]Migration, error) {
+
+	status, err := m.Status(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var done []Migration
+
+	for i := len(status) - 1; i >= 0 && len(done) < steps; i-- {
+
+		migration := status[i]
+
+		if migration.AppliedAt == 0 {
+			continue
+		}
+
+		err = m.run(ctx, migration.Down)
+
+		if err != nil {
+			return done, fmt.Errorf("migration %d_%s: %w", migration.Version, migration.Name, err)
+		}
+
+		_, err = m.Db.ExecContext(ctx, "DELETE FROM schema_migrations WHERE version = ?", migration.Version)
+
+		if err != nil {
+			return done, err
+		}
+
+		log.Printf("Reverted migration %d_%s", migration.Version, migration.Name)
+
+		done = append(done, migration.Migration)
+	}
+
+	return done, nil
+}
+
+// RequireCurrentSchema stops the service from starting against a database
+// missing migrations, the code would fail on the first query otherwise.
+func RequireCurrentSchema(lc fx.Lifecycle, db *sql.DB, repos *repositories.Repositories) {
+
+	lc.Append(fx.Hook{
+		OnStart: func(ctx context.Context) error {
+
+			migrator, err := NewMigrator(db, DirFor(repos.Dialect))
+
+			if err != nil {
+				return err
+			}
+
+			pending, err := migrator.Pending(ctx)
+
+			if err != nil {
+				return err
+			}
+
+			if len(pending) > 0 {
+				return fmt.Errorf("%w: %d pending, starting with %d_%s", ErrSchemaBehind, len(pending), pending[0].Version, pending[0].Name)
+			}
+
+			return nil
+		},
+	})
+}
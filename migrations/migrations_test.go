@@ -0,0 +1,171 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/jdrew153/repositories"
+)
+
+func TestStatements(t *testing.T) {
+
+	got := statements("-- comment\nCREATE TABLE a (id INT);\n\nDROP TABLE b;\n")
+
+	if len(got) != 2 || got[0] != "CREATE TABLE a (id INT)" || got[1] != "DROP TABLE b" {
+		t.Fatalf("statements = %q", got)
+	}
+}
+
+func TestMigrationsMatchAcrossDatabases(t *testing.T) {
+
+	mysql, err := Load(files, MySQL)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sqlite, err := Load(files, SQLite)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(mysql) != len(sqlite) {
+		t.Fatalf("%d MySQL migrations, %d SQLite migrations", len(mysql), len(sqlite))
+	}
+
+	for i := range mysql {
+		if mysql[i].Version != sqlite[i].Version || mysql[i].Name != sqlite[i].Name {
+			t.Fatalf("migration %d_%s has no SQLite counterpart", mysql[i].Version, mysql[i].Name)
+		}
+	}
+}
+
+func TestUpDownSQLite(t *testing.T) {
+
+	db, err := sql.Open(repositories.SQLiteDriver, "file:"+filepath.Join(t.TempDir(), "test.db"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	migrator, err := NewMigrator(db, SQLite)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+
+	applied, err := migrator.Up(ctx)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(applied) != len(migrator.Migrations) {
+		t.Fatalf("applied %d of %d migrations", len(applied), len(migrator.Migrations))
+	}
+
+	pending, err := migrator.Pending(ctx)
+
+	if err != nil || len(pending) != 0 {
+		t.Fatalf("pending after up = %v, %v", pending, err)
+	}
+
+	reverted, err := migrator.Down(ctx, len(migrator.Migrations))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(reverted) != len(migrator.Migrations) {
+		t.Fatalf("reverted %d of %d migrations", len(reverted), len(migrator.Migrations))
+	}
+
+	var tables int
+
+	err = db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name <> 'schema_migrations'").Scan(&tables)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tables != 0 {
+		t.Fatalf("%d tables left after reverting every migration", tables)
+	}
+
+	// the down migrations leave a schema the up migrations apply to again
+	_, err = migrator.Up(ctx)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUploadLifecycleKeepsUploads(t *testing.T) {
+
+	db, err := sql.Open(repositories.SQLiteDriver, "file:"+filepath.Join(t.TempDir(), "test.db"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	migrator, err := NewMigrator(db, SQLite)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+
+	// back to the schema before 0006_upload_lifecycle
+	steps := 0
+
+	for _, migration := range migrator.Migrations {
+		if migration.Version >= 6 {
+			steps++
+		}
+	}
+
+	_, err = migrator.Up(ctx)
+
+	if err == nil {
+		_, err = migrator.Down(ctx, steps)
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.Exec("INSERT INTO uploads (id, url, fileType, createdAt, size, applicationId) VALUES ('a', 'https://kaykatjd.com/media/joshie_a.png', 'png', 1, '12', 'app')")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = migrator.Up(ctx)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var size int64
+	var status string
+
+	err = db.QueryRow("SELECT size, status FROM uploads WHERE id = 'a'").Scan(&size, &status)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if size != 12 || status != "ready" {
+		t.Fatalf("existing upload migrated to size %d, status %s", size, status)
+	}
+}
@@ -0,0 +1,21 @@
+-- Tables the service started out with, created if an existing deployment
+-- does not have them yet.
+CREATE TABLE IF NOT EXISTS applications (
+    id VARCHAR(36) NOT NULL PRIMARY KEY,
+    userId VARCHAR(36) NOT NULL,
+    name VARCHAR(255) NOT NULL DEFAULT '',
+    subscriptionType VARCHAR(32) NOT NULL DEFAULT 'free',
+    createdAt BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS uploads (
+    id VARCHAR(36) NOT NULL PRIMARY KEY,
+    url VARCHAR(512) NOT NULL,
+    fileType VARCHAR(32) NOT NULL,
+    createdAt BIGINT NOT NULL,
+    size VARCHAR(32) NOT NULL,
+    applicationId VARCHAR(36) NOT NULL,
+    userId VARCHAR(36) NULL,
+    INDEX uploads_application (applicationId, createdAt),
+    INDEX uploads_url (url)
+);
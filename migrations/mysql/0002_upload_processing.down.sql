@@ -0,0 +1,17 @@
+DROP TABLE blobs;
+
+DROP TABLE upload_metadata;
+
+DROP TABLE upload_variants;
+
+ALTER TABLE uploads
+    DROP COLUMN blurHash,
+    DROP COLUMN lqip,
+    DROP COLUMN dominantColor,
+    DROP COLUMN averageColor,
+    DROP COLUMN phash,
+    DROP COLUMN duplicateOf,
+    DROP COLUMN contentHash,
+    DROP COLUMN focalX,
+    DROP COLUMN focalY,
+    DROP COLUMN posterUrl;
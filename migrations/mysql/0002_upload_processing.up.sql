@@ -0,0 +1,39 @@
+ALTER TABLE uploads
+    ADD COLUMN blurHash VARCHAR(128) NULL,
+    ADD COLUMN lqip TEXT NULL,
+    ADD COLUMN dominantColor VARCHAR(16) NULL,
+    ADD COLUMN averageColor VARCHAR(16) NULL,
+    ADD COLUMN phash BIGINT NULL,
+    ADD COLUMN duplicateOf VARCHAR(36) NULL,
+    ADD COLUMN contentHash CHAR(64) NULL,
+    ADD COLUMN focalX DOUBLE NULL,
+    ADD COLUMN focalY DOUBLE NULL,
+    ADD COLUMN posterUrl VARCHAR(512) NULL;
+
+CREATE TABLE upload_variants (
+    id VARCHAR(36) NOT NULL PRIMARY KEY,
+    uploadId VARCHAR(36) NOT NULL,
+    kind VARCHAR(32) NOT NULL,
+    name VARCHAR(128) NOT NULL,
+    url VARCHAR(512) NOT NULL,
+    width INT NOT NULL DEFAULT 0,
+    height INT NOT NULL DEFAULT 0,
+    format VARCHAR(16) NOT NULL DEFAULT '',
+    size BIGINT NOT NULL DEFAULT 0,
+    createdAt BIGINT NOT NULL,
+    INDEX upload_variants_upload (uploadId, kind)
+);
+
+CREATE TABLE upload_metadata (
+    uploadId VARCHAR(36) NOT NULL,
+    name VARCHAR(128) NOT NULL,
+    value TEXT NOT NULL,
+    PRIMARY KEY (uploadId, name)
+);
+
+CREATE TABLE blobs (
+    hash CHAR(64) NOT NULL PRIMARY KEY,
+    size BIGINT NOT NULL,
+    refCount INT NOT NULL,
+    createdAt BIGINT NOT NULL
+);
@@ -0,0 +1,12 @@
+CREATE TABLE application_settings (
+    applicationId VARCHAR(36) NOT NULL,
+    name VARCHAR(64) NOT NULL,
+    value TEXT NOT NULL,
+    PRIMARY KEY (applicationId, name)
+);
+
+CREATE TABLE application_origins (
+    applicationId VARCHAR(36) NOT NULL,
+    origin VARCHAR(255) NOT NULL,
+    PRIMARY KEY (applicationId, origin)
+);
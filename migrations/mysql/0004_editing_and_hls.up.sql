@@ -0,0 +1,18 @@
+CREATE TABLE upload_sources (
+    uploadId VARCHAR(36) NOT NULL,
+    sourceId VARCHAR(36) NOT NULL,
+    position INT NOT NULL,
+    startTime DOUBLE NULL,
+    endTime DOUBLE NULL,
+    PRIMARY KEY (uploadId, position),
+    INDEX upload_sources_source (sourceId)
+);
+
+CREATE TABLE hls_keys (
+    id VARCHAR(36) NOT NULL PRIMARY KEY,
+    uploadId VARCHAR(36) NOT NULL,
+    keyData CHAR(32) NOT NULL,
+    sequenceStart INT NOT NULL,
+    createdAt BIGINT NOT NULL,
+    INDEX hls_keys_upload (uploadId)
+);
@@ -0,0 +1,12 @@
+CREATE TABLE jobs (
+    id VARCHAR(36) NOT NULL PRIMARY KEY,
+    uploadId VARCHAR(36) NULL,
+    applicationId VARCHAR(36) NOT NULL,
+    type VARCHAR(32) NOT NULL,
+    status VARCHAR(16) NOT NULL,
+    error TEXT NULL,
+    createdAt BIGINT NOT NULL,
+    updatedAt BIGINT NOT NULL,
+    INDEX jobs_upload (uploadId),
+    INDEX jobs_application (applicationId, createdAt)
+);
@@ -0,0 +1,12 @@
+-- The previous schema knows neither soft deletes nor derived uploads.
+DELETE FROM uploads WHERE status = 'deleted' OR parentId IS NOT NULL;
+
+ALTER TABLE uploads
+    DROP INDEX uploads_status,
+    DROP INDEX uploads_parent,
+    DROP COLUMN variantKind,
+    DROP COLUMN parentId,
+    DROP COLUMN originalFilename,
+    DROP COLUMN mimeType,
+    DROP COLUMN status,
+    MODIFY COLUMN size VARCHAR(32) NOT NULL;
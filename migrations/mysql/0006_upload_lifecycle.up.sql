@@ -0,0 +1,13 @@
+-- Existing uploads were served already, they start out ready. New rows are
+-- pending until their file is stored.
+ALTER TABLE uploads
+    MODIFY COLUMN size BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN status VARCHAR(16) NOT NULL DEFAULT 'ready',
+    ADD COLUMN mimeType VARCHAR(127) NOT NULL DEFAULT '',
+    ADD COLUMN originalFilename VARCHAR(255) NOT NULL DEFAULT '',
+    ADD COLUMN parentId VARCHAR(36) NULL,
+    ADD COLUMN variantKind VARCHAR(32) NULL,
+    ADD INDEX uploads_parent (parentId, variantKind),
+    ADD INDEX uploads_status (applicationId, status, createdAt);
+
+ALTER TABLE uploads ALTER COLUMN status SET DEFAULT 'pending';
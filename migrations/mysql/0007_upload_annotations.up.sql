@@ -0,0 +1,16 @@
+-- Tags and metadata set by applications on their uploads, kept apart from
+-- the extracted upload_metadata. Both are indexed for equality filters.
+CREATE TABLE upload_tags (
+    uploadId VARCHAR(36) NOT NULL,
+    tag VARCHAR(64) NOT NULL,
+    PRIMARY KEY (uploadId, tag),
+    INDEX upload_tags_tag (tag)
+);
+
+CREATE TABLE upload_user_metadata (
+    uploadId VARCHAR(36) NOT NULL,
+    name VARCHAR(64) NOT NULL,
+    value VARCHAR(512) NOT NULL,
+    PRIMARY KEY (uploadId, name),
+    INDEX upload_user_metadata_value (name, value)
+);
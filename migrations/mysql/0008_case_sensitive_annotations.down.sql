@@ -0,0 +1,6 @@
+-- Fails while an upload holds tags or metadata names differing only in case.
+ALTER TABLE upload_user_metadata
+    MODIFY COLUMN name VARCHAR(64) NOT NULL;
+
+ALTER TABLE upload_tags
+    MODIFY COLUMN tag VARCHAR(64) NOT NULL;
@@ -0,0 +1,7 @@
+-- Tags and metadata names are compared as written, like on SQLite. With the
+-- default collation "Avatar" and "avatar" collided on the primary keys.
+ALTER TABLE upload_tags
+    MODIFY COLUMN tag VARCHAR(64) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin NOT NULL;
+
+ALTER TABLE upload_user_metadata
+    MODIFY COLUMN name VARCHAR(64) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin NOT NULL;
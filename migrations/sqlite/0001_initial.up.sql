@@ -0,0 +1,23 @@
+-- Tables the service started out with, created if an existing deployment
+-- does not have them yet.
+CREATE TABLE IF NOT EXISTS applications (
+    id TEXT NOT NULL PRIMARY KEY,
+    userId TEXT NOT NULL,
+    name TEXT NOT NULL DEFAULT '',
+    subscriptionType TEXT NOT NULL DEFAULT 'free',
+    createdAt INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS uploads (
+    id TEXT NOT NULL PRIMARY KEY,
+    url TEXT NOT NULL,
+    fileType TEXT NOT NULL,
+    createdAt INTEGER NOT NULL,
+    size TEXT NOT NULL,
+    applicationId TEXT NOT NULL,
+    userId TEXT NULL
+);
+
+CREATE INDEX IF NOT EXISTS uploads_application ON uploads (applicationId, createdAt);
+
+CREATE INDEX IF NOT EXISTS uploads_url ON uploads (url);
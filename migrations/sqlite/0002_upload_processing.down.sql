@@ -0,0 +1,25 @@
+DROP TABLE blobs;
+
+DROP TABLE upload_metadata;
+
+DROP TABLE upload_variants;
+
+ALTER TABLE uploads DROP COLUMN blurHash;
+
+ALTER TABLE uploads DROP COLUMN lqip;
+
+ALTER TABLE uploads DROP COLUMN dominantColor;
+
+ALTER TABLE uploads DROP COLUMN averageColor;
+
+ALTER TABLE uploads DROP COLUMN phash;
+
+ALTER TABLE uploads DROP COLUMN duplicateOf;
+
+ALTER TABLE uploads DROP COLUMN contentHash;
+
+ALTER TABLE uploads DROP COLUMN focalX;
+
+ALTER TABLE uploads DROP COLUMN focalY;
+
+ALTER TABLE uploads DROP COLUMN posterUrl;
@@ -0,0 +1,48 @@
+ALTER TABLE uploads ADD COLUMN blurHash TEXT NULL;
+
+ALTER TABLE uploads ADD COLUMN lqip TEXT NULL;
+
+ALTER TABLE uploads ADD COLUMN dominantColor TEXT NULL;
+
+ALTER TABLE uploads ADD COLUMN averageColor TEXT NULL;
+
+ALTER TABLE uploads ADD COLUMN phash INTEGER NULL;
+
+ALTER TABLE uploads ADD COLUMN duplicateOf TEXT NULL;
+
+ALTER TABLE uploads ADD COLUMN contentHash TEXT NULL;
+
+ALTER TABLE uploads ADD COLUMN focalX REAL NULL;
+
+ALTER TABLE uploads ADD COLUMN focalY REAL NULL;
+
+ALTER TABLE uploads ADD COLUMN posterUrl TEXT NULL;
+
+CREATE TABLE upload_variants (
+    id TEXT NOT NULL PRIMARY KEY,
+    uploadId TEXT NOT NULL,
+    kind TEXT NOT NULL,
+    name TEXT NOT NULL,
+    url TEXT NOT NULL,
+    width INTEGER NOT NULL DEFAULT 0,
+    height INTEGER NOT NULL DEFAULT 0,
+    format TEXT NOT NULL DEFAULT '',
+    size INTEGER NOT NULL DEFAULT 0,
+    createdAt INTEGER NOT NULL
+);
+
+CREATE INDEX upload_variants_upload ON upload_variants (uploadId, kind);
+
+CREATE TABLE upload_metadata (
+    uploadId TEXT NOT NULL,
+    name TEXT NOT NULL,
+    value TEXT NOT NULL,
+    PRIMARY KEY (uploadId, name)
+);
+
+CREATE TABLE blobs (
+    hash TEXT NOT NULL PRIMARY KEY,
+    size INTEGER NOT NULL,
+    refCount INTEGER NOT NULL,
+    createdAt INTEGER NOT NULL
+);
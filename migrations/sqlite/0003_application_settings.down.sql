@@ -0,0 +1,3 @@
+DROP TABLE application_origins;
+
+DROP TABLE application_settings;
@@ -0,0 +1,12 @@
+CREATE TABLE application_settings (
+    applicationId TEXT NOT NULL,
+    name TEXT NOT NULL,
+    value TEXT NOT NULL,
+    PRIMARY KEY (applicationId, name)
+);
+
+CREATE TABLE application_origins (
+    applicationId TEXT NOT NULL,
+    origin TEXT NOT NULL,
+    PRIMARY KEY (applicationId, origin)
+);
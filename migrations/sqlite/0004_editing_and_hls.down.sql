@@ -0,0 +1,3 @@
+DROP TABLE hls_keys;
+
+DROP TABLE upload_sources;
@@ -0,0 +1,20 @@
+CREATE TABLE upload_sources (
+    uploadId TEXT NOT NULL,
+    sourceId TEXT NOT NULL,
+    position INTEGER NOT NULL,
+    startTime REAL NULL,
+    endTime REAL NULL,
+    PRIMARY KEY (uploadId, position)
+);
+
+CREATE INDEX upload_sources_source ON upload_sources (sourceId);
+
+CREATE TABLE hls_keys (
+    id TEXT NOT NULL PRIMARY KEY,
+    uploadId TEXT NOT NULL,
+    keyData TEXT NOT NULL,
+    sequenceStart INTEGER NOT NULL,
+    createdAt INTEGER NOT NULL
+);
+
+CREATE INDEX hls_keys_upload ON hls_keys (uploadId);
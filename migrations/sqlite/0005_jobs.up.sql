@@ -0,0 +1,14 @@
+CREATE TABLE jobs (
+    id TEXT NOT NULL PRIMARY KEY,
+    uploadId TEXT NULL,
+    applicationId TEXT NOT NULL,
+    type TEXT NOT NULL,
+    status TEXT NOT NULL,
+    error TEXT NULL,
+    createdAt INTEGER NOT NULL,
+    updatedAt INTEGER NOT NULL
+);
+
+CREATE INDEX jobs_upload ON jobs (uploadId);
+
+CREATE INDEX jobs_application ON jobs (applicationId, createdAt);
@@ -0,0 +1,33 @@
+-- The previous schema knows neither soft deletes nor derived uploads.
+CREATE TABLE uploads_previous (
+    id TEXT NOT NULL PRIMARY KEY,
+    url TEXT NOT NULL,
+    fileType TEXT NOT NULL,
+    createdAt INTEGER NOT NULL,
+    size TEXT NOT NULL,
+    applicationId TEXT NOT NULL,
+    userId TEXT NULL,
+    blurHash TEXT NULL,
+    lqip TEXT NULL,
+    dominantColor TEXT NULL,
+    averageColor TEXT NULL,
+    phash INTEGER NULL,
+    duplicateOf TEXT NULL,
+    contentHash TEXT NULL,
+    focalX REAL NULL,
+    focalY REAL NULL,
+    posterUrl TEXT NULL
+);
+
+INSERT INTO uploads_previous
+SELECT id, url, fileType, createdAt, CAST(size AS TEXT), applicationId, userId, blurHash, lqip, dominantColor, averageColor, phash, duplicateOf, contentHash, focalX, focalY, posterUrl
+FROM uploads
+WHERE status <> 'deleted' AND parentId IS NULL;
+
+DROP TABLE uploads;
+
+ALTER TABLE uploads_previous RENAME TO uploads;
+
+CREATE INDEX uploads_application ON uploads (applicationId, createdAt);
+
+CREATE INDEX uploads_url ON uploads (url);
@@ -0,0 +1,42 @@
+-- SQLite cannot change the type of a column, the table is rebuilt with a
+-- numeric size. Existing uploads were served already, they start out ready.
+CREATE TABLE uploads_lifecycle (
+    id TEXT NOT NULL PRIMARY KEY,
+    url TEXT NOT NULL,
+    fileType TEXT NOT NULL,
+    createdAt INTEGER NOT NULL,
+    size INTEGER NOT NULL DEFAULT 0,
+    applicationId TEXT NOT NULL,
+    userId TEXT NULL,
+    blurHash TEXT NULL,
+    lqip TEXT NULL,
+    dominantColor TEXT NULL,
+    averageColor TEXT NULL,
+    phash INTEGER NULL,
+    duplicateOf TEXT NULL,
+    contentHash TEXT NULL,
+    focalX REAL NULL,
+    focalY REAL NULL,
+    posterUrl TEXT NULL,
+    status TEXT NOT NULL DEFAULT 'pending',
+    mimeType TEXT NOT NULL DEFAULT '',
+    originalFilename TEXT NOT NULL DEFAULT '',
+    parentId TEXT NULL,
+    variantKind TEXT NULL
+);
+
+INSERT INTO uploads_lifecycle (id, url, fileType, createdAt, size, applicationId, userId, blurHash, lqip, dominantColor, averageColor, phash, duplicateOf, contentHash, focalX, focalY, posterUrl, status)
+SELECT id, url, fileType, createdAt, CAST(size AS INTEGER), applicationId, userId, blurHash, lqip, dominantColor, averageColor, phash, duplicateOf, contentHash, focalX, focalY, posterUrl, 'ready'
+FROM uploads;
+
+DROP TABLE uploads;
+
+ALTER TABLE uploads_lifecycle RENAME TO uploads;
+
+CREATE INDEX uploads_application ON uploads (applicationId, createdAt);
+
+CREATE INDEX uploads_url ON uploads (url);
+
+CREATE INDEX uploads_parent ON uploads (parentId, variantKind);
+
+CREATE INDEX uploads_status ON uploads (applicationId, status, createdAt);
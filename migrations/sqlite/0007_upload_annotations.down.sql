@@ -0,0 +1,3 @@
+DROP TABLE upload_user_metadata;
+
+DROP TABLE upload_tags;
@@ -0,0 +1,18 @@
+-- Tags and metadata set by applications on their uploads, kept apart from
+-- the extracted upload_metadata. Both are indexed for equality filters.
+CREATE TABLE upload_tags (
+    uploadId TEXT NOT NULL,
+    tag TEXT NOT NULL,
+    PRIMARY KEY (uploadId, tag)
+);
+
+CREATE INDEX upload_tags_tag ON upload_tags (tag);
+
+CREATE TABLE upload_user_metadata (
+    uploadId TEXT NOT NULL,
+    name TEXT NOT NULL,
+    value TEXT NOT NULL,
+    PRIMARY KEY (uploadId, name)
+);
+
+CREATE INDEX upload_user_metadata_value ON upload_user_metadata (name, value);
@@ -0,0 +1,2 @@
+-- SQLite compares text as written already, only MySQL needs a binary
+-- collation on tags and metadata names.
@@ -6,8 +6,73 @@ type Upload struct {
 	Url string  `json:"url"`
 	FileType string  `json:"fileType"`
 	CreatedAt int64  `json:"createdAt"`
-	Size string `json:"size"`
+	Size int64 `json:"size"`
 	ApplicationId string `json:"applicationId"`
 	UserId string `json:"userId"`
+	// Status is one of pending, processing, ready, failed and deleted.
+	Status string `json:"status"`
+	MimeType string `json:"mimeType"`
+	// Checksum is the hex SHA-256 of the stored file, empty until stored.
+	Checksum string `json:"checksum,omitempty"`
+	OriginalFilename string `json:"originalFilename,omitempty"`
+	// ParentId and VariantKind are set on files derived from another upload,
+	// like its renditions.
+	ParentId string `json:"parentId,omitempty"`
+	VariantKind string `json:"variantKind,omitempty"`
+	// Tags and Metadata are set by the application, for instance to link the
+	// upload to its own records.
+	Tags []string `json:"tags,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	BlurHash string `json:"blurHash,omitempty"`
+	Lqip string `json:"lqip,omitempty"`
+	DominantColor string `json:"dominantColor,omitempty"`
+	AverageColor string `json:"averageColor,omitempty"`
+	DuplicateOf string `json:"duplicateOf,omitempty"`
+	FocalX *float64 `json:"focalX,omitempty"`
+	FocalY *float64 `json:"focalY,omitempty"`
+	PosterUrl string `json:"posterUrl,omitempty"`
 }
 
+type UploadVariant struct {
+	Id string `json:"id"`
+	UploadId string `json:"uploadId"`
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+	Url string `json:"url"`
+	Width int `json:"width"`
+	Height int `json:"height"`
+	Format string `json:"format"`
+	Size int64 `json:"size"`
+	CreatedAt int64 `json:"createdAt"`
+}
+
+// UploadSource links an edited upload to one of the uploads it was made
+// from. Start and End are set for trims and clips.
+type UploadSource struct {
+	SourceId string `json:"sourceId"`
+	Position int `json:"position"`
+	Start *float64 `json:"start,omitempty"`
+	End *float64 `json:"end,omitempty"`
+}
+
+// Job is a background task run for an upload, like a transcode.
+type Job struct {
+	Id string `json:"id"`
+	UploadId string `json:"uploadId,omitempty"`
+	ApplicationId string `json:"applicationId"`
+	Type string `json:"type"`
+	Status string `json:"status"`
+	Error string `json:"error,omitempty"`
+	CreatedAt int64 `json:"createdAt"`
+	UpdatedAt int64 `json:"updatedAt"`
+}
+
+// HlsKey is one content key of an encrypted video, covering the segments
+// from SequenceStart up to the next key.
+type HlsKey struct {
+	Id string `json:"id"`
+	UploadId string `json:"uploadId"`
+	Key []byte `json:"-"`
+	SequenceStart int `json:"sequenceStart"`
+	CreatedAt int64 `json:"createdAt"`
+}
@@ -0,0 +1,178 @@
+package repositories
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"strings"
+
+	"github.com/jdrew153/models"
+)
+
+// UploadFilter narrows listed uploads to those carrying all Tags and every
+// Metadata name with exactly its value.
+type UploadFilter struct {
+	Tags     []string
+	Metadata map[string]string
+}
+
+// conditions returns the filter as conditions on the uploads table.
+func (f UploadFilter) conditions() (string, []any) {
+
+	var conditions strings.Builder
+	var args []any
+
+	for _, tag := range f.Tags {
+		conditions.WriteString(" AND EXISTS (SELECT 1 FROM upload_tags WHERE upload_tags.uploadId = uploads.id AND upload_tags.tag = ?)")
+		args = append(args, tag)
+	}
+
+	names := make([]string, 0, len(f.Metadata))
+
+	for name := range f.Metadata {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		conditions.WriteString(" AND EXISTS (SELECT 1 FROM upload_user_metadata WHERE upload_user_metadata.uploadId = uploads.id AND upload_user_metadata.name = ? AND upload_user_metadata.value = ?)")
+		args = append(args, name, f.Metadata[name])
+	}
+
+	return conditions.String(), args
+}
+
+// writeAnnotations replaces the tags and the user metadata of an upload,
+// each left alone when nil.
+func writeAnnotations(ctx context.Context, tx *sql.Tx, id string, tags []string, metadata map[string]string) error {
+
+	if tags != nil {
+
+		_, err := tx.ExecContext(ctx, "DELETE FROM upload_tags WHERE uploadId = ?", id)
+
+		if err != nil {
+			return err
+		}
+
+		for _, tag := range tags {
+
+			_, err = tx.ExecContext(ctx, "INSERT INTO upload_tags (uploadId, tag) VALUES (?, ?)", id, tag)
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if metadata != nil {
+
+		_, err := tx.ExecContext(ctx, "DELETE FROM upload_user_metadata WHERE uploadId = ?", id)
+
+		if err != nil {
+			return err
+		}
+
+		for name, value := range metadata {
+
+			_, err = tx.ExecContext(ctx, "INSERT INTO upload_user_metadata (uploadId, name, value) VALUES (?, ?, ?)", id, name, value)
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (r *sqlUploadRepository) SetAnnotations(ctx context.Context, id string, tags []string, metadata map[string]string) error {
+
+	tx, err := r.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	err = writeAnnotations(ctx, tx, id, tags, metadata)
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (r *sqlUploadRepository) LoadAnnotations(ctx context.Context, uploads []models.Upload) error {
+
+	if len(uploads) == 0 {
+		return nil
+	}
+
+	byId := map[string]*models.Upload{}
+	args := []any{}
+
+	for i := range uploads {
+		byId[uploads[i].Id] = &uploads[i]
+		args = append(args, uploads[i].Id)
+	}
+
+	in := "(?" + strings.Repeat(", ?", len(uploads)-1) + ")"
+
+	rows, err := r.db.QueryContext(ctx, "SELECT uploadId, tag FROM upload_tags WHERE uploadId IN "+in+" ORDER BY tag", args...)
+
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+
+		var uploadId, tag string
+
+		err = rows.Scan(&uploadId, &tag)
+
+		if err != nil {
+			return err
+		}
+
+		upload := byId[uploadId]
+		upload.Tags = append(upload.Tags, tag)
+	}
+
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	rows, err = r.db.QueryContext(ctx, "SELECT uploadId, name, value FROM upload_user_metadata WHERE uploadId IN "+in, args...)
+
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+
+		var uploadId, name, value string
+
+		err = rows.Scan(&uploadId, &name, &value)
+
+		if err != nil {
+			return err
+		}
+
+		upload := byId[uploadId]
+
+		if upload.Metadata == nil {
+			upload.Metadata = map[string]string{}
+		}
+
+		upload.Metadata[name] = value
+	}
+
+	return rows.Err()
+}
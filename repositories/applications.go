@@ -0,0 +1,101 @@
+package repositories
+
+import (
+	"context"
+	"database/sql"
+)
+
+type ApplicationRepository interface {
+	SubscriptionType(ctx context.Context, id string) (string, error)
+	// StorageUsed is the total size of the application uploads in bytes,
+	// deleted ones aside.
+	StorageUsed(ctx context.Context, id string) (int64, error)
+	// Setting returns the JSON value of a setting, sql.ErrNoRows when unset.
+	Setting(ctx context.Context, applicationId string, name string) (string, error)
+	// SetSetting stores the JSON value of a setting, replacing the old one.
+	SetSetting(ctx context.Context, applicationId string, name string, value string) error
+	Origins(ctx context.Context, applicationId string) ([]string, error)
+	AddOrigin(ctx context.Context, applicationId string, origin string) error
+	RemoveOrigin(ctx context.Context, applicationId string, origin string) error
+}
+
+type sqlApplicationRepository struct {
+	db      *sql.DB
+	dialect Dialect
+}
+
+func (r *sqlApplicationRepository) SubscriptionType(ctx context.Context, id string) (string, error) {
+
+	var subscriptionType string
+
+	err := r.db.QueryRowContext(ctx, "SELECT subscriptionType FROM applications WHERE id = ?", id).Scan(&subscriptionType)
+
+	return subscriptionType, err
+}
+
+func (r *sqlApplicationRepository) StorageUsed(ctx context.Context, id string) (int64, error) {
+
+	var used int64
+
+	err := r.db.QueryRowContext(ctx, "SELECT COALESCE(SUM(size), 0) FROM uploads WHERE applicationId = ? AND status <> ?", id, UploadDeleted).Scan(&used)
+
+	return used, err
+}
+
+func (r *sqlApplicationRepository) Setting(ctx context.Context, applicationId string, name string) (string, error) {
+
+	var value string
+
+	err := r.db.QueryRowContext(ctx, "SELECT value FROM application_settings WHERE applicationId = ? AND name = ?", applicationId, name).Scan(&value)
+
+	return value, err
+}
+
+func (r *sqlApplicationRepository) SetSetting(ctx context.Context, applicationId string, name string, value string) error {
+
+	_, err := r.db.ExecContext(ctx, "INSERT INTO application_settings (applicationId, name, value) VALUES (?, ?, ?)"+r.dialect.OnConflictUpdate("applicationId, name", "value = "+r.dialect.Excluded("value")), applicationId, name, value)
+
+	return err
+}
+
+func (r *sqlApplicationRepository) Origins(ctx context.Context, applicationId string) ([]string, error) {
+
+	rows, err := r.db.QueryContext(ctx, "SELECT origin FROM application_origins WHERE applicationId = ? ORDER BY origin", applicationId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	origins := []string{}
+
+	for rows.Next() {
+
+		var origin string
+
+		err = rows.Scan(&origin)
+
+		if err != nil {
+			return nil, err
+		}
+
+		origins = append(origins, origin)
+	}
+
+	return origins, rows.Err()
+}
+
+func (r *sqlApplicationRepository) AddOrigin(ctx context.Context, applicationId string, origin string) error {
+
+	_, err := r.db.ExecContext(ctx, r.dialect.InsertIgnore+" INTO application_origins (applicationId, origin) VALUES (?, ?)", applicationId, origin)
+
+	return err
+}
+
+func (r *sqlApplicationRepository) RemoveOrigin(ctx context.Context, applicationId string, origin string) error {
+
+	_, err := r.db.ExecContext(ctx, "DELETE FROM application_origins WHERE applicationId = ? AND origin = ?", applicationId, origin)
+
+	return err
+}
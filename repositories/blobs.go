@@ -0,0 +1,112 @@
+package repositories
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// BlobRepository counts the references to content addressed files. The file
+// work of a change runs while its blob row is locked, so concurrent stores
+// and releases of the same content see the file and the row agree.
+type BlobRepository interface {
+	// Acquire takes a reference on the blob of hash for an upload, recording
+	// the hash on the upload, and runs store to put the file in place. The
+	// reference is only committed when store succeeds.
+	Acquire(ctx context.Context, hash string, size int64, uploadId string, store func() error) error
+	// Release drops a reference. The last one deletes the row and runs
+	// remove before the deletion is committed.
+	Release(ctx context.Context, hash string, remove func() error) error
+	// RefCount is the number of references to a blob.
+	RefCount(ctx context.Context, hash string) (int, error)
+}
+
+type sqlBlobRepository struct {
+	db      *sql.DB
+	dialect Dialect
+}
+
+func (r *sqlBlobRepository) Acquire(ctx context.Context, hash string, size int64, uploadId string, store func() error) error {
+
+	tx, err := r.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	// the blob row stays locked until commit, a concurrent store of the same
+	// content waits for the blob file to be complete
+	_, err = tx.ExecContext(ctx, "INSERT INTO blobs (hash, size, refCount, createdAt) VALUES (?, ?, 1, ?)"+r.dialect.OnConflictUpdate("hash", "refCount = refCount + 1"), hash, size, time.Now().UnixMilli())
+
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE uploads SET contentHash = ? WHERE id = ?", hash, uploadId)
+
+	if err != nil {
+		return err
+	}
+
+	err = store()
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (r *sqlBlobRepository) Release(ctx context.Context, hash string, remove func() error) error {
+
+	tx, err := r.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	var refCount int
+
+	err = tx.QueryRowContext(ctx, "SELECT refCount FROM blobs WHERE hash = ?"+r.dialect.ForUpdate, hash).Scan(&refCount)
+
+	if err != nil {
+		return err
+	}
+
+	if refCount > 1 {
+		_, err = tx.ExecContext(ctx, "UPDATE blobs SET refCount = refCount - 1 WHERE hash = ?", hash)
+
+		if err != nil {
+			return err
+		}
+
+		return tx.Commit()
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM blobs WHERE hash = ?", hash)
+
+	if err != nil {
+		return err
+	}
+
+	err = remove()
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (r *sqlBlobRepository) RefCount(ctx context.Context, hash string) (int, error) {
+
+	var refCount int
+
+	err := r.db.QueryRowContext(ctx, "SELECT refCount FROM blobs WHERE hash = ?", hash).Scan(&refCount)
+
+	return refCount, err
+}
@@ -0,0 +1,57 @@
+package repositories
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+
+	"github.com/jdrew153/models"
+)
+
+// HlsKeyRepository holds the content keys of encrypted videos, stored hex
+// encoded.
+type HlsKeyRepository interface {
+	Insert(ctx context.Context, key models.HlsKey) error
+	Get(ctx context.Context, id string) (models.HlsKey, error)
+	// Exists reports whether an upload has any key, that is whether its
+	// renditions are encrypted.
+	Exists(ctx context.Context, uploadId string) (bool, error)
+}
+
+type sqlHlsKeyRepository struct {
+	db *sql.DB
+}
+
+func (r *sqlHlsKeyRepository) Insert(ctx context.Context, key models.HlsKey) error {
+
+	_, err := r.db.ExecContext(ctx, "INSERT INTO hls_keys (id, uploadId, keyData, sequenceStart, createdAt) VALUES (?, ?, ?, ?, ?)",
+		key.Id, key.UploadId, hex.EncodeToString(key.Key), key.SequenceStart, key.CreatedAt)
+
+	return err
+}
+
+func (r *sqlHlsKeyRepository) Get(ctx context.Context, id string) (models.HlsKey, error) {
+
+	var key models.HlsKey
+	var keyData string
+
+	err := r.db.QueryRowContext(ctx, "SELECT id, uploadId, keyData, sequenceStart, createdAt FROM hls_keys WHERE id = ?", id).
+		Scan(&key.Id, &key.UploadId, &keyData, &key.SequenceStart, &key.CreatedAt)
+
+	if err != nil {
+		return key, err
+	}
+
+	key.Key, err = hex.DecodeString(keyData)
+
+	return key, err
+}
+
+func (r *sqlHlsKeyRepository) Exists(ctx context.Context, uploadId string) (bool, error) {
+
+	var exists bool
+
+	err := r.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM hls_keys WHERE uploadId = ?)", uploadId).Scan(&exists)
+
+	return exists, err
+}
@@ -0,0 +1,101 @@
+package repositories
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/jdrew153/models"
+	"github.com/savsgio/gotils/uuid"
+)
+
+// Job statuses.
+const (
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+)
+
+type JobRepository interface {
+	// Start records a running job, the upload may be unknown.
+	Start(ctx context.Context, uploadId string, applicationId string, jobType string) (string, error)
+	// Finish records the outcome of a job, failed with message when one is given.
+	Finish(ctx context.Context, id string, message string) error
+	Get(ctx context.Context, id string) (models.Job, error)
+	// ListForUpload returns the jobs of an upload, oldest first.
+	ListForUpload(ctx context.Context, uploadId string) ([]models.Job, error)
+}
+
+const jobColumns = "id, COALESCE(uploadId, ''), applicationId, type, status, COALESCE(error, ''), createdAt, updatedAt"
+
+func scanJob(row RowScanner) (models.Job, error) {
+
+	var job models.Job
+
+	err := row.Scan(&job.Id, &job.UploadId, &job.ApplicationId, &job.Type, &job.Status, &job.Error, &job.CreatedAt, &job.UpdatedAt)
+
+	return job, err
+}
+
+type sqlJobRepository struct {
+	db *sql.DB
+}
+
+func (r *sqlJobRepository) Start(ctx context.Context, uploadId string, applicationId string, jobType string) (string, error) {
+
+	id := uuid.V4()
+	now := time.Now().UnixMilli()
+
+	_, err := r.db.ExecContext(ctx, "INSERT INTO jobs (id, uploadId, applicationId, type, status, createdAt, updatedAt) VALUES (?, NULLIF(?, ''), ?, ?, ?, ?, ?)",
+		id, uploadId, applicationId, jobType, JobRunning, now, now)
+
+	if err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
+
+func (r *sqlJobRepository) Finish(ctx context.Context, id string, message string) error {
+
+	status := JobSucceeded
+
+	if message != "" {
+		status = JobFailed
+	}
+
+	_, err := r.db.ExecContext(ctx, "UPDATE jobs SET status = ?, error = NULLIF(?, ''), updatedAt = ? WHERE id = ?",
+		status, message, time.Now().UnixMilli(), id)
+
+	return err
+}
+
+func (r *sqlJobRepository) Get(ctx context.Context, id string) (models.Job, error) {
+	return scanJob(r.db.QueryRowContext(ctx, "SELECT "+jobColumns+" FROM jobs WHERE id = ?", id))
+}
+
+func (r *sqlJobRepository) ListForUpload(ctx context.Context, uploadId string) ([]models.Job, error) {
+
+	jobs := []models.Job{}
+
+	rows, err := r.db.QueryContext(ctx, "SELECT "+jobColumns+" FROM jobs WHERE uploadId = ? ORDER BY createdAt", uploadId)
+
+	if err != nil {
+		return jobs, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+
+		job, err := scanJob(rows)
+
+		if err != nil {
+			return jobs, err
+		}
+
+		jobs = append(jobs, job)
+	}
+
+	return jobs, rows.Err()
+}
@@ -0,0 +1,107 @@
+// Package repositories holds the SQL of uploads with their variants,
+// metadata, blobs and HLS keys, of applications and of jobs behind
+// interfaces, for MySQL in production and SQLite in tests and small
+// deployments.
+package repositories
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Dialect covers the SQL that differs between the supported databases.
+type Dialect struct {
+	Name string
+	// InsertIgnore starts an insert skipping rows that already exist.
+	InsertIgnore string
+	// ForUpdate locks selected rows until the transaction ends. SQLite locks
+	// the whole database on write and has no row locks.
+	ForUpdate string
+	mysql     bool
+}
+
+var (
+	MySQL  = Dialect{Name: "mysql", InsertIgnore: "INSERT IGNORE", ForUpdate: " FOR UPDATE", mysql: true}
+	SQLite = Dialect{Name: "sqlite3", InsertIgnore: "INSERT OR IGNORE", ForUpdate: ""}
+)
+
+// DialectFor returns the dialect of a database/sql driver name.
+func DialectFor(driver string) (Dialect, error) {
+
+	switch driver {
+	case MySQL.Name:
+		return MySQL, nil
+	case SQLite.Name, SQLiteDriver:
+		return SQLite, nil
+	}
+
+	return Dialect{}, fmt.Errorf("unsupported database driver %s", driver)
+}
+
+// OnConflictUpdate ends an insert whose rows may already exist under the
+// conflict columns by applying assignments to them instead.
+func (d Dialect) OnConflictUpdate(conflict string, assignments string) string {
+
+	if d.mysql {
+		return " ON DUPLICATE KEY UPDATE " + assignments
+	}
+
+	return fmt.Sprintf(" ON CONFLICT (%s) DO UPDATE SET %s", conflict, assignments)
+}
+
+// Excluded refers to the value an OnConflictUpdate insert tried to write.
+func (d Dialect) Excluded(column string) string {
+
+	if d.mysql {
+		return fmt.Sprintf("VALUES(%s)", column)
+	}
+
+	return "excluded." + column
+}
+
+// HammingDistance is the number of differing bits of two integer expressions.
+func (d Dialect) HammingDistance(a string, b string) string {
+
+	if d.mysql {
+		return fmt.Sprintf("BIT_COUNT(%s ^ %s)", a, b)
+	}
+
+	return fmt.Sprintf("HAMMING_DISTANCE(%s, %s)", a, b)
+}
+
+// RowScanner is implemented by *sql.Row and *sql.Rows.
+type RowScanner interface {
+	Scan(dest ...any) error
+}
+
+type Repositories struct {
+	Dialect      Dialect
+	Uploads      UploadRepository
+	Variants     VariantRepository
+	Metadata     MetadataRepository
+	Blobs        BlobRepository
+	HlsKeys      HlsKeyRepository
+	Applications ApplicationRepository
+	Jobs         JobRepository
+}
+
+func New(db *sql.DB, dialect Dialect) *Repositories {
+	return &Repositories{
+		Dialect:      dialect,
+		Uploads:      &sqlUploadRepository{db: db, dialect: dialect},
+		Variants:     &sqlVariantRepository{db: db},
+		Metadata:     &sqlMetadataRepository{db: db, dialect: dialect},
+		Blobs:        &sqlBlobRepository{db: db, dialect: dialect},
+		HlsKeys:      &sqlHlsKeyRepository{db: db},
+		Applications: &sqlApplicationRepository{db: db, dialect: dialect},
+		Jobs:         &sqlJobRepository{db: db},
+	}
+}
+
+func NewMySQL(db *sql.DB) *Repositories {
+	return New(db, MySQL)
+}
+
+func NewSQLite(db *sql.DB) *Repositories {
+	return New(db, SQLite)
+}
@@ -0,0 +1,729 @@
+package repositories_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/jdrew153/migrations"
+	"github.com/jdrew153/models"
+	"github.com/jdrew153/repositories"
+)
+
+// newTestRepositories opens a migrated SQLite database in a temporary
+// directory, no external services needed.
+func newTestRepositories(t *testing.T) (*sql.DB, *repositories.Repositories) {
+
+	t.Helper()
+
+	db, err := sql.Open(repositories.SQLiteDriver, "file:"+filepath.Join(t.TempDir(), "test.db")+"?_busy_timeout=5000")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { db.Close() })
+
+	migrator, err := migrations.NewMigrator(db, migrations.SQLite)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = migrator.Up(context.Background())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return db, repositories.NewSQLite(db)
+}
+
+func TestUploads(t *testing.T) {
+
+	_, repos := newTestRepositories(t)
+
+	ctx := context.Background()
+
+	ids, err := repos.Uploads.Insert(ctx, []models.Upload{
+		{Url: "https://kaykatjd.com/media/avatars/joshie_a.png", FileType: "png", Size: 10, ApplicationId: "app", UserId: "user"},
+		{Url: "https://kaykatjd.com/media/joshie_b.mp4", FileType: "mp4", Size: 20, ApplicationId: "app"},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ids) != 2 {
+		t.Fatalf("got %d ids, want 2", len(ids))
+	}
+
+	upload, err := repos.Uploads.Get(ctx, ids[0])
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if upload.Url != "https://kaykatjd.com/media/avatars/joshie_a.png" || upload.UserId != "user" || upload.ApplicationId != "app" {
+		t.Fatalf("unexpected upload %+v", upload)
+	}
+
+	id, err := repos.Uploads.FindIdByUrl(ctx, "https://kaykatjd.com/media/joshie_b.mp4")
+
+	if err != nil || id != ids[1] {
+		t.Fatalf("FindIdByUrl = %q, %v, want %q", id, err, ids[1])
+	}
+
+	uploads, err := repos.Uploads.List(ctx, "app", repositories.UploadFilter{}, 10, 0)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(uploads) != 2 {
+		t.Fatalf("listed %d uploads, want 2", len(uploads))
+	}
+
+	applicationId, err := repos.Uploads.ApplicationIdForFileId(ctx, "joshie_a")
+
+	if err != nil || applicationId != "app" {
+		t.Fatalf("ApplicationIdForFileId = %q, %v, want app", applicationId, err)
+	}
+
+	// "_" is a LIKE wildcard and must match itself only
+	applicationId, err = repos.Uploads.ApplicationIdForFileId(ctx, "joshie_")
+
+	if err != nil || applicationId != "" {
+		t.Fatalf("ApplicationIdForFileId of a prefix = %q, %v, want none", applicationId, err)
+	}
+
+	applicationId, err = repos.Uploads.ApplicationIdForUrl(ctx, "https://kaykatjd.com/media/avatars/joshie_a.png")
+
+	if err != nil || applicationId != "app" {
+		t.Fatalf("ApplicationIdForUrl = %q, %v, want app", applicationId, err)
+	}
+
+	applicationId, err = repos.Uploads.ApplicationIdForUrl(ctx, "https://kaykatjd.com/media/joshie_a.png")
+
+	if err != nil || applicationId != "" {
+		t.Fatalf("ApplicationIdForUrl of another folder = %q, %v, want none", applicationId, err)
+	}
+
+	x, y := 0.25, 0.75
+
+	err = repos.Uploads.SetFocalPoint(ctx, ids[0], &x, &y)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repos.Uploads.SetPlaceholders(ctx, ids[0], "LKO2?U%2Tw=w", "data:image/jpeg;base64,", "#112233", "#445566")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upload, err = repos.Uploads.Get(ctx, ids[0])
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if upload.FocalX == nil || *upload.FocalX != x || upload.FocalY == nil || *upload.FocalY != y {
+		t.Fatalf("focal point not stored: %+v", upload)
+	}
+
+	if upload.BlurHash != "LKO2?U%2Tw=w" || upload.DominantColor != "#112233" {
+		t.Fatalf("placeholders not stored: %+v", upload)
+	}
+
+	err = repos.Uploads.SetFocalPoint(ctx, ids[0], nil, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upload, err = repos.Uploads.Get(ctx, ids[0])
+
+	if err != nil || upload.FocalX != nil {
+		t.Fatalf("focal point not cleared: %+v, %v", upload, err)
+	}
+}
+
+func TestUploadsInsertIsAtomic(t *testing.T) {
+
+	db, repos := newTestRepositories(t)
+
+	ctx := context.Background()
+
+	_, err := db.Exec(`CREATE TRIGGER reject_upload BEFORE INSERT ON uploads WHEN NEW.url LIKE '%rejected%'
+BEGIN SELECT RAISE(ABORT, 'rejected'); END`)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = repos.Uploads.Insert(ctx, []models.Upload{
+		{Url: "https://kaykatjd.com/media/joshie_a.png", FileType: "png", Size: 10, ApplicationId: "app"},
+		{Url: "https://kaykatjd.com/media/joshie_rejected.png", FileType: "png", Size: 10, ApplicationId: "app"},
+	})
+
+	if err == nil {
+		t.Fatal("batch with a rejected upload succeeded")
+	}
+
+	var count int
+
+	err = db.QueryRow("SELECT COUNT(*) FROM uploads").Scan(&count)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 0 {
+		t.Fatalf("%d uploads written by a failed batch", count)
+	}
+}
+
+func TestApplications(t *testing.T) {
+
+	db, repos := newTestRepositories(t)
+
+	ctx := context.Background()
+
+	_, err := db.Exec("INSERT INTO applications (id, userId, subscriptionType) VALUES ('app', 'user', 'pro')")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subscriptionType, err := repos.Applications.SubscriptionType(ctx, "app")
+
+	if err != nil || subscriptionType != "pro" {
+		t.Fatalf("SubscriptionType = %q, %v, want pro", subscriptionType, err)
+	}
+
+	_, err = repos.Applications.SubscriptionType(ctx, "missing")
+
+	if err != sql.ErrNoRows {
+		t.Fatalf("SubscriptionType of a missing application = %v, want sql.ErrNoRows", err)
+	}
+
+	_, err = repos.Uploads.Insert(ctx, []models.Upload{
+		{Url: "https://kaykatjd.com/media/joshie_a.png", FileType: "png", Size: 10, ApplicationId: "app"},
+		{Url: "https://kaykatjd.com/media/joshie_b.png", FileType: "png", Size: 32, ApplicationId: "app"},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	used, err := repos.Applications.StorageUsed(ctx, "app")
+
+	if err != nil || used != 42 {
+		t.Fatalf("StorageUsed = %d, %v, want 42", used, err)
+	}
+
+	_, err = repos.Applications.Setting(ctx, "app", "hotlinkProtection")
+
+	if err != sql.ErrNoRows {
+		t.Fatalf("unset Setting = %v, want sql.ErrNoRows", err)
+	}
+
+	_, err = db.Exec(`INSERT INTO application_settings (applicationId, name, value) VALUES ('app', 'hotlinkProtection', '{"enabled":true}')`)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := repos.Applications.Setting(ctx, "app", "hotlinkProtection")
+
+	if err != nil || value != `{"enabled":true}` {
+		t.Fatalf("Setting = %q, %v", value, err)
+	}
+
+	err = repos.Applications.SetSetting(ctx, "app", "hotlinkProtection", `{"enabled":false}`)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, err = repos.Applications.Setting(ctx, "app", "hotlinkProtection")
+
+	if err != nil || value != `{"enabled":false}` {
+		t.Fatalf("Setting after SetSetting = %q, %v", value, err)
+	}
+
+	for _, origin := range []string{"https://b.example.com", "https://a.example.com", "https://a.example.com"} {
+
+		err = repos.Applications.AddOrigin(ctx, "app", origin)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	origins, err := repos.Applications.Origins(ctx, "app")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(origins) != 2 || origins[0] != "https://a.example.com" || origins[1] != "https://b.example.com" {
+		t.Fatalf("Origins = %v", origins)
+	}
+
+	err = repos.Applications.RemoveOrigin(ctx, "app", "https://a.example.com")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	origins, err = repos.Applications.Origins(ctx, "app")
+
+	if err != nil || len(origins) != 1 {
+		t.Fatalf("Origins after removal = %v, %v", origins, err)
+	}
+}
+
+func TestJobs(t *testing.T) {
+
+	_, repos := newTestRepositories(t)
+
+	ctx := context.Background()
+
+	succeeded, err := repos.Jobs.Start(ctx, "upload", "app", "transcode")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failed, err := repos.Jobs.Start(ctx, "upload", "app", "transcode")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job, err := repos.Jobs.Get(ctx, succeeded)
+
+	if err != nil || job.Status != repositories.JobRunning {
+		t.Fatalf("started job = %+v, %v", job, err)
+	}
+
+	err = repos.Jobs.Finish(ctx, succeeded, "")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repos.Jobs.Finish(ctx, failed, "ffmpeg exited with status 1")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jobs, err := repos.Jobs.ListForUpload(ctx, "upload")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(jobs) != 2 {
+		t.Fatalf("listed %d jobs, want 2", len(jobs))
+	}
+
+	for _, job := range jobs {
+
+		want := repositories.JobSucceeded
+
+		if job.Id == failed {
+			want = repositories.JobFailed
+		}
+
+		if job.Status != want {
+			t.Fatalf("job %s is %s, want %s", job.Id, job.Status, want)
+		}
+	}
+
+	// jobs may run before their upload is known
+	id, err := repos.Jobs.Start(ctx, "", "app", "transcode")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job, err = repos.Jobs.Get(ctx, id)
+
+	if err != nil || job.UploadId != "" {
+		t.Fatalf("job without upload = %+v, %v", job, err)
+	}
+}
+
+func TestUploadLifecycle(t *testing.T) {
+
+	_, repos := newTestRepositories(t)
+
+	ctx := context.Background()
+
+	ids, err := repos.Uploads.Insert(ctx, []models.Upload{
+		{Url: "https://kaykatjd.com/media/joshie_a.mp4", FileType: "mp4", Size: 10, ApplicationId: "app", UserId: "user", MimeType: "video/mp4", OriginalFilename: "holiday.mp4"},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parentId := ids[0]
+
+	upload, err := repos.Uploads.Get(ctx, parentId)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if upload.Status != repositories.UploadPending || upload.MimeType != "video/mp4" || upload.OriginalFilename != "holiday.mp4" || upload.Size != 10 {
+		t.Fatalf("unexpected new upload %+v", upload)
+	}
+
+	err = repos.Uploads.SetStatus(ctx, parentId, repositories.UploadPending)
+
+	if err != repositories.ErrInvalidStatusTransition {
+		t.Fatalf("moving back to pending = %v, want ErrInvalidStatusTransition", err)
+	}
+
+	for _, status := range []string{repositories.UploadProcessing, repositories.UploadFailed, repositories.UploadProcessing, repositories.UploadReady} {
+
+		err = repos.Uploads.SetStatus(ctx, parentId, status)
+
+		if err != nil {
+			t.Fatalf("moving to %s: %v", status, err)
+		}
+	}
+
+	err = repos.Uploads.SetContent(ctx, parentId, 2048, "abc123")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids, err = repos.Uploads.Insert(ctx, []models.Upload{
+		{Url: "https://kaykatjd.com/media/joshie_a.mp4_1280x720.mp4", FileType: "mp4", ApplicationId: "app", UserId: "user", ParentId: parentId, VariantKind: repositories.VariantRendition},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uploads, err := repos.Uploads.List(ctx, "app", repositories.UploadFilter{}, 10, 0)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(uploads) != 1 || uploads[0].Id != parentId || uploads[0].Size != 2048 || uploads[0].Checksum != "abc123" {
+		t.Fatalf("List = %+v, want the parent upload only", uploads)
+	}
+
+	children, err := repos.Uploads.ListChildren(ctx, parentId)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(children) != 1 || children[0].Id != ids[0] || children[0].VariantKind != repositories.VariantRendition || children[0].UserId != "user" {
+		t.Fatalf("ListChildren = %+v", children)
+	}
+
+	err = repos.Uploads.SetStatus(ctx, parentId, repositories.UploadDeleted)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = repos.Uploads.Get(ctx, parentId)
+
+	if err != sql.ErrNoRows {
+		t.Fatalf("Get of a deleted upload = %v, want sql.ErrNoRows", err)
+	}
+
+	err = repos.Uploads.SetStatus(ctx, parentId, repositories.UploadProcessing)
+
+	if err != repositories.ErrInvalidStatusTransition {
+		t.Fatalf("reviving a deleted upload = %v, want ErrInvalidStatusTransition", err)
+	}
+}
+
+func TestUploadAnnotations(t *testing.T) {
+
+	_, repos := newTestRepositories(t)
+
+	ctx := context.Background()
+
+	ids, err := repos.Uploads.Insert(ctx, []models.Upload{
+		{Url: "https://kaykatjd.com/media/joshie_a.png", FileType: "png", ApplicationId: "app", Tags: []string{"avatar", "public"}, Metadata: map[string]string{"postId": "42"}},
+		{Url: "https://kaykatjd.com/media/joshie_b.png", FileType: "png", ApplicationId: "app", Tags: []string{"avatar"}, Metadata: map[string]string{"postId": "7"}},
+		{Url: "https://kaykatjd.com/media/joshie_c.png", FileType: "png", ApplicationId: "app"},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	list := func(filter repositories.UploadFilter) []string {
+
+		t.Helper()
+
+		uploads, err := repos.Uploads.List(ctx, "app", filter, 10, 0)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var listed []string
+
+		for _, upload := range uploads {
+			listed = append(listed, upload.Id)
+		}
+
+		return listed
+	}
+
+	if listed := list(repositories.UploadFilter{Tags: []string{"avatar"}}); len(listed) != 2 {
+		t.Fatalf("tag filter listed %v, want the first two uploads", listed)
+	}
+
+	if listed := list(repositories.UploadFilter{Tags: []string{"avatar", "public"}}); len(listed) != 1 || listed[0] != ids[0] {
+		t.Fatalf("two tag filter listed %v, want %s", listed, ids[0])
+	}
+
+	if listed := list(repositories.UploadFilter{Tags: []string{"avatar"}, Metadata: map[string]string{"postId": "7"}}); len(listed) != 1 || listed[0] != ids[1] {
+		t.Fatalf("metadata filter listed %v, want %s", listed, ids[1])
+	}
+
+	// nil tags are left alone, an empty map clears the metadata
+	err = repos.Uploads.SetAnnotations(ctx, ids[0], nil, map[string]string{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uploads := []models.Upload{{Id: ids[0]}, {Id: ids[2]}}
+
+	err = repos.Uploads.LoadAnnotations(ctx, uploads)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(uploads[0].Tags) != 2 || uploads[0].Tags[0] != "avatar" || len(uploads[0].Metadata) != 0 {
+		t.Fatalf("annotations after update = %v, %v", uploads[0].Tags, uploads[0].Metadata)
+	}
+
+	if uploads[1].Tags != nil || uploads[1].Metadata != nil {
+		t.Fatalf("upload without annotations got %v, %v", uploads[1].Tags, uploads[1].Metadata)
+	}
+}
+
+func TestVariants(t *testing.T) {
+
+	_, repos := newTestRepositories(t)
+
+	ctx := context.Background()
+
+	err := repos.Variants.Insert(ctx, "upload", "image", []models.UploadVariant{
+		{Name: "small", Url: "https://kaykatjd.com/media/a_small.webp", Width: 320, Height: 240, Format: "webp", Size: 10},
+		{Name: "large", Url: "https://kaykatjd.com/media/a_large.webp", Width: 1280, Height: 960, Format: "webp", Size: 40},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repos.Variants.Insert(ctx, "upload", "poster", []models.UploadVariant{{Name: "poster", Url: "https://kaykatjd.com/media/a_poster.jpg"}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	all, err := repos.Variants.List(ctx, "upload", "")
+
+	if err != nil || len(all) != 3 {
+		t.Fatalf("List of all kinds = %v, %v", all, err)
+	}
+
+	variant, err := repos.Variants.Get(ctx, all[0].Id)
+
+	if err != nil || variant.Url != all[0].Url || variant.UploadId != "upload" {
+		t.Fatalf("Get = %+v, %v", variant, err)
+	}
+
+	old, err := repos.Variants.Replace(ctx, "upload", "image", []models.UploadVariant{{Name: "medium", Url: "https://kaykatjd.com/media/a_medium.webp"}})
+
+	if err != nil || len(old) != 2 {
+		t.Fatalf("Replace returned %v, %v, want the 2 replaced variants", old, err)
+	}
+
+	images, err := repos.Variants.List(ctx, "upload", "image")
+
+	if err != nil || len(images) != 1 || images[0].Name != "medium" {
+		t.Fatalf("images after Replace = %v, %v", images, err)
+	}
+
+	err = repos.Variants.DeleteKind(ctx, "upload", "image")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repos.Variants.Delete(ctx, all[2].Id)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	all, err = repos.Variants.List(ctx, "upload", "")
+
+	if err != nil || len(all) != 0 {
+		t.Fatalf("variants left after deleting = %v, %v", all, err)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+
+	_, repos := newTestRepositories(t)
+
+	ctx := context.Background()
+
+	err := repos.Metadata.Set(ctx, "upload", map[string]string{"make": "Canon", "model": "EOS"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repos.Metadata.Set(ctx, "upload", map[string]string{"model": "EOS R5"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repos.Metadata.Delete(ctx, "upload", "make")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metadata, err := repos.Metadata.Get(ctx, "upload")
+
+	if err != nil || len(metadata) != 1 || metadata["model"] != "EOS R5" {
+		t.Fatalf("Get = %v, %v", metadata, err)
+	}
+}
+
+func TestBlobs(t *testing.T) {
+
+	_, repos := newTestRepositories(t)
+
+	ctx := context.Background()
+
+	ids, err := repos.Uploads.Insert(ctx, []models.Upload{{Url: "https://kaykatjd.com/media/joshie_a.txt", FileType: "txt", ApplicationId: "app"}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a failed store takes no reference
+	err = repos.Blobs.Acquire(ctx, "hash", 10, ids[0], func() error { return errors.New("disk full") })
+
+	if err == nil {
+		t.Fatal("Acquire succeeded without its file")
+	}
+
+	_, err = repos.Blobs.RefCount(ctx, "hash")
+
+	if err != sql.ErrNoRows {
+		t.Fatalf("RefCount after a failed store = %v, want sql.ErrNoRows", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := repos.Blobs.Acquire(ctx, "hash", 10, ids[0], func() error { return nil }); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	upload, err := repos.Uploads.Get(ctx, ids[0])
+
+	if err != nil || upload.Checksum != "hash" {
+		t.Fatalf("content hash of the upload = %q, %v", upload.Checksum, err)
+	}
+
+	removed := 0
+
+	remove := func() error {
+		removed++
+		return nil
+	}
+
+	err = repos.Blobs.Release(ctx, "hash", remove)
+
+	if err != nil || removed != 0 {
+		t.Fatalf("first Release = %v, removed %d times", err, removed)
+	}
+
+	refCount, err := repos.Blobs.RefCount(ctx, "hash")
+
+	if err != nil || refCount != 1 {
+		t.Fatalf("RefCount = %d, %v, want 1", refCount, err)
+	}
+
+	// a failed removal keeps the last reference
+	err = repos.Blobs.Release(ctx, "hash", func() error { return errors.New("busy") })
+
+	if err == nil {
+		t.Fatal("Release succeeded without removing the file")
+	}
+
+	err = repos.Blobs.Release(ctx, "hash", remove)
+
+	if err != nil || removed != 1 {
+		t.Fatalf("last Release = %v, removed %d times", err, removed)
+	}
+
+	_, err = repos.Blobs.RefCount(ctx, "hash")
+
+	if err != sql.ErrNoRows {
+		t.Fatalf("RefCount after the last Release = %v, want sql.ErrNoRows", err)
+	}
+}
+
+func TestHlsKeys(t *testing.T) {
+
+	_, repos := newTestRepositories(t)
+
+	ctx := context.Background()
+
+	exists, err := repos.HlsKeys.Exists(ctx, "upload")
+
+	if err != nil || exists {
+		t.Fatalf("Exists without keys = %v, %v", exists, err)
+	}
+
+	err = repos.HlsKeys.Insert(ctx, models.HlsKey{Id: "key", UploadId: "upload", Key: []byte{0, 1, 0xfe, 0xff}, SequenceStart: 4, CreatedAt: 1})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := repos.HlsKeys.Get(ctx, "key")
+
+	if err != nil || key.UploadId != "upload" || key.SequenceStart != 4 || string(key.Key) != string([]byte{0, 1, 0xfe, 0xff}) {
+		t.Fatalf("Get = %+v, %v", key, err)
+	}
+
+	exists, err = repos.HlsKeys.Exists(ctx, "upload")
+
+	if err != nil || !exists {
+		t.Fatalf("Exists with a key = %v, %v", exists, err)
+	}
+}
@@ -0,0 +1,23 @@
+package repositories
+
+import (
+	"database/sql"
+	"math/bits"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// SQLiteDriver is go-sqlite3 with the functions SQLite lacks, open SQLite
+// databases with it. A DSN like "file:sploader.db?_busy_timeout=5000" keeps
+// concurrent writers waiting instead of failing.
+const SQLiteDriver = "sqlite3_sploader"
+
+func init() {
+	sql.Register(SQLiteDriver, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			return conn.RegisterFunc("HAMMING_DISTANCE", func(a int64, b int64) int64 {
+				return int64(bits.OnesCount64(uint64(a ^ b)))
+			}, true)
+		},
+	})
+}
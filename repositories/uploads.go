@@ -0,0 +1,486 @@
+package repositories
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jdrew153/models"
+	"github.com/savsgio/gotils/uuid"
+)
+
+// Upload statuses. Uploads are pending until their file is stored,
+// processing while it is worked on and deleted rows are kept as tombstones.
+const (
+	UploadPending    = "pending"
+	UploadProcessing = "processing"
+	UploadReady      = "ready"
+	UploadFailed     = "failed"
+	UploadDeleted    = "deleted"
+)
+
+// Variant kinds of uploads derived from another upload.
+const (
+	VariantRendition = "rendition"
+)
+
+var ErrInvalidStatusTransition = errors.New("invalid upload status transition")
+
+// uploadTransitions lists the statuses an upload may move to each status
+// from. Ready and failed uploads are processed again, for example when
+// transcoded later or retried, deleted ones stay deleted.
+var uploadTransitions = map[string][]string{
+	UploadPending:    {},
+	UploadProcessing: {UploadPending, UploadReady, UploadFailed},
+	UploadReady:      {UploadPending, UploadProcessing},
+	UploadFailed:     {UploadPending, UploadProcessing},
+	UploadDeleted:    {UploadPending, UploadProcessing, UploadReady, UploadFailed},
+}
+
+type UploadRepository interface {
+	// Insert writes uploads with their tags and metadata in one transaction,
+	// all or none, and returns their new ids in order. Uploads without a
+	// status are pending.
+	Insert(ctx context.Context, uploads []models.Upload) ([]string, error)
+	// Get, FindIdByUrl, List and ListChildren skip deleted uploads.
+	Get(ctx context.Context, id string) (models.Upload, error)
+	FindIdByUrl(ctx context.Context, url string) (string, error)
+	// List returns the uploads of an application matching filter, newest
+	// first, without the uploads derived from them.
+	List(ctx context.Context, applicationId string, filter UploadFilter, limit int, offset int) ([]models.Upload, error)
+	// ListChildren returns the uploads derived from an upload, oldest first.
+	ListChildren(ctx context.Context, parentId string) ([]models.Upload, error)
+	// SetStatus moves an upload to status, ErrInvalidStatusTransition when
+	// its current status does not allow it or it does not exist.
+	SetStatus(ctx context.Context, id string, status string) error
+	// SetContent records the size and checksum of the stored file.
+	SetContent(ctx context.Context, id string, size int64, checksum string) error
+	// ApplicationIdForFileId finds the application of the upload stored as
+	// "<fileId>.<ext>" in any folder, empty when there is none.
+	ApplicationIdForFileId(ctx context.Context, fileId string) (string, error)
+	// ApplicationIdForUrl finds the application of the upload or variant
+	// stored at url, empty when there is none.
+	ApplicationIdForUrl(ctx context.Context, url string) (string, error)
+	SetPlaceholders(ctx context.Context, id string, blurHash string, lqip string, dominantColor string, averageColor string) error
+	// SetFocalPoint stores the focal point of an upload, nil clears it.
+	SetFocalPoint(ctx context.Context, id string, x *float64, y *float64) error
+	SetPoster(ctx context.Context, id string, url string) error
+	// SetAnnotations replaces the tags and the metadata set on an upload by
+	// its application, each left alone when nil.
+	SetAnnotations(ctx context.Context, id string, tags []string, metadata map[string]string) error
+	// LoadAnnotations fills the tags and metadata of uploads.
+	LoadAnnotations(ctx context.Context, uploads []models.Upload) error
+	// Delete marks an upload and the uploads derived from it deleted, and
+	// drops its variants, metadata, sources and HLS keys in one transaction.
+	// It returns the urls of the files to remove and the content hash of
+	// the upload, sql.ErrNoRows when it is missing or deleted already.
+	Delete(ctx context.Context, id string) ([]string, string, error)
+	// NearDuplicates returns the uploads of an application, but excludeId,
+	// whose perceptual hash is within maxDistance bits of hash, closest
+	// first.
+	NearDuplicates(ctx context.Context, applicationId string, hash int64, maxDistance int, excludeId string) ([]UploadDistance, error)
+	// PerceptualHash is sql.ErrNoRows for uploads without one.
+	PerceptualHash(ctx context.Context, id string) (int64, error)
+	// SetPerceptualHash stores the hash and the upload it was flagged as a
+	// near-duplicate of, if any.
+	SetPerceptualHash(ctx context.Context, id string, hash int64, duplicateOf string) error
+	// InsertSources links an edited upload to the uploads it was made from.
+	InsertSources(ctx context.Context, id string, sources []models.UploadSource) error
+	// ListSources returns the sources of an edited upload in order.
+	ListSources(ctx context.Context, id string) ([]models.UploadSource, error)
+}
+
+// UploadDistance is an upload with the distance of its perceptual hash.
+type UploadDistance struct {
+	Upload   models.Upload
+	Distance int
+}
+
+// UploadColumns is the column list scanned by ScanUpload.
+const UploadColumns = "id, url, fileType, createdAt, size, applicationId, COALESCE(userId, ''), status, mimeType, COALESCE(contentHash, ''), originalFilename, COALESCE(parentId, ''), COALESCE(variantKind, ''), " +
+	"COALESCE(blurHash, ''), COALESCE(lqip, ''), COALESCE(dominantColor, ''), COALESCE(averageColor, ''), COALESCE(duplicateOf, ''), focalX, focalY, COALESCE(posterUrl, '')"
+
+// ScanUpload scans UploadColumns followed by any extra selected columns.
+func ScanUpload(row RowScanner, extra ...any) (models.Upload, error) {
+
+	var upload models.Upload
+
+	dest := []any{&upload.Id, &upload.Url, &upload.FileType, &upload.CreatedAt, &upload.Size, &upload.ApplicationId, &upload.UserId,
+		&upload.Status, &upload.MimeType, &upload.Checksum, &upload.OriginalFilename, &upload.ParentId, &upload.VariantKind,
+		&upload.BlurHash, &upload.Lqip, &upload.DominantColor, &upload.AverageColor, &upload.DuplicateOf, &upload.FocalX, &upload.FocalY, &upload.PosterUrl}
+
+	err := row.Scan(append(dest, extra...)...)
+
+	return upload, err
+}
+
+type sqlUploadRepository struct {
+	db      *sql.DB
+	dialect Dialect
+}
+
+func (r *sqlUploadRepository) Insert(ctx context.Context, uploads []models.Upload) ([]string, error) {
+
+	tx, err := r.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, "INSERT INTO uploads (id, url, fileType, createdAt, size, applicationId, userId, status, mimeType, originalFilename, parentId, variantKind) "+
+		"VALUES (?, ?, ?, ?, ?, ?, NULLIF(?, ''), ?, ?, ?, NULLIF(?, ''), NULLIF(?, ''))")
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer stmt.Close()
+
+	var ids []string
+
+	for _, upload := range uploads {
+
+		id := uuid.V4()
+
+		status := upload.Status
+
+		if status == "" {
+			status = UploadPending
+		}
+
+		_, err = stmt.ExecContext(ctx, id, upload.Url, upload.FileType, time.Now().UnixMilli(), upload.Size, upload.ApplicationId, upload.UserId,
+			status, upload.MimeType, upload.OriginalFilename, upload.ParentId, upload.VariantKind)
+
+		if err != nil {
+			return nil, err
+		}
+
+		err = writeAnnotations(ctx, tx, id, upload.Tags, upload.Metadata)
+
+		if err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, tx.Commit()
+}
+
+func (r *sqlUploadRepository) Get(ctx context.Context, id string) (models.Upload, error) {
+	return ScanUpload(r.db.QueryRowContext(ctx, "SELECT "+UploadColumns+" FROM uploads WHERE id = ? AND status <> ?", id, UploadDeleted))
+}
+
+func (r *sqlUploadRepository) FindIdByUrl(ctx context.Context, url string) (string, error) {
+
+	var id string
+
+	err := r.db.QueryRowContext(ctx, "SELECT id FROM uploads WHERE url = ? AND status <> ?", url, UploadDeleted).Scan(&id)
+
+	return id, err
+}
+
+func (r *sqlUploadRepository) List(ctx context.Context, applicationId string, filter UploadFilter, limit int, offset int) ([]models.Upload, error) {
+
+	conditions, args := filter.conditions()
+
+	args = append([]any{applicationId, UploadDeleted}, args...)
+
+	return r.query(ctx, "SELECT "+UploadColumns+" FROM uploads WHERE applicationId = ? AND status <> ? AND parentId IS NULL"+conditions+" ORDER BY createdAt DESC LIMIT ? OFFSET ?",
+		append(args, limit, offset)...)
+}
+
+func (r *sqlUploadRepository) ListChildren(ctx context.Context, parentId string) ([]models.Upload, error) {
+	return r.query(ctx, "SELECT "+UploadColumns+" FROM uploads WHERE parentId = ? AND status <> ? ORDER BY createdAt, url", parentId, UploadDeleted)
+}
+
+func (r *sqlUploadRepository) query(ctx context.Context, query string, args ...any) ([]models.Upload, error) {
+
+	uploads := []models.Upload{}
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+
+	if err != nil {
+		return uploads, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+
+		upload, err := ScanUpload(rows)
+
+		if err != nil {
+			return uploads, err
+		}
+
+		uploads = append(uploads, upload)
+	}
+
+	return uploads, rows.Err()
+}
+
+// likeEscaper escapes LIKE wildcards with "!", which unlike the backslash
+// is no escape character in MySQL string literals.
+var likeEscaper = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+
+func (r *sqlUploadRepository) ApplicationIdForFileId(ctx context.Context, fileId string) (string, error) {
+
+	var applicationId string
+
+	pattern := "https://kaykatjd.com/media/%" + likeEscaper.Replace(fileId) + ".%"
+
+	err := r.db.QueryRowContext(ctx, "SELECT applicationId FROM uploads WHERE url LIKE ? ESCAPE '!' AND status <> ? LIMIT 1", pattern, UploadDeleted).Scan(&applicationId)
+
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+
+	return applicationId, err
+}
+
+func (r *sqlUploadRepository) ApplicationIdForUrl(ctx context.Context, url string) (string, error) {
+
+	var applicationId string
+
+	query := "SELECT applicationId FROM uploads WHERE url = ? AND status <> ? " +
+		"UNION ALL SELECT uploads.applicationId FROM upload_variants JOIN uploads ON uploads.id = upload_variants.uploadId WHERE upload_variants.url = ? AND uploads.status <> ? LIMIT 1"
+
+	err := r.db.QueryRowContext(ctx, query, url, UploadDeleted, url, UploadDeleted).Scan(&applicationId)
+
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+
+	return applicationId, err
+}
+
+func (r *sqlUploadRepository) SetPlaceholders(ctx context.Context, id string, blurHash string, lqip string, dominantColor string, averageColor string) error {
+
+	_, err := r.db.ExecContext(ctx, "UPDATE uploads SET blurHash = ?, lqip = ?, dominantColor = ?, averageColor = ? WHERE id = ?",
+		blurHash, lqip, dominantColor, averageColor, id)
+
+	return err
+}
+
+func (r *sqlUploadRepository) SetFocalPoint(ctx context.Context, id string, x *float64, y *float64) error {
+
+	_, err := r.db.ExecContext(ctx, "UPDATE uploads SET focalX = ?, focalY = ? WHERE id = ?", x, y, id)
+
+	return err
+}
+
+func (r *sqlUploadRepository) SetPoster(ctx context.Context, id string, url string) error {
+
+	_, err := r.db.ExecContext(ctx, "UPDATE uploads SET posterUrl = ? WHERE id = ?", url, id)
+
+	return err
+}
+
+func (r *sqlUploadRepository) SetStatus(ctx context.Context, id string, status string) error {
+
+	from, ok := uploadTransitions[status]
+
+	if !ok || len(from) == 0 {
+		return ErrInvalidStatusTransition
+	}
+
+	query := "UPDATE uploads SET status = ? WHERE id = ? AND status IN (?" + strings.Repeat(", ?", len(from)-1) + ")"
+
+	args := []any{status, id}
+
+	for _, previous := range from {
+		args = append(args, previous)
+	}
+
+	result, err := r.db.ExecContext(ctx, query, args...)
+
+	if err != nil {
+		return err
+	}
+
+	updated, err := result.RowsAffected()
+
+	if err != nil {
+		return err
+	}
+
+	if updated == 0 {
+		return ErrInvalidStatusTransition
+	}
+
+	return nil
+}
+
+func (r *sqlUploadRepository) SetContent(ctx context.Context, id string, size int64, checksum string) error {
+
+	_, err := r.db.ExecContext(ctx, "UPDATE uploads SET size = ?, contentHash = NULLIF(?, '') WHERE id = ?", size, checksum, id)
+
+	return err
+}
+
+func (r *sqlUploadRepository) Delete(ctx context.Context, id string) ([]string, string, error) {
+
+	tx, err := r.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	defer tx.Rollback()
+
+	var url string
+	var contentHash sql.NullString
+
+	// the lock keeps a concurrent delete from releasing the blob twice
+	err = tx.QueryRowContext(ctx, "SELECT url, contentHash FROM uploads WHERE id = ? AND status <> ?"+r.dialect.ForUpdate, id, UploadDeleted).Scan(&url, &contentHash)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	urls := []string{url}
+
+	rows, err := tx.QueryContext(ctx, "SELECT url FROM upload_variants WHERE uploadId = ? UNION ALL SELECT url FROM uploads WHERE parentId = ? AND status <> ?",
+		id, id, UploadDeleted)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	for rows.Next() {
+
+		var variantUrl string
+
+		if err := rows.Scan(&variantUrl); err != nil {
+			rows.Close()
+			return nil, "", err
+		}
+
+		urls = append(urls, variantUrl)
+	}
+
+	rows.Close()
+
+	for _, query := range []string{
+		"DELETE FROM upload_variants WHERE uploadId = ?",
+		"DELETE FROM upload_metadata WHERE uploadId = ?",
+		"DELETE FROM upload_sources WHERE uploadId = ?",
+		"DELETE FROM hls_keys WHERE uploadId = ?",
+	} {
+		_, err = tx.ExecContext(ctx, query, id)
+
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE uploads SET status = ? WHERE id = ? OR parentId = ?", UploadDeleted, id, id)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	return urls, contentHash.String, tx.Commit()
+}
+
+func (r *sqlUploadRepository) NearDuplicates(ctx context.Context, applicationId string, hash int64, maxDistance int, excludeId string) ([]UploadDistance, error) {
+
+	duplicates := []UploadDistance{}
+
+	hamming := r.dialect.HammingDistance("phash", "?")
+
+	query := "SELECT " + UploadColumns + ", " + hamming + " AS distance FROM uploads WHERE applicationId = ? AND id <> ? AND status <> ? AND phash IS NOT NULL AND " + hamming + " <= ? ORDER BY distance, createdAt"
+
+	rows, err := r.db.QueryContext(ctx, query, hash, applicationId, excludeId, UploadDeleted, hash, maxDistance)
+
+	if err != nil {
+		return duplicates, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+
+		var distance int
+
+		upload, err := ScanUpload(rows, &distance)
+
+		if err != nil {
+			return duplicates, err
+		}
+
+		duplicates = append(duplicates, UploadDistance{Upload: upload, Distance: distance})
+	}
+
+	return duplicates, rows.Err()
+}
+
+func (r *sqlUploadRepository) PerceptualHash(ctx context.Context, id string) (int64, error) {
+
+	var hash int64
+
+	err := r.db.QueryRowContext(ctx, "SELECT phash FROM uploads WHERE id = ? AND phash IS NOT NULL", id).Scan(&hash)
+
+	return hash, err
+}
+
+func (r *sqlUploadRepository) SetPerceptualHash(ctx context.Context, id string, hash int64, duplicateOf string) error {
+
+	_, err := r.db.ExecContext(ctx, "UPDATE uploads SET phash = ?, duplicateOf = NULLIF(?, '') WHERE id = ?", hash, duplicateOf, id)
+
+	return err
+}
+
+func (r *sqlUploadRepository) InsertSources(ctx context.Context, id string, sources []models.UploadSource) error {
+
+	tx, err := r.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	for _, source := range sources {
+
+		_, err = tx.ExecContext(ctx, "INSERT INTO upload_sources (uploadId, sourceId, position, startTime, endTime) VALUES (?, ?, ?, ?, ?)",
+			id, source.SourceId, source.Position, source.Start, source.End)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (r *sqlUploadRepository) ListSources(ctx context.Context, id string) ([]models.UploadSource, error) {
+
+	sources := []models.UploadSource{}
+
+	rows, err := r.db.QueryContext(ctx, "SELECT sourceId, position, startTime, endTime FROM upload_sources WHERE uploadId = ? ORDER BY position", id)
+
+	if err != nil {
+		return sources, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+
+		var source models.UploadSource
+
+		if err := rows.Scan(&source.SourceId, &source.Position, &source.Start, &source.End); err != nil {
+			return sources, err
+		}
+
+		sources = append(sources, source)
+	}
+
+	return sources, rows.Err()
+}
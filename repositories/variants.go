@@ -0,0 +1,237 @@
+package repositories
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/jdrew153/models"
+	"github.com/savsgio/gotils/uuid"
+)
+
+type VariantRepository interface {
+	Get(ctx context.Context, id string) (models.UploadVariant, error)
+	// List returns the variants of an upload of one kind, all kinds when
+	// kind is empty, oldest first.
+	List(ctx context.Context, uploadId string, kind string) ([]models.UploadVariant, error)
+	// Insert records variants of an upload under new ids.
+	Insert(ctx context.Context, uploadId string, kind string, variants []models.UploadVariant) error
+	// Replace swaps the variants of an upload of one kind for variants in
+	// one transaction and returns the replaced ones.
+	Replace(ctx context.Context, uploadId string, kind string, variants []models.UploadVariant) ([]models.UploadVariant, error)
+	// DeleteKind forgets the variants of an upload of one kind.
+	DeleteKind(ctx context.Context, uploadId string, kind string) error
+	Delete(ctx context.Context, id string) error
+}
+
+const variantColumns = "id, uploadId, kind, name, url, width, height, format, size, createdAt"
+
+func scanVariant(row RowScanner) (models.UploadVariant, error) {
+
+	var variant models.UploadVariant
+
+	err := row.Scan(&variant.Id, &variant.UploadId, &variant.Kind, &variant.Name, &variant.Url, &variant.Width, &variant.Height, &variant.Format, &variant.Size, &variant.CreatedAt)
+
+	return variant, err
+}
+
+// querier is implemented by *sql.DB and *sql.Tx.
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+type sqlVariantRepository struct {
+	db *sql.DB
+}
+
+func (r *sqlVariantRepository) Get(ctx context.Context, id string) (models.UploadVariant, error) {
+	return scanVariant(r.db.QueryRowContext(ctx, "SELECT "+variantColumns+" FROM upload_variants WHERE id = ?", id))
+}
+
+func (r *sqlVariantRepository) List(ctx context.Context, uploadId string, kind string) ([]models.UploadVariant, error) {
+	return listVariants(ctx, r.db, uploadId, kind)
+}
+
+func listVariants(ctx context.Context, q querier, uploadId string, kind string) ([]models.UploadVariant, error) {
+
+	variants := []models.UploadVariant{}
+
+	rows, err := q.QueryContext(ctx, "SELECT "+variantColumns+" FROM upload_variants WHERE uploadId = ? AND (? = '' OR kind = ?) ORDER BY createdAt, name", uploadId, kind, kind)
+
+	if err != nil {
+		return variants, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+
+		variant, err := scanVariant(rows)
+
+		if err != nil {
+			return variants, err
+		}
+
+		variants = append(variants, variant)
+	}
+
+	return variants, rows.Err()
+}
+
+func insertVariants(ctx context.Context, q querier, uploadId string, kind string, variants []models.UploadVariant) error {
+
+	for _, variant := range variants {
+
+		_, err := q.ExecContext(ctx, "INSERT INTO upload_variants (id, uploadId, kind, name, url, width, height, format, size, createdAt) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			uuid.V4(), uploadId, kind, variant.Name, variant.Url, variant.Width, variant.Height, variant.Format, variant.Size, time.Now().UnixMilli())
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *sqlVariantRepository) Insert(ctx context.Context, uploadId string, kind string, variants []models.UploadVariant) error {
+
+	tx, err := r.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	err = insertVariants(ctx, tx, uploadId, kind, variants)
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (r *sqlVariantRepository) Replace(ctx context.Context, uploadId string, kind string, variants []models.UploadVariant) ([]models.UploadVariant, error) {
+
+	tx, err := r.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	old, err := listVariants(ctx, tx, uploadId, kind)
+
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM upload_variants WHERE uploadId = ? AND kind = ?", uploadId, kind)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = insertVariants(ctx, tx, uploadId, kind, variants)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return old, tx.Commit()
+}
+
+func (r *sqlVariantRepository) DeleteKind(ctx context.Context, uploadId string, kind string) error {
+
+	_, err := r.db.ExecContext(ctx, "DELETE FROM upload_variants WHERE uploadId = ? AND kind = ?", uploadId, kind)
+
+	return err
+}
+
+func (r *sqlVariantRepository) Delete(ctx context.Context, id string) error {
+
+	_, err := r.db.ExecContext(ctx, "DELETE FROM upload_variants WHERE id = ?", id)
+
+	return err
+}
+
+// MetadataRepository holds the metadata extracted from upload files, like
+// EXIF fields, apart from the metadata applications set.
+type MetadataRepository interface {
+	Get(ctx context.Context, uploadId string) (map[string]string, error)
+	// Set writes fields in one transaction, replacing their old values.
+	Set(ctx context.Context, uploadId string, metadata map[string]string) error
+	Delete(ctx context.Context, uploadId string, names ...string) error
+}
+
+type sqlMetadataRepository struct {
+	db      *sql.DB
+	dialect Dialect
+}
+
+func (r *sqlMetadataRepository) Get(ctx context.Context, uploadId string) (map[string]string, error) {
+
+	metadata := map[string]string{}
+
+	rows, err := r.db.QueryContext(ctx, "SELECT name, value FROM upload_metadata WHERE uploadId = ?", uploadId)
+
+	if err != nil {
+		return metadata, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+
+		var name, value string
+
+		if err := rows.Scan(&name, &value); err != nil {
+			return metadata, err
+		}
+
+		metadata[name] = value
+	}
+
+	return metadata, rows.Err()
+}
+
+func (r *sqlMetadataRepository) Set(ctx context.Context, uploadId string, metadata map[string]string) error {
+
+	tx, err := r.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	query := "INSERT INTO upload_metadata (uploadId, name, value) VALUES (?, ?, ?)" + r.dialect.OnConflictUpdate("uploadId, name", "value = "+r.dialect.Excluded("value"))
+
+	for name, value := range metadata {
+
+		_, err = tx.ExecContext(ctx, query, uploadId, name, value)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (r *sqlMetadataRepository) Delete(ctx context.Context, uploadId string, names ...string) error {
+
+	for _, name := range names {
+
+		_, err := r.db.ExecContext(ctx, "DELETE FROM upload_metadata WHERE uploadId = ? AND name = ?", uploadId, name)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
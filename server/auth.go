@@ -0,0 +1,242 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/jdrew153/services"
+)
+
+// anyMethod is the routeScopes entry used for methods without their own.
+const anyMethod = "*"
+
+// routeScopes is the scope every authenticated route needs, per method.
+// Paths missing here are public, which covers the media files served by "/".
+// The image routes of routeClasses write an upload's images and need the
+// upload scope, the transcode routes the transcode scope.
+var routeScopes = map[string]map[string]string{
+	"/transcode":           {anyMethod: services.ScopeTranscode},
+	"/download":            {anyMethod: services.ScopeUpload},
+	"/resize":              {anyMethod: services.ScopeUpload},
+	"/uploads":             {http.MethodGet: services.ScopeRead, http.MethodPatch: services.ScopeUpload, http.MethodDelete: services.ScopeDelete},
+	"/duplicates":          {anyMethod: services.ScopeRead},
+	"/focal-point":         {anyMethod: services.ScopeUpload},
+	"/posters":             {http.MethodGet: services.ScopeRead, http.MethodPost: services.ScopeUpload},
+	"/download-transcode":  {anyMethod: services.ScopeUpload},
+	"/thumbnail":           {anyMethod: services.ScopeTranscode},
+	"/m3u8":                {anyMethod: services.ScopeTranscode},
+	"/waveform":            {anyMethod: services.ScopeTranscode},
+	"/captions":            {http.MethodGet: services.ScopeRead, http.MethodPost: services.ScopeUpload, http.MethodDelete: services.ScopeDelete},
+	"/edit":                {anyMethod: services.ScopeTranscode},
+	"/hls-key/token":       {anyMethod: services.ScopeRead},
+	"/api-keys":            {anyMethod: services.ScopeAdmin},
+	"/api-keys/rotate":     {anyMethod: services.ScopeAdmin},
+	"/upload-tokens":       {anyMethod: services.ScopeUpload},
+	"/application-origins": {anyMethod: services.ScopeAdmin},
+	"/hotlink-protection":  {anyMethod: services.ScopeAdmin},
+}
+
+// optionalAuthRoutes authenticate a key, which needs the given scope, when
+// one is sent but also accept other credentials checked by the handler,
+// like signed HLS key tokens.
+var optionalAuthRoutes = map[string]string{
+	"/hls-key": services.ScopeRead,
+}
+
+// uploadTokenRoutes accept a signed upload token in place of an API key,
+// see services.NewUploadToken.
+var uploadTokenRoutes = map[string]bool{
+	"/download": true,
+}
+
+// requestCredential reads a credential from a header, or from a field of
+// multipart chunk uploads which cannot always set headers.
+func requestCredential(r *http.Request, header string, field string) string {
+
+	if value := r.Header.Get(header); value != "" {
+		return value
+	}
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		if err := r.ParseMultipartForm(32 << 20); err == nil {
+			if values := r.MultipartForm.Value[field]; len(values) > 0 {
+				return values[0]
+			}
+		}
+	}
+
+	return ""
+}
+
+func requestAPIKey(r *http.Request) string {
+	return requestCredential(r, "x-api-key", "apiKey")
+}
+
+func requestUploadToken(r *http.Request) string {
+	return requestCredential(r, "x-upload-token", "uploadToken")
+}
+
+// clientIp is the peer address, or the first X-Forwarded-For hop when
+// TRUST_PROXY is set because the service runs behind a reverse proxy.
+func clientIp(r *http.Request) string {
+
+	if os.Getenv("TRUST_PROXY") == "true" {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// declaredUploadSize is the total size a chunked upload announces, or the
+// request body size for single requests.
+func declaredUploadSize(r *http.Request) int64 {
+
+	if size, err := strconv.ParseInt(r.URL.Query().Get("totalSize"), 10, 64); err == nil {
+		return size
+	}
+
+	return r.ContentLength
+}
+
+// AuthMiddleware authenticates the API key of every non public route and
+// enforces its scopes and restrictions. It answers 401 when the key is
+// missing, unknown or expired, 403 when a valid key is not allowed to make
+// the request and 405 for methods a route has no scope for.
+func AuthMiddleware(media *services.MediaService, next http.Handler) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		scopes, protected := routeScopes[r.URL.Path]
+		optionalScope, optional := optionalAuthRoutes[r.URL.Path]
+
+		if !protected && !optional {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		scope, ok := scopes[r.Method]
+
+		if !ok {
+			scope, ok = scopes[anyMethod]
+		}
+
+		// a method without a scope would authorize every key
+		if protected && !ok {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		apiKey := requestAPIKey(r)
+
+		if apiKey == "" && uploadTokenRoutes[r.URL.Path] {
+			if token := requestUploadToken(r); token != "" {
+				serveWithUploadToken(media, w, r, token, next)
+				return
+			}
+		}
+
+		if apiKey == "" {
+			if optional {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			http.Error(w, "Missing API key", http.StatusUnauthorized)
+			return
+		}
+
+		key, err := media.APIKeyCheck(apiKey)
+
+		if errors.Is(err, services.ErrAPIKeyExpired) {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, "Invalid API key", http.StatusUnauthorized)
+			return
+		}
+
+		if optional {
+			scope = optionalScope
+		}
+
+		err = key.Authorize(scope, r.Header.Get("Origin"), clientIp(r))
+
+		if err != nil {
+			log.Printf("Denied %s %s for application %s: %v", r.Method, r.URL.Path, key.ApplicationId, err)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+
+		if scope == services.ScopeUpload && !key.AllowsUploadSize(declaredUploadSize(r)) {
+			http.Error(w, services.ErrUploadSizeExceeded.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(services.WithAPIKey(r.Context(), key)))
+	})
+}
+
+// serveWithUploadToken authenticates a request by upload token. The token
+// stands in for an upload only key with its size limit and origins, and is
+// only good for the chunks of one file.
+func serveWithUploadToken(media *services.MediaService, w http.ResponseWriter, r *http.Request, token string, next http.Handler) {
+
+	claims, err := services.VerifyUploadToken(token)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	key := claims.APIKey()
+
+	err = key.Authorize(services.ScopeUpload, r.Header.Get("Origin"), clientIp(r))
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if !key.AllowsUploadSize(declaredUploadSize(r)) {
+		http.Error(w, services.ErrUploadSizeExceeded.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	err = media.ClaimUploadToken(claims, r.URL.Query().Get("fileId"))
+
+	if errors.Is(err, services.ErrUploadTokenFileId) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if errors.Is(err, services.ErrUploadTokenUsed) || errors.Is(err, services.ErrUploadTokenExpired) {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// the token cannot be checked against its use, it is not accepted
+	if err != nil {
+		log.Println("Error claiming upload token:", err)
+		http.Error(w, "Upload token could not be checked", http.StatusServiceUnavailable)
+		return
+	}
+
+	ctx := services.WithUploadToken(services.WithAPIKey(r.Context(), key), claims)
+
+	next.ServeHTTP(w, r.WithContext(ctx))
+}
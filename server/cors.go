@@ -0,0 +1,84 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/jdrew153/services"
+)
+
+var (
+	corsMethods        = []string{"GET", "POST", "OPTIONS", "PUT", "PATCH", "DELETE"}
+	corsExposedHeaders = []string{"RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "RateLimit-Policy", "Retry-After"}
+)
+
+// CORSMiddleware answers preflight requests and lets every origin read the
+// responses. Preflights carry no API key, so which application a request
+// belongs to, and whether its origin is allowed, is only known once
+// ApplicationCORSMiddleware or ServeContent see it.
+func CORSMiddleware(next http.Handler) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		origin := r.Header.Get("Origin")
+
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+			w.Header().Set("Access-Control-Allow-Methods", strings.Join(corsMethods, ", "))
+
+			if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+				w.Header().Set("Access-Control-Allow-Headers", headers)
+			}
+
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		w.Header().Set("Access-Control-Expose-Headers", strings.Join(corsExposedHeaders, ", "))
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ApplicationCORSMiddleware rejects API calls made by browsers on origins
+// the application of the key did not configure.
+func ApplicationCORSMiddleware(origins *services.OriginService, next http.Handler) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		key, ok := services.APIKeyFromContext(r.Context())
+		origin := r.Header.Get("Origin")
+
+		if !ok || origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		policy, err := origins.Policy(key.ApplicationId)
+
+		if err != nil {
+			log.Println("Error loading origin policy:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if !policy.AllowsOrigin(origin) {
+			w.Header().Del("Access-Control-Allow-Origin")
+			http.Error(w, "Origin not allowed for this application", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/jdrew153/services"
+)
+
+// routeClasses is the rate limit class of each route, authenticated routes
+// missing here count as reads. Keep it in step with routeScopes.
+var routeClasses = map[string]string{
+	"/transcode":           services.RateClassTranscode,
+	"/download-transcode":  services.RateClassTranscode,
+	"/m3u8":                services.RateClassTranscode,
+	"/thumbnail":           services.RateClassTranscode,
+	"/waveform":            services.RateClassTranscode,
+	"/edit":                services.RateClassTranscode,
+	"/resize":              services.RateClassImage,
+	"/focal-point":         services.RateClassImage,
+	"/posters":             services.RateClassImage,
+	"/download":            services.RateClassUpload,
+	"/captions":            services.RateClassUpload,
+	"/upload-tokens":       services.RateClassUpload,
+	"/api-keys":            services.RateClassAdmin,
+	"/api-keys/rotate":     services.RateClassAdmin,
+	"/application-origins": services.RateClassAdmin,
+	"/hotlink-protection":  services.RateClassAdmin,
+}
+
+// RateLimitMiddleware limits the requests the auth middleware authenticated,
+// per key and per application, and answers 429 once a limit is reached.
+// Requests pass when Redis is unavailable rather than failing the service.
+func RateLimitMiddleware(limiter *services.RateLimiter, next http.Handler) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		key, ok := services.APIKeyFromContext(r.Context())
+
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		class, ok := routeClasses[r.URL.Path]
+
+		if !ok {
+			class = services.RateClassRead
+		}
+
+		result, err := limiter.Allow(key, class)
+
+		if err != nil {
+			log.Println("Error checking rate limit:", err)
+		}
+
+		if result.Limit > 0 {
+			for name, value := range result.Headers() {
+				w.Header().Set(name, value)
+			}
+		}
+
+		if !result.Allowed {
+			log.Printf("Rate limited %s %s for application %s", r.Method, r.URL.Path, key.ApplicationId)
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
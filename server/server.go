@@ -7,13 +7,16 @@ import (
 	"os"
 
 	"github.com/jdrew153/controllers"
-	"github.com/rs/cors"
+	"github.com/jdrew153/services"
 	"go.uber.org/fx"
 )
 
 func NewMuxServer(lc fx.Lifecycle, 
 	mediaController *controllers.MediaController,
-	transcoderController *controllers.TranscoderController) *http.ServeMux {
+	transcoderController *controllers.TranscoderController,
+	media *services.MediaService,
+	limiter *services.RateLimiter,
+	origins *services.OriginService) *http.ServeMux {
 
 	mux := http.NewServeMux()
 
@@ -25,19 +28,40 @@ func NewMuxServer(lc fx.Lifecycle,
 
 	mux.HandleFunc("/resize", mediaController.ResizeImagesController)
 
+	mux.HandleFunc("/uploads", mediaController.UploadsController)
+
+	mux.HandleFunc("/duplicates", mediaController.FindDuplicatesController)
+
+	mux.HandleFunc("/focal-point", mediaController.FocalPointController)
+	mux.HandleFunc("/posters", mediaController.PostersController)
+
 	mux.HandleFunc("/download-transcode", transcoderController.DownloadFromUrlToTranscode)
 
 	mux.HandleFunc("/thumbnail", transcoderController.ThumbnailFileReceiver)
 
 	mux.HandleFunc("/m3u8", transcoderController.WriteNewM3U8FileFromMP4)
 
-	c := cors.New(cors.Options{
-		AllowedOrigins: []string{"*"},
-		AllowedMethods: []string{"GET", "POST", "OPTIONS", "PUT", "DELETE"},
-		AllowedHeaders: []string{"*"},
-	})
+	mux.HandleFunc("/waveform", transcoderController.WaveformController)
+
+	mux.HandleFunc("/captions", transcoderController.CaptionsController)
+
+	mux.HandleFunc("/edit", transcoderController.EditController)
+
+	mux.HandleFunc("/hls-key", transcoderController.HlsKeyController)
+
+	mux.HandleFunc("/hls-key/token", transcoderController.HlsKeyTokenController)
+
+	mux.HandleFunc("/api-keys", mediaController.APIKeysController)
+
+	mux.HandleFunc("/api-keys/rotate", mediaController.RotateAPIKeyController)
+
+	mux.HandleFunc("/upload-tokens", mediaController.UploadTokenController)
+
+	mux.HandleFunc("/application-origins", mediaController.ApplicationOriginsController)
+
+	mux.HandleFunc("/hotlink-protection", mediaController.HotlinkProtectionController)
 
-	handler := c.Handler(mux)
+	handler := CORSMiddleware(AuthMiddleware(media, ApplicationCORSMiddleware(origins, RateLimitMiddleware(limiter, mux))))
 
 	var serverHolder *http.Server
 
@@ -0,0 +1,164 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jdrew153/repositories"
+)
+
+// Limits of the tags and metadata applications set on their uploads.
+// MaxUploadMetadataSize counts the bytes of every name and value.
+const (
+	MaxUploadTags          = 20
+	MaxUploadTagLength     = 64
+	MaxUploadMetadataKeys  = 32
+	MaxMetadataNameLength  = 64
+	MaxMetadataValueLength = 512
+	MaxUploadMetadataSize  = 4096
+)
+
+var (
+	uploadTagPattern    = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.:/-]*$`)
+	metadataNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+)
+
+// UploadAnnotations are the tags and metadata an application sets on an
+// upload, e.g. {"tags": ["avatar"], "metadata": {"postId": "42"}}. A nil
+// field is left alone by updates, an empty one clears it.
+type UploadAnnotations struct {
+	Tags     []string          `json:"tags"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+// ValidateUploadTags checks tags against the limits and returns them without
+// duplicates, in order. Tags are case sensitive, as are metadata names.
+func ValidateUploadTags(tags []string) ([]string, error) {
+
+	if tags == nil {
+		return nil, nil
+	}
+
+	unique := []string{}
+	seen := map[string]bool{}
+
+	for _, tag := range tags {
+
+		if len(tag) > MaxUploadTagLength || !uploadTagPattern.MatchString(tag) {
+			return nil, fmt.Errorf("invalid tag %q", tag)
+		}
+
+		if !seen[tag] {
+			seen[tag] = true
+			unique = append(unique, tag)
+		}
+	}
+
+	if len(unique) > MaxUploadTags {
+		return nil, fmt.Errorf("uploads take at most %d tags", MaxUploadTags)
+	}
+
+	return unique, nil
+}
+
+// ValidateUploadMetadata checks metadata against the limits.
+func ValidateUploadMetadata(metadata map[string]string) error {
+
+	if len(metadata) > MaxUploadMetadataKeys {
+		return fmt.Errorf("uploads take at most %d metadata fields", MaxUploadMetadataKeys)
+	}
+
+	size := 0
+
+	for name, value := range metadata {
+
+		if len(name) > MaxMetadataNameLength || !metadataNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid metadata name %q", name)
+		}
+
+		if len(value) > MaxMetadataValueLength {
+			return fmt.Errorf("metadata %s is longer than %d bytes", name, MaxMetadataValueLength)
+		}
+
+		size += len(name) + len(value)
+	}
+
+	if size > MaxUploadMetadataSize {
+		return fmt.Errorf("upload metadata is larger than %d bytes", MaxUploadMetadataSize)
+	}
+
+	return nil
+}
+
+func (a *UploadAnnotations) Validate() error {
+
+	tags, err := ValidateUploadTags(a.Tags)
+
+	if err != nil {
+		return err
+	}
+
+	a.Tags = tags
+
+	return ValidateUploadMetadata(a.Metadata)
+}
+
+// ParseUploadAnnotations reads the annotations sent along an upload, tags as
+// a comma separated list and metadata as a JSON object of strings.
+func ParseUploadAnnotations(tags string, metadata string) (UploadAnnotations, error) {
+
+	var annotations UploadAnnotations
+
+	for _, tag := range strings.Split(tags, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			annotations.Tags = append(annotations.Tags, tag)
+		}
+	}
+
+	if metadata != "" {
+		err := json.Unmarshal([]byte(metadata), &annotations.Metadata)
+
+		if err != nil {
+			return annotations, fmt.Errorf("metadata must be a JSON object of strings")
+		}
+	}
+
+	return annotations, annotations.Validate()
+}
+
+// SetUploadAnnotations replaces the tags and metadata of an upload, see
+// UploadAnnotations.
+func (s *MediaService) SetUploadAnnotations(uploadId string, annotations UploadAnnotations) error {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	return s.Uploads.SetAnnotations(ctx, uploadId, annotations.Tags, annotations.Metadata)
+}
+
+// UploadFilterFromQuery reads the filters of an upload listing, every "tag"
+// parameter and "metadata.<name>=<value>" equalities.
+func UploadFilterFromQuery(query map[string][]string) (repositories.UploadFilter, error) {
+
+	filter := repositories.UploadFilter{
+		Tags:     query["tag"],
+		Metadata: map[string]string{},
+	}
+
+	for key, values := range query {
+		if name, ok := strings.CutPrefix(key, "metadata."); ok && len(values) > 0 {
+			filter.Metadata[name] = values[0]
+		}
+	}
+
+	if _, err := ValidateUploadTags(filter.Tags); err != nil {
+		return filter, err
+	}
+
+	return filter, ValidateUploadMetadata(filter.Metadata)
+}
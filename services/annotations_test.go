@@ -0,0 +1,52 @@
+package services
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseUploadAnnotations(t *testing.T) {
+
+	annotations, err := ParseUploadAnnotations("avatar, public,avatar", `{"postId":"42"}`)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(annotations.Tags) != 2 || annotations.Tags[0] != "avatar" || annotations.Tags[1] != "public" {
+		t.Fatalf("tags = %v", annotations.Tags)
+	}
+
+	if annotations.Metadata["postId"] != "42" {
+		t.Fatalf("metadata = %v", annotations.Metadata)
+	}
+
+	for _, invalid := range []struct{ tags, metadata string }{
+		{"has space", ""},
+		{strings.Repeat("a", MaxUploadTagLength+1), ""},
+		{"", `{"postId":42}`},
+		{"", `{"bad name":"x"}`},
+		{"", `{"postId":"` + strings.Repeat("a", MaxMetadataValueLength+1) + `"}`},
+	} {
+		if _, err := ParseUploadAnnotations(invalid.tags, invalid.metadata); err == nil {
+			t.Errorf("tags %q and metadata %q were accepted", invalid.tags, invalid.metadata)
+		}
+	}
+}
+
+func TestUploadFilterFromQuery(t *testing.T) {
+
+	filter, err := UploadFilterFromQuery(map[string][]string{
+		"tag":             {"avatar", "public"},
+		"metadata.postId": {"42"},
+		"limit":           {"10"},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(filter.Tags) != 2 || len(filter.Metadata) != 1 || filter.Metadata["postId"] != "42" {
+		t.Fatalf("filter = %+v", filter)
+	}
+}
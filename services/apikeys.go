@@ -0,0 +1,179 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// API key scopes. Admin implies every other scope.
+const (
+	ScopeUpload    = "upload"
+	ScopeRead      = "read"
+	ScopeTranscode = "transcode"
+	ScopeDelete    = "delete"
+	ScopeAdmin     = "admin"
+)
+
+// LegacyScopes are granted to key records written before keys had scopes.
+var LegacyScopes = []string{ScopeUpload, ScopeRead, ScopeTranscode, ScopeDelete}
+
+var (
+	ErrAPIKeyExpired      = errors.New("API key expired")
+	ErrScopeDenied        = errors.New("API key lacks the required scope")
+	ErrOriginDenied       = errors.New("origin not allowed for this API key")
+	ErrIpDenied           = errors.New("IP address not allowed for this API key")
+	ErrUploadSizeExceeded = errors.New("upload exceeds the maximum size of this API key")
+)
+
+func ValidScope(scope string) bool {
+	switch scope {
+	case ScopeUpload, ScopeRead, ScopeTranscode, ScopeDelete, ScopeAdmin:
+		return true
+	}
+	return false
+}
+
+// HasScope reports whether the key grants scope.
+func (m ValidUserIDAndAppIDModel) HasScope(scope string) bool {
+
+	scopes := m.Scopes
+
+	if scopes == nil {
+		scopes = LegacyScopes
+	}
+
+	for _, granted := range scopes {
+		if granted == scope || granted == ScopeAdmin {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (m ValidUserIDAndAppIDModel) Expired() bool {
+	return m.ExpiresAt > 0 && time.Now().UnixMilli() >= m.ExpiresAt
+}
+
+// AllowsOrigin matches the Origin header against the allowed origins.
+// Requests without an Origin come from servers, not browsers, and are not
+// restricted.
+func (m ValidUserIDAndAppIDModel) AllowsOrigin(origin string) bool {
+
+	if len(m.AllowedOrigins) == 0 || origin == "" {
+		return true
+	}
+
+	return MatchOrigin(m.AllowedOrigins, origin)
+}
+
+// MatchOrigin reports whether origin is one of allowed, a
+// "https://*.example.com" entry allows every subdomain.
+func MatchOrigin(allowed []string, origin string) bool {
+
+	for _, entry := range allowed {
+
+		if entry == "*" || strings.EqualFold(entry, origin) {
+			return true
+		}
+
+		if scheme, host, ok := strings.Cut(entry, "://*."); ok {
+			if strings.HasPrefix(origin, scheme+"://") && strings.HasSuffix(strings.ToLower(origin), "."+strings.ToLower(host)) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// AllowsIp matches the client address against allowed addresses and CIDR ranges.
+func (m ValidUserIDAndAppIDModel) AllowsIp(ip string) bool {
+
+	if len(m.AllowedIps) == 0 {
+		return true
+	}
+
+	addr := net.ParseIP(ip)
+
+	if addr == nil {
+		return false
+	}
+
+	for _, allowed := range m.AllowedIps {
+
+		if _, network, err := net.ParseCIDR(allowed); err == nil {
+			if network.Contains(addr) {
+				return true
+			}
+			continue
+		}
+
+		if allowedAddr := net.ParseIP(allowed); allowedAddr != nil && allowedAddr.Equal(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ValidateRestrictions checks the allowed origins, "*" or an origin as
+// ValidateOrigin accepts, and the allowed addresses and CIDR ranges.
+func (m ValidUserIDAndAppIDModel) ValidateRestrictions() error {
+
+	for _, origin := range m.AllowedOrigins {
+		if origin != "*" {
+			if err := ValidateOrigin(origin); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, allowed := range m.AllowedIps {
+		if _, _, err := net.ParseCIDR(allowed); err != nil && net.ParseIP(allowed) == nil {
+			return fmt.Errorf("invalid IP address or range %s", allowed)
+		}
+	}
+
+	return nil
+}
+
+// AllowsUploadSize reports whether an upload of size bytes fits the key's limit.
+func (m ValidUserIDAndAppIDModel) AllowsUploadSize(size int64) bool {
+	return m.MaxUploadSize <= 0 || size <= m.MaxUploadSize
+}
+
+// Authorize checks the restrictions of the key for a request needing scope.
+func (m ValidUserIDAndAppIDModel) Authorize(scope string, origin string, ip string) error {
+
+	if !m.AllowsIp(ip) {
+		return ErrIpDenied
+	}
+
+	if !m.AllowsOrigin(origin) {
+		return ErrOriginDenied
+	}
+
+	if scope != "" && !m.HasScope(scope) {
+		return ErrScopeDenied
+	}
+
+	return nil
+}
+
+type apiKeyContextKey struct{}
+
+// WithAPIKey stores the authenticated key of a request in its context.
+func WithAPIKey(ctx context.Context, key ValidUserIDAndAppIDModel) context.Context {
+	return context.WithValue(ctx, apiKeyContextKey{}, key)
+}
+
+// APIKeyFromContext returns the key the auth middleware authenticated.
+func APIKeyFromContext(ctx context.Context) (ValidUserIDAndAppIDModel, bool) {
+	key, ok := ctx.Value(apiKeyContextKey{}).(ValidUserIDAndAppIDModel)
+	return key, ok
+}
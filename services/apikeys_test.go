@@ -0,0 +1,30 @@
+package services
+
+import "testing"
+
+func TestValidateRestrictions(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		origins []string
+		ips     []string
+		valid   bool
+	}{
+		{"none", nil, nil, true},
+		{"origins", []string{"*", "https://example.com", "http://localhost:3000", "https://*.example.com"}, nil, true},
+		{"addresses", nil, []string{"10.0.0.1", "10.0.0.0/8", "::1", "2001:db8::/32"}, true},
+		{"origin with path", []string{"https://example.com/app"}, nil, false},
+		{"origin without scheme", []string{"example.com"}, nil, false},
+		{"bad address", nil, []string{"10.0.0.256"}, false},
+		{"bad range", nil, []string{"10.0.0.0/33"}, false},
+	}
+
+	for _, test := range tests {
+
+		key := ValidUserIDAndAppIDModel{AllowedOrigins: test.origins, AllowedIps: test.ips}
+
+		if err := key.ValidateRestrictions(); (err == nil) != test.valid {
+			t.Errorf("%s: ValidateRestrictions() = %v, want valid %v", test.name, err, test.valid)
+		}
+	}
+}
@@ -0,0 +1,367 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/savsgio/gotils/uuid"
+)
+
+// APIKeyTag starts every generated key, the tag and the next
+// apiKeyPrefixLength characters form the visible prefix identifying a key
+// in listings.
+const (
+	APIKeyTag          = "sk_"
+	apiKeyPrefixLength = 8
+)
+
+// DefaultRotationGrace is how long a rotated key keeps working next to its
+// replacement, MaxRotationGrace caps what callers can ask for.
+const (
+	DefaultRotationGrace = 24 * time.Hour
+	MaxRotationGrace     = 30 * 24 * time.Hour
+)
+
+var (
+	ErrAPIKeyNotFound = errors.New("API key not found")
+	ErrAPIKeyRotated  = errors.New("API key was already rotated")
+)
+
+// HashAPIKey is the sha256 under which a key is stored, keys themselves are
+// only shown once when created.
+func HashAPIKey(apiKey string) string {
+
+	sum := sha256.Sum256([]byte(apiKey))
+
+	return hex.EncodeToString(sum[:])
+}
+
+func apiKeyRecordKey(hash string) string {
+	return fmt.Sprintf("apikey:%s", hash)
+}
+
+// apiKeyIndexKey holds the key id to hash map of an application.
+func apiKeyIndexKey(applicationId string) string {
+	return fmt.Sprintf("apikeys:%s", applicationId)
+}
+
+// apiKeyUsageKey holds the key id to last use, in unix ms, of an application.
+// It is kept apart from the records so authenticating never rewrites them.
+func apiKeyUsageKey(applicationId string) string {
+	return fmt.Sprintf("apikeys:%s:used", applicationId)
+}
+
+// generateAPIKey returns a new random key and its visible prefix.
+func generateAPIKey() (string, string, error) {
+
+	secret := make([]byte, 32)
+
+	_, err := rand.Read(secret)
+
+	if err != nil {
+		return "", "", err
+	}
+
+	encoded := hex.EncodeToString(secret)
+
+	prefix := APIKeyTag + encoded[:apiKeyPrefixLength]
+
+	return prefix + "_" + encoded[apiKeyPrefixLength:], prefix, nil
+}
+
+// storeAPIKey writes the record of a key hash and indexes it under its
+// application.
+func (s *MediaService) storeAPIKey(hash string, record ValidUserIDAndAppIDModel, ttl time.Duration) error {
+
+	data, err := json.Marshal(record)
+
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err = s.Redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, apiKeyRecordKey(hash), data, ttl)
+		pipe.HSet(ctx, apiKeyIndexKey(record.ApplicationId), record.Id, hash)
+		return nil
+	})
+
+	return err
+}
+
+// lookupAPIKey reads the record stored under hash, redis.Nil when unknown.
+func (s *MediaService) lookupAPIKey(ctx context.Context, hash string) (ValidUserIDAndAppIDModel, error) {
+
+	var record ValidUserIDAndAppIDModel
+
+	value, err := s.Redis.Get(ctx, apiKeyRecordKey(hash)).Result()
+
+	if err != nil {
+		return record, err
+	}
+
+	err = json.Unmarshal([]byte(value), &record)
+
+	return record, err
+}
+
+// legacyAPIKeyCandidate reports whether a Redis key may be a raw API key
+// from before hashing. Everything the service stores itself is namespaced
+// with a colon.
+func legacyAPIKeyCandidate(key string) bool {
+	return key != "" && !strings.Contains(key, ":")
+}
+
+// MigrateLegacyAPIKeys moves the keys stored raw, as the Redis key itself,
+// to hashed storage and returns how many were moved. It is a one time step
+// of the migrate command, requests only ever look keys up by hash.
+func (s *MediaService) MigrateLegacyAPIKeys(ctx context.Context) (int, error) {
+
+	migrated := 0
+
+	iter := s.Redis.Scan(ctx, 0, "*", 1000).Iterator()
+
+	for iter.Next(ctx) {
+
+		apiKey := iter.Val()
+
+		if !legacyAPIKeyCandidate(apiKey) {
+			continue
+		}
+
+		value, err := s.Redis.Get(ctx, apiKey).Result()
+
+		if err != nil {
+			// gone meanwhile, or not a string value
+			continue
+		}
+
+		var record ValidUserIDAndAppIDModel
+
+		if json.Unmarshal([]byte(value), &record) != nil || record.ApplicationId == "" || record.UserId == "" {
+			continue
+		}
+
+		record.Id = uuid.V4()
+		record.Prefix = apiKey
+
+		if len(apiKey) > apiKeyPrefixLength {
+			record.Prefix = apiKey[:apiKeyPrefixLength]
+		}
+
+		record.CreatedAt = time.Now().UnixMilli()
+
+		err = s.storeAPIKey(HashAPIKey(apiKey), record, 0)
+
+		if err != nil {
+			return migrated, err
+		}
+
+		err = s.Redis.Del(ctx, apiKey).Err()
+
+		if err != nil {
+			return migrated, err
+		}
+
+		log.Printf("Migrated API key %s of application %s to hashed storage", record.Prefix, record.ApplicationId)
+
+		migrated++
+	}
+
+	return migrated, iter.Err()
+}
+
+// touchAPIKey records the last use of a key.
+func (s *MediaService) touchAPIKey(ctx context.Context, record ValidUserIDAndAppIDModel) {
+
+	err := s.Redis.HSet(ctx, apiKeyUsageKey(record.ApplicationId), record.Id, time.Now().UnixMilli()).Err()
+
+	if err != nil {
+		log.Println("Error recording API key use:", err)
+	}
+}
+
+// CreateAPIKey stores a new key with the restrictions of record and returns
+// the key, which cannot be recovered later, with its stored record.
+func (s *MediaService) CreateAPIKey(record ValidUserIDAndAppIDModel) (string, ValidUserIDAndAppIDModel, error) {
+
+	for _, scope := range record.Scopes {
+		if !ValidScope(scope) {
+			return "", record, fmt.Errorf("unknown scope %s", scope)
+		}
+	}
+
+	if err := record.ValidateRestrictions(); err != nil {
+		return "", record, err
+	}
+
+	apiKey, prefix, err := generateAPIKey()
+
+	if err != nil {
+		return "", record, err
+	}
+
+	record.Id = uuid.V4()
+	record.Prefix = prefix
+	record.CreatedAt = time.Now().UnixMilli()
+	record.LastUsedAt = 0
+
+	err = s.storeAPIKey(HashAPIKey(apiKey), record, 0)
+
+	if err != nil {
+		return "", record, err
+	}
+
+	return apiKey, record, nil
+}
+
+// GetAPIKey returns the record of a key of the application with its hash.
+func (s *MediaService) GetAPIKey(applicationId string, id string) (ValidUserIDAndAppIDModel, string, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	hash, err := s.Redis.HGet(ctx, apiKeyIndexKey(applicationId), id).Result()
+
+	if err == redis.Nil {
+		return ValidUserIDAndAppIDModel{}, "", ErrAPIKeyNotFound
+	}
+
+	if err != nil {
+		return ValidUserIDAndAppIDModel{}, "", err
+	}
+
+	record, err := s.lookupAPIKey(ctx, hash)
+
+	if err == redis.Nil {
+		return record, hash, ErrAPIKeyNotFound
+	}
+
+	return record, hash, err
+}
+
+// ListAPIKeys returns the keys of an application, oldest first, with their
+// last use. Index entries of keys whose grace period ran out are dropped.
+func (s *MediaService) ListAPIKeys(applicationId string) ([]ValidUserIDAndAppIDModel, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	index, err := s.Redis.HGetAll(ctx, apiKeyIndexKey(applicationId)).Result()
+
+	if err != nil {
+		return nil, err
+	}
+
+	usage, err := s.Redis.HGetAll(ctx, apiKeyUsageKey(applicationId)).Result()
+
+	if err != nil {
+		return nil, err
+	}
+
+	records := []ValidUserIDAndAppIDModel{}
+
+	for id, hash := range index {
+
+		record, err := s.lookupAPIKey(ctx, hash)
+
+		if err == redis.Nil {
+			s.Redis.HDel(ctx, apiKeyIndexKey(applicationId), id)
+			s.Redis.HDel(ctx, apiKeyUsageKey(applicationId), id)
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		record.LastUsedAt, _ = strconv.ParseInt(usage[id], 10, 64)
+
+		records = append(records, record)
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].CreatedAt < records[j].CreatedAt
+	})
+
+	return records, nil
+}
+
+// RevokeAPIKey deletes a key of the application, it stops working at once.
+func (s *MediaService) RevokeAPIKey(applicationId string, id string) error {
+
+	_, hash, err := s.GetAPIKey(applicationId, id)
+
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err = s.Redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, apiKeyRecordKey(hash))
+		pipe.HDel(ctx, apiKeyIndexKey(applicationId), id)
+		pipe.HDel(ctx, apiKeyUsageKey(applicationId), id)
+		return nil
+	})
+
+	return err
+}
+
+// RotateAPIKey replaces a key with a new one having the same restrictions.
+// The old key keeps working for the grace period, then disappears.
+func (s *MediaService) RotateAPIKey(applicationId string, id string, grace time.Duration) (string, ValidUserIDAndAppIDModel, error) {
+
+	if grace < 0 || grace > MaxRotationGrace {
+		return "", ValidUserIDAndAppIDModel{}, fmt.Errorf("grace period must be between 0 and %s", MaxRotationGrace)
+	}
+
+	old, hash, err := s.GetAPIKey(applicationId, id)
+
+	if err != nil {
+		return "", old, err
+	}
+
+	if old.RotatedAt > 0 {
+		return "", old, ErrAPIKeyRotated
+	}
+
+	replacement := old
+	replacement.RotatedAt = 0
+
+	apiKey, replacement, err := s.CreateAPIKey(replacement)
+
+	if err != nil {
+		return "", replacement, err
+	}
+
+	now := time.Now()
+
+	old.RotatedAt = now.UnixMilli()
+
+	if graceEnd := now.Add(grace).UnixMilli(); old.ExpiresAt == 0 || graceEnd < old.ExpiresAt {
+		old.ExpiresAt = graceEnd
+	}
+
+	ttl := time.Until(time.UnixMilli(old.ExpiresAt))
+
+	if ttl <= 0 {
+		return apiKey, replacement, s.RevokeAPIKey(applicationId, id)
+	}
+
+	return apiKey, replacement, s.storeAPIKey(hash, old, ttl)
+}
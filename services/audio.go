@@ -0,0 +1,276 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/xfrr/goffmpeg/transcoder"
+)
+
+// AudioExtensions are the upload extensions handled by the audio pipeline.
+var AudioExtensions = map[string]bool{
+	".mp3":  true,
+	".wav":  true,
+	".flac": true,
+	".m4a":  true,
+	".ogg":  true,
+	".opus": true,
+	".aac":  true,
+}
+
+func IsAudioFile(filePath string) bool {
+	return AudioExtensions[strings.ToLower(filepath.Ext(filePath))]
+}
+
+// Audio codecs.
+const (
+	AudioAAC  = "aac"
+	AudioOpus = "opus"
+)
+
+// AudioPreset is one audio rendition. Bitrate is in kbit/s, Hls renditions
+// are segmented into an audio-only playlist instead of a single file and
+// Normalize applies loudness normalization to the rendition.
+type AudioPreset struct {
+	Name      string `json:"name"`
+	Codec     string `json:"codec"`
+	Bitrate   int    `json:"bitrate"`
+	Hls       bool   `json:"hls"`
+	Normalize bool   `json:"normalize"`
+}
+
+var DefaultAudioPresets = []AudioPreset{
+	{Name: "aac-128", Codec: AudioAAC, Bitrate: 128},
+	{Name: "aac-64-hls", Codec: AudioAAC, Bitrate: 64, Hls: true},
+	{Name: "opus-96", Codec: AudioOpus, Bitrate: 96},
+}
+
+var audioPresetName = regexp.MustCompile(`^[a-z0-9-]+$`)
+
+func (p AudioPreset) Validate() error {
+
+	if !audioPresetName.MatchString(p.Name) {
+		return fmt.Errorf("audio preset name %q must be lowercase letters, digits and dashes", p.Name)
+	}
+
+	if p.Codec != AudioAAC && p.Codec != AudioOpus {
+		return fmt.Errorf("audio preset %s: unknown codec %q", p.Name, p.Codec)
+	}
+
+	if p.Bitrate < 16 || p.Bitrate > 320 {
+		return fmt.Errorf("audio preset %s: bitrate must be between 16 and 320 kbit/s", p.Name)
+	}
+
+	// HLS players only reliably decode AAC in MPEG-TS segments
+	if p.Hls && p.Codec != AudioAAC {
+		return fmt.Errorf("audio preset %s: HLS renditions must use aac", p.Name)
+	}
+
+	return nil
+}
+
+func ValidateAudioPresets(presets []AudioPreset) error {
+
+	names := map[string]bool{}
+
+	for _, preset := range presets {
+		if err := preset.Validate(); err != nil {
+			return err
+		}
+
+		if names[preset.Name] {
+			return fmt.Errorf("duplicate audio preset name %q", preset.Name)
+		}
+
+		names[preset.Name] = true
+	}
+
+	return nil
+}
+
+func (p AudioPreset) encoder() string {
+	if p.Codec == AudioOpus {
+		return "libopus"
+	}
+	return "aac"
+}
+
+func (p AudioPreset) format() string {
+	if p.Hls {
+		return "hls"
+	}
+	return p.Codec
+}
+
+func (p AudioPreset) fileName() string {
+
+	switch {
+	case p.Hls:
+		return fmt.Sprintf("audio-%s.m3u8", p.Name)
+	case p.Codec == AudioOpus:
+		return fmt.Sprintf("audio-%s.opus", p.Name)
+	}
+
+	return fmt.Sprintf("audio-%s.m4a", p.Name)
+}
+
+// transcodeAudioPreset encodes the audio track of inputPath into the preset,
+// reporting progress on the preset's pusher channel like video renditions.
+func (s *TranscoderService) transcodeAudioPreset(inputPath string, preset AudioPreset, loudnorm string) (ResizedImageUrlAndSizeModel, error) {
+
+	fileId := mediaFileId(inputPath)
+	outputDir := fmt.Sprintf("./media/%s", fileId)
+
+	err := os.MkdirAll(outputDir, 0755)
+
+	if err != nil {
+		return ResizedImageUrlAndSizeModel{}, err
+	}
+
+	outputPath := fmt.Sprintf("%s/%s", outputDir, preset.fileName())
+
+	trans := new(transcoder.Transcoder)
+
+	err = trans.Initialize(inputPath, outputPath)
+
+	if err != nil {
+		return ResizedImageUrlAndSizeModel{}, err
+	}
+
+	log.Printf("Transcoding audio of %s to %s", inputPath, preset.Name)
+
+	trans.MediaFile().SetSkipVideo(true)
+	trans.MediaFile().SetAudioCodec(preset.encoder())
+	trans.MediaFile().SetAudioBitRate(fmt.Sprintf("%dk", preset.Bitrate))
+
+	if preset.Normalize && loudnorm != "" {
+		// loudnorm resamples to 192 kHz internally
+		trans.MediaFile().SetAudioFilter(loudnorm)
+		trans.MediaFile().SetAudioRate(48000)
+	}
+
+	if preset.Hls {
+		trans.MediaFile().SetOutputFormat("hls")
+		trans.MediaFile().SetHlsSegmentDuration(10)
+		trans.MediaFile().SetHlsListSize(0)
+		trans.MediaFile().SetHlsPlaylistType("vod")
+		trans.MediaFile().SetHlsSegmentFilename(fmt.Sprintf("%s/audio-%s_%%03d.ts", outputDir, preset.Name))
+	}
+
+	done := trans.Run(true)
+
+	for msg := range trans.Output() {
+		SendPusherNotif(inputPath, preset.Name, msg, s.Pusher)
+	}
+
+	err = <-done
+
+	if err != nil {
+		return ResizedImageUrlAndSizeModel{}, err
+	}
+
+	// an HLS rendition weighs its playlist plus all of its segments
+	files := []string{outputPath}
+
+	if preset.Hls {
+		segments, _ := filepath.Glob(fmt.Sprintf("%s/audio-%s_*.ts", outputDir, preset.Name))
+		files = append(files, segments...)
+	}
+
+	var size int64
+
+	for _, file := range files {
+		info, err := os.Stat(file)
+
+		if err != nil {
+			return ResizedImageUrlAndSizeModel{}, err
+		}
+
+		size += info.Size()
+	}
+
+	return ResizedImageUrlAndSizeModel{
+		Name:   preset.Name,
+		Url:    fmt.Sprintf("https://kaykatjd.com/media/%s/%s", fileId, preset.fileName()),
+		Size:   size,
+		Format: preset.format(),
+	}, nil
+}
+
+// TranscodeAudio runs every preset over the audio track of inputPath in
+// parallel and records the outputs as "audio" variants of the upload. Failed
+// presets are logged and left out. loudnorm is the normalization filter for
+// the presets asking for it, see PrepareLoudnessNormalization.
+func (s *TranscoderService) TranscodeAudio(inputPath string, presets []AudioPreset, applicationId string, loudnorm string) ([]ResizedImageUrlAndSizeModel, error) {
+
+	if len(presets) == 0 {
+		presets = DefaultAudioPresets
+	}
+
+	err := ValidateAudioPresets(presets)
+
+	if err != nil {
+		return nil, err
+	}
+
+	renditions := make([]*ResizedImageUrlAndSizeModel, len(presets))
+
+	wg := sync.WaitGroup{}
+	wg.Add(len(presets))
+
+	for i, preset := range presets {
+
+		go func(i int, preset AudioPreset) {
+
+			defer wg.Done()
+
+			rendition, err := s.transcodeAudioPreset(inputPath, preset, loudnorm)
+
+			if err != nil {
+				log.Println("Error transcoding audio of " + inputPath + " to " + preset.Name)
+				log.Println(err)
+				return
+			}
+
+			renditions[i] = &rendition
+
+			if !preset.Hls {
+				CallbackFunctionToUpdateUpload(applicationId, MediaPathFromUrl(rendition.Url))
+			}
+
+		}(i, preset)
+	}
+
+	wg.Wait()
+
+	var results []ResizedImageUrlAndSizeModel
+
+	for _, rendition := range renditions {
+		if rendition != nil {
+			results = append(results, *rendition)
+		}
+	}
+
+	if len(results) == 0 {
+		return nil, fmt.Errorf("no audio rendition of %s could be created", inputPath)
+	}
+
+	uploadId, err := s.uploadIdForPath(inputPath)
+
+	if err != nil || uploadId == "" {
+		return results, err
+	}
+
+	err = s.Media.DeleteVariantRows(uploadId, "audio")
+
+	if err != nil {
+		return results, err
+	}
+
+	return results, s.Media.WriteVariantsToDB(uploadId, "audio", results)
+}
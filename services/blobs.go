@@ -0,0 +1,235 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Finalized uploads are stored once per content hash under ./media/blobs and
+// the upload's own path becomes a symlink to the blob. The blobs table keeps
+// a reference count so the blob is only removed with its last upload.
+
+const blobsDir = "./media/blobs"
+
+func blobPath(hash string) string {
+	return fmt.Sprintf("%s/%s/%s", blobsDir, hash[:2], hash)
+}
+
+// MediaPathFromUrl maps a public media url onto its path on disk.
+func MediaPathFromUrl(url string) string {
+
+	parts := strings.SplitN(url, "/media/", 2)
+
+	if len(parts) != 2 {
+		return ""
+	}
+
+	return fmt.Sprintf("./media/%s", parts[1])
+}
+
+func hashFile(filePath string) (string, int64, error) {
+
+	file, err := os.Open(filePath)
+
+	if err != nil {
+		return "", 0, err
+	}
+
+	defer file.Close()
+
+	hasher := sha256.New()
+
+	size, err := io.Copy(hasher, file)
+
+	if err != nil {
+		return "", 0, err
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil)), size, nil
+}
+
+// StoreBlob moves a finalized upload into content addressed storage, links
+// filePath to the blob and takes a reference on it for the upload. The
+// reference is committed only once the files are in place, and the files
+// are put back when it cannot be.
+func (s *MediaService) StoreBlob(filePath string, uploadId string) (string, error) {
+
+	hash, size, err := hashFile(filePath)
+
+	if err != nil {
+		return "", err
+	}
+
+	target := blobPath(hash)
+
+	err = os.MkdirAll(filepath.Dir(target), os.ModePerm)
+
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	var undo func()
+
+	err = s.Blobs.Acquire(ctx, hash, size, uploadId, func() error {
+		undo, err = linkBlob(filePath, target)
+		return err
+	})
+
+	if err != nil {
+		// the files were linked but the reference could not be committed
+		if undo != nil {
+			undo()
+		}
+
+		return "", err
+	}
+
+	// a copy of content stored before is only dropped now
+	os.Remove(filePath + ".duplicate")
+
+	log.Printf("Stored upload %s as blob %s", uploadId, hash)
+
+	return hash, nil
+}
+
+// linkBlob moves filePath to the blob at target, keeping the file aside
+// when the blob exists already, and replaces it with a symlink. The
+// returned undo puts the file back.
+func linkBlob(filePath string, target string) (func(), error) {
+
+	moved := target
+	_, err := os.Stat(target)
+
+	if err == nil {
+		log.Printf("Blob %s already stored, dropping duplicate copy of %s", filepath.Base(target), filePath)
+
+		moved = filePath + ".duplicate"
+	}
+
+	err = os.Rename(filePath, moved)
+
+	if err != nil {
+		return nil, err
+	}
+
+	undo := func() {
+		os.Remove(filePath)
+
+		if err := os.Rename(moved, filePath); err != nil {
+			log.Println("Error restoring", filePath, err)
+		}
+	}
+
+	relative, err := filepath.Rel(filepath.Dir(filePath), target)
+
+	if err == nil {
+		err = os.Symlink(relative, filePath)
+	}
+
+	if err != nil {
+		undo()
+		return nil, err
+	}
+
+	return undo, nil
+}
+
+// ReleaseBlob drops one reference and removes the blob once nothing uses it.
+// The file is moved aside while the blob row is still locked, a concurrent
+// StoreBlob of the same content then finds no blob and stores its own.
+func (s *MediaService) ReleaseBlob(hash string) error {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	target := blobPath(hash)
+	released := ""
+
+	err := s.Blobs.Release(ctx, hash, func() error {
+
+		log.Printf("Last reference to blob %s released, removing it", hash)
+
+		err := os.Rename(target, target+".released")
+
+		if err == nil {
+			released = target + ".released"
+		}
+
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		return nil
+	})
+
+	if released == "" {
+		return err
+	}
+
+	if err != nil {
+		if err := os.Rename(released, target); err != nil {
+			log.Println("Error restoring blob", hash, err)
+		}
+
+		return err
+	}
+
+	err = os.Remove(released)
+
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// DeleteUpload soft deletes an upload with the uploads derived from it, and
+// removes its variants, metadata and files, evicting them from the content
+// cache, before releasing its blob. The rows stay behind with the deleted
+// status.
+func (s *MediaService) DeleteUpload(uploadId string) error {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	urls, contentHash, err := s.Uploads.Delete(ctx, uploadId)
+
+	if err != nil {
+		return err
+	}
+
+	for _, url := range urls {
+
+		path := MediaPathFromUrl(url)
+
+		if path == "" {
+			continue
+		}
+
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Println(err)
+		}
+
+		s.Cache.Remove(path)
+	}
+
+	if contentHash != "" {
+		return s.ReleaseBlob(contentHash)
+	}
+
+	return nil
+}
@@ -0,0 +1,513 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// captionSegmentDuration matches the -hls_time of the video renditions.
+const captionSegmentDuration = 10.0
+
+var captionLanguage = regexp.MustCompile(`^[a-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+
+func ValidateCaptionLanguage(language string) error {
+	if !captionLanguage.MatchString(language) {
+		return fmt.Errorf("invalid caption language %q, expected a BCP 47 tag like en or pt-BR", language)
+	}
+	return nil
+}
+
+// CaptionTrack is a caption file attached to a video upload. Url is the full
+// WebVTT file, PlaylistUrl its HLS subtitle rendition.
+type CaptionTrack struct {
+	Id          string `json:"id"`
+	Language    string `json:"language"`
+	Label       string `json:"label"`
+	Default     bool   `json:"default"`
+	Url         string `json:"url"`
+	PlaylistUrl string `json:"playlistUrl"`
+}
+
+var srtTiming = regexp.MustCompile(`^(\d{1,2}:\d{2}:\d{2}),(\d{3})\s*-->\s*(\d{1,2}:\d{2}:\d{2}),(\d{3})(.*)$`)
+
+// ConvertSRTToVTT rewrites SubRip captions as WebVTT: it drops the cue
+// numbers and uses dots as millisecond separators.
+func ConvertSRTToVTT(data []byte) ([]byte, error) {
+
+	text := strings.ReplaceAll(strings.TrimPrefix(string(data), "\uFEFF"), "\r\n", "\n")
+
+	var out strings.Builder
+
+	out.WriteString("WEBVTT\n\n")
+
+	cues := 0
+
+	for _, block := range strings.Split(strings.TrimSpace(text), "\n\n") {
+
+		lines := strings.Split(strings.TrimSpace(block), "\n")
+
+		// the cue number is optional in the wild
+		if len(lines) > 0 && !strings.Contains(lines[0], "-->") {
+			lines = lines[1:]
+		}
+
+		if len(lines) == 0 {
+			continue
+		}
+
+		match := srtTiming.FindStringSubmatch(strings.TrimSpace(lines[0]))
+
+		if match == nil {
+			return nil, fmt.Errorf("invalid SRT timing line %q", lines[0])
+		}
+
+		fmt.Fprintf(&out, "%s.%s --> %s.%s\n", match[1], match[2], match[3], match[4])
+
+		for _, line := range lines[1:] {
+			out.WriteString(line)
+			out.WriteString("\n")
+		}
+
+		out.WriteString("\n")
+		cues++
+	}
+
+	if cues == 0 {
+		return nil, fmt.Errorf("SRT file has no cues")
+	}
+
+	return []byte(out.String()), nil
+}
+
+type vttCue struct {
+	Start float64
+	End   float64
+	Block string
+}
+
+func parseVTTTimestamp(value string) (float64, error) {
+
+	parts := strings.Split(value, ":")
+
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, fmt.Errorf("invalid WebVTT timestamp %q", value)
+	}
+
+	seconds := 0.0
+
+	for _, part := range parts[:len(parts)-1] {
+		n, err := strconv.Atoi(part)
+
+		if err != nil {
+			return 0, fmt.Errorf("invalid WebVTT timestamp %q", value)
+		}
+
+		seconds = seconds*60 + float64(n)
+	}
+
+	last, err := strconv.ParseFloat(parts[len(parts)-1], 64)
+
+	if err != nil {
+		return 0, fmt.Errorf("invalid WebVTT timestamp %q", value)
+	}
+
+	return seconds*60 + last, nil
+}
+
+// ParseVTT splits a WebVTT file into its STYLE and REGION blocks, which every
+// segment repeats, and its cues. Comments are dropped.
+func ParseVTT(data []byte) ([]string, []vttCue, error) {
+
+	text := strings.ReplaceAll(strings.TrimPrefix(string(data), "\uFEFF"), "\r\n", "\n")
+
+	if !strings.HasPrefix(text, "WEBVTT") {
+		return nil, nil, fmt.Errorf("not a WebVTT file")
+	}
+
+	blocks := strings.Split(strings.TrimSpace(text), "\n\n")
+
+	var headers []string
+	var cues []vttCue
+
+	for _, block := range blocks[1:] {
+
+		block = strings.Trim(block, "\n")
+
+		if block == "" || strings.HasPrefix(block, "NOTE") {
+			continue
+		}
+
+		if strings.HasPrefix(block, "STYLE") || strings.HasPrefix(block, "REGION") {
+			headers = append(headers, block)
+			continue
+		}
+
+		lines := strings.Split(block, "\n")
+		timing := lines[0]
+
+		if !strings.Contains(timing, "-->") && len(lines) > 1 {
+			timing = lines[1]
+		}
+
+		fields := strings.Fields(timing)
+
+		if len(fields) < 3 || fields[1] != "-->" {
+			return nil, nil, fmt.Errorf("invalid WebVTT cue %q", timing)
+		}
+
+		start, err := parseVTTTimestamp(fields[0])
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		end, err := parseVTTTimestamp(fields[2])
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		cues = append(cues, vttCue{Start: start, End: end, Block: block})
+	}
+
+	if len(cues) == 0 {
+		return nil, nil, fmt.Errorf("WebVTT file has no cues")
+	}
+
+	return headers, cues, nil
+}
+
+// firstSegmentStartTime returns the presentation time the video segments
+// start at, which the X-TIMESTAMP-MAP of subtitle segments must point to.
+func firstSegmentStartTime(dir string) float64 {
+
+	// ffmpeg's mpegts muxer starts streams at 1.4s by default
+	start := 1.4
+
+	playlists, _ := filepath.Glob(fmt.Sprintf("%s/*.m3u8", dir))
+
+	for _, playlist := range playlists {
+
+		if !renditionPlaylist.MatchString(filepath.Base(playlist)) {
+			continue
+		}
+
+		file, err := os.Open(playlist)
+
+		if err != nil {
+			continue
+		}
+
+		segment := ""
+		scanner := bufio.NewScanner(file)
+
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+
+			if line != "" && !strings.HasPrefix(line, "#") {
+				segment = line
+				break
+			}
+		}
+
+		file.Close()
+
+		if segment == "" {
+			continue
+		}
+
+		out, err := exec.Command("ffprobe", "-v", "error",
+			"-show_entries", "format=start_time",
+			"-of", "default=noprint_wrappers=1:nokey=1",
+			filepath.Join(dir, segment)).Output()
+
+		if err != nil {
+			continue
+		}
+
+		if value, err := strconv.ParseFloat(strings.TrimSpace(string(out)), 64); err == nil {
+			start = value
+		}
+
+		break
+	}
+
+	return start
+}
+
+// segmentCaptions writes the cues as an HLS subtitle rendition of
+// captionSegmentDuration long WebVTT segments covering duration seconds.
+func segmentCaptions(dir string, language string, headers []string, cues []vttCue, duration float64) error {
+
+	count := int(math.Ceil(duration / captionSegmentDuration))
+
+	if count < 1 {
+		count = 1
+	}
+
+	timestampMap := fmt.Sprintf("X-TIMESTAMP-MAP=MPEGTS:%d,LOCAL:00:00:00.000", int64(math.Round(firstSegmentStartTime(dir)*90000)))
+
+	var playlist strings.Builder
+
+	fmt.Fprintf(&playlist, "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-PLAYLIST-TYPE:VOD\n", int(captionSegmentDuration))
+
+	for i := 0; i < count; i++ {
+
+		start := float64(i) * captionSegmentDuration
+		end := math.Min(start+captionSegmentDuration, duration)
+
+		if i == count-1 && end <= start {
+			end = start + captionSegmentDuration
+		}
+
+		var segment bytes.Buffer
+
+		fmt.Fprintf(&segment, "WEBVTT\n%s\n\n", timestampMap)
+
+		for _, header := range headers {
+			fmt.Fprintf(&segment, "%s\n\n", header)
+		}
+
+		// cues spanning a boundary are repeated in every segment they overlap
+		for _, cue := range cues {
+			if cue.End > start && cue.Start < end {
+				fmt.Fprintf(&segment, "%s\n\n", cue.Block)
+			}
+		}
+
+		name := fmt.Sprintf("subs_%s_%d.vtt", language, i)
+
+		err := os.WriteFile(fmt.Sprintf("%s/%s", dir, name), segment.Bytes(), 0644)
+
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(&playlist, "#EXTINF:%.3f,\n%s\n", end-start, name)
+	}
+
+	playlist.WriteString("#EXT-X-ENDLIST\n")
+
+	return os.WriteFile(fmt.Sprintf("%s/subs_%s.m3u8", dir, language), []byte(playlist.String()), 0644)
+}
+
+func removeCaptionFiles(dir string, language string) {
+
+	files, _ := filepath.Glob(fmt.Sprintf("%s/subs_%s_*.vtt", dir, language))
+	files = append(files, fmt.Sprintf("%s/subs_%s.m3u8", dir, language), fmt.Sprintf("%s/captions_%s.vtt", dir, language))
+
+	for _, file := range files {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			log.Println(err)
+		}
+	}
+}
+
+// ListCaptions returns the caption tracks of an upload, labels and default
+// flags live in its metadata.
+func (s *TranscoderService) ListCaptions(uploadId string) ([]CaptionTrack, error) {
+
+	variants, err := s.Media.ListVariants(uploadId, "caption")
+
+	if err != nil {
+		return nil, err
+	}
+
+	metadata, err := s.Media.GetUploadMetadata(uploadId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	captions := []CaptionTrack{}
+
+	for _, variant := range variants {
+
+		label := metadata[fmt.Sprintf("caption.%s.label", variant.Name)]
+
+		if label == "" {
+			label = variant.Name
+		}
+
+		captions = append(captions, CaptionTrack{
+			Id:          variant.Id,
+			Language:    variant.Name,
+			Label:       label,
+			Default:     metadata[fmt.Sprintf("caption.%s.default", variant.Name)] == "true",
+			Url:         variant.Url,
+			PlaylistUrl: strings.Replace(variant.Url, fmt.Sprintf("captions_%s.vtt", variant.Name), fmt.Sprintf("subs_%s.m3u8", variant.Name), 1),
+		})
+	}
+
+	return captions, nil
+}
+
+// AddCaptions attaches an SRT or WebVTT caption file to a transcoded video,
+// replacing the track of the same language, and regenerates the master
+// playlist. A default track clears the default flag of the others.
+func (s *TranscoderService) AddCaptions(uploadId string, inputPath string, language string, label string, isDefault bool, data []byte) (CaptionTrack, error) {
+
+	err := ValidateCaptionLanguage(language)
+
+	if err != nil {
+		return CaptionTrack{}, err
+	}
+
+	if !bytes.HasPrefix(bytes.TrimPrefix(data, []byte("\uFEFF")), []byte("WEBVTT")) {
+		data, err = ConvertSRTToVTT(data)
+
+		if err != nil {
+			return CaptionTrack{}, err
+		}
+	}
+
+	headers, cues, err := ParseVTT(data)
+
+	if err != nil {
+		return CaptionTrack{}, err
+	}
+
+	duration, err := ProbeDuration(inputPath)
+
+	if err != nil {
+		return CaptionTrack{}, err
+	}
+
+	fileId := mediaFileId(inputPath)
+	dir := fmt.Sprintf("./media/%s", fileId)
+
+	err = os.MkdirAll(dir, 0755)
+
+	if err != nil {
+		return CaptionTrack{}, err
+	}
+
+	removeCaptionFiles(dir, language)
+
+	err = os.WriteFile(fmt.Sprintf("%s/captions_%s.vtt", dir, language), data, 0644)
+
+	if err != nil {
+		return CaptionTrack{}, err
+	}
+
+	err = segmentCaptions(dir, language, headers, cues, duration)
+
+	if err != nil {
+		return CaptionTrack{}, err
+	}
+
+	existing, err := s.ListCaptions(uploadId)
+
+	if err != nil {
+		return CaptionTrack{}, err
+	}
+
+	metadata := map[string]string{
+		fmt.Sprintf("caption.%s.label", language):   label,
+		fmt.Sprintf("caption.%s.default", language): strconv.FormatBool(isDefault),
+	}
+
+	for _, caption := range existing {
+		if caption.Language == language {
+			err = s.Media.DeleteVariantRow(caption.Id)
+
+			if err != nil {
+				return CaptionTrack{}, err
+			}
+		} else if isDefault && caption.Default {
+			metadata[fmt.Sprintf("caption.%s.default", caption.Language)] = "false"
+		}
+	}
+
+	err = s.Media.WriteUploadMetadata(uploadId, metadata)
+
+	if err != nil {
+		return CaptionTrack{}, err
+	}
+
+	err = s.Media.WriteVariantsToDB(uploadId, "caption", []ResizedImageUrlAndSizeModel{{
+		Name:   language,
+		Url:    fmt.Sprintf("https://kaykatjd.com/media/%s/captions_%s.vtt", fileId, language),
+		Size:   int64(len(data)),
+		Format: "vtt",
+	}})
+
+	if err != nil {
+		return CaptionTrack{}, err
+	}
+
+	log.Printf("Added %s captions with %d cues to upload %s", language, len(cues), uploadId)
+
+	err = s.WriteMasterPlaylist(fileId, uploadId)
+
+	if err != nil {
+		log.Println("Error writing master playlist:", err)
+	}
+
+	captions, err := s.ListCaptions(uploadId)
+
+	if err != nil {
+		return CaptionTrack{}, err
+	}
+
+	for _, caption := range captions {
+		if caption.Language == language {
+			return caption, nil
+		}
+	}
+
+	return CaptionTrack{}, fmt.Errorf("caption track %s was not recorded", language)
+}
+
+// RemoveCaptions deletes the caption track of one language and regenerates
+// the master playlist.
+func (s *TranscoderService) RemoveCaptions(uploadId string, inputPath string, language string) (bool, error) {
+
+	captions, err := s.ListCaptions(uploadId)
+
+	if err != nil {
+		return false, err
+	}
+
+	for _, caption := range captions {
+
+		if caption.Language != language {
+			continue
+		}
+
+		err = s.Media.DeleteVariantRow(caption.Id)
+
+		if err != nil {
+			return true, err
+		}
+
+		err = s.Media.DeleteUploadMetadata(uploadId, fmt.Sprintf("caption.%s.label", language), fmt.Sprintf("caption.%s.default", language))
+
+		if err != nil {
+			return true, err
+		}
+
+		fileId := mediaFileId(inputPath)
+
+		removeCaptionFiles(fmt.Sprintf("./media/%s", fileId), language)
+
+		err = s.WriteMasterPlaylist(fileId, uploadId)
+
+		if err != nil {
+			log.Println("Error writing master playlist:", err)
+		}
+
+		return true, nil
+	}
+
+	return false, nil
+}
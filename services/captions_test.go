@@ -0,0 +1,203 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConvertSRTToVTT(t *testing.T) {
+
+	tests := []struct {
+		name string
+		srt  string
+		vtt  string
+		err  bool
+	}{
+		{
+			name: "numbered cues",
+			srt:  "1\n00:00:01,000 --> 00:00:02,500\nHello\n\n2\n00:00:03,000 --> 00:00:04,000\nTwo\nlines\n",
+			vtt:  "WEBVTT\n\n00:00:01.000 --> 00:00:02.500\nHello\n\n00:00:03.000 --> 00:00:04.000\nTwo\nlines\n\n",
+		},
+		{
+			name: "byte order mark and CRLF",
+			srt:  "\uFEFF1\r\n00:00:01,000 --> 00:00:02,000\r\nHello\r\n",
+			vtt:  "WEBVTT\n\n00:00:01.000 --> 00:00:02.000\nHello\n\n",
+		},
+		{
+			name: "cue number missing",
+			srt:  "00:00:01,000 --> 00:00:02,000\nHello\n",
+			vtt:  "WEBVTT\n\n00:00:01.000 --> 00:00:02.000\nHello\n\n",
+		},
+		{
+			name: "single digit hours and position dropped",
+			srt:  "1\n0:00:01,000 --> 0:00:02,000 X1:10 X2:20\nHello\n",
+			vtt:  "WEBVTT\n\n0:00:01.000 --> 0:00:02.000\nHello\n\n",
+		},
+		{
+			name: "dot separated timing",
+			srt:  "1\n00:00:01.000 --> 00:00:02.000\nHello\n",
+			err:  true,
+		},
+		{
+			name: "no cues",
+			srt:  "\n\n",
+			err:  true,
+		},
+	}
+
+	for _, test := range tests {
+
+		vtt, err := ConvertSRTToVTT([]byte(test.srt))
+
+		if (err != nil) != test.err {
+			t.Errorf("%s: error %v, want error %v", test.name, err, test.err)
+			continue
+		}
+
+		if string(vtt) != test.vtt {
+			t.Errorf("%s: converted to %q, want %q", test.name, vtt, test.vtt)
+		}
+	}
+}
+
+func TestParseVTTTimestamp(t *testing.T) {
+
+	tests := []struct {
+		value   string
+		seconds float64
+		err     bool
+	}{
+		{"00:00:01.500", 1.5, false},
+		{"01:02:03.250", 3723.25, false},
+		{"02:03.000", 123, false},
+		{"3.000", 0, true},
+		{"aa:00:01.000", 0, true},
+		{"00:00:01:00:00", 0, true},
+	}
+
+	for _, test := range tests {
+
+		seconds, err := parseVTTTimestamp(test.value)
+
+		if (err != nil) != test.err || seconds != test.seconds {
+			t.Errorf("parseVTTTimestamp(%q) = %v, %v, want %v and error %v", test.value, seconds, err, test.seconds, test.err)
+		}
+	}
+}
+
+func TestParseVTT(t *testing.T) {
+
+	data := "WEBVTT\n\nSTYLE\n::cue { color: yellow }\n\nNOTE a comment\n\nintro\n00:00:01.000 --> 00:00:02.000 align:start\nHello\n\n00:00:11.000 --> 00:00:12.000\nLater\n"
+
+	headers, cues, err := ParseVTT([]byte(data))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(headers) != 1 || !strings.HasPrefix(headers[0], "STYLE") {
+		t.Errorf("headers %q, want the STYLE block", headers)
+	}
+
+	if len(cues) != 2 || cues[0].Start != 1 || cues[0].End != 2 || cues[1].Start != 11 {
+		t.Fatalf("cues %+v", cues)
+	}
+
+	if cues[0].Block != "intro\n00:00:01.000 --> 00:00:02.000 align:start\nHello" {
+		t.Errorf("cue block %q keeps its identifier and settings", cues[0].Block)
+	}
+
+	for _, invalid := range []string{"00:00:01.000 --> 00:00:02.000\nHello", "WEBVTT\n\nNOTE only", "WEBVTT\n\n00:00:01.000 -> 00:00:02.000\nHello"} {
+		if _, _, err := ParseVTT([]byte(invalid)); err == nil {
+			t.Errorf("ParseVTT(%q) succeeded", invalid)
+		}
+	}
+}
+
+func TestSegmentCaptions(t *testing.T) {
+
+	dir := t.TempDir()
+
+	headers, cues, err := ParseVTT([]byte("WEBVTT\n\n00:00:01.000 --> 00:00:02.000\nFirst\n\n00:00:09.000 --> 00:00:11.000\nSpanning\n"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = segmentCaptions(dir, "en", headers, cues, 15)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	playlist, err := os.ReadFile(filepath.Join(dir, "subs_en.m3u8"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(string(playlist), "#EXTINF:10.000,\nsubs_en_0.vtt\n#EXTINF:5.000,\nsubs_en_1.vtt\n#EXT-X-ENDLIST") {
+		t.Errorf("playlist %q", playlist)
+	}
+
+	tests := []struct {
+		segment string
+		cues    []string
+		missing []string
+	}{
+		{"subs_en_0.vtt", []string{"First", "Spanning"}, nil},
+		{"subs_en_1.vtt", []string{"Spanning"}, []string{"First"}},
+	}
+
+	for _, test := range tests {
+
+		segment, err := os.ReadFile(filepath.Join(dir, test.segment))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// without video segments the mpegts default start of 1.4s is mapped
+		if !strings.HasPrefix(string(segment), "WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:126000,LOCAL:00:00:00.000\n") {
+			t.Errorf("%s starts %q", test.segment, segment)
+		}
+
+		for _, cue := range test.cues {
+			if !strings.Contains(string(segment), cue) {
+				t.Errorf("%s is missing cue %s", test.segment, cue)
+			}
+		}
+
+		for _, cue := range test.missing {
+			if strings.Contains(string(segment), cue) {
+				t.Errorf("%s has cue %s", test.segment, cue)
+			}
+		}
+	}
+}
+
+func TestValidateCaptionLanguage(t *testing.T) {
+
+	tests := []struct {
+		language string
+		valid    bool
+	}{
+		{"en", true},
+		{"pt-BR", true},
+		{"zh-Hant-TW", true},
+		{"fil", true},
+		{"EN", false},
+		{"english", false},
+		{"en_US", false},
+		{"../en", false},
+		{"", false},
+	}
+
+	for _, test := range tests {
+		if err := ValidateCaptionLanguage(test.language); (err == nil) != test.valid {
+			t.Errorf("ValidateCaptionLanguage(%q) = %v, want valid %v", test.language, err, test.valid)
+		}
+	}
+}
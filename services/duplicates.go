@@ -0,0 +1,129 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"log"
+	"os"
+	"time"
+
+	"github.com/corona10/goimagehash"
+	"github.com/jdrew153/models"
+)
+
+// Duplicate policy modes checked when an image upload is finalized.
+const (
+	DuplicatesOff    = "off"
+	DuplicatesFlag   = "flag"
+	DuplicatesReject = "reject"
+)
+
+// DuplicatePolicy is the per-application "duplicatePolicy" setting.
+type DuplicatePolicy struct {
+	Mode        string `json:"mode"`
+	MaxDistance int    `json:"maxDistance"`
+}
+
+var DefaultDuplicatePolicy = DuplicatePolicy{Mode: DuplicatesOff, MaxDistance: 5}
+
+func (p DuplicatePolicy) Validate() error {
+
+	switch p.Mode {
+	case DuplicatesOff, DuplicatesFlag, DuplicatesReject:
+	default:
+		return fmt.Errorf("unknown duplicate policy mode %q", p.Mode)
+	}
+
+	if p.MaxDistance < 0 || p.MaxDistance > 64 {
+		return fmt.Errorf("duplicate policy maxDistance must be between 0 and 64")
+	}
+
+	return nil
+}
+
+// ComputePerceptualHash returns the 64 bit pHash of img. It is stored as a
+// signed integer so it fits a BIGINT column unchanged.
+func ComputePerceptualHash(img image.Image) (int64, error) {
+
+	hash, err := goimagehash.PerceptionHash(img)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(hash.GetHash()), nil
+}
+
+func (s *MediaService) ComputeImageHash(filePath string) (int64, error) {
+
+	data, err := os.ReadFile(filePath)
+
+	if err != nil {
+		return 0, err
+	}
+
+	img, _, err := DecodeImage(data)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return ComputePerceptualHash(img)
+}
+
+type NearDuplicateModel struct {
+	Upload   models.Upload `json:"upload"`
+	Distance int           `json:"distance"`
+}
+
+// FindNearDuplicates returns the application's uploads whose perceptual hash
+// is within maxDistance bits of hash, closest first.
+func (s *MediaService) FindNearDuplicates(applicationId string, hash int64, maxDistance int, excludeId string) ([]NearDuplicateModel, error) {
+
+	duplicates := []NearDuplicateModel{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	near, err := s.Uploads.NearDuplicates(ctx, applicationId, hash, maxDistance, excludeId)
+
+	if err != nil {
+		return duplicates, err
+	}
+
+	for _, upload := range near {
+		duplicates = append(duplicates, NearDuplicateModel{Upload: upload.Upload, Distance: upload.Distance})
+	}
+
+	return duplicates, nil
+}
+
+func (s *MediaService) GetUploadHash(uploadId string) (int64, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	return s.Uploads.PerceptualHash(ctx, uploadId)
+}
+
+// WritePerceptualHashToDB stores the hash and, when set, the upload it was
+// flagged as a near-duplicate of.
+func (s *MediaService) WritePerceptualHashToDB(uploadId string, hash int64, duplicateOf string) error {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	err := s.Uploads.SetPerceptualHash(ctx, uploadId, hash, duplicateOf)
+
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Wrote perceptual hash for upload %s", uploadId)
+
+	return nil
+}
@@ -0,0 +1,367 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jdrew153/models"
+	"github.com/jdrew153/repositories"
+	"github.com/savsgio/gotils/uuid"
+)
+
+// Edit job types.
+const (
+	EditTrim   = "trim"
+	EditClips  = "clips"
+	EditConcat = "concat"
+)
+
+// MaxEditClips and MaxConcatSources bound the outputs of a clips job and
+// the inputs of a concat job, each one costs a full ffmpeg run.
+const (
+	MaxEditClips     = 20
+	MaxConcatSources = 20
+)
+
+var (
+	ErrEditSourceNotFound = errors.New("source upload not found")
+	ErrInvalidEdit        = errors.New("invalid edit")
+)
+
+// ClipRange is a [Start, End] cut of a video in seconds.
+type ClipRange struct {
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+}
+
+func (r ClipRange) Validate() error {
+	if r.Start < 0 || r.End <= r.Start {
+		return fmt.Errorf("%w: clip range must satisfy 0 <= start < end", ErrInvalidEdit)
+	}
+	return nil
+}
+
+// EditOptions say who owns the edited uploads and whether they go through
+// the normal rendition pipeline afterwards.
+type EditOptions struct {
+	ApplicationId string
+	UserId        string
+	ApiKeyId      string
+	Transcode     bool
+	Resolutions   []string
+}
+
+// editedVideoArgs are the encoder settings shared by every edit output, cuts
+// are re-encoded so they are frame accurate.
+var editedVideoArgs = []string{
+	"-c:v", "libx264", "-preset", "veryfast", "-crf", "20", "-pix_fmt", "yuv420p",
+	"-c:a", "aac", "-b:a", "128k",
+	"-movflags", "+faststart",
+}
+
+func runFFmpeg(args ...string) error {
+
+	cmd := exec.Command("ffmpeg", args...)
+
+	stderr := bytes.Buffer{}
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+
+	if err != nil {
+		return fmt.Errorf("ffmpeg: %v: %s", err, stderr.String())
+	}
+
+	return nil
+}
+
+// editSource loads a source upload and checks it belongs to the application.
+func (s *TranscoderService) editSource(sourceId string, applicationId string) (models.Upload, string, error) {
+
+	upload, err := s.Media.GetUpload(sourceId)
+
+	if err == sql.ErrNoRows || (err == nil && upload.ApplicationId != applicationId) {
+		return upload, "", fmt.Errorf("%w: %s", ErrEditSourceNotFound, sourceId)
+	}
+
+	if err != nil {
+		return upload, "", err
+	}
+
+	inputPath := MediaPathFromUrl(upload.Url)
+
+	if IsAudioFile(inputPath) || !IsFilePathValid(inputPath) {
+		return upload, "", fmt.Errorf("%w: upload %s is not a video", ErrInvalidEdit, sourceId)
+	}
+
+	return upload, inputPath, nil
+}
+
+// registerEdit stores an edit output as a new upload linked to its sources
+// and starts the rendition pipeline on it when asked to.
+func (s *TranscoderService) registerEdit(outputPath string, fileId string, sources []models.UploadSource, options EditOptions) (models.Upload, error) {
+
+	info, err := os.Stat(outputPath)
+
+	if err != nil {
+		return models.Upload{}, err
+	}
+
+	ids, err := s.Media.WriteNewUploadsToDB([]NewUploadModel{{
+		Url:           fmt.Sprintf("https://kaykatjd.com/media/%s.mp4", fileId),
+		FileType:      "mp4",
+		Size:          info.Size(),
+		ApplicationId: options.ApplicationId,
+		UserId:        options.UserId,
+		Status:        repositories.UploadProcessing,
+	}})
+
+	if err != nil {
+		os.Remove(outputPath)
+		return models.Upload{}, err
+	}
+
+	uploadId := ids[0]
+
+	err = s.Media.WriteUploadSources(uploadId, sources)
+
+	if err != nil {
+		return models.Upload{}, err
+	}
+
+	_, err = s.Media.StoreBlob(outputPath, uploadId)
+
+	if err != nil {
+		if statusErr := s.Media.SetUploadStatus(uploadId, repositories.UploadFailed); statusErr != nil {
+			log.Println(statusErr)
+		}
+
+		return models.Upload{}, err
+	}
+
+	err = s.Media.SetUploadStatus(uploadId, repositories.UploadReady)
+
+	if err != nil {
+		return models.Upload{}, err
+	}
+
+	if options.Transcode {
+		go s.Transcode(TranscodeRequest{
+			InputPath:     outputPath,
+			Resolutions:   options.Resolutions,
+			ApiKeyId:      options.ApiKeyId,
+			ApplicationId: options.ApplicationId,
+		})
+	}
+
+	return s.Media.GetUpload(uploadId)
+}
+
+// TrimVideo cuts [Start, End] out of a video upload into a new upload.
+func (s *TranscoderService) TrimVideo(sourceId string, clip ClipRange, options EditOptions) (models.Upload, error) {
+
+	err := clip.Validate()
+
+	if err != nil {
+		return models.Upload{}, err
+	}
+
+	_, inputPath, err := s.editSource(sourceId, options.ApplicationId)
+
+	if err != nil {
+		return models.Upload{}, err
+	}
+
+	duration, err := ProbeDuration(inputPath)
+
+	if err != nil {
+		return models.Upload{}, err
+	}
+
+	if clip.Start >= duration {
+		return models.Upload{}, fmt.Errorf("%w: clip starts after the end of the video", ErrInvalidEdit)
+	}
+
+	end := clip.End
+
+	if end > duration {
+		end = duration
+	}
+
+	fileId := fmt.Sprintf("joshie_%s", uuid.V4())
+	outputPath := fmt.Sprintf("./media/%s.mp4", fileId)
+
+	args := []string{"-y",
+		"-ss", strconv.FormatFloat(clip.Start, 'f', 3, 64),
+		"-i", inputPath,
+		"-t", strconv.FormatFloat(end-clip.Start, 'f', 3, 64),
+	}
+
+	err = runFFmpeg(append(append(args, editedVideoArgs...), outputPath)...)
+
+	if err != nil {
+		os.Remove(outputPath)
+		return models.Upload{}, err
+	}
+
+	log.Printf("Trimmed %s to %.3f-%.3f into %s", sourceId, clip.Start, end, outputPath)
+
+	return s.registerEdit(outputPath, fileId, []models.UploadSource{{
+		SourceId: sourceId,
+		Start:    &clip.Start,
+		End:      &end,
+	}}, options)
+}
+
+// ExtractClips cuts every range out of a video upload, each into its own
+// new upload.
+func (s *TranscoderService) ExtractClips(sourceId string, clips []ClipRange, options EditOptions) ([]models.Upload, error) {
+
+	if len(clips) == 0 {
+		return nil, fmt.Errorf("%w: no clips requested", ErrInvalidEdit)
+	}
+
+	if len(clips) > MaxEditClips {
+		return nil, fmt.Errorf("%w: at most %d clips can be extracted at once", ErrInvalidEdit, MaxEditClips)
+	}
+
+	for _, clip := range clips {
+		if err := clip.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	var uploads []models.Upload
+
+	for _, clip := range clips {
+
+		upload, err := s.TrimVideo(sourceId, clip, options)
+
+		if err != nil {
+			return uploads, err
+		}
+
+		uploads = append(uploads, upload)
+	}
+
+	return uploads, nil
+}
+
+// ConcatVideos joins video uploads in order into a new upload. Every input
+// is letterboxed to the size of the first one, inputs without sound get
+// silence.
+func (s *TranscoderService) ConcatVideos(sourceIds []string, options EditOptions) (models.Upload, error) {
+
+	if len(sourceIds) < 2 {
+		return models.Upload{}, fmt.Errorf("%w: concatenation needs at least two uploads", ErrInvalidEdit)
+	}
+
+	if len(sourceIds) > MaxConcatSources {
+		return models.Upload{}, fmt.Errorf("%w: at most %d uploads can be concatenated", ErrInvalidEdit, MaxConcatSources)
+	}
+
+	var inputs []string
+	var sources []models.UploadSource
+
+	for i, sourceId := range sourceIds {
+
+		_, inputPath, err := s.editSource(sourceId, options.ApplicationId)
+
+		if err != nil {
+			return models.Upload{}, err
+		}
+
+		inputs = append(inputs, inputPath)
+		sources = append(sources, models.UploadSource{SourceId: sourceId, Position: i})
+	}
+
+	width, height, err := ProbeDimensions(inputs[0])
+
+	if err != nil {
+		return models.Upload{}, err
+	}
+
+	// libx264 wants even dimensions
+	width, height = width/2*2, height/2*2
+
+	args := []string{"-y"}
+
+	var filter strings.Builder
+
+	for i, inputPath := range inputs {
+
+		args = append(args, "-i", inputPath)
+
+		fmt.Fprintf(&filter, "[%d:v]scale=%d:%d:force_original_aspect_ratio=decrease,pad=%d:%d:(ow-iw)/2:(oh-ih)/2,setsar=1,fps=30,format=yuv420p[v%d];",
+			i, width, height, width, height, i)
+
+		hasAudio, err := HasAudioStream(inputPath)
+
+		if err != nil {
+			return models.Upload{}, err
+		}
+
+		if hasAudio {
+			fmt.Fprintf(&filter, "[%d:a]aresample=48000,aformat=channel_layouts=stereo[a%d];", i, i)
+			continue
+		}
+
+		duration, err := ProbeDuration(inputPath)
+
+		if err != nil {
+			return models.Upload{}, err
+		}
+
+		fmt.Fprintf(&filter, "anullsrc=r=48000:cl=stereo:d=%.3f[a%d];", duration, i)
+	}
+
+	for i := range inputs {
+		fmt.Fprintf(&filter, "[v%d][a%d]", i, i)
+	}
+
+	fmt.Fprintf(&filter, "concat=n=%d:v=1:a=1[v][a]", len(inputs))
+
+	fileId := fmt.Sprintf("joshie_%s", uuid.V4())
+	outputPath := fmt.Sprintf("./media/%s.mp4", fileId)
+
+	args = append(args, "-filter_complex", filter.String(), "-map", "[v]", "-map", "[a]")
+
+	err = runFFmpeg(append(append(args, editedVideoArgs...), outputPath)...)
+
+	if err != nil {
+		os.Remove(outputPath)
+		return models.Upload{}, err
+	}
+
+	log.Printf("Concatenated %s into %s", strings.Join(sourceIds, ", "), outputPath)
+
+	return s.registerEdit(outputPath, fileId, sources, options)
+}
+
+// WriteUploadSources links an edited upload to the uploads it was cut from.
+func (s *MediaService) WriteUploadSources(uploadId string, sources []models.UploadSource) error {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	return s.Uploads.InsertSources(ctx, uploadId, sources)
+}
+
+func (s *MediaService) ListUploadSources(uploadId string) ([]models.UploadSource, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	return s.Uploads.ListSources(ctx, uploadId)
+}
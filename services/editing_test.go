@@ -0,0 +1,29 @@
+package services
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestEditLimits(t *testing.T) {
+
+	s := &TranscoderService{}
+
+	clips := make([]ClipRange, MaxEditClips+1)
+
+	for i := range clips {
+		clips[i] = ClipRange{Start: 0, End: 1}
+	}
+
+	_, err := s.ExtractClips("source", clips, EditOptions{})
+
+	if !errors.Is(err, ErrInvalidEdit) {
+		t.Fatalf("extracting %d clips: %v, want ErrInvalidEdit", len(clips), err)
+	}
+
+	_, err = s.ConcatVideos(make([]string, MaxConcatSources+1), EditOptions{})
+
+	if !errors.Is(err, ErrInvalidEdit) {
+		t.Fatalf("concatenating %d uploads: %v, want ErrInvalidEdit", MaxConcatSources+1, err)
+	}
+}
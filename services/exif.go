@@ -0,0 +1,410 @@
+package services
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"strings"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// Metadata policy modes applied to stored originals and image variants.
+const (
+	// MetadataKeep leaves EXIF/XMP/IPTC untouched.
+	MetadataKeep = "keep"
+	// MetadataStrip removes EXIF/XMP/IPTC, only the orientation survives on originals.
+	MetadataStrip = "strip"
+	// MetadataCopyright removes everything except the artist and copyright fields.
+	MetadataCopyright = "copyright"
+)
+
+// MetadataPolicy is the per-application "metadataPolicy" setting.
+type MetadataPolicy struct {
+	Mode    string `json:"mode"`
+	SaveGps bool   `json:"saveGps"`
+}
+
+var DefaultMetadataPolicy = MetadataPolicy{Mode: MetadataKeep}
+
+func (p MetadataPolicy) Validate() error {
+	switch p.Mode {
+	case MetadataKeep, MetadataStrip, MetadataCopyright:
+		return nil
+	}
+	return fmt.Errorf("unknown metadata policy mode %q", p.Mode)
+}
+
+const (
+	exifTagOrientation = 0x0112
+	exifTagArtist      = 0x013B
+	exifTagCopyright   = 0x8298
+)
+
+func decodeExif(data []byte) *exif.Exif {
+
+	x, err := exif.Decode(bytes.NewReader(data))
+
+	if err != nil {
+		return nil
+	}
+
+	return x
+}
+
+func exifString(x *exif.Exif, name exif.FieldName) string {
+
+	tag, err := x.Get(name)
+
+	if err != nil {
+		return ""
+	}
+
+	value, err := tag.StringVal()
+
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(strings.TrimRight(value, "\x00"))
+}
+
+// ImageOrientation returns the EXIF orientation (1-8) of a JPEG, 1 when absent.
+func ImageOrientation(data []byte) int {
+
+	x := decodeExif(data)
+
+	if x == nil {
+		return 1
+	}
+
+	tag, err := x.Get(exif.Orientation)
+
+	if err != nil {
+		return 1
+	}
+
+	orientation, err := tag.Int(0)
+
+	if err != nil || orientation < 1 || orientation > 8 {
+		return 1
+	}
+
+	return orientation
+}
+
+// ApplyOrientation rotates and flips img so it displays upright for the given EXIF orientation.
+func ApplyOrientation(img image.Image, orientation int) image.Image {
+
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+
+	bounds := img.Bounds()
+	src := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+
+	w, h := bounds.Dx(), bounds.Dy()
+
+	var dst *image.NRGBA
+
+	if orientation >= 5 {
+		dst = image.NewNRGBA(image.Rect(0, 0, h, w))
+	} else {
+		dst = image.NewNRGBA(image.Rect(0, 0, w, h))
+	}
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+
+			var dx, dy int
+
+			switch orientation {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+
+			si := src.PixOffset(x, y)
+			di := dst.PixOffset(dx, dy)
+			copy(dst.Pix[di:di+4], src.Pix[si:si+4])
+		}
+	}
+
+	return dst
+}
+
+// ExtractExifMetadata returns camera, capture time and optionally GPS fields
+// keyed the way they are stored in upload_metadata.
+func ExtractExifMetadata(data []byte, includeGps bool) map[string]string {
+
+	metadata := map[string]string{}
+
+	x := decodeExif(data)
+
+	if x == nil {
+		return metadata
+	}
+
+	if cameraMake := exifString(x, exif.Make); cameraMake != "" {
+		metadata["exif.cameraMake"] = cameraMake
+	}
+
+	if model := exifString(x, exif.Model); model != "" {
+		metadata["exif.cameraModel"] = model
+	}
+
+	if takenAt, err := x.DateTime(); err == nil {
+		metadata["exif.takenAt"] = takenAt.Format(time.RFC3339)
+	}
+
+	if includeGps {
+		if lat, long, err := x.LatLong(); err == nil {
+			metadata["exif.gpsLatitude"] = fmt.Sprintf("%.6f", lat)
+			metadata["exif.gpsLongitude"] = fmt.Sprintf("%.6f", long)
+		}
+	}
+
+	return metadata
+}
+
+// ApplyMetadataPolicyToOriginal rewrites the metadata segments of a stored JPEG
+// without re-encoding it. The orientation is carried over so the original
+// still displays upright.
+func ApplyMetadataPolicyToOriginal(data []byte, policy MetadataPolicy) []byte {
+
+	if policy.Mode == MetadataKeep {
+		return data
+	}
+
+	var artist, copyright string
+
+	if policy.Mode == MetadataCopyright {
+		if x := decodeExif(data); x != nil {
+			artist = exifString(x, exif.Artist)
+			copyright = exifString(x, exif.Copyright)
+		}
+	}
+
+	orientation := ImageOrientation(data)
+
+	stripped := removeJPEGSegments(data, 0xE1, 0xED)
+
+	if orientation == 1 && artist == "" && copyright == "" {
+		return stripped
+	}
+
+	return insertJPEGSegments(stripped, [][]byte{buildExifSegment(orientation, artist, copyright)})
+}
+
+// variantMetadataSegments returns the metadata segments to embed into an
+// already oriented JPEG variant of source.
+func variantMetadataSegments(source []byte, policy MetadataPolicy) [][]byte {
+
+	switch policy.Mode {
+	case MetadataKeep:
+		var segments [][]byte
+
+		for _, segment := range jpegMetadataSegments(source) {
+			if isExifSegment(segment) {
+				segment = resetExifOrientation(segment)
+			}
+			segments = append(segments, segment)
+		}
+
+		return segments
+	case MetadataCopyright:
+		x := decodeExif(source)
+
+		if x == nil {
+			return nil
+		}
+
+		artist := exifString(x, exif.Artist)
+		copyright := exifString(x, exif.Copyright)
+
+		if artist == "" && copyright == "" {
+			return nil
+		}
+
+		return [][]byte{buildExifSegment(1, artist, copyright)}
+	}
+
+	return nil
+}
+
+// removeJPEGSegments drops every segment with one of the given markers
+// that appears before the image data.
+func removeJPEGSegments(data []byte, markers ...byte) []byte {
+
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return data
+	}
+
+	out := bytes.Buffer{}
+	out.Write(data[:2])
+
+	i := 2
+
+	for i+4 <= len(data) {
+		if data[i] != 0xFF {
+			break
+		}
+
+		marker := data[i+1]
+
+		if marker == 0xDA || marker == 0xD9 {
+			break
+		}
+
+		length := int(binary.BigEndian.Uint16(data[i+2 : i+4]))
+
+		if length < 2 || i+2+length > len(data) {
+			break
+		}
+
+		drop := false
+
+		for _, m := range markers {
+			if marker == m {
+				drop = true
+			}
+		}
+
+		if !drop {
+			out.Write(data[i : i+2+length])
+		}
+
+		i += 2 + length
+	}
+
+	out.Write(data[i:])
+
+	return out.Bytes()
+}
+
+func isExifSegment(segment []byte) bool {
+	return len(segment) > 10 && segment[1] == 0xE1 && bytes.Equal(segment[4:10], []byte("Exif\x00\x00"))
+}
+
+// resetExifOrientation returns a copy of an EXIF APP1 segment with the
+// orientation tag set to 1.
+func resetExifOrientation(segment []byte) []byte {
+
+	out := append([]byte(nil), segment...)
+	tiff := out[10:]
+
+	if len(tiff) < 8 {
+		return out
+	}
+
+	var order binary.ByteOrder = binary.BigEndian
+
+	if tiff[0] == 'I' {
+		order = binary.LittleEndian
+	}
+
+	ifd := int(order.Uint32(tiff[4:8]))
+
+	if ifd+2 > len(tiff) {
+		return out
+	}
+
+	count := int(order.Uint16(tiff[ifd : ifd+2]))
+
+	for i := 0; i < count; i++ {
+		entry := ifd + 2 + i*12
+
+		if entry+12 > len(tiff) {
+			break
+		}
+
+		if order.Uint16(tiff[entry:entry+2]) == exifTagOrientation && order.Uint16(tiff[entry+2:entry+4]) == 3 {
+			order.PutUint16(tiff[entry+8:entry+10], 1)
+		}
+	}
+
+	return out
+}
+
+// buildExifSegment writes a minimal big endian EXIF APP1 segment holding only
+// the orientation, artist and copyright tags.
+func buildExifSegment(orientation int, artist string, copyright string) []byte {
+
+	type entry struct {
+		tag   uint16
+		typ   uint16
+		count uint32
+		value []byte
+	}
+
+	var entries []entry
+
+	if orientation > 1 {
+		value := make([]byte, 2)
+		binary.BigEndian.PutUint16(value, uint16(orientation))
+		entries = append(entries, entry{exifTagOrientation, 3, 1, value})
+	}
+
+	if artist != "" {
+		entries = append(entries, entry{exifTagArtist, 2, uint32(len(artist) + 1), append([]byte(artist), 0)})
+	}
+
+	if copyright != "" {
+		entries = append(entries, entry{exifTagCopyright, 2, uint32(len(copyright) + 1), append([]byte(copyright), 0)})
+	}
+
+	tiff := bytes.Buffer{}
+	tiff.WriteString("MM")
+	binary.Write(&tiff, binary.BigEndian, uint16(42))
+	binary.Write(&tiff, binary.BigEndian, uint32(8))
+	binary.Write(&tiff, binary.BigEndian, uint16(len(entries)))
+
+	dataOffset := uint32(8 + 2 + 12*len(entries) + 4)
+	data := bytes.Buffer{}
+
+	for _, e := range entries {
+		binary.Write(&tiff, binary.BigEndian, e.tag)
+		binary.Write(&tiff, binary.BigEndian, e.typ)
+		binary.Write(&tiff, binary.BigEndian, e.count)
+
+		if len(e.value) <= 4 {
+			value := make([]byte, 4)
+			copy(value, e.value)
+			tiff.Write(value)
+			continue
+		}
+
+		binary.Write(&tiff, binary.BigEndian, dataOffset+uint32(data.Len()))
+		data.Write(e.value)
+
+		if data.Len()%2 == 1 {
+			data.WriteByte(0)
+		}
+	}
+
+	binary.Write(&tiff, binary.BigEndian, uint32(0))
+	tiff.Write(data.Bytes())
+
+	segment := bytes.Buffer{}
+	segment.Write([]byte{0xFF, 0xE1})
+	binary.Write(&segment, binary.BigEndian, uint16(2+6+tiff.Len()))
+	segment.WriteString("Exif\x00\x00")
+	segment.Write(tiff.Bytes())
+
+	return segment.Bytes()
+}
@@ -0,0 +1,203 @@
+package services
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+func TestMetadataPolicyValidate(t *testing.T) {
+
+	tests := []struct {
+		mode  string
+		valid bool
+	}{
+		{MetadataKeep, true},
+		{MetadataStrip, true},
+		{MetadataCopyright, true},
+		{"", false},
+		{"remove", false},
+	}
+
+	for _, test := range tests {
+		if err := (MetadataPolicy{Mode: test.mode}).Validate(); (err == nil) != test.valid {
+			t.Errorf("Validate(%q) = %v, want valid %v", test.mode, err, test.valid)
+		}
+	}
+}
+
+func TestApplyOrientation(t *testing.T) {
+
+	// a 3x2 image, red in the top left and blue in the top right corner
+	img := image.NewNRGBA(image.Rect(0, 0, 3, 2))
+
+	red := color.NRGBA{R: 255, A: 255}
+	blue := color.NRGBA{B: 255, A: 255}
+
+	img.Set(0, 0, red)
+	img.Set(2, 0, blue)
+
+	tests := []struct {
+		orientation int
+		width       int
+		height      int
+		red         image.Point
+		blue        image.Point
+	}{
+		{0, 3, 2, image.Pt(0, 0), image.Pt(2, 0)},
+		{1, 3, 2, image.Pt(0, 0), image.Pt(2, 0)},
+		{2, 3, 2, image.Pt(2, 0), image.Pt(0, 0)},
+		{3, 3, 2, image.Pt(2, 1), image.Pt(0, 1)},
+		{4, 3, 2, image.Pt(0, 1), image.Pt(2, 1)},
+		{5, 2, 3, image.Pt(0, 0), image.Pt(0, 2)},
+		{6, 2, 3, image.Pt(1, 0), image.Pt(1, 2)},
+		{7, 2, 3, image.Pt(1, 2), image.Pt(1, 0)},
+		{8, 2, 3, image.Pt(0, 2), image.Pt(0, 0)},
+		{9, 3, 2, image.Pt(0, 0), image.Pt(2, 0)},
+	}
+
+	for _, test := range tests {
+
+		out := ApplyOrientation(img, test.orientation)
+
+		if out.Bounds().Dx() != test.width || out.Bounds().Dy() != test.height {
+			t.Errorf("orientation %d: size %v, want %dx%d", test.orientation, out.Bounds().Size(), test.width, test.height)
+			continue
+		}
+
+		if got := color.NRGBAModel.Convert(out.At(test.red.X, test.red.Y)); got != red {
+			t.Errorf("orientation %d: %v at %v, want red", test.orientation, got, test.red)
+		}
+
+		if got := color.NRGBAModel.Convert(out.At(test.blue.X, test.blue.Y)); got != blue {
+			t.Errorf("orientation %d: %v at %v, want blue", test.orientation, got, test.blue)
+		}
+	}
+}
+
+// testJPEG encodes a small JPEG carrying an EXIF segment with the given
+// orientation, artist and copyright.
+func testJPEG(t *testing.T, orientation int, artist string, copyright string) []byte {
+
+	t.Helper()
+
+	encoded := bytes.Buffer{}
+
+	err := jpeg.Encode(&encoded, image.NewGray(image.Rect(0, 0, 8, 8)), nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return insertJPEGSegments(encoded.Bytes(), [][]byte{buildExifSegment(orientation, artist, copyright)})
+}
+
+func exifFields(t *testing.T, data []byte) (string, string) {
+
+	t.Helper()
+
+	x, err := exif.Decode(bytes.NewReader(data))
+
+	if err != nil {
+		return "", ""
+	}
+
+	return exifString(x, exif.Artist), exifString(x, exif.Copyright)
+}
+
+func TestApplyMetadataPolicyToOriginal(t *testing.T) {
+
+	source := testJPEG(t, 6, "Jane Doe", "CC BY 4.0")
+
+	tests := []struct {
+		mode        string
+		orientation int
+		artist      string
+		copyright   string
+	}{
+		{MetadataKeep, 6, "Jane Doe", "CC BY 4.0"},
+		{MetadataStrip, 6, "", ""},
+		{MetadataCopyright, 6, "Jane Doe", "CC BY 4.0"},
+	}
+
+	for _, test := range tests {
+
+		out := ApplyMetadataPolicyToOriginal(source, MetadataPolicy{Mode: test.mode})
+
+		if orientation := ImageOrientation(out); orientation != test.orientation {
+			t.Errorf("%s: orientation %d, want %d", test.mode, orientation, test.orientation)
+		}
+
+		artist, copyright := exifFields(t, out)
+
+		if artist != test.artist || copyright != test.copyright {
+			t.Errorf("%s: artist %q and copyright %q, want %q and %q", test.mode, artist, copyright, test.artist, test.copyright)
+		}
+
+		if _, err := jpeg.Decode(bytes.NewReader(out)); err != nil {
+			t.Errorf("%s: output does not decode: %v", test.mode, err)
+		}
+	}
+
+	// an upright image without copyright loses its EXIF segment altogether
+	out := ApplyMetadataPolicyToOriginal(testJPEG(t, 1, "Jane Doe", ""), MetadataPolicy{Mode: MetadataStrip})
+
+	if len(jpegMetadataSegments(out)) != 0 {
+		t.Errorf("metadata segments left after stripping an upright image")
+	}
+}
+
+func TestVariantMetadataSegments(t *testing.T) {
+
+	source := testJPEG(t, 6, "Jane Doe", "CC BY 4.0")
+
+	tests := []struct {
+		mode      string
+		segments  int
+		artist    string
+		copyright string
+	}{
+		{MetadataKeep, 1, "Jane Doe", "CC BY 4.0"},
+		{MetadataStrip, 0, "", ""},
+		{MetadataCopyright, 1, "Jane Doe", "CC BY 4.0"},
+	}
+
+	for _, test := range tests {
+
+		segments := variantMetadataSegments(source, MetadataPolicy{Mode: test.mode})
+
+		if len(segments) != test.segments {
+			t.Errorf("%s: %d segments, want %d", test.mode, len(segments), test.segments)
+			continue
+		}
+
+		if test.segments == 0 {
+			continue
+		}
+
+		variant := testJPEG(t, 1, "", "")
+		variant = insertJPEGSegments(removeJPEGSegments(variant, 0xE1), segments)
+
+		// variants are already rotated, their orientation must be reset
+		if orientation := ImageOrientation(variant); orientation != 1 {
+			t.Errorf("%s: variant orientation %d, want 1", test.mode, orientation)
+		}
+
+		artist, copyright := exifFields(t, variant)
+
+		if artist != test.artist || copyright != test.copyright {
+			t.Errorf("%s: artist %q and copyright %q, want %q and %q", test.mode, artist, copyright, test.artist, test.copyright)
+		}
+	}
+}
+
+func TestExtractExifMetadataWithoutExif(t *testing.T) {
+
+	if metadata := ExtractExifMetadata([]byte("not an image"), true); len(metadata) != 0 {
+		t.Fatalf("metadata of a non image = %v", metadata)
+	}
+}
@@ -0,0 +1,191 @@
+package services
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// renditionWidths maps the heights CreateM3U8 names its playlists after to
+// the widths of the transcoder resolutions.
+var renditionWidths = map[int]int{
+	720: 1280,
+	480: 854,
+	360: 640,
+}
+
+var renditionPlaylist = regexp.MustCompile(`^(\d+)\.m3u8$`)
+
+// playlistBandwidth returns the peak and average bitrate in bit/s of a media
+// playlist, from its segment durations and sizes on disk.
+func playlistBandwidth(playlistPath string) (int, int, error) {
+
+	file, err := os.Open(playlistPath)
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	defer file.Close()
+
+	dir := filepath.Dir(playlistPath)
+
+	peak := 0.0
+	totalBits := 0.0
+	totalDuration := 0.0
+	duration := 0.0
+
+	scanner := bufio.NewScanner(file)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if strings.HasPrefix(line, "#EXTINF:") {
+			value := strings.SplitN(strings.TrimPrefix(line, "#EXTINF:"), ",", 2)[0]
+			duration, _ = strconv.ParseFloat(value, 64)
+			continue
+		}
+
+		if line == "" || strings.HasPrefix(line, "#") || duration <= 0 {
+			continue
+		}
+
+		info, err := os.Stat(filepath.Join(dir, line))
+
+		if err != nil {
+			return 0, 0, err
+		}
+
+		bits := float64(info.Size()) * 8
+
+		if bits/duration > peak {
+			peak = bits / duration
+		}
+
+		totalBits += bits
+		totalDuration += duration
+		duration = 0
+	}
+
+	if err := scanner.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	if totalDuration == 0 {
+		return 0, 0, fmt.Errorf("playlist %s has no segments", playlistPath)
+	}
+
+	return int(peak), int(totalBits / totalDuration), nil
+}
+
+// WriteMasterPlaylist (re)writes ./media/<fileId>/master.m3u8 from the video
+// renditions and caption tracks found next to it, and records it as the
+// "hls" variant of the upload when uploadId is set.
+func (s *TranscoderService) WriteMasterPlaylist(fileId string, uploadId string) error {
+
+	dir := fmt.Sprintf("./media/%s", fileId)
+
+	entries, err := os.ReadDir(dir)
+
+	if err != nil {
+		return err
+	}
+
+	var heights []int
+
+	for _, entry := range entries {
+		match := renditionPlaylist.FindStringSubmatch(entry.Name())
+
+		if match == nil {
+			continue
+		}
+
+		height, _ := strconv.Atoi(match[1])
+		heights = append(heights, height)
+	}
+
+	if len(heights) == 0 {
+		return fmt.Errorf("no renditions to list in the master playlist of %s", fileId)
+	}
+
+	sort.Sort(sort.Reverse(sort.IntSlice(heights)))
+
+	var captions []CaptionTrack
+
+	if uploadId != "" {
+		captions, err = s.ListCaptions(uploadId)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	var playlist strings.Builder
+
+	playlist.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+
+	for _, caption := range captions {
+		def := "NO"
+
+		if caption.Default {
+			def = "YES"
+		}
+
+		fmt.Fprintf(&playlist, "#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID=\"subs\",NAME=\"%s\",LANGUAGE=\"%s\",DEFAULT=%s,AUTOSELECT=YES,URI=\"subs_%s.m3u8\"\n",
+			strings.ReplaceAll(caption.Label, `"`, `'`), caption.Language, def, caption.Language)
+	}
+
+	for _, height := range heights {
+		peak, average, err := playlistBandwidth(fmt.Sprintf("%s/%d.m3u8", dir, height))
+
+		if err != nil {
+			log.Println("Skipping rendition in master playlist:", err)
+			continue
+		}
+
+		fmt.Fprintf(&playlist, "#EXT-X-STREAM-INF:BANDWIDTH=%d,AVERAGE-BANDWIDTH=%d", peak, average)
+
+		if width, ok := renditionWidths[height]; ok {
+			fmt.Fprintf(&playlist, ",RESOLUTION=%dx%d", width, height)
+		}
+
+		if len(captions) > 0 {
+			playlist.WriteString(",SUBTITLES=\"subs\"")
+		}
+
+		fmt.Fprintf(&playlist, "\n%d.m3u8\n", height)
+	}
+
+	masterPath := fmt.Sprintf("%s/master.m3u8", dir)
+
+	err = os.WriteFile(masterPath, []byte(playlist.String()), 0644)
+
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Wrote master playlist for %s with %d captions", fileId, len(captions))
+
+	if uploadId == "" {
+		return nil
+	}
+
+	err = s.Media.DeleteVariantRows(uploadId, "hls")
+
+	if err != nil {
+		return err
+	}
+
+	return s.Media.WriteVariantsToDB(uploadId, "hls", []ResizedImageUrlAndSizeModel{{
+		Name:   "master",
+		Url:    fmt.Sprintf("https://kaykatjd.com/media/%s/master.m3u8", fileId),
+		Size:   int64(playlist.Len()),
+		Format: "m3u8",
+	}})
+}
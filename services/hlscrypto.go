@@ -0,0 +1,455 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jdrew153/models"
+	"github.com/savsgio/gotils/uuid"
+)
+
+// HLS encryption methods.
+const (
+	HlsAES128    = "AES-128"
+	HlsSampleAES = "SAMPLE-AES"
+)
+
+// HlsEncryption turns on segment encryption for a transcode. A new key is
+// used every RotateEvery segments, 0 keeps one key for the whole video.
+//
+// Only the HLS renditions are produced for an encrypted transcode, the mp4
+// and single file audio renditions are left out. The original upload is no
+// longer served publicly once its keys exist, see IsEncryptedSource; the
+// posters, preview and waveform made from it stay in the clear.
+//
+// AES-128 encrypts whole segments. SAMPLE-AES encrypts the H.264 and AAC
+// samples inside the transport stream, see encryptSampleAES.
+type HlsEncryption struct {
+	Method      string `json:"method"`
+	RotateEvery int    `json:"rotateEvery"`
+}
+
+func (e HlsEncryption) Validate() error {
+
+	switch e.Method {
+	case "", HlsAES128, HlsSampleAES:
+	default:
+		return fmt.Errorf("unknown HLS encryption method %q", e.Method)
+	}
+
+	if e.RotateEvery < 0 {
+		return fmt.Errorf("rotateEvery must not be negative")
+	}
+
+	return nil
+}
+
+func (s *MediaService) WriteHlsKey(key models.HlsKey) error {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	return s.HlsKeys.Insert(ctx, key)
+}
+
+func (s *MediaService) GetHlsKey(id string) (models.HlsKey, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	return s.HlsKeys.Get(ctx, id)
+}
+
+// IsEncryptedSource reports whether a file under ./media is the source of an
+// upload with encrypted HLS renditions, which must not be served publicly.
+func (s *MediaService) IsEncryptedSource(filePath string) (bool, error) {
+
+	uploadId, err := s.FindUploadIdByUrl(fmt.Sprintf("https://kaykatjd.com/%s", filePath))
+
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	return s.HlsKeys.Exists(ctx, uploadId)
+}
+
+// encryptSegment encrypts a whole segment with AES-128-CBC and PKCS7 padding
+// as the HLS spec requires.
+func encryptSegment(data []byte, key []byte, iv []byte) ([]byte, error) {
+
+	block, err := aes.NewCipher(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	padding := aes.BlockSize - len(data)%aes.BlockSize
+	padded := append(append([]byte{}, data...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+
+	out := make([]byte, len(padded))
+
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(out, padded)
+
+	return out, nil
+}
+
+// sequenceIV is the IV players derive when EXT-X-KEY has none: the media
+// sequence number of the segment as a big endian 128-bit integer.
+func sequenceIV(sequence int) []byte {
+
+	iv := make([]byte, aes.BlockSize)
+
+	binary.BigEndian.PutUint64(iv[8:], uint64(sequence))
+
+	return iv
+}
+
+func HlsKeyUrl(keyId string) string {
+	return fmt.Sprintf("https://kaykatjd.com/hls-key?id=%s", keyId)
+}
+
+// encryptedPlaylist matches the media playlists EncryptHLS covers, the video
+// renditions and the HLS audio renditions.
+var encryptedPlaylist = regexp.MustCompile(`^(\d+|audio-[a-z0-9-]+)\.m3u8$`)
+
+// encryptedSegmentName is the file the encryption of a segment is written
+// to, segments are never encrypted in place.
+func encryptedSegmentName(segment string) string {
+
+	ext := filepath.Ext(segment)
+
+	return strings.TrimSuffix(segment, ext) + ".enc" + ext
+}
+
+// method returns the EXT-X-KEY method, AES-128 by default.
+func (e HlsEncryption) method() string {
+
+	if e.Method == "" {
+		return HlsAES128
+	}
+
+	return e.Method
+}
+
+// encryptPlaylist encrypts the segments of one media playlist into new files
+// with method and returns the playlist pointing at them, with an EXT-X-KEY
+// wherever the key changes, and the plain segments it replaces. The playlist
+// itself is left alone. keyFor returns the key of a media sequence number.
+// An already encrypted playlist gives an empty result.
+func encryptPlaylist(playlistPath string, method string, keyFor func(int) (models.HlsKey, error)) (string, []string, error) {
+
+	data, err := os.ReadFile(playlistPath)
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	if bytes.Contains(data, []byte("#EXT-X-KEY")) {
+		log.Printf("%s is already encrypted", playlistPath)
+		return "", nil, nil
+	}
+
+	dir := filepath.Dir(playlistPath)
+
+	var out strings.Builder
+
+	// tags since the last segment, the key tag has to come before them
+	var pending []string
+
+	var plain []string
+
+	sequence := 0
+	currentKey := ""
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+
+		// SAMPLE-AES needs protocol version 5
+		if method == HlsSampleAES && strings.HasPrefix(trimmed, "#EXT-X-VERSION:") {
+			if version, _ := strconv.Atoi(strings.TrimPrefix(trimmed, "#EXT-X-VERSION:")); version < 5 {
+				line = "#EXT-X-VERSION:5"
+			}
+		}
+
+		if strings.HasPrefix(trimmed, "#EXT-X-MEDIA-SEQUENCE:") {
+			sequence, _ = strconv.Atoi(strings.TrimPrefix(trimmed, "#EXT-X-MEDIA-SEQUENCE:"))
+		}
+
+		if !strings.HasPrefix(trimmed, "#EXTINF") && len(pending) == 0 && (trimmed == "" || strings.HasPrefix(trimmed, "#")) {
+			out.WriteString(line + "\n")
+			continue
+		}
+
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			pending = append(pending, line)
+			continue
+		}
+
+		key, err := keyFor(sequence)
+
+		if err != nil {
+			return "", nil, err
+		}
+
+		segmentPath := filepath.Join(dir, trimmed)
+
+		segment, err := os.ReadFile(segmentPath)
+
+		if err != nil {
+			return "", nil, err
+		}
+
+		var encrypted []byte
+
+		if method == HlsSampleAES {
+			encrypted, err = encryptSampleAES(segment, key.Key, sequenceIV(sequence))
+		} else {
+			encrypted, err = encryptSegment(segment, key.Key, sequenceIV(sequence))
+		}
+
+		if err != nil {
+			return "", nil, err
+		}
+
+		err = os.WriteFile(encryptedSegmentName(segmentPath), encrypted, 0644)
+
+		if err != nil {
+			return "", nil, err
+		}
+
+		plain = append(plain, segmentPath)
+
+		if key.Id != currentKey {
+			fmt.Fprintf(&out, "#EXT-X-KEY:METHOD=%s,URI=\"%s\"\n", method, HlsKeyUrl(key.Id))
+			currentKey = key.Id
+		}
+
+		for _, tag := range pending {
+			out.WriteString(tag + "\n")
+		}
+
+		pending = nil
+
+		out.WriteString(encryptedSegmentName(trimmed) + "\n")
+		sequence++
+	}
+
+	if err := scanner.Err(); err != nil {
+		return "", nil, err
+	}
+
+	for _, tag := range pending {
+		out.WriteString(tag + "\n")
+	}
+
+	return out.String(), plain, nil
+}
+
+// EncryptHLS encrypts every HLS rendition of a transcoded upload, video and
+// audio, with AES-128, rotating keys every options.RotateEvery segments. Keys
+// are shared between renditions, whose segments line up, and only leave the
+// server through the key delivery endpoint.
+//
+// The playlists are only switched to the encrypted segments once all of them
+// are encrypted, a run failing midway leaves the plain renditions as they
+// were and can be repeated.
+func (s *TranscoderService) EncryptHLS(fileId string, uploadId string, options HlsEncryption) error {
+
+	err := options.Validate()
+
+	if err != nil {
+		return err
+	}
+
+	if uploadId == "" {
+		return fmt.Errorf("encrypted videos need an upload to authorize key requests")
+	}
+
+	keys := map[int]models.HlsKey{}
+
+	keyFor := func(sequence int) (models.HlsKey, error) {
+
+		group := 0
+
+		if options.RotateEvery > 0 {
+			group = sequence / options.RotateEvery
+		}
+
+		if key, ok := keys[group]; ok {
+			return key, nil
+		}
+
+		key := models.HlsKey{
+			Id:            uuid.V4(),
+			UploadId:      uploadId,
+			Key:           make([]byte, 16),
+			SequenceStart: group * options.RotateEvery,
+			CreatedAt:     time.Now().UnixMilli(),
+		}
+
+		if _, err := rand.Read(key.Key); err != nil {
+			return key, err
+		}
+
+		if err := s.Media.WriteHlsKey(key); err != nil {
+			return key, err
+		}
+
+		keys[group] = key
+
+		return key, nil
+	}
+
+	playlists, err := filepath.Glob(fmt.Sprintf("./media/%s/*.m3u8", fileId))
+
+	if err != nil {
+		return err
+	}
+
+	found := 0
+	encrypted := map[string]string{}
+	var plain []string
+
+	for _, playlist := range playlists {
+
+		if !encryptedPlaylist.MatchString(filepath.Base(playlist)) {
+			continue
+		}
+
+		found++
+
+		content, segments, err := encryptPlaylist(playlist, options.method(), keyFor)
+
+		if err != nil {
+			return err
+		}
+
+		if content != "" {
+			encrypted[playlist] = content
+		}
+
+		plain = append(plain, segments...)
+	}
+
+	if found == 0 {
+		return fmt.Errorf("no HLS rendition of %s to encrypt", fileId)
+	}
+
+	for playlist, content := range encrypted {
+
+		err = os.WriteFile(playlist+".tmp", []byte(content), 0644)
+
+		if err == nil {
+			err = os.Rename(playlist+".tmp", playlist)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, segment := range plain {
+		if err := os.Remove(segment); err != nil && !os.IsNotExist(err) {
+			log.Println(err)
+		}
+	}
+
+	log.Printf("Encrypted %d renditions of %s with %d keys", len(encrypted), fileId, len(keys))
+
+	return nil
+}
+
+var ErrInvalidHlsToken = errors.New("invalid or expired HLS key token")
+
+func hlsTokenSecret() ([]byte, error) {
+
+	secret := os.Getenv("HLS_TOKEN_SECRET")
+
+	if secret == "" {
+		return nil, fmt.Errorf("HLS_TOKEN_SECRET is not set")
+	}
+
+	return []byte(secret), nil
+}
+
+func signHlsToken(secret []byte, uploadId string, expires int64) string {
+
+	mac := hmac.New(sha256.New, secret)
+
+	fmt.Fprintf(mac, "%s:%d", uploadId, expires)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// NewHlsKeyToken signs a token letting its bearer fetch the keys of one
+// upload until expiry, for players that cannot send an API key.
+func NewHlsKeyToken(uploadId string, ttl time.Duration) (string, int64, error) {
+
+	secret, err := hlsTokenSecret()
+
+	if err != nil {
+		return "", 0, err
+	}
+
+	expires := time.Now().Add(ttl).Unix()
+
+	return fmt.Sprintf("%d.%s", expires, signHlsToken(secret, uploadId, expires)), expires, nil
+}
+
+func VerifyHlsKeyToken(token string, uploadId string) error {
+
+	secret, err := hlsTokenSecret()
+
+	if err != nil {
+		return err
+	}
+
+	parts := strings.SplitN(token, ".", 2)
+
+	if len(parts) != 2 {
+		return ErrInvalidHlsToken
+	}
+
+	expires, err := strconv.ParseInt(parts[0], 10, 64)
+
+	if err != nil || time.Now().Unix() > expires {
+		return ErrInvalidHlsToken
+	}
+
+	if !hmac.Equal([]byte(parts[1]), []byte(signHlsToken(secret, uploadId, expires))) {
+		return ErrInvalidHlsToken
+	}
+
+	return nil
+}
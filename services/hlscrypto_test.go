@@ -0,0 +1,100 @@
+package services
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jdrew153/models"
+)
+
+func TestEncryptPlaylistKeepsPlainRendition(t *testing.T) {
+
+	dir := t.TempDir()
+
+	playlist := "#EXTM3U\n#EXT-X-MEDIA-SEQUENCE:0\n#EXTINF:10.0,\n7200.ts\n#EXTINF:4.0,\n7201.ts\n#EXT-X-ENDLIST\n"
+
+	playlistPath := filepath.Join(dir, "720.m3u8")
+
+	os.WriteFile(playlistPath, []byte(playlist), 0644)
+	os.WriteFile(filepath.Join(dir, "7200.ts"), []byte("first segment"), 0644)
+	os.WriteFile(filepath.Join(dir, "7201.ts"), []byte("second segment"), 0644)
+
+	key := models.HlsKey{Id: "key", Key: bytes.Repeat([]byte{1}, 16)}
+
+	content, plain, err := encryptPlaylist(playlistPath, HlsAES128, func(int) (models.HlsKey, error) { return key, nil })
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(plain) != 2 {
+		t.Fatalf("plain segments = %v", plain)
+	}
+
+	if !strings.Contains(content, "#EXT-X-KEY") || !strings.Contains(content, "\n7201.enc.ts\n") {
+		t.Fatalf("unexpected playlist:\n%s", content)
+	}
+
+	// nothing is swapped in yet
+	data, _ := os.ReadFile(playlistPath)
+
+	if string(data) != playlist {
+		t.Fatalf("playlist rewritten:\n%s", data)
+	}
+
+	data, _ = os.ReadFile(filepath.Join(dir, "7201.ts"))
+
+	if string(data) != "second segment" {
+		t.Fatalf("plain segment changed to %q", data)
+	}
+
+	encrypted, err := os.ReadFile(filepath.Join(dir, "7201.enc.ts"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block, _ := aes.NewCipher(key.Key)
+
+	decrypted := make([]byte, len(encrypted))
+
+	cipher.NewCBCDecrypter(block, sequenceIV(1)).CryptBlocks(decrypted, encrypted)
+
+	if !bytes.HasPrefix(decrypted, []byte("second segment")) {
+		t.Fatalf("segment decrypts to %q", decrypted)
+	}
+}
+
+func TestIsEncryptedSource(t *testing.T) {
+
+	s := newTestMediaService(t)
+
+	ids, err := s.WriteNewUploadsToDB([]NewUploadModel{
+		{Url: "https://kaykatjd.com/media/clip.mp4", FileType: "mp4", ApplicationId: "app"},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, filePath := range []string{"media/clip.mp4", "media/unregistered.mp4"} {
+		if encrypted, err := s.IsEncryptedSource(filePath); err != nil || encrypted {
+			t.Fatalf("IsEncryptedSource(%s) before encryption = %v, %v", filePath, encrypted, err)
+		}
+	}
+
+	err = s.WriteHlsKey(models.HlsKey{Id: "key", UploadId: ids[0], Key: make([]byte, 16)})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if encrypted, err := s.IsEncryptedSource("media/clip.mp4"); err != nil || !encrypted {
+		t.Fatalf("IsEncryptedSource after encryption = %v, %v", encrypted, err)
+	}
+}
@@ -0,0 +1,48 @@
+package services
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Job types of the jobs table.
+const (
+	JobTranscode = "transcode"
+)
+
+// trackJob records a job around run, jobs still run when they cannot be
+// recorded.
+func (s *MediaService) trackJob(uploadId string, applicationId string, jobType string, run func() error) error {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	id, err := s.Jobs.Start(ctx, uploadId, applicationId, jobType)
+
+	cancel()
+
+	if err != nil {
+		log.Println("Error recording job:", err)
+		return run()
+	}
+
+	runErr := run()
+
+	message := ""
+
+	if runErr != nil {
+		message = runErr.Error()
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	err = s.Jobs.Finish(ctx, id, message)
+
+	if err != nil {
+		log.Println("Error recording job outcome:", err)
+	}
+
+	return runErr
+}
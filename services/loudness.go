@@ -0,0 +1,190 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// LoudnessOptions are the EBU R128 targets of the loudnorm filter:
+// integrated loudness in LUFS, true peak in dBTP and loudness range in LU.
+// Zero values take the EBU R128 broadcast defaults.
+type LoudnessOptions struct {
+	IntegratedLoudness float64 `json:"integratedLoudness"`
+	TruePeak           float64 `json:"truePeak"`
+	LoudnessRange      float64 `json:"loudnessRange"`
+}
+
+func (o LoudnessOptions) Validate() error {
+
+	if o.IntegratedLoudness != 0 && (o.IntegratedLoudness < -70 || o.IntegratedLoudness > -5) {
+		return fmt.Errorf("integrated loudness must be between -70 and -5 LUFS")
+	}
+
+	if o.TruePeak < -9 || o.TruePeak > 0 {
+		return fmt.Errorf("true peak must be between -9 and 0 dBTP")
+	}
+
+	if o.LoudnessRange != 0 && (o.LoudnessRange < 1 || o.LoudnessRange > 50) {
+		return fmt.Errorf("loudness range must be between 1 and 50 LU")
+	}
+
+	return nil
+}
+
+func (o LoudnessOptions) withDefaults() LoudnessOptions {
+
+	if o.IntegratedLoudness == 0 {
+		o.IntegratedLoudness = -23
+	}
+
+	if o.TruePeak == 0 {
+		o.TruePeak = -1
+	}
+
+	if o.LoudnessRange == 0 {
+		o.LoudnessRange = 7
+	}
+
+	return o
+}
+
+func (o LoudnessOptions) targets() string {
+	return fmt.Sprintf("I=%.1f:TP=%.1f:LRA=%.1f", o.IntegratedLoudness, o.TruePeak, o.LoudnessRange)
+}
+
+// LoudnessMeasurement is the first pass analysis of loudnorm.
+type LoudnessMeasurement struct {
+	IntegratedLoudness float64
+	TruePeak           float64
+	LoudnessRange      float64
+	Threshold          float64
+	TargetOffset       float64
+}
+
+// loudnormStats is the print_format=json output, loudnorm prints numbers as strings.
+type loudnormStats struct {
+	InputI       string `json:"input_i"`
+	InputTP      string `json:"input_tp"`
+	InputLRA     string `json:"input_lra"`
+	InputThresh  string `json:"input_thresh"`
+	TargetOffset string `json:"target_offset"`
+}
+
+func parseLoudnormStats(output string) (LoudnessMeasurement, error) {
+
+	var measurement LoudnessMeasurement
+
+	start := strings.LastIndex(output, "{")
+	end := strings.LastIndex(output, "}")
+
+	if start < 0 || end < start {
+		return measurement, fmt.Errorf("no loudnorm statistics in ffmpeg output")
+	}
+
+	var stats loudnormStats
+
+	err := json.Unmarshal([]byte(output[start:end+1]), &stats)
+
+	if err != nil {
+		return measurement, err
+	}
+
+	for _, field := range []struct {
+		value string
+		dest  *float64
+	}{
+		{stats.InputI, &measurement.IntegratedLoudness},
+		{stats.InputTP, &measurement.TruePeak},
+		{stats.InputLRA, &measurement.LoudnessRange},
+		{stats.InputThresh, &measurement.Threshold},
+		{stats.TargetOffset, &measurement.TargetOffset},
+	} {
+		// silence is measured as -inf, which ParseFloat understands
+		*field.dest, err = strconv.ParseFloat(strings.TrimSpace(field.value), 64)
+
+		if err != nil {
+			return measurement, fmt.Errorf("invalid loudnorm statistic %q", field.value)
+		}
+	}
+
+	return measurement, nil
+}
+
+// MeasureLoudness runs the analysis pass of loudnorm over the audio of inputPath.
+func MeasureLoudness(inputPath string, options LoudnessOptions) (LoudnessMeasurement, error) {
+
+	options = options.withDefaults()
+
+	cmd := exec.Command("ffmpeg", "-hide_banner", "-nostats",
+		"-i", inputPath,
+		"-vn",
+		"-af", fmt.Sprintf("loudnorm=%s:print_format=json", options.targets()),
+		"-f", "null", "-")
+
+	stderr := bytes.Buffer{}
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+
+	if err != nil {
+		return LoudnessMeasurement{}, fmt.Errorf("ffmpeg: %v: %s", err, stderr.String())
+	}
+
+	return parseLoudnormStats(stderr.String())
+}
+
+// LoudnormFilter returns the second pass filter applying the measured
+// correction linearly, so the audio is not dynamically compressed.
+func LoudnormFilter(options LoudnessOptions, measurement LoudnessMeasurement) string {
+
+	options = options.withDefaults()
+
+	return fmt.Sprintf("loudnorm=%s:measured_I=%.2f:measured_TP=%.2f:measured_LRA=%.2f:measured_thresh=%.2f:offset=%.2f:linear=true",
+		options.targets(), measurement.IntegratedLoudness, measurement.TruePeak, measurement.LoudnessRange, measurement.Threshold, measurement.TargetOffset)
+}
+
+// PrepareLoudnessNormalization measures inputPath, stores the measurement in
+// the upload's metadata and returns the filter normalizing it. Silent media
+// gets no filter.
+func (s *TranscoderService) PrepareLoudnessNormalization(inputPath string, options LoudnessOptions) (string, error) {
+
+	measurement, err := MeasureLoudness(inputPath, options)
+
+	if err != nil {
+		return "", err
+	}
+
+	log.Printf("Measured %s at %.2f LUFS, %.2f dBTP, %.2f LU", inputPath, measurement.IntegratedLoudness, measurement.TruePeak, measurement.LoudnessRange)
+
+	uploadId, err := s.uploadIdForPath(inputPath)
+
+	if err != nil {
+		return "", err
+	}
+
+	if uploadId != "" && !math.IsInf(measurement.IntegratedLoudness, 0) {
+		err = s.Media.WriteUploadMetadata(uploadId, map[string]string{
+			"audio.integratedLoudness": strconv.FormatFloat(measurement.IntegratedLoudness, 'f', 2, 64),
+			"audio.truePeak":           strconv.FormatFloat(measurement.TruePeak, 'f', 2, 64),
+			"audio.loudnessRange":      strconv.FormatFloat(measurement.LoudnessRange, 'f', 2, 64),
+		})
+
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// below the gating threshold there is nothing loudnorm can bring up
+	if math.IsInf(measurement.IntegratedLoudness, 0) || measurement.IntegratedLoudness < -70 {
+		log.Printf("%s is silent, skipping loudness normalization", inputPath)
+		return "", nil
+	}
+
+	return LoudnormFilter(options, measurement), nil
+}
@@ -4,34 +4,45 @@ import (
 	"bytes"
 	"context"
 	"database/sql"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"image"
+	"image/gif"
 	"image/jpeg"
-	"image/png"
 	"io"
 	"log"
 	"os"
-	"strconv"
+	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/hashicorp/golang-lru/v2"
-	"github.com/nfnt/resize"
+	"github.com/jdrew153/models"
+	"github.com/jdrew153/repositories"
 	"github.com/redis/go-redis/v9"
-	"github.com/savsgio/gotils/uuid"
 )
 
 type MediaService struct {
-	Cache *lru.Cache[string, []byte]
-	Redis *redis.Client
-	Db    *sql.DB
+	Cache    *lru.Cache[string, []byte]
+	Redis    *redis.Client
+	Uploads  repositories.UploadRepository
+	Variants repositories.VariantRepository
+	Metadata repositories.MetadataRepository
+	Blobs    repositories.BlobRepository
+	HlsKeys  repositories.HlsKeyRepository
+	Jobs     repositories.JobRepository
 }
 
-func NewMediaService(cache *lru.Cache[string, []byte], redis *redis.Client, db *sql.DB) *MediaService {
+func NewMediaService(cache *lru.Cache[string, []byte], redis *redis.Client, repos *repositories.Repositories) *MediaService {
 	return &MediaService{
-		Cache: cache,
-		Redis: redis,
-		Db:    db,
+		Cache:    cache,
+		Redis:    redis,
+		Uploads:  repos.Uploads,
+		Variants: repos.Variants,
+		Metadata: repos.Metadata,
+		Blobs:    repos.Blobs,
+		HlsKeys:  repos.HlsKeys,
+		Jobs:     repos.Jobs,
 	}
 }
 
@@ -120,221 +131,262 @@ func (s *MediaService) CalculateCacheWeight() {
 	}
 }
 
+// ValidUserIDAndAppIDModel is the API key record stored in Redis. Records
+// without scopes predate them and get LegacyScopes. ExpiresAt is in unix
+// milliseconds and MaxUploadSize in bytes, zero means no limit for both.
 type ValidUserIDAndAppIDModel struct {
-	UserId        string `json:"userId"`
-	ApplicationId string `json:"applicationId"`
+	Id             string   `json:"id,omitempty"`
+	Name           string   `json:"name,omitempty"`
+	Prefix         string   `json:"prefix,omitempty"`
+	UserId         string   `json:"userId"`
+	ApplicationId  string   `json:"applicationId"`
+	Scopes         []string `json:"scopes,omitempty"`
+	AllowedOrigins []string `json:"allowedOrigins,omitempty"`
+	AllowedIps     []string `json:"allowedIps,omitempty"`
+	ExpiresAt      int64    `json:"expiresAt,omitempty"`
+	MaxUploadSize  int64    `json:"maxUploadSize,omitempty"`
+	CreatedAt      int64    `json:"createdAt,omitempty"`
+	RotatedAt      int64    `json:"rotatedAt,omitempty"`
+	LastUsedAt     int64    `json:"lastUsedAt,omitempty"`
 }
 
+// APIKeyCheck authenticates a key by its hash. Keys still stored raw, from
+// before hashing, need the "migrate api-keys" command first.
 func (s *MediaService) APIKeyCheck(apiKey string) (ValidUserIDAndAppIDModel, error) {
 
-	var validUserIDAndAppID ValidUserIDAndAppIDModel
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 
-	value, err := s.Redis.Get(context.Background(), apiKey).Result()
+	validUserIDAndAppID, err := s.lookupAPIKey(ctx, HashAPIKey(apiKey))
 
-	log.Println("Value from api key", value)
+	if err == redis.Nil {
+		err = ErrAPIKeyNotFound
+	}
 
 	if err != nil {
 		log.Println(err)
 		return validUserIDAndAppID, err
 	}
 
-	err = json.Unmarshal([]byte(value), &validUserIDAndAppID)
-
-	if err != nil {
-		return validUserIDAndAppID, err
-
+	if validUserIDAndAppID.Expired() {
+		return validUserIDAndAppID, ErrAPIKeyExpired
 	}
 
-	log.Printf("Value from api key %s\n", value)
+	s.touchAPIKey(ctx, validUserIDAndAppID)
 
 	return validUserIDAndAppID, nil
 }
 
 type ResizedImageUrlAndSizeModel struct {
-	Url  string `json:"url"`
-	Size int64  `json:"size"`
+	Name   string `json:"name,omitempty"`
+	Url    string `json:"url"`
+	Size   int64  `json:"size"`
+	Width  int    `json:"width,omitempty"`
+	Height int    `json:"height,omitempty"`
+	Format string `json:"format,omitempty"`
 }
 
-func (s *MediaService) ResizeImages(filePath string) ([]ResizedImageUrlAndSizeModel, error) {
-	sizes := []string{
-		"720p",
-		"480p",
-		"360p",
-	}
+// ResizeImagesOptions configure ResizeImages. Watermark is only applied to
+// profiles that ask for it, and without a Focal point cover profiles crop
+// around an automatically detected one.
+type ResizeImagesOptions struct {
+	Profiles  []ImageVariantProfile
+	Policy    MetadataPolicy
+	Watermark *WatermarkConfig
+	Focal     *FocalPoint
+}
 
-	basePath := strings.Split(filePath, ".")[0]
-	ext := strings.Split(filePath, ".")[1]
+// ResizeImages writes one variant per profile next to the original.
+func (s *MediaService) ResizeImages(filePath string, options ResizeImagesOptions) ([]ResizedImageUrlAndSizeModel, error) {
 
-	file, err := os.Open(fmt.Sprintf("./media/%s", filePath))
+	profiles := options.Profiles
+	policy := options.Policy
+	watermark := options.Watermark
 
-	if err != nil {
-		log.Println(err)
-		return nil, err
+	if len(profiles) == 0 {
+		profiles = DefaultImageVariantProfiles
 	}
 
-	defer file.Close()
+	err := ValidateImageVariantProfiles(profiles)
 
-	var newFiles []ResizedImageUrlAndSizeModel
+	if err != nil {
+		return nil, err
+	}
 
-	switch ext {
-	case "jpg":
+	ext := filepath.Ext(filePath)
+	basePath := strings.TrimSuffix(filePath, ext)
+	ext = strings.TrimPrefix(ext, ".")
 
-		img, err := jpeg.Decode(file)
+	data, err := os.ReadFile(fmt.Sprintf("./media/%s", filePath))
 
-		if err != nil {
-			return nil, err
-		}
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
 
-		for _, size := range sizes {
-			parsedSize := strings.Split(size, "p")[0]
-			intSize, err := strconv.Atoi(parsedSize)
+	img, sourceFormat, err := DecodeImage(data)
 
-			if err != nil {
-				return nil, err
-			}
+	if err != nil {
+		return nil, err
+	}
 
-			m := resize.Resize(0, uint(intSize), img, resize.Lanczos3)
+	animated, isAnimated := (*gif.GIF)(nil), false
 
-			newFileName := fmt.Sprintf("./media/%s-%s.%s", basePath, size, ext)
+	if sourceFormat == "gif" {
+		animated, isAnimated = DecodeAnimatedGIF(data)
+	}
 
-			out, err := os.Create(newFileName)
+	focal := CenterFocalPoint
 
-			if err != nil {
-				return nil, err
+	if options.Focal != nil {
+		focal = *options.Focal
+	} else {
+		for _, profile := range profiles {
+			if profile.Fit == FitCover {
+				focal = AutoFocalPoint(img)
+				break
 			}
+		}
+	}
 
-			jpeg.Encode(out, m, nil)
-
-			baseNewFilePath := strings.Split(newFileName, "./media/")[1]
+	var newFiles []ResizedImageUrlAndSizeModel
 
-			newUrl := fmt.Sprintf("https://kaykatjd.com/media/%s", baseNewFilePath)
+	for _, profile := range profiles {
 
-			fileInfo, err := out.Stat()
+		var profileWatermark *WatermarkConfig
 
-			if err != nil {
-				return nil, err
+		if profile.Watermark {
+			if watermark == nil {
+				return nil, fmt.Errorf("profile %s wants a watermark but none is configured", profile.Name)
 			}
 
-			model := ResizedImageUrlAndSizeModel{
-				Url:  newUrl,
-				Size: fileInfo.Size(),
-			}
-
-			newFiles = append(newFiles, model)
-
-			out.Close()
-
+			profileWatermark = watermark
 		}
 
-	case "png":
-		img, err := png.Decode(file)
+		if profile.Format == "mp4" {
+			if !isAnimated {
+				continue
+			}
+
+			canvas := image.Rect(0, 0, animated.Config.Width, animated.Config.Height)
 
-		if err != nil {
-			return nil, err
-		}
+			width, height := VariantDimensions(canvas.Dx(), canvas.Dy(), profile)
 
-		for _, size := range sizes {
-			parsedSize := strings.Split(size, "p")[0]
-			intSize, err := strconv.Atoi(parsedSize)
+			crop := canvas
 
-			if err != nil {
-				return nil, err
+			if profile.Fit == FitCover {
+				crop = CropForAspect(canvas, width, height, focal)
 			}
 
-			m := resize.Resize(0, uint(intSize), img, resize.Lanczos3)
+			newFileName := fmt.Sprintf("%s-%s.mp4", basePath, profile.Name)
 
-			newFileName := fmt.Sprintf("./media/%s-%s.%s", basePath, size, ext)
-			out, err := os.Create(newFileName)
+			err = ConvertAnimatedToMP4(fmt.Sprintf("./media/%s", filePath), fmt.Sprintf("./media/%s", newFileName), crop, width, height, profileWatermark)
 
 			if err != nil {
 				return nil, err
 			}
 
-			png.Encode(out, m)
-
-			baseNewFilePath := strings.Split(newFileName, "./media/")[1]
-
-			newUrl := fmt.Sprintf("https://kaykatjd.com/media/%s", baseNewFilePath)
-
-			fileInfo, err := out.Stat()
+			fileInfo, err := os.Stat(fmt.Sprintf("./media/%s", newFileName))
 
 			if err != nil {
 				return nil, err
 			}
 
-			model := ResizedImageUrlAndSizeModel{
-				Url:  newUrl,
-				Size: fileInfo.Size(),
-			}
+			newFiles = append(newFiles, ResizedImageUrlAndSizeModel{
+				Name:   profile.Name,
+				Url:    fmt.Sprintf("https://kaykatjd.com/media/%s", newFileName),
+				Size:   fileInfo.Size(),
+				Width:  width - width%2,
+				Height: height - height%2,
+				Format: "mp4",
+			})
 
-			newFiles = append(newFiles, model)
+			continue
+		}
 
-			out.Close()
+		format := DefaultOutputFormat(sourceFormat)
+		outExt := ext
 
+		if format != sourceFormat {
+			outExt = format
 		}
 
-	case "jpeg":
-		img, err := jpeg.Decode(file)
-
-		if err != nil {
-			return nil, err
+		if profile.Format != "" && NormalizeImageFormat(profile.Format) != format {
+			format = NormalizeImageFormat(profile.Format)
+			outExt = format
 		}
 
-		for _, size := range sizes {
-			parsedSize := strings.Split(size, "p")[0]
-			intSize, err := strconv.Atoi(parsedSize)
+		out := bytes.Buffer{}
 
-			if err != nil {
-				return nil, err
-			}
+		var width, height int
 
-			m := resize.Resize(0, uint(intSize), img, resize.Lanczos3)
+		if isAnimated && format == "gif" {
+			var resized *gif.GIF
 
-			newFileName := fmt.Sprintf("./media/%s-%s.%s", basePath, size, ext)
-			out, err := os.Create(newFileName)
+			resized, err = ResizeAnimatedGIF(animated, profile, focal, profileWatermark)
 
 			if err != nil {
 				return nil, err
 			}
 
-			jpeg.Encode(out, m, nil)
+			err = gif.EncodeAll(&out, resized)
 
-			baseNewFilePath := strings.Split(newFileName, "./media/")[1]
-
-			newUrl := fmt.Sprintf("https://kaykatjd.com/media/%s", baseNewFilePath)
+			width, height = resized.Config.Width, resized.Config.Height
+		} else {
+			m := ResizeForProfile(img, profile, focal)
 
-			fileInfo, err := out.Stat()
+			if profileWatermark != nil {
+				m, err = ApplyWatermark(m, *profileWatermark)
 
-			if err != nil {
-				return nil, err
+				if err != nil {
+					return nil, err
+				}
 			}
 
-			model := ResizedImageUrlAndSizeModel{
-				Url:  newUrl,
-				Size: fileInfo.Size(),
-			}
+			err = EncodeImage(&out, m, format, profile.Quality)
 
-			newFiles = append(newFiles, model)
+			width, height = m.Bounds().Dx(), m.Bounds().Dy()
+		}
+
+		if err != nil {
+			return nil, err
+		}
 
-			out.Close()
+		encoded := out.Bytes()
 
+		if !profile.StripMetadata && format == "jpeg" && sourceFormat == "jpeg" {
+			encoded = insertJPEGSegments(encoded, variantMetadataSegments(data, policy))
 		}
 
-	}
+		newFileName := fmt.Sprintf("%s-%s.%s", basePath, profile.Name, outExt)
 
-	log.Println("Resized images for", filePath)
+		err = os.WriteFile(fmt.Sprintf("./media/%s", newFileName), encoded, 0644)
 
-	originalUrl := fmt.Sprintf("https://kaykatjd.com/media/%s", filePath)
+		if err != nil {
+			return nil, err
+		}
 
-	fileInfo, err := file.Stat()
+		model := ResizedImageUrlAndSizeModel{
+			Name:   profile.Name,
+			Url:    fmt.Sprintf("https://kaykatjd.com/media/%s", newFileName),
+			Size:   int64(len(encoded)),
+			Width:  width,
+			Height: height,
+			Format: format,
+		}
 
-	if err != nil {
-		return nil, err
+		newFiles = append(newFiles, model)
 	}
 
+	log.Println("Resized images for", filePath)
+
 	model := ResizedImageUrlAndSizeModel{
-		Url:  originalUrl,
-		Size: fileInfo.Size(),
+		Name:   "original",
+		Url:    fmt.Sprintf("https://kaykatjd.com/media/%s", filePath),
+		Size:   int64(len(data)),
+		Width:  img.Bounds().Dx(),
+		Height: img.Bounds().Dy(),
+		Format: sourceFormat,
 	}
 
 	newFiles = append(newFiles, model)
@@ -343,24 +395,29 @@ func (s *MediaService) ResizeImages(filePath string) ([]ResizedImageUrlAndSizeMo
 
 }
 
-func (s *MediaService) GenerateThumbnail(fileName string) (string, error) {
+// GenerateThumbnail writes a 200x200 square crop around the focal point,
+// detected automatically when focal is nil.
+func (s *MediaService) GenerateThumbnail(fileName string, focal *FocalPoint) (string, error) {
 
-	file, err := os.Open(fmt.Sprintf("./media/%s", fileName))
+	data, err := os.ReadFile(fmt.Sprintf("./media/%s", fileName))
 
 	if err != nil {
 		log.Println(err)
 		return "", err
 	}
 
-	defer file.Close()
-
-	img, err := jpeg.Decode(file)
+	img, _, err := DecodeImage(data)
 
 	if err != nil {
 		return "", err
 	}
 
-	m := resize.Thumbnail(200, 200, img, resize.Lanczos3)
+	if focal == nil {
+		auto := AutoFocalPoint(img)
+		focal = &auto
+	}
+
+	m := CoverResize(img, 200, 200, *focal)
 
 	newFileName := fmt.Sprintf("./media/%s-thumbnail.jpg", fileName)
 
@@ -384,47 +441,436 @@ func (s *MediaService) GenerateThumbnail(fileName string) (string, error) {
 
 }
 
+// ProcessImageMetadata applies the metadata policy to a stored original and,
+// when uploadId is set, saves the extracted EXIF fields as upload metadata.
+func (s *MediaService) ProcessImageMetadata(filePath string, uploadId string, policy MetadataPolicy) error {
+
+	if NormalizeImageFormat(filepath.Ext(filePath)) != "jpeg" {
+		return nil
+	}
+
+	path := fmt.Sprintf("./media/%s", filePath)
+
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+		return err
+	}
+
+	if uploadId != "" {
+		metadata := ExtractExifMetadata(data, policy.SaveGps)
+
+		err = s.WriteUploadMetadata(uploadId, metadata)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	processed := ApplyMetadataPolicyToOriginal(data, policy)
+
+	if bytes.Equal(processed, data) {
+		return nil
+	}
+
+	tmpPath := path + ".tmp"
+
+	err = os.WriteFile(tmpPath, processed, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Applied %s metadata policy to %s", policy.Mode, filePath)
+
+	return os.Rename(tmpPath, path)
+}
+
 type NewUploadModel struct {
-	Url           string `json:"url"`
-	FileType      string `json:"fileType"`
-	Size          string `json:"size"`
-	ApplicationId string `json:"applicationId"`
-	UserId        string `json:"userId"`
+	Url              string `json:"url"`
+	FileType         string `json:"fileType"`
+	Size             int64  `json:"size"`
+	ApplicationId    string `json:"applicationId"`
+	UserId           string `json:"userId"`
+	Status           string `json:"status"`
+	MimeType         string `json:"mimeType"`
+	OriginalFilename string `json:"originalFilename"`
+	ParentId         string `json:"parentId"`
+	VariantKind      string `json:"variantKind"`
+	UploadAnnotations
 }
 
-func (s *MediaService) WriteNewUploadsToDB(uploads []NewUploadModel) error {
+// WriteNewUploadsToDB inserts the uploads in one transaction and returns
+// their new ids in order. The MIME type defaults to the one of the file type.
+func (s *MediaService) WriteNewUploadsToDB(uploads []NewUploadModel) ([]string, error) {
+
+	var rows []models.Upload
 
 	for _, upload := range uploads {
 
-		log.Println("Application ID", upload.ApplicationId)
+		mimeType := upload.MimeType
 
-		query := "INSERT INTO uploads (id, url, fileType, createdAt, size, applicationId) VALUES (?, ?, ?, ?, ?, ?)"
+		if mimeType == "" {
+			mimeType = UploadMimeType(upload.FileType)
+		}
 
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		rows = append(rows, models.Upload{
+			Url:              upload.Url,
+			FileType:         upload.FileType,
+			Size:             upload.Size,
+			ApplicationId:    upload.ApplicationId,
+			UserId:           upload.UserId,
+			Status:           upload.Status,
+			MimeType:         mimeType,
+			OriginalFilename: upload.OriginalFilename,
+			ParentId:         upload.ParentId,
+			VariantKind:      upload.VariantKind,
+			Tags:             upload.Tags,
+			Metadata:         upload.Metadata,
+		})
+	}
 
-		defer cancel()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 
-		stmt, err := s.Db.PrepareContext(ctx, query)
+	defer cancel()
 
-		if err != nil {
-			return err
+	ids, err := s.Uploads.Insert(ctx, rows)
+
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Wrote %d new uploads to db", len(ids))
+
+	return ids, nil
+}
+
+// GetUpload returns an upload with its tags and metadata.
+func (s *MediaService) GetUpload(id string) (models.Upload, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	upload, err := s.Uploads.Get(ctx, id)
+
+	if err != nil {
+		return upload, err
+	}
+
+	uploads := []models.Upload{upload}
+
+	err = s.Uploads.LoadAnnotations(ctx, uploads)
+
+	return uploads[0], err
+}
+
+// ListUploads returns an application's uploads matching filter, newest
+// first, with their tags and metadata.
+func (s *MediaService) ListUploads(applicationId string, filter repositories.UploadFilter, limit int, offset int) ([]models.Upload, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	uploads, err := s.Uploads.List(ctx, applicationId, filter, limit, offset)
+
+	if err != nil {
+		return uploads, err
+	}
+
+	return uploads, s.Uploads.LoadAnnotations(ctx, uploads)
+}
+
+// ListUploadChildren returns the uploads derived from an upload, like its
+// renditions.
+func (s *MediaService) ListUploadChildren(parentId string) ([]models.Upload, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	return s.Uploads.ListChildren(ctx, parentId)
+}
+
+// SetUploadStatus moves an upload through its lifecycle, see
+// repositories.UploadRepository.SetStatus.
+func (s *MediaService) SetUploadStatus(uploadId string, status string) error {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	err := s.Uploads.SetStatus(ctx, uploadId, status)
+
+	if err != nil {
+		return fmt.Errorf("%w: upload %s to %s", err, uploadId, status)
+	}
+
+	log.Printf("Upload %s is %s", uploadId, status)
+
+	return nil
+}
+
+// SetUploadContent records the size and checksum of an upload's file.
+func (s *MediaService) SetUploadContent(uploadId string, size int64, checksum string) error {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	return s.Uploads.SetContent(ctx, uploadId, size, checksum)
+}
+
+// SetFocalPoint stores the focal point of an upload, nil clears it.
+func (s *MediaService) SetFocalPoint(uploadId string, focal *FocalPoint) error {
+
+	var x, y *float64
+
+	if focal != nil {
+		x, y = &focal.X, &focal.Y
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	return s.Uploads.SetFocalPoint(ctx, uploadId, x, y)
+}
+
+// SetPoster makes url the canonical poster of a video upload.
+func (s *MediaService) SetPoster(uploadId string, url string) error {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	return s.Uploads.SetPoster(ctx, uploadId, url)
+}
+
+func (s *MediaService) FindUploadIdByUrl(url string) (string, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	return s.Uploads.FindIdByUrl(ctx, url)
+}
+
+func (s *MediaService) GetVariant(id string) (models.UploadVariant, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	return s.Variants.Get(ctx, id)
+}
+
+// ListVariants returns the upload's variants of one kind, all kinds when kind is empty.
+func (s *MediaService) ListVariants(uploadId string, kind string) ([]models.UploadVariant, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	return s.Variants.List(ctx, uploadId, kind)
+}
+
+func uploadVariants(variants []ResizedImageUrlAndSizeModel) []models.UploadVariant {
+
+	records := make([]models.UploadVariant, 0, len(variants))
+
+	for _, variant := range variants {
+		records = append(records, models.UploadVariant{
+			Name:   variant.Name,
+			Url:    variant.Url,
+			Width:  variant.Width,
+			Height: variant.Height,
+			Format: variant.Format,
+			Size:   variant.Size,
+		})
+	}
+
+	return records
+}
+
+// WriteVariantsToDB records files derived from an upload, e.g. resized images.
+func (s *MediaService) WriteVariantsToDB(uploadId string, kind string, variants []ResizedImageUrlAndSizeModel) error {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	err := s.Variants.Insert(ctx, uploadId, kind, uploadVariants(variants))
+
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Wrote %d %s variants for upload %s", len(variants), kind, uploadId)
+
+	return nil
+}
+
+// DeleteVariants removes the upload's variants of one kind with their files.
+func (s *MediaService) DeleteVariants(uploadId string, kind string) error {
+
+	variants, err := s.ListVariants(uploadId, kind)
+
+	if err != nil {
+		return err
+	}
+
+	err = s.DeleteVariantRows(uploadId, kind)
+
+	if err != nil {
+		return err
+	}
+
+	for _, variant := range variants {
+		if err := os.Remove(MediaPathFromUrl(variant.Url)); err != nil && !os.IsNotExist(err) {
+			log.Println(err)
 		}
+	}
 
-		defer stmt.Close()
+	return nil
+}
 
-		id := uuid.V4()
+// ReplaceVariants records variants as the upload's variants of one kind in
+// place of the current ones, whose files are removed unless the new variants
+// were written over them.
+func (s *MediaService) ReplaceVariants(uploadId string, kind string, variants []ResizedImageUrlAndSizeModel) error {
 
-		result, err := stmt.ExecContext(ctx, id, upload.Url, upload.FileType, time.Now().UnixMilli(), upload.Size, upload.ApplicationId)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 
-		if err != nil {
-			return err
+	defer cancel()
+
+	old, err := s.Variants.Replace(ctx, uploadId, kind, uploadVariants(variants))
+
+	if err != nil {
+		return err
+	}
+
+	kept := map[string]bool{}
+
+	for _, variant := range variants {
+		kept[variant.Url] = true
+	}
+
+	for _, variant := range old {
+		if kept[variant.Url] {
+			continue
+		}
+
+		if err := os.Remove(MediaPathFromUrl(variant.Url)); err != nil && !os.IsNotExist(err) {
+			log.Println(err)
 		}
+	}
+
+	return nil
+}
+
+// DeleteVariantRows forgets the upload's variants of one kind but leaves
+// their files, for outputs that were just regenerated in place.
+func (s *MediaService) DeleteVariantRows(uploadId string, kind string) error {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	return s.Variants.DeleteKind(ctx, uploadId, kind)
+}
+
+func (s *MediaService) DeleteVariantRow(id string) error {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 
-		log.Printf("Wrote new upload to db with result %v", result)
+	defer cancel()
 
+	return s.Variants.Delete(ctx, id)
+}
+
+func (s *MediaService) GetUploadMetadata(uploadId string) (map[string]string, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	return s.Metadata.Get(ctx, uploadId)
+}
+
+func (s *MediaService) DeleteUploadMetadata(uploadId string, names ...string) error {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	return s.Metadata.Delete(ctx, uploadId, names...)
+}
+
+func (s *MediaService) WriteUploadMetadata(uploadId string, metadata map[string]string) error {
+
+	if len(metadata) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	err := s.Metadata.Set(ctx, uploadId, metadata)
+
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Wrote %d metadata fields for upload %s", len(metadata), uploadId)
+
+	return nil
+}
+
+// GenerateImagePlaceholders computes the placeholders of a stored image and
+// saves them on the upload when uploadId is set.
+func (s *MediaService) GenerateImagePlaceholders(filePath string, uploadId string) (ImagePlaceholders, error) {
+
+	data, err := os.ReadFile(filePath)
+
+	if err != nil {
+		return ImagePlaceholders{}, err
+	}
+
+	img, _, err := DecodeImage(data)
+
+	if err != nil {
+		return ImagePlaceholders{}, err
 	}
 
-	log.Println("Wrote new uploads to db")
+	placeholders, err := ComputePlaceholders(img)
+
+	if err != nil {
+		return placeholders, err
+	}
+
+	if uploadId != "" {
+		err = s.WritePlaceholdersToDB(uploadId, placeholders)
+	}
+
+	return placeholders, err
+}
+
+func (s *MediaService) WritePlaceholdersToDB(uploadId string, placeholders ImagePlaceholders) error {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	err := s.Uploads.SetPlaceholders(ctx, uploadId, placeholders.BlurHash, placeholders.Lqip, placeholders.DominantColor, placeholders.AverageColor)
+
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Wrote placeholders for upload %s", uploadId)
 
 	return nil
 }
@@ -477,3 +923,105 @@ func (s *MediaService) WriteNewUploadsToDB(uploads []NewUploadModel) error {
 // 	return newUrl, nil
 
 // }
+
+// ApplicationIdForPath finds the application owning a media path, like
+// "media/<folder>/<file>", from where uploads are stored: the upload or
+// variant at the path, the upload "<path>_<suffix>" was rendered from, or the
+// upload whose derived files live in a directory of the path. It is empty
+// for files belonging to no upload.
+func (s *MediaService) ApplicationIdForPath(filePath string) (string, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	filePath = strings.TrimPrefix(filePath, "./")
+
+	candidates := []string{filePath}
+
+	if i := strings.LastIndex(filePath, "_"); i > strings.LastIndex(filePath, "/") && filepath.Ext(filePath[:i]) != "" {
+		candidates = append(candidates, filePath[:i])
+	}
+
+	for _, candidate := range candidates {
+
+		applicationId, err := s.Uploads.ApplicationIdForUrl(ctx, "https://kaykatjd.com/"+candidate)
+
+		if err != nil || applicationId != "" {
+			return applicationId, err
+		}
+	}
+
+	directories := strings.Split(filepath.Dir(filePath), "/")
+
+	// the leading "media" is no upload directory
+	for i := len(directories) - 1; i > 0; i-- {
+
+		applicationId, err := s.Uploads.ApplicationIdForFileId(ctx, directories[i])
+
+		if err != nil || applicationId != "" {
+			return applicationId, err
+		}
+	}
+
+	return "", nil
+}
+
+var (
+	ErrInvalidMediaPath = errors.New("invalid media path")
+	ErrMediaNotFound    = errors.New("media file not found")
+)
+
+// CleanMediaPath cleans a path under ./media sent by a client, rejecting
+// absolute paths and paths leaving ./media.
+func CleanMediaPath(filePath string) (string, error) {
+
+	cleaned := filepath.Clean(filePath)
+
+	if filePath == "" || cleaned == "." || filepath.IsAbs(cleaned) || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", ErrInvalidMediaPath
+	}
+
+	return cleaned, nil
+}
+
+// OwnedMediaUpload cleans a path under ./media sent by an application and
+// returns it with the id of the upload stored there, empty for files that
+// were never registered. Files of another application's uploads, or derived
+// from them, give ErrMediaNotFound.
+func (s *MediaService) OwnedMediaUpload(filePath string, applicationId string) (string, string, error) {
+
+	cleaned, err := CleanMediaPath(filePath)
+
+	if err != nil {
+		return "", "", err
+	}
+
+	uploadId, err := s.FindUploadIdByUrl(fmt.Sprintf("https://kaykatjd.com/media/%s", cleaned))
+
+	if err == nil {
+		upload, err := s.GetUpload(uploadId)
+
+		if err == sql.ErrNoRows || (err == nil && upload.ApplicationId != applicationId) {
+			return "", "", ErrMediaNotFound
+		}
+
+		return cleaned, uploadId, err
+	}
+
+	if err != sql.ErrNoRows {
+		return "", "", err
+	}
+
+	owner, err := s.ApplicationIdForPath("media/" + cleaned)
+
+	if err != nil {
+		return "", "", err
+	}
+
+	if owner != "" && owner != applicationId {
+		return "", "", ErrMediaNotFound
+	}
+
+	return cleaned, "", nil
+}
@@ -0,0 +1,448 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/golang-lru/v2"
+	"github.com/jdrew153/migrations"
+	"github.com/jdrew153/repositories"
+)
+
+// newTestMediaService returns a media service over a migrated SQLite
+// database, without Redis.
+func newTestMediaService(t *testing.T) *MediaService {
+
+	t.Helper()
+
+	s, _ := newTestMediaServiceDb(t)
+
+	return s
+}
+
+// newTestMediaServiceDb also returns the database, for tests checking rows
+// the service does not expose.
+func newTestMediaServiceDb(t *testing.T) (*MediaService, *sql.DB) {
+
+	t.Helper()
+
+	db, err := sql.Open(repositories.SQLiteDriver, "file:"+filepath.Join(t.TempDir(), "test.db")+"?_busy_timeout=5000")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { db.Close() })
+
+	migrator, err := migrations.NewMigrator(db, migrations.SQLite)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = migrator.Up(context.Background())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err := lru.New[string, []byte](100)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return NewMediaService(cache, nil, repositories.NewSQLite(db)), db
+}
+
+// chdirTemp runs the test in a temporary directory holding an empty ./media.
+func chdirTemp(t *testing.T) {
+
+	t.Helper()
+
+	wd, err := os.Getwd()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.Chdir(t.TempDir())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	os.MkdirAll("./media", os.ModePerm)
+}
+
+func TestWriteUploadMetadataUpserts(t *testing.T) {
+
+	s := newTestMediaService(t)
+
+	err := s.WriteUploadMetadata("upload", map[string]string{"camera": "X100", "iso": "200"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.WriteUploadMetadata("upload", map[string]string{"iso": "400"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metadata, err := s.GetUploadMetadata("upload")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(metadata) != 2 || metadata["camera"] != "X100" || metadata["iso"] != "400" {
+		t.Fatalf("metadata = %v", metadata)
+	}
+}
+
+func TestFindNearDuplicates(t *testing.T) {
+
+	s := newTestMediaService(t)
+
+	ids, err := s.WriteNewUploadsToDB([]NewUploadModel{
+		{Url: "https://kaykatjd.com/media/joshie_a.png", FileType: "png", Size: 10, ApplicationId: "app"},
+		{Url: "https://kaykatjd.com/media/joshie_b.png", FileType: "png", Size: 10, ApplicationId: "app"},
+		{Url: "https://kaykatjd.com/media/joshie_c.png", FileType: "png", Size: 10, ApplicationId: "app"},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// negative hashes use the sign bit, as stored pHashes do
+	hashes := []int64{-1, -1 ^ 0b11, 0}
+
+	for i, id := range ids {
+
+		err = s.WritePerceptualHashToDB(id, hashes[i], "")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	duplicates, err := s.FindNearDuplicates("app", -1, 5, ids[0])
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(duplicates) != 1 || duplicates[0].Upload.Id != ids[1] || duplicates[0].Distance != 2 {
+		t.Fatalf("duplicates = %+v", duplicates)
+	}
+}
+
+func TestReleaseBlobCountsReferences(t *testing.T) {
+
+	s, db := newTestMediaServiceDb(t)
+
+	_, err := db.Exec("INSERT INTO blobs (hash, size, refCount, createdAt) VALUES ('missing', 10, 2, 0)")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.ReleaseBlob("missing")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var refCount int
+
+	err = db.QueryRow("SELECT refCount FROM blobs WHERE hash = 'missing'").Scan(&refCount)
+
+	if err != nil || refCount != 1 {
+		t.Fatalf("refCount = %d, %v, want 1", refCount, err)
+	}
+
+	// the last release removes the row, the file is already gone
+	err = s.ReleaseBlob("missing")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.QueryRow("SELECT refCount FROM blobs WHERE hash = 'missing'").Scan(&refCount)
+
+	if err != sql.ErrNoRows {
+		t.Fatalf("blob row left after the last release: %v", err)
+	}
+}
+
+func TestDeleteUploadIsSoft(t *testing.T) {
+
+	s, db := newTestMediaServiceDb(t)
+
+	ids, err := s.WriteNewUploadsToDB([]NewUploadModel{
+		{Url: "https://kaykatjd.com/media/joshie_gone.png", FileType: "png", Size: 10, ApplicationId: "app", Status: repositories.UploadReady},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = s.WriteNewUploadsToDB([]NewUploadModel{
+		{Url: "https://kaykatjd.com/media/joshie_gone.png_small.png", FileType: "png", ApplicationId: "app", ParentId: ids[0], VariantKind: "rendition"},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upload, err := s.GetUpload(ids[0])
+
+	if err != nil || upload.MimeType != "image/png" {
+		t.Fatalf("MIME type not derived from the file type: %+v, %v", upload, err)
+	}
+
+	s.Cache.Add("./media/joshie_gone.png_small.png", []byte("cached"))
+
+	err = s.DeleteUpload(ids[0])
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Cache.Contains("./media/joshie_gone.png_small.png") {
+		t.Fatal("deleted rendition still served from the cache")
+	}
+
+	var statuses []string
+
+	rows, err := db.Query("SELECT status FROM uploads ORDER BY url")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+
+		var status string
+
+		if err := rows.Scan(&status); err != nil {
+			t.Fatal(err)
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	if len(statuses) != 2 || statuses[0] != repositories.UploadDeleted || statuses[1] != repositories.UploadDeleted {
+		t.Fatalf("statuses after delete = %v, want both rows kept as deleted", statuses)
+	}
+
+	err = s.DeleteUpload(ids[0])
+
+	if err != sql.ErrNoRows {
+		t.Fatalf("deleting twice = %v, want sql.ErrNoRows", err)
+	}
+}
+
+func TestStoreBlobSharesContent(t *testing.T) {
+
+	s := newTestMediaService(t)
+
+	// blobs live under ./media
+	chdirTemp(t)
+
+	ids, err := s.WriteNewUploadsToDB([]NewUploadModel{
+		{Url: "https://kaykatjd.com/media/joshie_a.txt", FileType: "txt", ApplicationId: "app"},
+		{Url: "https://kaykatjd.com/media/joshie_b.txt", FileType: "txt", ApplicationId: "app"},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var hashes []string
+
+	for i, name := range []string{"./media/joshie_a.txt", "./media/joshie_b.txt"} {
+
+		err = os.WriteFile(name, []byte("same content"), 0644)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		hash, err := s.StoreBlob(name, ids[i])
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		hashes = append(hashes, hash)
+	}
+
+	if hashes[0] != hashes[1] {
+		t.Fatalf("same content stored as %v", hashes)
+	}
+
+	var refCount int
+
+	refCount, err = s.Blobs.RefCount(context.Background(), hashes[0])
+
+	if err != nil || refCount != 2 {
+		t.Fatalf("refCount = %d, %v, want 2", refCount, err)
+	}
+
+	for _, name := range []string{"./media/joshie_a.txt", "./media/joshie_b.txt"} {
+
+		data, err := os.ReadFile(name)
+
+		if err != nil || string(data) != "same content" {
+			t.Fatalf("%s reads %q, %v", name, data, err)
+		}
+	}
+
+	if _, err := os.Stat("./media/joshie_b.txt.duplicate"); !os.IsNotExist(err) {
+		t.Fatalf("duplicate copy left behind: %v", err)
+	}
+	for range ids {
+		if err := s.ReleaseBlob(hashes[0]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if entries, err := os.ReadDir(filepath.Dir(blobPath(hashes[0]))); err != nil || len(entries) != 0 {
+		t.Fatalf("blob files left after the last release: %v, %v", entries, err)
+	}
+}
+
+func TestReplaceVariantsKeepsRewrittenFiles(t *testing.T) {
+
+	s := newTestMediaService(t)
+
+	chdirTemp(t)
+
+	variant := func(name string) ResizedImageUrlAndSizeModel {
+
+		os.WriteFile("./media/"+name, []byte(name), 0644)
+
+		return ResizedImageUrlAndSizeModel{Name: name, Url: "https://kaykatjd.com/media/" + name, Format: "jpeg"}
+	}
+
+	err := s.WriteVariantsToDB("upload", "poster-image", []ResizedImageUrlAndSizeModel{variant("small.jpeg"), variant("old.jpeg")})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.ReplaceVariants("upload", "poster-image", []ResizedImageUrlAndSizeModel{variant("small.jpeg"), variant("large.jpeg")})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	variants, err := s.ListVariants("upload", "poster-image")
+
+	if err != nil || len(variants) != 2 {
+		t.Fatalf("variants = %+v, %v", variants, err)
+	}
+
+	for name, exists := range map[string]bool{"small.jpeg": true, "large.jpeg": true, "old.jpeg": false} {
+		if _, err := os.Stat("./media/" + name); (err == nil) != exists {
+			t.Fatalf("%s exists = %v, want %v", name, err == nil, exists)
+		}
+	}
+}
+
+func TestApplicationIdForPath(t *testing.T) {
+
+	s := newTestMediaService(t)
+
+	ids, err := s.WriteNewUploadsToDB([]NewUploadModel{
+		{Url: "https://kaykatjd.com/media/clips/intro.mp4", FileType: "mp4", ApplicationId: "app"},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.WriteVariantsToDB(ids[0], "hls", []ResizedImageUrlAndSizeModel{{Name: "master", Url: "https://kaykatjd.com/media/elsewhere/master.m3u8"}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for path, want := range map[string]string{
+		"media/clips/intro.mp4":         "app",
+		"media/clips/intro.mp4_720.mp4": "app",
+		"media/intro/7200.ts":           "app",
+		"media/elsewhere/master.m3u8":   "app",
+		"media/clips/outro.mp4":         "",
+		"media/clips/intro_720.mp4":     "",
+		"media/other/intro.mp4_720.mp4": "",
+	} {
+		applicationId, err := s.ApplicationIdForPath(path)
+
+		if err != nil || applicationId != want {
+			t.Fatalf("ApplicationIdForPath(%s) = %q, %v, want %q", path, applicationId, err, want)
+		}
+	}
+}
+
+func TestCleanMediaPath(t *testing.T) {
+
+	for path, want := range map[string]string{
+		"joshie_a.png":            "joshie_a.png",
+		"avatars/./joshie_a.png":  "avatars/joshie_a.png",
+		"avatars/../joshie_a.png": "joshie_a.png",
+		"../secret":               "",
+		"avatars/../../secret":    "",
+		"/etc/passwd":             "",
+		"":                        "",
+		".":                       "",
+	} {
+		cleaned, err := CleanMediaPath(path)
+
+		if cleaned != want || (want == "") != (err != nil) {
+			t.Fatalf("CleanMediaPath(%q) = %q, %v, want %q", path, cleaned, err, want)
+		}
+	}
+}
+
+func TestOwnedMediaUpload(t *testing.T) {
+
+	s := newTestMediaService(t)
+
+	ids, err := s.WriteNewUploadsToDB([]NewUploadModel{
+		{Url: "https://kaykatjd.com/media/joshie_a.png", FileType: "png", ApplicationId: "app"},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, uploadId, err := s.OwnedMediaUpload("joshie_a.png", "app")
+
+	if err != nil || uploadId != ids[0] {
+		t.Fatalf("OwnedMediaUpload = %q, %v, want %q", uploadId, err, ids[0])
+	}
+
+	for _, path := range []string{"joshie_a.png", "joshie_a/720.m3u8"} {
+		if _, _, err := s.OwnedMediaUpload(path, "other"); !errors.Is(err, ErrMediaNotFound) {
+			t.Fatalf("OwnedMediaUpload(%s) of another application: %v, want ErrMediaNotFound", path, err)
+		}
+	}
+
+	_, uploadId, err = s.OwnedMediaUpload("unregistered.png", "other")
+
+	if err != nil || uploadId != "" {
+		t.Fatalf("OwnedMediaUpload of an unregistered file = %q, %v", uploadId, err)
+	}
+}
@@ -0,0 +1,189 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"regexp"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// HotlinkSetting is the application setting holding the HotlinkPolicy.
+const HotlinkSetting = "hotlinkProtection"
+
+// HotlinkPolicy is the "hotlinkProtection" application setting. When
+// enabled, media is only served to pages on the application origins.
+type HotlinkPolicy struct {
+	Enabled bool `json:"enabled"`
+	// AllowEmptyReferer serves requests carrying neither Referer nor Origin,
+	// like direct visits, apps and browsers hiding the referer.
+	AllowEmptyReferer bool `json:"allowEmptyReferer"`
+}
+
+// OriginPolicy is what an application allows browsers to do: call the API
+// from its origins and embed its media. Without origins every origin may
+// call the API.
+type OriginPolicy struct {
+	Origins []string      `json:"origins"`
+	Hotlink HotlinkPolicy `json:"hotlink"`
+}
+
+// AllowsOrigin reports whether a browser on origin may call the API.
+func (p OriginPolicy) AllowsOrigin(origin string) bool {
+
+	if len(p.Origins) == 0 || origin == "" {
+		return true
+	}
+
+	return MatchOrigin(p.Origins, origin)
+}
+
+// AllowsEmbedding reports whether a page may load the application media,
+// from its Origin header or else the origin of its Referer.
+func (p OriginPolicy) AllowsEmbedding(origin string, referer string) bool {
+
+	if !p.Hotlink.Enabled {
+		return true
+	}
+
+	if origin == "" && referer != "" {
+		origin = refererOrigin(referer)
+	}
+
+	if origin == "" || origin == "null" {
+		return p.Hotlink.AllowEmptyReferer
+	}
+
+	return MatchOrigin(p.Origins, origin)
+}
+
+// refererOrigin is the scheme and host of a Referer header.
+func refererOrigin(referer string) string {
+
+	parsed, err := url.Parse(referer)
+
+	if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+		return ""
+	}
+
+	return parsed.Scheme + "://" + parsed.Host
+}
+
+var originPattern = regexp.MustCompile(`^https?://(\*\.)?[A-Za-z0-9.-]+(:\d+)?$`)
+
+// ValidateOrigin accepts origins like "https://example.com",
+// "http://localhost:3000" and "https://*.example.com".
+func ValidateOrigin(origin string) error {
+
+	if !originPattern.MatchString(origin) {
+		return fmt.Errorf("invalid origin %s", origin)
+	}
+
+	return nil
+}
+
+// originPolicyCacheTtl bounds how long a configuration change takes to
+// apply, mediaApplicationCacheTtl how long uploads keep their application.
+const (
+	originPolicyCacheTtl     = 5 * time.Minute
+	mediaApplicationCacheTtl = 10 * time.Minute
+)
+
+type OriginService struct {
+	Redis    *redis.Client
+	Sploader *SploaderService
+	Media    *MediaService
+}
+
+func NewOriginService(r *redis.Client, sploader *SploaderService, media *MediaService) *OriginService {
+	return &OriginService{
+		Redis:    r,
+		Sploader: sploader,
+		Media:    media,
+	}
+}
+
+func originPolicyKey(applicationId string) string {
+	return fmt.Sprintf("originpolicy:%s", applicationId)
+}
+
+// Policy returns the origin policy of an application, cached in Redis since
+// media requests and every API call need it.
+func (s *OriginService) Policy(applicationId string) (OriginPolicy, error) {
+
+	var policy OriginPolicy
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cached, err := s.Redis.Get(ctx, originPolicyKey(applicationId)).Result()
+
+	if err == nil && json.Unmarshal([]byte(cached), &policy) == nil {
+		return policy, nil
+	}
+
+	policy.Origins, err = s.Sploader.ApplicationOrigins(applicationId)
+
+	if err != nil {
+		return policy, err
+	}
+
+	_, err = s.Sploader.GetApplicationSetting(applicationId, HotlinkSetting, &policy.Hotlink)
+
+	if err != nil {
+		return policy, err
+	}
+
+	data, err := json.Marshal(policy)
+
+	if err == nil {
+		s.Redis.Set(ctx, originPolicyKey(applicationId), data, originPolicyCacheTtl)
+	}
+
+	return policy, nil
+}
+
+// InvalidatePolicy drops the cached policy after a configuration change.
+func (s *OriginService) InvalidatePolicy(applicationId string) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := s.Redis.Del(ctx, originPolicyKey(applicationId)).Err()
+
+	if err != nil {
+		log.Println("Error invalidating origin policy:", err)
+	}
+}
+
+// MediaApplicationId returns the application owning a served media path,
+// empty for files not belonging to an upload. Only paths of uploads are
+// cached, a request for any other path cannot grow the cache and a file
+// uploaded later is not taken for unowned meanwhile.
+func (s *OriginService) MediaApplicationId(filePath string) (string, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cacheKey := fmt.Sprintf("mediaapp:%s", filePath)
+
+	applicationId, err := s.Redis.Get(ctx, cacheKey).Result()
+
+	if err == nil {
+		return applicationId, nil
+	}
+
+	applicationId, err = s.Media.ApplicationIdForPath(filePath)
+
+	if err != nil || applicationId == "" {
+		return applicationId, err
+	}
+
+	s.Redis.Set(ctx, cacheKey, applicationId, mediaApplicationCacheTtl)
+
+	return applicationId, nil
+}
@@ -0,0 +1,130 @@
+package services
+
+import "testing"
+
+func TestMatchOrigin(t *testing.T) {
+
+	tests := []struct {
+		allowed []string
+		origin  string
+		matches bool
+	}{
+		{[]string{"https://example.com"}, "https://example.com", true},
+		{[]string{"https://Example.com"}, "https://example.COM", true},
+		{[]string{"https://example.com"}, "http://example.com", false},
+		{[]string{"https://example.com"}, "https://example.com:8443", false},
+		{[]string{"*"}, "https://anything.test", true},
+		{[]string{"https://*.example.com"}, "https://cdn.example.com", true},
+		{[]string{"https://*.example.com"}, "https://a.b.EXAMPLE.com", true},
+		{[]string{"https://*.example.com"}, "https://example.com", false},
+		{[]string{"https://*.example.com"}, "https://evilexample.com", false},
+		{[]string{"https://*.example.com"}, "http://cdn.example.com", false},
+		{[]string{"https://other.com", "https://example.com"}, "https://example.com", true},
+		{nil, "https://example.com", false},
+	}
+
+	for _, test := range tests {
+		if matches := MatchOrigin(test.allowed, test.origin); matches != test.matches {
+			t.Errorf("MatchOrigin(%q, %q) = %v, want %v", test.allowed, test.origin, matches, test.matches)
+		}
+	}
+}
+
+func TestOriginPolicyAllowsOrigin(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		origins []string
+		origin  string
+		allows  bool
+	}{
+		{"no origins configured", nil, "https://anything.test", true},
+		{"no origin header", []string{"https://example.com"}, "", true},
+		{"listed origin", []string{"https://example.com"}, "https://example.com", true},
+		{"other origin", []string{"https://example.com"}, "https://other.com", false},
+	}
+
+	for _, test := range tests {
+		if allows := (OriginPolicy{Origins: test.origins}).AllowsOrigin(test.origin); allows != test.allows {
+			t.Errorf("%s: AllowsOrigin(%q) = %v, want %v", test.name, test.origin, allows, test.allows)
+		}
+	}
+}
+
+func TestOriginPolicyAllowsEmbedding(t *testing.T) {
+
+	origins := []string{"https://example.com", "https://*.example.net"}
+
+	tests := []struct {
+		name    string
+		hotlink HotlinkPolicy
+		origin  string
+		referer string
+		allows  bool
+	}{
+		{"protection disabled", HotlinkPolicy{}, "https://other.com", "", true},
+		{"listed origin", HotlinkPolicy{Enabled: true}, "https://example.com", "", true},
+		{"other origin", HotlinkPolicy{Enabled: true}, "https://other.com", "", false},
+		{"origin wins over referer", HotlinkPolicy{Enabled: true}, "https://other.com", "https://example.com/page", false},
+		{"listed referer", HotlinkPolicy{Enabled: true}, "", "https://cdn.example.net/a/page?x=1", true},
+		{"other referer", HotlinkPolicy{Enabled: true}, "", "https://other.com/page", false},
+		{"empty referer denied", HotlinkPolicy{Enabled: true}, "", "", false},
+		{"empty referer allowed", HotlinkPolicy{Enabled: true, AllowEmptyReferer: true}, "", "", true},
+		{"null origin", HotlinkPolicy{Enabled: true, AllowEmptyReferer: true}, "null", "", true},
+		{"unparsable referer", HotlinkPolicy{Enabled: true}, "", "not a url", false},
+	}
+
+	for _, test := range tests {
+
+		policy := OriginPolicy{Origins: origins, Hotlink: test.hotlink}
+
+		if allows := policy.AllowsEmbedding(test.origin, test.referer); allows != test.allows {
+			t.Errorf("%s: AllowsEmbedding(%q, %q) = %v, want %v", test.name, test.origin, test.referer, allows, test.allows)
+		}
+	}
+}
+
+func TestRefererOrigin(t *testing.T) {
+
+	tests := []struct {
+		referer string
+		origin  string
+	}{
+		{"https://example.com/page?q=1#top", "https://example.com"},
+		{"http://localhost:3000/", "http://localhost:3000"},
+		{"/relative/page", ""},
+		{"example.com/page", ""},
+		{"%zz", ""},
+	}
+
+	for _, test := range tests {
+		if origin := refererOrigin(test.referer); origin != test.origin {
+			t.Errorf("refererOrigin(%q) = %q, want %q", test.referer, origin, test.origin)
+		}
+	}
+}
+
+func TestValidateOrigin(t *testing.T) {
+
+	tests := []struct {
+		origin string
+		valid  bool
+	}{
+		{"https://example.com", true},
+		{"http://localhost:3000", true},
+		{"https://*.example.com", true},
+		{"ftp://example.com", false},
+		{"https://example.com/", false},
+		{"https://example.com/path", false},
+		{"https://*example.com", false},
+		{"https://a.*.example.com", false},
+		{"example.com", false},
+		{"*", false},
+	}
+
+	for _, test := range tests {
+		if err := ValidateOrigin(test.origin); (err == nil) != test.valid {
+			t.Errorf("ValidateOrigin(%q) = %v, want valid %v", test.origin, err, test.valid)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package services
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/jpeg"
+
+	"github.com/buckket/go-blurhash"
+	"github.com/nfnt/resize"
+)
+
+// ImagePlaceholders are shown by clients while the real image loads.
+type ImagePlaceholders struct {
+	BlurHash      string `json:"blurHash"`
+	Lqip          string `json:"lqip"`
+	DominantColor string `json:"dominantColor"`
+	AverageColor  string `json:"averageColor"`
+}
+
+// ComputePlaceholders derives a BlurHash, a tiny base64 JPEG data URI and
+// the dominant and average colors of img.
+func ComputePlaceholders(img image.Image) (ImagePlaceholders, error) {
+
+	var placeholders ImagePlaceholders
+
+	// everything below works on a small copy, the full image adds nothing
+	small := resize.Thumbnail(64, 64, img, resize.Bilinear)
+
+	hash, err := blurhash.Encode(4, 3, small)
+
+	if err != nil {
+		return placeholders, err
+	}
+
+	placeholders.BlurHash = hash
+
+	tiny := resize.Thumbnail(16, 16, img, resize.Bilinear)
+
+	out := bytes.Buffer{}
+
+	err = jpeg.Encode(&out, tiny, &jpeg.Options{Quality: 40})
+
+	if err != nil {
+		return placeholders, err
+	}
+
+	placeholders.Lqip = "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(out.Bytes())
+
+	placeholders.DominantColor, placeholders.AverageColor = imageColors(small)
+
+	return placeholders, nil
+}
+
+// imageColors returns the dominant and average colors as hex strings.
+// Transparent pixels are ignored and the dominant color is the mean of the
+// most common 4-bit-per-channel bucket.
+func imageColors(img image.Image) (string, string) {
+
+	type bucket struct {
+		count   int
+		r, g, b int
+	}
+
+	buckets := map[int]*bucket{}
+
+	var total, sumR, sumG, sumB int
+
+	bounds := img.Bounds()
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+
+			r, g, b, a := img.At(x, y).RGBA()
+
+			if a == 0 {
+				continue
+			}
+
+			// un-premultiply and scale to 8 bits
+			r8 := int(r * 0xff / a)
+			g8 := int(g * 0xff / a)
+			b8 := int(b * 0xff / a)
+
+			total++
+			sumR += r8
+			sumG += g8
+			sumB += b8
+
+			key := (r8>>4)<<8 | (g8>>4)<<4 | b8>>4
+
+			if buckets[key] == nil {
+				buckets[key] = &bucket{}
+			}
+
+			buckets[key].count++
+			buckets[key].r += r8
+			buckets[key].g += g8
+			buckets[key].b += b8
+		}
+	}
+
+	if total == 0 {
+		return "", ""
+	}
+
+	var dominant *bucket
+	dominantKey := 0
+
+	for key, candidate := range buckets {
+		if dominant == nil || candidate.count > dominant.count || (candidate.count == dominant.count && key < dominantKey) {
+			dominant = candidate
+			dominantKey = key
+		}
+	}
+
+	dominantColor := fmt.Sprintf("#%02x%02x%02x", dominant.r/dominant.count, dominant.g/dominant.count, dominant.b/dominant.count)
+	averageColor := fmt.Sprintf("#%02x%02x%02x", sumR/total, sumG/total, sumB/total)
+
+	return dominantColor, averageColor
+}
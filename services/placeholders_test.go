@@ -0,0 +1,121 @@
+package services
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"strings"
+	"testing"
+
+	"github.com/buckket/go-blurhash"
+)
+
+// filledImage is a 4x4 image whose pixels after the first count of each
+// color take the next color.
+func filledImage(colors []color.NRGBA, counts []int) image.Image {
+
+	img := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+
+	pixel := 0
+
+	for i, c := range colors {
+		for n := 0; n < counts[i]; n++ {
+			img.SetNRGBA(pixel%4, pixel/4, c)
+			pixel++
+		}
+	}
+
+	return img
+}
+
+func TestImageColors(t *testing.T) {
+
+	red := color.NRGBA{R: 255, A: 255}
+	blue := color.NRGBA{B: 255, A: 255}
+	clear := color.NRGBA{R: 255, G: 255, B: 255}
+
+	tests := []struct {
+		name     string
+		colors   []color.NRGBA
+		counts   []int
+		dominant string
+		average  string
+	}{
+		{"solid", []color.NRGBA{red}, []int{16}, "#ff0000", "#ff0000"},
+		{"mostly red", []color.NRGBA{red, blue}, []int{12, 4}, "#ff0000", "#bf003f"},
+		{"tie takes the lower bucket", []color.NRGBA{red, blue}, []int{8, 8}, "#0000ff", "#7f007f"},
+		{"transparent pixels ignored", []color.NRGBA{blue, clear}, []int{2, 14}, "#0000ff", "#0000ff"},
+		{"half transparent pixels unpremultiplied", []color.NRGBA{{G: 255, A: 128}}, []int{16}, "#00ff00", "#00ff00"},
+		{"fully transparent", []color.NRGBA{clear}, []int{16}, "", ""},
+	}
+
+	for _, test := range tests {
+
+		dominant, average := imageColors(filledImage(test.colors, test.counts))
+
+		if dominant != test.dominant || average != test.average {
+			t.Errorf("%s: colors %q and %q, want %q and %q", test.name, dominant, average, test.dominant, test.average)
+		}
+	}
+}
+
+func TestComputePlaceholders(t *testing.T) {
+
+	img := image.NewNRGBA(image.Rect(0, 0, 200, 100))
+
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 200; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{R: 30, G: 120, B: 200, A: 255})
+		}
+	}
+
+	placeholders, err := ComputePlaceholders(img)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 4x3 components: one character each for the size flag and the quantized
+	// maximum, four for the DC value, then two per AC component
+	if len(placeholders.BlurHash) != 6+2*11 {
+		t.Errorf("BlurHash %q has %d characters, want 28", placeholders.BlurHash, len(placeholders.BlurHash))
+	}
+
+	decoded, err := blurhash.Decode(placeholders.BlurHash, 4, 3, 1)
+
+	if err != nil {
+		t.Fatalf("BlurHash %q does not decode: %v", placeholders.BlurHash, err)
+	}
+
+	if r, g, b, _ := decoded.At(2, 1).RGBA(); r>>8 > 40 || g>>8 < 110 || b>>8 < 190 {
+		t.Errorf("BlurHash decodes to %d, %d, %d", r>>8, g>>8, b>>8)
+	}
+
+	data, ok := strings.CutPrefix(placeholders.Lqip, "data:image/jpeg;base64,")
+
+	if !ok {
+		t.Fatalf("LQIP %q is no JPEG data URI", placeholders.Lqip)
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(data)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lqip, err := jpeg.Decode(bytes.NewReader(raw))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if lqip.Bounds().Dx() != 16 || lqip.Bounds().Dy() != 8 {
+		t.Errorf("LQIP is %v, want 16x8", lqip.Bounds().Size())
+	}
+
+	if placeholders.DominantColor != "#1e78c8" || placeholders.AverageColor != "#1e78c8" {
+		t.Errorf("colors %q and %q, want #1e78c8", placeholders.DominantColor, placeholders.AverageColor)
+	}
+}
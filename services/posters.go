@@ -0,0 +1,236 @@
+package services
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"image"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/nfnt/resize"
+)
+
+// DefaultPosterOffsets are the positions, in percent of the duration, at
+// which poster candidates are taken.
+var DefaultPosterOffsets = []float64{10, 25, 50, 75, 90}
+
+// darkFrameLuma is the mean luma, 0-1, below which a candidate counts as a
+// black or fade frame.
+const darkFrameLuma = 0.08
+
+// mediaFileId returns the file id of a source under ./media, which is also
+// the directory holding its derived files.
+func mediaFileId(inputPath string) string {
+	return strings.TrimSuffix(filepath.Base(inputPath), filepath.Ext(inputPath))
+}
+
+// uploadIdForPath finds the upload row of a source under ./media, an empty id
+// when the file was never registered.
+func (s *TranscoderService) uploadIdForPath(inputPath string) (string, error) {
+
+	uploadUrl := fmt.Sprintf("https://kaykatjd.com/media/%s", strings.TrimPrefix(inputPath, "./media/"))
+
+	uploadId, err := s.Media.FindUploadIdByUrl(uploadUrl)
+
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+
+	return uploadId, err
+}
+
+// ProbeDuration returns the duration of a media file in seconds.
+func ProbeDuration(inputPath string) (float64, error) {
+
+	cmd := exec.Command("ffprobe", "-v", "error",
+		"-show_entries", "format=duration",
+		"-of", "default=noprint_wrappers=1:nokey=1",
+		inputPath)
+
+	out, err := cmd.Output()
+
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+}
+
+// meanLuma returns the average luma of img between 0 and 1.
+func meanLuma(img image.Image) float64 {
+
+	small := resize.Thumbnail(64, 64, img, resize.Bilinear)
+	bounds := small.Bounds()
+
+	total := 0.0
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, _ := small.At(x, y).RGBA()
+			total += (0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)) / 0xffff
+		}
+	}
+
+	return total / float64(bounds.Dx()*bounds.Dy())
+}
+
+// extractPosterFrame writes the most representative frame of the few seconds
+// following offset, ffmpeg's thumbnail filter skips transitions and flashes.
+func extractPosterFrame(inputPath string, offset float64, outputPath string) error {
+
+	cmd := exec.Command("ffmpeg", "-y",
+		"-ss", strconv.FormatFloat(offset, 'f', 3, 64),
+		"-i", inputPath,
+		"-vf", "thumbnail=30",
+		"-frames:v", "1",
+		outputPath)
+
+	stderr := bytes.Buffer{}
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+
+	if err != nil {
+		return fmt.Errorf("ffmpeg: %v: %s", err, stderr.String())
+	}
+
+	return nil
+}
+
+// GeneratePosterCandidates grabs a poster frame at every offset of the
+// video, drops dark frames unless they are all dark, and records the rest as
+// "poster" variants when the upload is known. The first candidate is the
+// suggested canonical poster.
+func (s *TranscoderService) GeneratePosterCandidates(inputPath string, uploadId string, offsets []float64) ([]ResizedImageUrlAndSizeModel, error) {
+
+	if len(offsets) == 0 {
+		offsets = DefaultPosterOffsets
+	}
+
+	for _, offset := range offsets {
+		if offset < 0 || offset > 100 {
+			return nil, fmt.Errorf("poster offset %v is not a percentage", offset)
+		}
+	}
+
+	duration, err := ProbeDuration(inputPath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	fileId := mediaFileId(inputPath)
+
+	posterDir := fmt.Sprintf("./media/%s", fileId)
+
+	err = os.MkdirAll(posterDir, 0755)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var bright, dark []ResizedImageUrlAndSizeModel
+
+	for _, offset := range offsets {
+
+		name := fmt.Sprintf("poster-%s", strconv.FormatFloat(offset, 'f', -1, 64))
+		posterPath := fmt.Sprintf("%s/%s.jpg", posterDir, name)
+
+		err = extractPosterFrame(inputPath, duration*offset/100, posterPath)
+
+		if err != nil {
+			log.Println("Error extracting poster frame:", err)
+			continue
+		}
+
+		data, err := os.ReadFile(posterPath)
+
+		if err != nil {
+			return nil, err
+		}
+
+		img, _, err := DecodeImage(data)
+
+		if err != nil {
+			return nil, err
+		}
+
+		candidate := ResizedImageUrlAndSizeModel{
+			Name:   name,
+			Url:    fmt.Sprintf("https://kaykatjd.com/media/%s/%s.jpg", fileId, name),
+			Size:   int64(len(data)),
+			Width:  img.Bounds().Dx(),
+			Height: img.Bounds().Dy(),
+			Format: "jpeg",
+		}
+
+		if meanLuma(img) < darkFrameLuma {
+			log.Printf("Poster candidate %s of %s is too dark", name, inputPath)
+			dark = append(dark, candidate)
+			continue
+		}
+
+		bright = append(bright, candidate)
+	}
+
+	// nothing but dark frames, better some poster than none
+	candidates := dark
+
+	if len(bright) > 0 {
+		candidates = bright
+
+		for _, candidate := range dark {
+			os.Remove(MediaPathFromUrl(candidate.Url))
+		}
+	}
+
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no poster frame could be extracted from %s", inputPath)
+	}
+
+	if uploadId != "" {
+		err = s.Media.WriteVariantsToDB(uploadId, "poster", candidates)
+
+		if err != nil {
+			return candidates, err
+		}
+	}
+
+	return candidates, nil
+}
+
+// GeneratePosters creates the poster candidates of a transcoded video and
+// makes the first one the canonical poster, with its placeholders.
+func (s *TranscoderService) GeneratePosters(inputPath string, offsets []float64) error {
+
+	uploadId, err := s.uploadIdForPath(inputPath)
+
+	if err != nil {
+		return err
+	}
+
+	candidates, err := s.GeneratePosterCandidates(inputPath, uploadId, offsets)
+
+	if err != nil {
+		return err
+	}
+
+	if uploadId == "" {
+		return nil
+	}
+
+	err = s.Media.SetPoster(uploadId, candidates[0].Url)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = s.Media.GenerateImagePlaceholders(MediaPathFromUrl(candidates[0].Url), uploadId)
+
+	return err
+}
@@ -0,0 +1,237 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// PreviewSegment is one piece of a preview clip, Start is a percentage of
+// the source duration and Duration is in seconds.
+type PreviewSegment struct {
+	Start    float64 `json:"start"`
+	Duration float64 `json:"duration"`
+}
+
+// PreviewOptions configure the muted looping preview of a video. Fps only
+// applies to the animated WebP, the MP4 keeps the source frame rate.
+type PreviewOptions struct {
+	Segments []PreviewSegment `json:"segments"`
+	Width    int              `json:"width"`
+	Fps      int              `json:"fps"`
+}
+
+var DefaultPreviewSegments = []PreviewSegment{
+	{Start: 20, Duration: 1.5},
+	{Start: 50, Duration: 1.5},
+	{Start: 80, Duration: 1.5},
+}
+
+const (
+	defaultPreviewWidth = 480
+	defaultPreviewFps   = 12
+	maxPreviewDuration  = 15
+)
+
+func (o PreviewOptions) Validate() error {
+
+	total := 0.0
+
+	for _, segment := range o.Segments {
+		if segment.Start < 0 || segment.Start > 100 {
+			return fmt.Errorf("preview segment start %v is not a percentage", segment.Start)
+		}
+
+		if segment.Duration <= 0 {
+			return fmt.Errorf("preview segment duration must be positive")
+		}
+
+		total += segment.Duration
+	}
+
+	if total > maxPreviewDuration {
+		return fmt.Errorf("preview must not be longer than %d seconds", maxPreviewDuration)
+	}
+
+	if o.Width < 0 || o.Width > 1920 {
+		return fmt.Errorf("preview width must be between 1 and 1920")
+	}
+
+	if o.Fps < 0 || o.Fps > 30 {
+		return fmt.Errorf("preview fps must be between 1 and 30")
+	}
+
+	return nil
+}
+
+func (o PreviewOptions) withDefaults() PreviewOptions {
+
+	if len(o.Segments) == 0 {
+		o.Segments = DefaultPreviewSegments
+	}
+
+	if o.Width == 0 {
+		o.Width = defaultPreviewWidth
+	}
+
+	if o.Fps == 0 {
+		o.Fps = defaultPreviewFps
+	}
+
+	return o
+}
+
+// ProbeDimensions returns the width and height of the first video stream.
+func ProbeDimensions(inputPath string) (int, int, error) {
+
+	cmd := exec.Command("ffprobe", "-v", "error",
+		"-select_streams", "v:0",
+		"-show_entries", "stream=width,height",
+		"-of", "csv=s=x:p=0",
+		inputPath)
+
+	out, err := cmd.Output()
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var width, height int
+
+	_, err = fmt.Sscanf(strings.TrimSpace(string(out)), "%dx%d", &width, &height)
+
+	return width, height, err
+}
+
+// previewArgs builds a single ffmpeg run cutting every segment with input
+// seeking, concatenating them and writing both the MP4 and the WebP.
+func previewArgs(inputPath string, duration float64, options PreviewOptions, mp4Path string, webpPath string) []string {
+
+	args := []string{"-y"}
+
+	var filter strings.Builder
+
+	for i, segment := range options.Segments {
+
+		start := duration * segment.Start / 100
+
+		// keep the segment inside the video
+		if start+segment.Duration > duration {
+			start = duration - segment.Duration
+		}
+
+		if start < 0 {
+			start = 0
+		}
+
+		args = append(args,
+			"-ss", strconv.FormatFloat(start, 'f', 3, 64),
+			"-t", strconv.FormatFloat(segment.Duration, 'f', 3, 64),
+			"-i", inputPath)
+
+		fmt.Fprintf(&filter, "[%d:v]scale=%d:-2,setsar=1,setpts=PTS-STARTPTS[s%d];", i, options.Width, i)
+	}
+
+	for i := range options.Segments {
+		fmt.Fprintf(&filter, "[s%d]", i)
+	}
+
+	fmt.Fprintf(&filter, "concat=n=%d:v=1:a=0,split=2[mp4][anim];[anim]fps=%d[webp]", len(options.Segments), options.Fps)
+
+	args = append(args, "-filter_complex", filter.String(),
+		"-map", "[mp4]", "-an", "-c:v", "libx264", "-pix_fmt", "yuv420p", "-preset", "veryfast", "-crf", "28", "-movflags", "+faststart", mp4Path,
+		"-map", "[webp]", "-an", "-c:v", "libwebp", "-loop", "0", "-q:v", "60", webpPath)
+
+	return args
+}
+
+// GeneratePreview writes a muted looping preview of the video as MP4 and
+// animated WebP next to its other renditions and records both as "preview"
+// variants of the upload.
+func (s *TranscoderService) GeneratePreview(inputPath string, options PreviewOptions) ([]ResizedImageUrlAndSizeModel, error) {
+
+	err := options.Validate()
+
+	if err != nil {
+		return nil, err
+	}
+
+	options = options.withDefaults()
+
+	duration, err := ProbeDuration(inputPath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	fileId := mediaFileId(inputPath)
+
+	previewDir := fmt.Sprintf("./media/%s", fileId)
+
+	err = os.MkdirAll(previewDir, 0755)
+
+	if err != nil {
+		return nil, err
+	}
+
+	mp4Path := fmt.Sprintf("%s/preview.mp4", previewDir)
+	webpPath := fmt.Sprintf("%s/preview.webp", previewDir)
+
+	cmd := exec.Command("ffmpeg", previewArgs(inputPath, duration, options, mp4Path, webpPath)...)
+
+	stderr := bytes.Buffer{}
+	cmd.Stderr = &stderr
+
+	err = cmd.Run()
+
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg: %v: %s", err, stderr.String())
+	}
+
+	width, height, err := ProbeDimensions(mp4Path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var previews []ResizedImageUrlAndSizeModel
+
+	for _, format := range []string{"mp4", "webp"} {
+
+		info, err := os.Stat(fmt.Sprintf("%s/preview.%s", previewDir, format))
+
+		if err != nil {
+			return nil, err
+		}
+
+		previews = append(previews, ResizedImageUrlAndSizeModel{
+			Name:   "preview-" + format,
+			Url:    fmt.Sprintf("https://kaykatjd.com/media/%s/preview.%s", fileId, format),
+			Size:   info.Size(),
+			Width:  width,
+			Height: height,
+			Format: format,
+		})
+	}
+
+	log.Printf("Created preview clips for %s", inputPath)
+
+	uploadId, err := s.uploadIdForPath(inputPath)
+
+	if err != nil || uploadId == "" {
+		return previews, err
+	}
+
+	// a re-run replaces the previous preview rather than adding to it
+	err = s.Media.DeleteVariantRows(uploadId, "preview")
+
+	if err != nil {
+		return previews, err
+	}
+
+	return previews, s.Media.WriteVariantsToDB(uploadId, "preview", previews)
+}
@@ -0,0 +1,287 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/savsgio/gotils/uuid"
+)
+
+// Endpoint classes share a rate limit, each route belongs to one.
+const (
+	RateClassTranscode = "transcode"
+	RateClassImage     = "image"
+	RateClassUpload    = "upload"
+	RateClassRead      = "read"
+	RateClassAdmin     = "admin"
+)
+
+// DefaultSubscriptionType is used for applications whose subscription is
+// unknown or has no limits of its own.
+const DefaultSubscriptionType = "free"
+
+// RateLimit allows Requests per sliding Window, counted for each API key and
+// again, with ApplicationRequests, for all keys of the application.
+type RateLimit struct {
+	Requests            int
+	ApplicationRequests int
+	Window              time.Duration
+}
+
+// RateLimits are the limits of every endpoint class per subscription type.
+var RateLimits = map[string]map[string]RateLimit{
+	"free": {
+		RateClassTranscode: {Requests: 10, ApplicationRequests: 20, Window: time.Minute},
+		RateClassImage:     {Requests: 60, ApplicationRequests: 120, Window: time.Minute},
+		RateClassUpload:    {Requests: 600, ApplicationRequests: 1200, Window: time.Minute},
+		RateClassRead:      {Requests: 300, ApplicationRequests: 600, Window: time.Minute},
+		RateClassAdmin:     {Requests: 30, ApplicationRequests: 30, Window: time.Minute},
+	},
+	"pro": {
+		RateClassTranscode: {Requests: 60, ApplicationRequests: 120, Window: time.Minute},
+		RateClassImage:     {Requests: 300, ApplicationRequests: 600, Window: time.Minute},
+		RateClassUpload:    {Requests: 3000, ApplicationRequests: 6000, Window: time.Minute},
+		RateClassRead:      {Requests: 1200, ApplicationRequests: 2400, Window: time.Minute},
+		RateClassAdmin:     {Requests: 60, ApplicationRequests: 60, Window: time.Minute},
+	},
+	"enterprise": {
+		RateClassTranscode: {Requests: 300, ApplicationRequests: 1200, Window: time.Minute},
+		RateClassImage:     {Requests: 1200, ApplicationRequests: 4800, Window: time.Minute},
+		RateClassUpload:    {Requests: 12000, ApplicationRequests: 48000, Window: time.Minute},
+		RateClassRead:      {Requests: 6000, ApplicationRequests: 24000, Window: time.Minute},
+		RateClassAdmin:     {Requests: 120, ApplicationRequests: 120, Window: time.Minute},
+	},
+}
+
+// subscriptionCacheTtl bounds how long a subscription change takes to
+// affect the limits.
+const subscriptionCacheTtl = 5 * time.Minute
+
+// slidingWindowScript keeps the request times of each window in a sorted
+// set, one key per window with its limit in ARGV[3 + i]. It drops the
+// expired times and admits the request into every window, or none of them,
+// when all are below their limit. It returns whether it was admitted, then
+// the count and the oldest request time of each window.
+var slidingWindowScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local member = ARGV[3]
+
+local allowed = 1
+local counts = {}
+
+for i, key in ipairs(KEYS) do
+	redis.call("ZREMRANGEBYSCORE", key, "-inf", now - window)
+
+	counts[i] = redis.call("ZCARD", key)
+
+	if counts[i] >= tonumber(ARGV[3 + i]) then
+		allowed = 0
+	end
+end
+
+local result = {allowed}
+
+for i, key in ipairs(KEYS) do
+	if allowed == 1 then
+		redis.call("ZADD", key, now, member)
+		counts[i] = counts[i] + 1
+	end
+
+	redis.call("PEXPIRE", key, window)
+
+	local oldest = redis.call("ZRANGE", key, 0, 0, "WITHSCORES")[2] or now
+
+	table.insert(result, counts[i])
+	table.insert(result, tonumber(oldest))
+end
+
+return result
+`)
+
+// RateLimitResult describes the most constrained window a request counted
+// against, for the RateLimit-* headers.
+type RateLimitResult struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	Window    time.Duration
+	// Reset is when the oldest request leaves the window.
+	Reset time.Duration
+}
+
+type RateLimiter struct {
+	Redis    *redis.Client
+	Sploader *SploaderService
+}
+
+func NewRateLimiter(r *redis.Client, sploader *SploaderService) *RateLimiter {
+	return &RateLimiter{
+		Redis:    r,
+		Sploader: sploader,
+	}
+}
+
+// SubscriptionType returns the subscription of an application, cached in
+// Redis since every request needs it.
+func (l *RateLimiter) SubscriptionType(applicationId string) (string, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cacheKey := fmt.Sprintf("subscription:%s", applicationId)
+
+	subscriptionType, err := l.Redis.Get(ctx, cacheKey).Result()
+
+	if err == nil {
+		return subscriptionType, nil
+	}
+
+	if err != redis.Nil {
+		return "", err
+	}
+
+	subscriptionType, err = l.Sploader.DetermineApplicationType(applicationId)
+
+	if err == sql.ErrNoRows {
+		subscriptionType, err = DefaultSubscriptionType, nil
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	l.Redis.Set(ctx, cacheKey, subscriptionType, subscriptionCacheTtl)
+
+	return subscriptionType, nil
+}
+
+// LimitFor returns the limit of an endpoint class for a subscription type.
+func LimitFor(subscriptionType string, class string) RateLimit {
+
+	limits, ok := RateLimits[subscriptionType]
+
+	if !ok {
+		limits = RateLimits[DefaultSubscriptionType]
+	}
+
+	limit, ok := limits[class]
+
+	if !ok {
+		limit = limits[RateClassRead]
+	}
+
+	return limit
+}
+
+// hit counts one request against windows of the same length, keys[i]
+// allowing limits[i] requests, and returns the result of each window.
+func (l *RateLimiter) hit(ctx context.Context, keys []string, limits []int, window time.Duration) ([]RateLimitResult, error) {
+
+	now := time.Now()
+
+	args := []interface{}{now.UnixMilli(), window.Milliseconds(), uuid.V4()}
+
+	for _, limit := range limits {
+		args = append(args, limit)
+	}
+
+	values, err := slidingWindowScript.Run(ctx, l.Redis, keys, args...).Int64Slice()
+
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]RateLimitResult, len(keys))
+
+	for i := range keys {
+		results[i] = RateLimitResult{
+			Allowed:   values[0] == 1,
+			Limit:     limits[i],
+			Remaining: limits[i] - int(values[1+2*i]),
+			Window:    window,
+			Reset:     time.UnixMilli(values[2+2*i]).Add(window).Sub(now),
+		}
+	}
+
+	return results, nil
+}
+
+// Allow counts a request of key against the limits of its endpoint class,
+// per key and per application. Keys without an id, like upload tokens, only
+// count against the application. The windows are checked together, a
+// request rejected by any of them counts against none. The result reports
+// the full window of a rejected request, or else the one closest to its
+// limit.
+func (l *RateLimiter) Allow(key ValidUserIDAndAppIDModel, class string) (RateLimitResult, error) {
+
+	subscriptionType, err := l.SubscriptionType(key.ApplicationId)
+
+	if err != nil {
+		return RateLimitResult{Allowed: true}, err
+	}
+
+	limit := LimitFor(subscriptionType, class)
+
+	keys := []string{fmt.Sprintf("ratelimit:%s:app:%s", class, key.ApplicationId)}
+	limits := []int{limit.ApplicationRequests}
+
+	if key.Id != "" {
+		keys = append(keys, fmt.Sprintf("ratelimit:%s:key:%s", class, key.Id))
+		limits = append(limits, limit.Requests)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	results, err := l.hit(ctx, keys, limits, limit.Window)
+
+	if err != nil {
+		return RateLimitResult{Allowed: true}, err
+	}
+
+	result := results[0]
+
+	for _, window := range results[1:] {
+		if window.Remaining < result.Remaining {
+			result = window
+		}
+	}
+
+	return result, nil
+}
+
+// Headers are the RateLimit-* response headers of the result, and
+// Retry-After when the request was rejected.
+func (r RateLimitResult) Headers() map[string]string {
+
+	// whole seconds, rounded up so clients never retry too early
+	reset := int64((r.Reset + time.Second - 1) / time.Second)
+
+	remaining := r.Remaining
+
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	headers := map[string]string{
+		"RateLimit-Limit":     strconv.Itoa(r.Limit),
+		"RateLimit-Remaining": strconv.Itoa(remaining),
+		"RateLimit-Reset":     strconv.FormatInt(reset, 10),
+		"RateLimit-Policy":    fmt.Sprintf("%d;w=%d", r.Limit, int64(r.Window/time.Second)),
+	}
+
+	if !r.Allowed {
+		if reset < 1 {
+			reset = 1
+		}
+
+		headers["Retry-After"] = strconv.FormatInt(reset, 10)
+	}
+
+	return headers
+}
@@ -0,0 +1,87 @@
+package services
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLimitFor(t *testing.T) {
+
+	tests := []struct {
+		subscriptionType string
+		class            string
+		limit            RateLimit
+	}{
+		{"pro", RateClassTranscode, RateLimits["pro"][RateClassTranscode]},
+		{"enterprise", RateClassAdmin, RateLimits["enterprise"][RateClassAdmin]},
+		{"unknown", RateClassImage, RateLimits[DefaultSubscriptionType][RateClassImage]},
+		{"", RateClassUpload, RateLimits[DefaultSubscriptionType][RateClassUpload]},
+		{"pro", "unknown", RateLimits["pro"][RateClassRead]},
+		{"unknown", "unknown", RateLimits[DefaultSubscriptionType][RateClassRead]},
+	}
+
+	for _, test := range tests {
+		if limit := LimitFor(test.subscriptionType, test.class); limit != test.limit {
+			t.Errorf("LimitFor(%q, %q) = %+v, want %+v", test.subscriptionType, test.class, limit, test.limit)
+		}
+	}
+}
+
+func TestRateLimitResultHeaders(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		result  RateLimitResult
+		headers map[string]string
+	}{
+		{
+			name:   "allowed",
+			result: RateLimitResult{Allowed: true, Limit: 10, Remaining: 7, Window: time.Minute, Reset: 42 * time.Second},
+			headers: map[string]string{
+				"RateLimit-Limit":     "10",
+				"RateLimit-Remaining": "7",
+				"RateLimit-Reset":     "42",
+				"RateLimit-Policy":    "10;w=60",
+			},
+		},
+		{
+			name:   "reset rounded up",
+			result: RateLimitResult{Allowed: true, Limit: 10, Remaining: 0, Window: time.Minute, Reset: 41*time.Second + time.Millisecond},
+			headers: map[string]string{
+				"RateLimit-Limit":     "10",
+				"RateLimit-Remaining": "0",
+				"RateLimit-Reset":     "42",
+				"RateLimit-Policy":    "10;w=60",
+			},
+		},
+		{
+			name:   "rejected",
+			result: RateLimitResult{Allowed: false, Limit: 10, Remaining: 0, Window: time.Minute, Reset: 1500 * time.Millisecond},
+			headers: map[string]string{
+				"RateLimit-Limit":     "10",
+				"RateLimit-Remaining": "0",
+				"RateLimit-Reset":     "2",
+				"RateLimit-Policy":    "10;w=60",
+				"Retry-After":         "2",
+			},
+		},
+		{
+			name:   "rejected at the window end retries after a second",
+			result: RateLimitResult{Allowed: false, Limit: 20, Remaining: -1, Window: 2 * time.Minute, Reset: 0},
+			headers: map[string]string{
+				"RateLimit-Limit":     "20",
+				"RateLimit-Remaining": "0",
+				"RateLimit-Reset":     "0",
+				"RateLimit-Policy":    "20;w=120",
+				"Retry-After":         "1",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		if headers := test.result.Headers(); !reflect.DeepEqual(headers, test.headers) {
+			t.Errorf("%s: headers %v, want %v", test.name, headers, test.headers)
+		}
+	}
+}
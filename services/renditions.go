@@ -0,0 +1,135 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/jdrew153/models"
+	"github.com/jdrew153/repositories"
+)
+
+func renditionUrl(outputPath string) string {
+	return fmt.Sprintf("https://kaykatjd.com/media/%s", strings.TrimPrefix(outputPath, "./media/"))
+}
+
+// registerRendition records a video rendition of parent as a pending upload
+// derived from it. A rendition transcoded before keeps its upload. The id is
+// empty when parent is not a registered upload.
+func (s *TranscoderService) registerRendition(parent models.Upload, outputPath string) string {
+
+	if parent.Id == "" {
+		return ""
+	}
+
+	url := renditionUrl(outputPath)
+
+	renditionId, err := s.Media.FindUploadIdByUrl(url)
+
+	if err == nil {
+		return renditionId
+	}
+
+	if err != sql.ErrNoRows {
+		log.Println("Error finding rendition:", err)
+		return ""
+	}
+
+	ids, err := s.Media.WriteNewUploadsToDB([]NewUploadModel{{
+		Url:           url,
+		FileType:      "mp4",
+		ApplicationId: parent.ApplicationId,
+		UserId:        parent.UserId,
+		Status:        repositories.UploadPending,
+		ParentId:      parent.Id,
+		VariantKind:   repositories.VariantRendition,
+	}})
+
+	if err != nil {
+		log.Println("Error registering rendition:", err)
+		return ""
+	}
+
+	return ids[0]
+}
+
+// startRendition marks a rendition as being transcoded.
+func (s *TranscoderService) startRendition(renditionId string) {
+
+	if renditionId == "" {
+		return
+	}
+
+	err := s.Media.SetUploadStatus(renditionId, repositories.UploadProcessing)
+
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// finishRendition records the outcome of a rendition, with the size and
+// checksum of its file once transcoded.
+func (s *TranscoderService) finishRendition(renditionId string, outputPath string, transcodeErr error) {
+
+	if renditionId == "" {
+		return
+	}
+
+	err := transcodeErr
+
+	if err == nil {
+		var checksum string
+		var size int64
+
+		checksum, size, err = hashFile(outputPath)
+
+		if err == nil {
+			err = s.Media.SetUploadContent(renditionId, size, checksum)
+		}
+	}
+
+	status := repositories.UploadReady
+
+	if err != nil {
+		log.Printf("Rendition %s failed: %v", outputPath, err)
+		status = repositories.UploadFailed
+	}
+
+	err = s.Media.SetUploadStatus(renditionId, status)
+
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// dropRendition removes the file of a video rendition and marks its upload
+// deleted.
+func (s *TranscoderService) dropRendition(parent models.Upload, outputPath string) {
+
+	err := os.Remove(outputPath)
+
+	if err != nil && !os.IsNotExist(err) {
+		log.Println(err)
+	}
+
+	if parent.Id == "" {
+		return
+	}
+
+	renditionId, err := s.Media.FindUploadIdByUrl(renditionUrl(outputPath))
+
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Println("Error finding rendition:", err)
+		}
+		return
+	}
+
+	err = s.Media.SetUploadStatus(renditionId, repositories.UploadDeleted)
+
+	if err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,677 @@
+package services
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+)
+
+// SAMPLE-AES encrypts the samples inside MPEG-TS segments rather than the
+// whole segment, following Apple's MPEG-2 Stream Encryption Format for HTTP
+// Live Streaming. H.264 slices and AAC frames are encrypted with AES-128-CBC
+// and the PMT announces the encrypted stream types, the rest of the segment
+// stays readable to players.
+
+const tsPacketSize = 188
+
+// MPEG-TS stream types, plain and SAMPLE-AES encrypted.
+const (
+	streamTypeAAC           = 0x0f
+	streamTypeH264          = 0x1b
+	streamTypeAACSampleAES  = 0xcf
+	streamTypeH264SampleAES = 0xdb
+)
+
+// sampleAESUnsupported are audio and video stream types SAMPLE-AES is not
+// implemented for, segments holding them are refused rather than left plain.
+var sampleAESUnsupported = map[byte]string{
+	0x03: "MPEG-1 audio",
+	0x04: "MPEG-2 audio",
+	0x24: "HEVC",
+	0x81: "AC-3",
+	0x87: "E-AC-3",
+}
+
+func tsPid(packet []byte) int {
+	return int(packet[1]&0x1f)<<8 | int(packet[2])
+}
+
+func tsPayloadStart(packet []byte) bool {
+	return packet[1]&0x40 != 0
+}
+
+// tsPayload returns the payload of a packet after its adaptation field.
+func tsPayload(packet []byte) []byte {
+
+	switch packet[3] >> 4 & 0x3 {
+	case 1:
+		return packet[4:]
+	case 3:
+		if 5+int(packet[4]) > tsPacketSize {
+			return nil
+		}
+		return packet[5+int(packet[4]):]
+	}
+
+	return nil
+}
+
+// tsAdaptationFields returns the adaptation field of a packet without its
+// length, stuffing, private data and extension, to be carried over to the
+// packet starting the rewritten PES.
+func tsAdaptationFields(packet []byte) []byte {
+
+	if packet[3]>>4&0x2 == 0 || packet[4] == 0 {
+		return nil
+	}
+
+	field := packet[5 : 5+int(packet[4])]
+	flags := field[0]
+
+	size := 1
+
+	if flags&0x10 != 0 {
+		size += 6
+	}
+
+	if flags&0x08 != 0 {
+		size += 6
+	}
+
+	if flags&0x04 != 0 {
+		size++
+	}
+
+	if size > len(field) {
+		return nil
+	}
+
+	kept := append([]byte{}, field[:size]...)
+	kept[0] = flags &^ 0x03
+
+	return kept
+}
+
+// tsPacketize splits a PES into packets of pid starting at continuity
+// counter cc, the first carrying the adaptation fields. It returns the
+// packets and the next continuity counter.
+func tsPacketize(pid int, pes []byte, fields []byte, cc byte) ([][]byte, byte) {
+
+	var packets [][]byte
+
+	for first := true; len(pes) > 0; first = false {
+
+		var field []byte
+
+		if first {
+			field = fields
+		}
+
+		room := tsPacketSize - 4
+
+		if field != nil {
+			room -= 1 + len(field)
+		}
+
+		size := len(pes)
+
+		if size > room {
+			size = room
+		}
+
+		if pad := room - size; pad > 0 {
+			switch {
+			case field != nil:
+				field = append(append([]byte{}, field...), bytes.Repeat([]byte{0xff}, pad)...)
+			case pad == 1:
+				field = []byte{}
+			default:
+				field = append([]byte{0x00}, bytes.Repeat([]byte{0xff}, pad-2)...)
+			}
+		}
+
+		packet := make([]byte, 0, tsPacketSize)
+
+		start := byte(0)
+
+		if first {
+			start = 0x40
+		}
+
+		control := byte(0x10)
+
+		if field != nil {
+			control = 0x30
+		}
+
+		packet = append(packet, 0x47, start|byte(pid>>8), byte(pid), control|cc)
+
+		if field != nil {
+			packet = append(packet, byte(len(field)))
+			packet = append(packet, field...)
+		}
+
+		packet = append(packet, pes[:size]...)
+		packets = append(packets, packet)
+
+		pes = pes[size:]
+		cc = (cc + 1) & 0x0f
+	}
+
+	return packets, cc
+}
+
+// mpegCRC32 is the CRC of PSI sections.
+func mpegCRC32(data []byte) uint32 {
+
+	crc := uint32(0xffffffff)
+
+	for _, b := range data {
+		crc ^= uint32(b) << 24
+
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+
+	return crc
+}
+
+// tsSection returns the PSI section starting in the payload of a packet.
+func tsSection(packet []byte) ([]byte, error) {
+
+	payload := tsPayload(packet)
+
+	if len(payload) == 0 || 1+int(payload[0])+3 > len(payload) {
+		return nil, fmt.Errorf("truncated PSI section")
+	}
+
+	section := payload[1+int(payload[0]):]
+	length := 3 + (int(section[1]&0x0f)<<8 | int(section[2]))
+
+	if length < 16 || length > len(section) {
+		return nil, fmt.Errorf("PSI section spans packets")
+	}
+
+	return section[:length], nil
+}
+
+type pmtStream struct {
+	streamType byte
+	pid        int
+	info       []byte
+}
+
+// parsePmt returns the streams of a PMT section with the bytes before them.
+func parsePmt(section []byte) ([]byte, []pmtStream, error) {
+
+	programInfo := int(section[10]&0x0f)<<8 | int(section[11])
+	offset := 12 + programInfo
+
+	if offset > len(section)-4 {
+		return nil, nil, fmt.Errorf("malformed PMT")
+	}
+
+	var streams []pmtStream
+
+	for offset+5 <= len(section)-4 {
+		info := int(section[offset+3]&0x0f)<<8 | int(section[offset+4])
+
+		if offset+5+info > len(section)-4 {
+			return nil, nil, fmt.Errorf("malformed PMT")
+		}
+
+		streams = append(streams, pmtStream{
+			streamType: section[offset],
+			pid:        int(section[offset+1]&0x1f)<<8 | int(section[offset+2]),
+			info:       section[offset+5 : offset+5+info],
+		})
+
+		offset += 5 + info
+	}
+
+	return section[:12+programInfo], streams, nil
+}
+
+// sampleAESPmt rewrites a PMT section for encrypted streams: the stream
+// types change and private data indicators, plus the audio setup of AAC,
+// describe the encryption.
+func sampleAESPmt(section []byte, audioSetup []byte) ([]byte, error) {
+
+	head, streams, err := parsePmt(section)
+
+	if err != nil {
+		return nil, err
+	}
+
+	out := append([]byte{}, head...)
+
+	for _, stream := range streams {
+
+		info := append([]byte{}, stream.info...)
+
+		switch stream.streamType {
+		case streamTypeH264:
+			stream.streamType = streamTypeH264SampleAES
+			info = append(info, 0x0f, 4, 'z', 'a', 'v', 'c')
+		case streamTypeAAC:
+			if audioSetup == nil {
+				return nil, fmt.Errorf("AAC stream without frames")
+			}
+
+			stream.streamType = streamTypeAACSampleAES
+			info = append(info, 0x0f, 4, 'a', 'a', 'c', 'd')
+
+			// audio_setup_information: type, priming, version and the
+			// AudioSpecificConfig of the stream
+			setup := append([]byte{'z', 'a', 'a', 'c', 0, 0, 1, byte(len(audioSetup))}, audioSetup...)
+
+			info = append(info, 0x05, byte(4+len(setup)), 'a', 'p', 'a', 'd')
+			info = append(info, setup...)
+		}
+
+		out = append(out, stream.streamType, 0xe0|byte(stream.pid>>8), byte(stream.pid), 0xf0|byte(len(info)>>8), byte(len(info)))
+		out = append(out, info...)
+	}
+
+	length := len(out) - 3 + 4
+
+	out[1] = out[1]&0xf0 | byte(length>>8)
+	out[2] = byte(length)
+
+	crc := mpegCRC32(out)
+
+	return append(out, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc)), nil
+}
+
+// tsWithSection replaces the section in a PSI packet, keeping its header.
+func tsWithSection(packet []byte, section []byte) ([]byte, error) {
+
+	headerSize := tsPacketSize - len(tsPayload(packet))
+
+	if headerSize+1+len(section) > tsPacketSize {
+		return nil, fmt.Errorf("PMT does not fit a packet")
+	}
+
+	out := append([]byte{}, packet[:headerSize]...)
+	out = append(out, 0)
+	out = append(out, section...)
+
+	return append(out, bytes.Repeat([]byte{0xff}, tsPacketSize-len(out))...), nil
+}
+
+// unescapeRbsp removes the emulation prevention bytes of a NAL unit.
+func unescapeRbsp(nal []byte) []byte {
+
+	out := make([]byte, 0, len(nal))
+	zeros := 0
+
+	for _, b := range nal {
+		if zeros >= 2 && b == 0x03 {
+			zeros = 0
+			continue
+		}
+
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+
+		out = append(out, b)
+	}
+
+	return out
+}
+
+// escapeRbsp inserts the emulation prevention bytes keeping a NAL unit free
+// of start codes.
+func escapeRbsp(nal []byte) []byte {
+
+	out := make([]byte, 0, len(nal)+len(nal)/64)
+	zeros := 0
+
+	for _, b := range nal {
+		if zeros >= 2 && b <= 0x03 {
+			out = append(out, 0x03)
+			zeros = 0
+		}
+
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+
+		out = append(out, b)
+	}
+
+	if len(out) > 0 && out[len(out)-1] == 0 {
+		out = append(out, 0x03)
+	}
+
+	return out
+}
+
+// encryptH264 encrypts the slices of an H.264 elementary stream: of every
+// coded slice NAL unit longer than 48 bytes, the first 32 bytes stay clear,
+// then one in ten 16-byte blocks is encrypted in a CBC chain starting at iv.
+func encryptH264(es []byte, block cipher.Block, iv []byte) []byte {
+
+	var starts []int
+
+	for i := 0; i+3 <= len(es); i++ {
+		if es[i] == 0 && es[i+1] == 0 && es[i+2] == 1 {
+			starts = append(starts, i+3)
+			i += 2
+		}
+	}
+
+	if len(starts) == 0 {
+		return es
+	}
+
+	out := append([]byte{}, es[:starts[0]]...)
+
+	for i, start := range starts {
+
+		end := len(es)
+
+		if i+1 < len(starts) {
+			end = starts[i+1] - 3
+		}
+
+		// zeros before the next start code belong to no NAL unit
+		trimmed := end
+
+		for trimmed > start && es[trimmed-1] == 0 {
+			trimmed--
+		}
+
+		nal := es[start:trimmed]
+
+		if len(nal) > 0 && (nal[0]&0x1f == 1 || nal[0]&0x1f == 5) {
+			if rbsp := unescapeRbsp(nal); len(rbsp) > 48 {
+
+				cbc := cipher.NewCBCEncrypter(block, iv)
+
+				for offset := 32; len(rbsp)-offset > 16; offset += 160 {
+					cbc.CryptBlocks(rbsp[offset:offset+16], rbsp[offset:offset+16])
+				}
+
+				nal = escapeRbsp(rbsp)
+			}
+		}
+
+		out = append(out, nal...)
+		out = append(out, es[trimmed:end]...)
+
+		if i+1 < len(starts) {
+			out = append(out, 0, 0, 1)
+		}
+	}
+
+	return out
+}
+
+// encryptADTS encrypts the AAC frames of an ADTS stream: after the header
+// and 16 clear bytes every whole 16-byte block of a frame is encrypted in a
+// CBC chain starting at iv. It returns the AudioSpecificConfig of the first
+// frame along.
+func encryptADTS(es []byte, block cipher.Block, iv []byte) ([]byte, []byte, error) {
+
+	out := append([]byte{}, es...)
+
+	var config []byte
+
+	for offset := 0; offset < len(out); {
+
+		frame := out[offset:]
+
+		if len(frame) < 7 || frame[0] != 0xff || frame[1]&0xf0 != 0xf0 {
+			return nil, nil, fmt.Errorf("invalid ADTS frame")
+		}
+
+		headerSize := 7
+
+		if frame[1]&0x01 == 0 {
+			headerSize = 9
+		}
+
+		frameSize := int(frame[3]&0x03)<<11 | int(frame[4])<<3 | int(frame[5])>>5
+
+		if frameSize < headerSize || frameSize > len(frame) {
+			return nil, nil, fmt.Errorf("truncated ADTS frame")
+		}
+
+		if config == nil {
+			objectType := frame[2]>>6 + 1
+			frequency := frame[2] >> 2 & 0x0f
+			channels := (frame[2]&0x01)<<2 | frame[3]>>6
+
+			config = []byte{objectType<<3 | frequency>>1, (frequency&0x01)<<7 | channels<<3}
+		}
+
+		payload := frame[headerSize:frameSize]
+
+		if blocks := (len(payload) - 16) / 16; blocks > 0 {
+			encrypted := payload[16 : 16+blocks*16]
+			cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, encrypted)
+		}
+
+		offset += frameSize
+	}
+
+	return out, config, nil
+}
+
+type tsPes struct {
+	pid     int
+	packets []int
+	data    []byte
+}
+
+// encryptSampleAES encrypts an MPEG-TS segment with SAMPLE-AES.
+func encryptSampleAES(segment []byte, key []byte, iv []byte) ([]byte, error) {
+
+	if len(segment)%tsPacketSize != 0 {
+		return nil, fmt.Errorf("segment is not MPEG-TS")
+	}
+
+	block, err := aes.NewCipher(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var packets [][]byte
+
+	for offset := 0; offset < len(segment); offset += tsPacketSize {
+
+		packet := segment[offset : offset+tsPacketSize]
+
+		if packet[0] != 0x47 {
+			return nil, fmt.Errorf("segment is not MPEG-TS")
+		}
+
+		packets = append(packets, packet)
+	}
+
+	pmtPid := -1
+
+	for _, packet := range packets {
+		if tsPid(packet) != 0 || !tsPayloadStart(packet) {
+			continue
+		}
+
+		pat, err := tsSection(packet)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for offset := 8; offset+4 <= len(pat)-4; offset += 4 {
+			if program := int(pat[offset])<<8 | int(pat[offset+1]); program != 0 {
+				pmtPid = int(pat[offset+2]&0x1f)<<8 | int(pat[offset+3])
+				break
+			}
+		}
+
+		break
+	}
+
+	var pmt []byte
+
+	for _, packet := range packets {
+		if tsPid(packet) == pmtPid && tsPayloadStart(packet) {
+			if pmt, err = tsSection(packet); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+
+	if pmt == nil {
+		return nil, fmt.Errorf("segment has no PMT")
+	}
+
+	_, streams, err := parsePmt(pmt)
+
+	if err != nil {
+		return nil, err
+	}
+
+	streamTypes := map[int]byte{}
+
+	for _, stream := range streams {
+		if name, ok := sampleAESUnsupported[stream.streamType]; ok {
+			return nil, fmt.Errorf("SAMPLE-AES does not support %s streams", name)
+		}
+
+		if stream.streamType == streamTypeH264 || stream.streamType == streamTypeAAC {
+			streamTypes[stream.pid] = stream.streamType
+		}
+	}
+
+	var pes []*tsPes
+
+	current := map[int]*tsPes{}
+
+	// the PES of each packet, with the position of the packet in it
+	owner := map[int]*tsPes{}
+	position := map[int]int{}
+
+	for i, packet := range packets {
+
+		pid := tsPid(packet)
+
+		if _, ok := streamTypes[pid]; !ok {
+			continue
+		}
+
+		if tsPayloadStart(packet) {
+			current[pid] = &tsPes{pid: pid}
+			pes = append(pes, current[pid])
+		}
+
+		if current[pid] == nil {
+			return nil, fmt.Errorf("segment does not start on a PES of stream %d", pid)
+		}
+
+		current[pid].packets = append(current[pid].packets, i)
+		current[pid].data = append(current[pid].data, tsPayload(packet)...)
+
+		owner[i] = current[pid]
+		position[i] = len(current[pid].packets) - 1
+	}
+
+	var audioSetup []byte
+
+	rebuilt := map[*tsPes][][]byte{}
+	cc := map[int]byte{}
+
+	for _, p := range pes {
+
+		data := p.data
+
+		if len(data) < 9 || data[0] != 0 || data[1] != 0 || data[2] != 1 || 9+int(data[8]) > len(data) {
+			return nil, fmt.Errorf("invalid PES in stream %d", p.pid)
+		}
+
+		headerSize := 9 + int(data[8])
+		header := append([]byte{}, data[:headerSize]...)
+
+		var es []byte
+
+		if streamTypes[p.pid] == streamTypeH264 {
+			es = encryptH264(data[headerSize:], block, iv)
+
+			// unbounded, escaping may grow the stream
+			header[4], header[5] = 0, 0
+		} else {
+			var config []byte
+
+			es, config, err = encryptADTS(data[headerSize:], block, iv)
+
+			if err != nil {
+				return nil, err
+			}
+
+			if audioSetup == nil {
+				audioSetup = config
+			}
+		}
+
+		first := packets[p.packets[0]]
+
+		if _, ok := cc[p.pid]; !ok {
+			cc[p.pid] = first[3] & 0x0f
+		}
+
+		rebuilt[p], cc[p.pid] = tsPacketize(p.pid, append(header, es...), tsAdaptationFields(first), cc[p.pid])
+	}
+
+	encryptedPmt, err := sampleAESPmt(pmt, audioSetup)
+
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, len(segment)+len(segment)/32)
+
+	for i, packet := range packets {
+
+		if p := owner[i]; p != nil {
+
+			// rewritten packets take the places of the original ones, the
+			// surplus follows the last
+			n := position[i]
+
+			switch {
+			case n == len(p.packets)-1 && n < len(rebuilt[p]):
+				for _, rewritten := range rebuilt[p][n:] {
+					out = append(out, rewritten...)
+				}
+			case n < len(rebuilt[p]):
+				out = append(out, rebuilt[p][n]...)
+			}
+
+			continue
+		}
+
+		if tsPid(packet) == pmtPid && tsPayloadStart(packet) {
+			if packet, err = tsWithSection(packet, encryptedPmt); err != nil {
+				return nil, err
+			}
+		}
+
+		out = append(out, packet...)
+	}
+
+	return out, nil
+}
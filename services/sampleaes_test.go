@@ -0,0 +1,176 @@
+package services
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"testing"
+)
+
+// psiPacket wraps a PSI section, CRC appended, in a packet of pid.
+func psiPacket(pid int, section []byte) []byte {
+
+	length := len(section) - 3 + 4
+
+	section[1] = 0xb0 | byte(length>>8)
+	section[2] = byte(length)
+
+	crc := mpegCRC32(section)
+	section = append(section, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+
+	packet := append([]byte{0x47, 0x40 | byte(pid>>8), byte(pid), 0x10, 0}, section...)
+
+	return append(packet, bytes.Repeat([]byte{0xff}, tsPacketSize-len(packet))...)
+}
+
+func pesOf(streamId byte, es []byte) []byte {
+	return append([]byte{0, 0, 1, streamId, 0, 0, 0x80, 0x80, 5, 0x21, 0, 1, 0, 1}, es...)
+}
+
+func adtsFrame(payload []byte) []byte {
+
+	size := 7 + len(payload)
+
+	// AAC LC, 44.1 kHz, stereo
+	header := []byte{0xff, 0xf1, 0x50, 0x80 | byte(size>>11), byte(size >> 3), byte(size<<5) | 0x1f, 0xfc}
+
+	return append(header, payload...)
+}
+
+// readPes reassembles the PES packets of pid.
+func readPes(t *testing.T, segment []byte, pid int) [][]byte {
+
+	var pes [][]byte
+
+	for offset := 0; offset < len(segment); offset += tsPacketSize {
+
+		packet := segment[offset : offset+tsPacketSize]
+
+		if packet[0] != 0x47 {
+			t.Fatalf("lost sync at %d", offset)
+		}
+
+		if tsPid(packet) != pid {
+			continue
+		}
+
+		if tsPayloadStart(packet) {
+			pes = append(pes, nil)
+		}
+
+		pes[len(pes)-1] = append(pes[len(pes)-1], tsPayload(packet)...)
+	}
+
+	return pes
+}
+
+func TestEncryptSampleAES(t *testing.T) {
+
+	pat := psiPacket(0, []byte{0x00, 0, 0, 0, 1, 0xc1, 0, 0, 0, 1, 0xf0, 0x00})
+	pmt := psiPacket(0x1000, []byte{0x02, 0, 0, 0, 1, 0xc1, 0, 0, 0xe1, 0x00, 0xf0, 0,
+		streamTypeH264, 0xe1, 0x00, 0xf0, 0,
+		streamTypeAAC, 0xe1, 0x01, 0xf0, 0})
+
+	// an IDR slice with runs of zeros needing emulation prevention
+	slice := []byte{0x65}
+
+	for i := 0; len(slice) < 400; i++ {
+		slice = append(slice, byte(i*7), 0, 0, 3, 1, byte(i))
+	}
+
+	video := append([]byte{0, 0, 0, 1, 0x09, 0xf0, 0, 0, 0, 1}, slice...)
+
+	frames := [][]byte{bytes.Repeat([]byte{0x11}, 100), bytes.Repeat([]byte{0x22}, 60)}
+	audio := append(adtsFrame(frames[0]), adtsFrame(frames[1])...)
+
+	videoPackets, _ := tsPacketize(0x100, pesOf(0xe0, video), []byte{0x50, 0, 0, 0, 0, 0x7e, 0}, 0)
+	audioPackets, _ := tsPacketize(0x101, pesOf(0xc0, audio), nil, 0)
+
+	var segment []byte
+
+	for _, packet := range append(append([][]byte{pat, pmt}, videoPackets...), audioPackets...) {
+		segment = append(segment, packet...)
+	}
+
+	key := bytes.Repeat([]byte{7}, 16)
+	iv := sequenceIV(3)
+
+	encrypted, err := encryptSampleAES(segment, key, iv)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(encrypted)%tsPacketSize != 0 {
+		t.Fatalf("encrypted segment of %d bytes", len(encrypted))
+	}
+
+	section, err := tsSection(encrypted[tsPacketSize : 2*tsPacketSize])
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if mpegCRC32(section) != 0 {
+		t.Fatal("PMT CRC does not match")
+	}
+
+	_, streams, err := parsePmt(section)
+
+	if err != nil || len(streams) != 2 || streams[0].streamType != streamTypeH264SampleAES || streams[1].streamType != streamTypeAACSampleAES {
+		t.Fatalf("PMT streams = %+v, %v", streams, err)
+	}
+
+	if !bytes.Contains(streams[1].info, []byte("apad")) {
+		t.Fatal("AAC stream has no audio setup")
+	}
+
+	block, _ := aes.NewCipher(key)
+
+	videoPes := readPes(t, encrypted, 0x100)
+
+	if len(videoPes) != 1 {
+		t.Fatalf("%d video PES", len(videoPes))
+	}
+
+	es := videoPes[0][9+int(videoPes[0][8]):]
+
+	if !bytes.HasPrefix(es, video[:10]) {
+		t.Fatal("access unit delimiter changed")
+	}
+
+	rbsp := unescapeRbsp(es[10:])
+
+	if bytes.Equal(rbsp, unescapeRbsp(slice)) {
+		t.Fatal("slice left in the clear")
+	}
+
+	cbc := cipher.NewCBCDecrypter(block, iv)
+
+	for offset := 32; len(rbsp)-offset > 16; offset += 160 {
+		cbc.CryptBlocks(rbsp[offset:offset+16], rbsp[offset:offset+16])
+	}
+
+	if !bytes.Equal(rbsp, unescapeRbsp(slice)) {
+		t.Fatal("slice does not decrypt")
+	}
+
+	audioPes := readPes(t, encrypted, 0x101)
+
+	es = audioPes[0][9+int(audioPes[0][8]):]
+
+	for _, frame := range frames {
+
+		payload := append([]byte{}, es[7:7+len(frame)]...)
+
+		if blocks := (len(payload) - 16) / 16; blocks > 0 {
+			cipher.NewCBCDecrypter(block, iv).CryptBlocks(payload[16:16+blocks*16], payload[16:16+blocks*16])
+		}
+
+		if !bytes.Equal(payload, frame) {
+			t.Fatal("AAC frame does not decrypt")
+		}
+
+		es = es[7+len(frame):]
+	}
+}
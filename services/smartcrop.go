@@ -0,0 +1,177 @@
+package services
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+
+	"github.com/nfnt/resize"
+)
+
+// FocalPoint is the point of interest of an image in relative coordinates,
+// 0,0 is the top left corner and 1,1 the bottom right one.
+type FocalPoint struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+var CenterFocalPoint = FocalPoint{X: 0.5, Y: 0.5}
+
+func (f FocalPoint) Validate() error {
+	if f.X < 0 || f.X > 1 || f.Y < 0 || f.Y > 1 {
+		return fmt.Errorf("focal point coordinates must be between 0 and 1")
+	}
+	return nil
+}
+
+// edgeEnergy returns the Sobel gradient magnitude of a small grayscale copy
+// of img, row major, with the copy's size.
+func edgeEnergy(img image.Image) ([]float64, int, int) {
+
+	small := resize.Thumbnail(128, 128, img, resize.Bilinear)
+	bounds := small.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+
+	gray := make([]float64, w*h)
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			r, g, b, _ := small.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			gray[y*w+x] = 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+		}
+	}
+
+	energy := make([]float64, w*h)
+
+	at := func(x, y int) float64 {
+		if x < 0 {
+			x = 0
+		}
+		if x >= w {
+			x = w - 1
+		}
+		if y < 0 {
+			y = 0
+		}
+		if y >= h {
+			y = h - 1
+		}
+		return gray[y*w+x]
+	}
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			gx := at(x+1, y-1) + 2*at(x+1, y) + at(x+1, y+1) - at(x-1, y-1) - 2*at(x-1, y) - at(x-1, y+1)
+			gy := at(x-1, y+1) + 2*at(x, y+1) + at(x+1, y+1) - at(x-1, y-1) - 2*at(x, y-1) - at(x+1, y-1)
+			energy[y*w+x] = math.Hypot(gx, gy)
+		}
+	}
+
+	return energy, w, h
+}
+
+// AutoFocalPoint picks the center of the window, a third of the image in
+// each direction, holding the most edge energy. Flat images get the center.
+func AutoFocalPoint(img image.Image) FocalPoint {
+
+	energy, w, h := edgeEnergy(img)
+
+	if w < 3 || h < 3 {
+		return CenterFocalPoint
+	}
+
+	// summed area table, one row and column of padding
+	sums := make([]float64, (w+1)*(h+1))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			sums[(y+1)*(w+1)+x+1] = energy[y*w+x] + sums[y*(w+1)+x+1] + sums[(y+1)*(w+1)+x] - sums[y*(w+1)+x]
+		}
+	}
+
+	winW, winH := w/3, h/3
+
+	best := -1.0
+	focal := CenterFocalPoint
+
+	for y := 0; y+winH <= h; y++ {
+		for x := 0; x+winW <= w; x++ {
+			total := sums[(y+winH)*(w+1)+x+winW] - sums[y*(w+1)+x+winW] - sums[(y+winH)*(w+1)+x] + sums[y*(w+1)+x]
+
+			if total > best {
+				best = total
+				focal = FocalPoint{
+					X: (float64(x) + float64(winW)/2) / float64(w),
+					Y: (float64(y) + float64(winH)/2) / float64(h),
+				}
+			}
+		}
+	}
+
+	if best <= 0 {
+		return CenterFocalPoint
+	}
+
+	return focal
+}
+
+// CropForAspect returns the largest rectangle of bounds with the aspect
+// ratio of width x height, centered on the focal point as far as the
+// image edges allow.
+func CropForAspect(bounds image.Rectangle, width int, height int, focal FocalPoint) image.Rectangle {
+
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+	aspect := float64(width) / float64(height)
+
+	cropW, cropH := srcW, int(math.Round(float64(srcW)/aspect))
+
+	if cropH > srcH {
+		cropW, cropH = int(math.Round(float64(srcH)*aspect)), srcH
+	}
+
+	if cropW < 1 {
+		cropW = 1
+	}
+	if cropH < 1 {
+		cropH = 1
+	}
+
+	clamp := func(v, max int) int {
+		if v < 0 {
+			return 0
+		}
+		if v > max {
+			return max
+		}
+		return v
+	}
+
+	x := clamp(int(focal.X*float64(srcW))-cropW/2, srcW-cropW)
+	y := clamp(int(focal.Y*float64(srcH))-cropH/2, srcH-cropH)
+
+	return image.Rect(bounds.Min.X+x, bounds.Min.Y+y, bounds.Min.X+x+cropW, bounds.Min.Y+y+cropH)
+}
+
+func cropImage(img image.Image, rect image.Rectangle) image.Image {
+
+	if sub, ok := img.(interface {
+		SubImage(image.Rectangle) image.Image
+	}); ok {
+		return sub.SubImage(rect)
+	}
+
+	out := image.NewRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+	draw.Draw(out, out.Bounds(), img, rect.Min, draw.Src)
+
+	return out
+}
+
+// CoverResize crops img to the aspect of width x height around the focal
+// point and scales the crop to exactly that size.
+func CoverResize(img image.Image, width int, height int, focal FocalPoint) image.Image {
+
+	cropped := cropImage(img, CropForAspect(img.Bounds(), width, height, focal))
+
+	return resize.Resize(uint(width), uint(height), cropped, resize.Lanczos3)
+}
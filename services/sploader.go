@@ -3,85 +3,151 @@ package services
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"log"
 	"time"
+
+	"github.com/jdrew153/repositories"
 )
 
 type SploaderService struct {
 	db *sql.DB
+	applications repositories.ApplicationRepository
 }
 
 
-func NewSploaderService(db *sql.DB) *SploaderService {
+func NewSploaderService(db *sql.DB, repos *repositories.Repositories) *SploaderService {
 	return &SploaderService{
 		db: db,
+		applications: repos.Applications,
 	}
 }
 
 
 func (s *SploaderService) DetermineApplicationType(applicationId string) (string,error) {
 
-	var subscriptionType string
-
-	query := `SELECT subscriptionType from applications where id = ?`
-
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 
 	defer cancel()
 
-	stmt, err := s.db.PrepareContext(ctx, query)
+	subscriptionType, err := s.applications.SubscriptionType(ctx, applicationId)
+
+	log.Printf("Application type db result %v", subscriptionType)
 
 	if err != nil {
 		return subscriptionType, err
 	}
 
-	defer stmt.Close()
+	return subscriptionType, nil
+}
 
-	
-	result, err := stmt.QueryContext(ctx, applicationId)
+
+func (s *SploaderService) CalculateApplicationStorage(applicationId string) (bool, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	used, err := s.applications.StorageUsed(ctx, applicationId)
 
 	if err != nil {
-		return subscriptionType, err
+		return false, err
 	}
 
-	err = result.Scan(&subscriptionType)
+	log.Printf("Application %s uses %d bytes of storage", applicationId, used)
 
-	log.Printf("Application type db result %v", result)
+	return true, nil
+}
+
+
+// GetApplicationSetting loads a JSON encoded per-application setting into dest.
+// It reports false when the application has no value for the setting.
+func (s *SploaderService) GetApplicationSetting(applicationId string, name string, dest any) (bool, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	value, err := s.applications.Setting(ctx, applicationId, name)
+
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
 
 	if err != nil {
-		return subscriptionType, err
+		return false, err
 	}
 
-	return subscriptionType, nil
+	err = json.Unmarshal([]byte(value), dest)
+
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
 }
 
+// SetApplicationSetting stores value JSON encoded as a per-application setting.
+func (s *SploaderService) SetApplicationSetting(applicationId string, name string, value any) error {
 
-func (s *SploaderService) CalculateApplicationStorage(applicationId string) (bool, error) {
+	data, err := json.Marshal(value)
 
-	query := `SELECT SUM(size) FROM uploads WHERE application_id = ?`
-	
+	if err != nil {
+		return err
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 
-		defer cancel()
+	defer cancel()
 
-		stmt, err := s.db.PrepareContext(ctx, query)
+	return s.applications.SetSetting(ctx, applicationId, name, string(data))
+}
 
-		if err != nil {
-			return false, err
-		}
+// ApplicationWatermark returns the application's watermark, nil when it has none.
+func (s *SploaderService) ApplicationWatermark(applicationId string) (*WatermarkConfig, error) {
 
-		defer stmt.Close()
+	var watermark WatermarkConfig
 
+	ok, err := s.GetApplicationSetting(applicationId, "watermark", &watermark)
 
-		result, err := stmt.ExecContext(ctx, applicationId)
+	if err != nil || !ok {
+		return nil, err
+	}
 
-		if err != nil {
-			return false, err
-		}
+	err = watermark.Validate()
 
-		log.Printf("Wrote new upload to db with result %v", result)
+	if err != nil {
+		return nil, err
+	}
 
-		return true, nil
+	return &watermark, nil
 }
 
+// ApplicationOrigins returns the origins the application serves its pages
+// from, they drive its CORS policy and hotlink protection.
+func (s *SploaderService) ApplicationOrigins(applicationId string) ([]string, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	return s.applications.Origins(ctx, applicationId)
+}
+
+func (s *SploaderService) AddApplicationOrigin(applicationId string, origin string) error {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	return s.applications.AddOrigin(ctx, applicationId, origin)
+}
+
+func (s *SploaderService) RemoveApplicationOrigin(applicationId string, origin string) error {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	return s.applications.RemoveOrigin(ctx, applicationId, origin)
+}
@@ -4,6 +4,9 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -11,26 +14,31 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/jdrew153/models"
+	"github.com/jdrew153/repositories"
 	"github.com/pusher/pusher-http-go/v5"
 	"github.com/redis/go-redis/v9"
-	"github.com/xfrr/goffmpeg/models"
+	ffmpeg "github.com/xfrr/goffmpeg/models"
 	"github.com/xfrr/goffmpeg/transcoder"
 )
 
 type TranscoderService struct {
 	Pusher *pusher.Client
 	Redis *redis.Client
+	Media *MediaService
 }
 
-func NewTranscoderService(p *pusher.Client, r *redis.Client) *TranscoderService {
+func NewTranscoderService(p *pusher.Client, r *redis.Client, media *MediaService) *TranscoderService {
 	return &TranscoderService{
 		Pusher: p,
 		Redis: r,
+		Media: media,
 	}
 
 }
@@ -44,11 +52,90 @@ const (
 type TranscodeRequest struct {
 	InputPath string `json:"inputPath"`
 	Resolutions []string `json:"resolutions"`
-	ApiKey string `json:"apiKey"`
+	// ApiKeyId is the id of the key the request came with, its active
+	// transcodes are tracked under it.
+	ApiKeyId string `json:"apiKeyId"`
+	// ApplicationId owns the upload, renditions are reported to its backend.
+	ApplicationId string `json:"applicationId"`
+	// Watermark is burned into every rendition when set, the source is left untouched.
+	Watermark *WatermarkConfig `json:"watermark,omitempty"`
+	// PosterOffsets are the poster candidate positions in percent, DefaultPosterOffsets when empty.
+	PosterOffsets []float64 `json:"posterOffsets,omitempty"`
+	// Preview, when set, also produces a short muted preview clip.
+	Preview *PreviewOptions `json:"preview,omitempty"`
+	// AudioPresets are the audio renditions, DefaultAudioPresets when empty.
+	// They are produced for audio uploads and, with ExtractAudio, for videos.
+	AudioPresets []AudioPreset `json:"audioPresets,omitempty"`
+	ExtractAudio bool `json:"extractAudio"`
+	// Waveform, when set, also produces waveform peak data.
+	Waveform *WaveformOptions `json:"waveform,omitempty"`
+	// Loudness normalizes the audio of every output to these targets. Audio
+	// presets can also ask for normalization one by one, with default targets.
+	Loudness *LoudnessOptions `json:"loudness,omitempty"`
+	// Encryption, when set, encrypts the HLS renditions, see EncryptHLS.
+	Encryption *HlsEncryption `json:"encryption,omitempty"`
 }
 
+// Transcode produces the renditions of a request and records the run in the
+// jobs table. A registered upload is processing meanwhile, then ready or
+// failed. It returns 1 on success and 0 on failure.
 func (s *TranscoderService) Transcode(request TranscodeRequest) int {
 
+	var parent models.Upload
+
+	uploadId, err := s.uploadIdForPath(request.InputPath)
+
+	if err == nil && uploadId != "" {
+		parent, err = s.Media.GetUpload(uploadId)
+	}
+
+	if err != nil {
+		log.Println(err)
+		parent = models.Upload{}
+	}
+
+	if parent.Id != "" {
+		err = s.Media.SetUploadStatus(parent.Id, repositories.UploadProcessing)
+
+		if err != nil {
+			log.Println(err)
+		}
+	}
+
+	result := 0
+
+	s.Media.trackJob(uploadId, request.ApplicationId, JobTranscode, func() error {
+
+		result = s.transcode(request, parent)
+
+		if result != 1 {
+			return fmt.Errorf("transcode of %s failed", request.InputPath)
+		}
+
+		return nil
+	})
+
+	if parent.Id != "" {
+		status := repositories.UploadReady
+
+		if result != 1 {
+			status = repositories.UploadFailed
+		}
+
+		err = s.Media.SetUploadStatus(parent.Id, status)
+
+		if err != nil {
+			log.Println(err)
+		}
+	}
+
+	return result
+}
+
+// transcode runs a request, the renditions of a registered parent upload are
+// recorded as uploads derived from it.
+func (s *TranscoderService) transcode(request TranscodeRequest, parent models.Upload) int {
+
 	inputPath := request.InputPath
 	resolutions := request.Resolutions
 
@@ -64,17 +151,98 @@ func (s *TranscoderService) Transcode(request TranscodeRequest) int {
 		return 0
 	}
 
+	isAudio := IsAudioFile(inputPath)
+
+	if isAudio && len(resolutions) > 0 {
+		log.Printf("Ignoring video resolutions for audio file %s\n", inputPath)
+		resolutions = nil
+	}
+
+	audioPresets := request.AudioPresets
+
+	if len(audioPresets) == 0 {
+		audioPresets = DefaultAudioPresets
+	}
+
+	if !isAudio && !request.ExtractAudio {
+		audioPresets = nil
+	}
+
+	if request.Encryption != nil {
+		// single file audio renditions cannot be encrypted, only the HLS
+		// ones are produced
+		var hlsPresets []AudioPreset
+
+		for _, preset := range audioPresets {
+			if preset.Hls {
+				hlsPresets = append(hlsPresets, preset)
+			} else {
+				log.Printf("Skipping audio preset %s of encrypted %s\n", preset.Name, inputPath)
+			}
+		}
+
+		audioPresets = hlsPresets
+	}
+
+	if err := ValidateAudioPresets(audioPresets); err != nil {
+		log.Println(err)
+		return 0
+	}
+
+	loudness := request.Loudness
+	normalize := loudness != nil
+
+	for _, preset := range audioPresets {
+		normalize = normalize || preset.Normalize
+	}
+
+	if loudness != nil {
+		// a request wide target covers every preset
+		normalized := make([]AudioPreset, len(audioPresets))
+
+		for i, preset := range audioPresets {
+			preset.Normalize = true
+			normalized[i] = preset
+		}
+
+		audioPresets = normalized
+	} else {
+		loudness = &LoudnessOptions{}
+	}
+
+	loudnorm := ""
+
+	if normalize {
+		if err := loudness.Validate(); err != nil {
+			log.Println(err)
+			return 0
+		}
+
+		var err error
+
+		loudnorm, err = s.PrepareLoudnessNormalization(inputPath, *loudness)
+
+		if err != nil {
+			log.Println("Error measuring loudness, transcoding without normalization:", err)
+		}
+	}
+
 	log.Println("Transcoding " + inputPath)
 
 	wg := sync.WaitGroup{}
 	wg.Add(len(resolutions))
 
-	fileName := strings.Split(inputPath, "/")[2]
+	// audio renditions report progress on channels named after their preset
+	qualities := append([]string{}, resolutions...)
+
+	for _, preset := range audioPresets {
+		qualities = append(qualities, preset.Name)
+	}
 
 	model := SetActiveTranscodingModel{
-		Qualities: resolutions,
-		FileId: strings.Split(fileName, ".mp4")[0],
-		ApiKey: request.ApiKey,
+		Qualities: qualities,
+		FileId: mediaFileId(inputPath),
+		ApiKeyId: request.ApiKeyId,
 	}
 
 	err := SetActiveTranscodingUploadId(model, s.Redis)
@@ -92,17 +260,36 @@ func (s *TranscoderService) Transcode(request TranscodeRequest) int {
 
 			defer wg.Done()
             
+			outputPath := inputPath+"_"+resolution+".mp4"
+
+			renditionId := s.registerRendition(parent, outputPath)
 
 			trans := new(transcoder.Transcoder)
-			err := trans.Initialize(inputPath, inputPath+"_"+resolution+".mp4")
+			err := trans.Initialize(inputPath, outputPath)
+
+			defer func() {
+				s.finishRendition(renditionId, outputPath, err)
+			}()
 
 			if err != nil {
 				return
 			}
+
+			s.startRendition(renditionId)
+
 			log.Println("Transcoding to " + resolution)
 
 			trans.MediaFile().SetResolution(resolution)
 			trans.MediaFile().SetVideoBitRate("1000k")
+
+			if request.Watermark != nil {
+				trans.MediaFile().SetVideoFilter(WatermarkFilter(*request.Watermark, "in"))
+			}
+
+			if request.Loudness != nil && loudnorm != "" {
+				trans.MediaFile().SetAudioFilter(loudnorm)
+				trans.MediaFile().SetAudioRate(48000)
+			}
 			
 
 			done := trans.Run(true)
@@ -125,9 +312,24 @@ func (s *TranscoderService) Transcode(request TranscodeRequest) int {
 		}(resolution)
 	}
 
+	if len(audioPresets) > 0 {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			_, err := s.TranscodeAudio(inputPath, audioPresets, request.ApplicationId, loudnorm)
+
+			if err != nil {
+				log.Println("Error transcoding audio of " + inputPath)
+				log.Println(err)
+			}
+		}()
+	}
+
 	wg.Wait()
 
-	RemoveActiveTranscodingKeys(model.ApiKey, s.Redis)
+	RemoveActiveTranscodingKeys(model.ApiKeyId, s.Redis)
 
 	log.Println("Transcode complete")
 	log.Println("Updating upload sizes")
@@ -137,7 +339,7 @@ func (s *TranscoderService) Transcode(request TranscodeRequest) int {
 
 	for _, resolution := range resolutions {
 	
-		go func (resolution string, apiKey string, wg *sync.WaitGroup) {
+		go func (resolution string, applicationId string, wg *sync.WaitGroup) {
 			defer wg.Done()
 
 			//baseFilePath := strings.Split(inputPath, ".mp4")[0]
@@ -145,27 +347,81 @@ func (s *TranscoderService) Transcode(request TranscodeRequest) int {
 
 			formattedFilePath := fmt.Sprintf("%s_%s.mp4", inputPath, baseResolution)
 
-			CallbackFunctionToUpdateUpload(apiKey, formattedFilePath)
+			CallbackFunctionToUpdateUpload(applicationId, formattedFilePath)
 
 			s.CreateM3U8(inputPath, resolution)
 
 			s.CreateSrcubbingPhotoDirectory(inputPath)
 
-		}(resolution, request.ApiKey, &finalWG)
+		}(resolution, request.ApplicationId, &finalWG)
 	}
 
 	finalWG.Wait()
 
 	log.Println("Upload sizes updated")
 
-	//RemoveActiveTranscodingKeys(model.ApiKey, s.Redis)
+	if request.Waveform != nil {
+		_, err = s.GenerateWaveform(inputPath, *request.Waveform)
+
+		if err != nil {
+			log.Println("Error generating waveform:", err)
+		}
+	}
+
+	uploadId, err := s.uploadIdForPath(inputPath)
+
+	if err != nil {
+		log.Println(err)
+	}
+
+	// renditions left in the clear would serve what the request asked to
+	// protect, the transcode fails instead
+	if request.Encryption != nil {
+		err = s.EncryptHLS(mediaFileId(inputPath), uploadId, *request.Encryption)
+
+		if err != nil {
+			log.Println("Error encrypting HLS renditions:", err)
+			return 0
+		}
+
+		// the mp4 renditions would serve the video in the clear
+		for _, resolution := range resolutions {
+			s.dropRendition(parent, inputPath+"_"+resolution+".mp4")
+		}
+	}
+
+	if isAudio {
+		return 1
+	}
+
+	err = s.WriteMasterPlaylist(mediaFileId(inputPath), uploadId)
+
+	if err != nil {
+		log.Println("Error writing master playlist:", err)
+	}
+
+	err = s.GeneratePosters(inputPath, request.PosterOffsets)
+
+	if err != nil {
+		log.Println("Error generating posters:", err)
+	}
+
+	if request.Preview != nil {
+		_, err = s.GeneratePreview(inputPath, *request.Preview)
+
+		if err != nil {
+			log.Println("Error generating preview:", err)
+		}
+	}
+
+	//RemoveActiveTranscodingKeys(model.ApiKeyId, s.Redis)
 
 	return 1
 }
 
 func (s *TranscoderService) CreateThumbnail(inputPath string) ([]byte, error) {
 
-	cmd := exec.Command("ffmpeg", "-i", inputPath, 
+	cmd := exec.Command("ffmpeg", "-y", "-i", inputPath, 
 	"-ss", "00:00:01.000", 
 	"-vframes", 
 	"1", inputPath+"_thumbnail.jpeg");
@@ -233,11 +489,9 @@ func (s *TranscoderService) DownloadFile(URL, fileName string) error {
 
 func (s *TranscoderService) CreateM3U8(inputPath string, resoultion string) error {
 
-	baseFilePath := strings.Split(inputPath, ".mp4")[0]
-
-	log.Println("base file path", baseFilePath)
+	fileId := mediaFileId(inputPath)
 
-	fileId := strings.Split(baseFilePath, "/")[2]
+	log.Println("file id", fileId)
 
 	// Create the directory if it doesn't exist
 	m3u8Dir := fmt.Sprintf("./media/%s", fileId)
@@ -255,7 +509,7 @@ func (s *TranscoderService) CreateM3U8(inputPath string, resoultion string) erro
 
 	m3u8FilePath := fmt.Sprintf("./media/%s/%s.m3u8", fileId, baseResolution)
 
-	currFilePath := fmt.Sprintf("./media/%s.mp4", fileId)
+	currFilePath := fmt.Sprintf("./media/%s%s", fileId, filepath.Ext(inputPath))
 
 	log.Printf("current file path: %s\n", currFilePath)
 	log.Printf("m3u8 file path: %s\n", m3u8FilePath)
@@ -282,10 +536,10 @@ func (s *TranscoderService) CreateM3U8(inputPath string, resoultion string) erro
 func (s *TranscoderService) CreateSrcubbingPhotoDirectory(inputPath string) error {
 
 	log.Println("scrubbing input path", inputPath)
-	// note - input path should be .mp4 file 
-    baseFileId := strings.Split(inputPath, ".mp4")[0]
+	// note - input path should be a video file under ./media
+	baseFileId := strings.TrimSuffix(inputPath, filepath.Ext(inputPath))
 
-	uploadId := strings.Split(baseFileId, "/")[2]
+	uploadId := mediaFileId(inputPath)
 
 	log.Println("base file id", baseFileId)
 
@@ -332,7 +586,7 @@ func IsFilePathValid(filePath string) bool {
 
 
 
-func SendPusherNotif(filePath string, quality string, msg models.Progress, client *pusher.Client) {
+func SendPusherNotif(filePath string, quality string, msg ffmpeg.Progress, client *pusher.Client) {
 
 	time.Sleep(2 * time.Second)
 	
@@ -355,7 +609,28 @@ type UpdateUploadRequest struct {
 	Size int `json:"size"`
 }
 
-func CallbackFunctionToUpdateUpload(apiKey string, filePath string) {
+// SignCallback signs a callback body with CALLBACK_SIGNING_SECRET, receivers
+// recompute the HMAC-SHA256 of "<timestamp>.<applicationId>.<body>", the
+// application id taken from the x-application-id header, and compare it to
+// v1. A callback cannot be replayed for another application.
+func SignCallback(applicationId string, body []byte, timestamp int64) (string, error) {
+
+	secret := os.Getenv("CALLBACK_SIGNING_SECRET")
+
+	if secret == "" {
+		return "", fmt.Errorf("CALLBACK_SIGNING_SECRET is not set")
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+
+	fmt.Fprintf(mac, "%d.%s.%s", timestamp, applicationId, body)
+
+	return fmt.Sprintf("t=%d,v1=%s", timestamp, hex.EncodeToString(mac.Sum(nil))), nil
+}
+
+// CallbackFunctionToUpdateUpload reports the size of a rendition to the
+// application backend. The request is signed rather than carrying an API key.
+func CallbackFunctionToUpdateUpload(applicationId string, filePath string) {
 
 	requestUrl := "http://localhost:3000/api/applications/uploads/callback"
 
@@ -390,13 +665,21 @@ func CallbackFunctionToUpdateUpload(apiKey string, filePath string) {
 	req, err := http.NewRequest(http.MethodPost, requestUrl, bytes.NewBuffer(requestBody))
 
 	
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	signature, err := SignCallback(applicationId, requestBody, time.Now().Unix())
+
 	if err != nil {
 		log.Println(err)
 		return
 	}
 
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("x-api-key", apiKey)
+	req.Header.Set("x-application-id", applicationId)
+	req.Header.Set("x-signature", signature)
 
 	client := http.DefaultClient
 
@@ -425,7 +708,7 @@ func CallbackFunctionToUpdateUpload(apiKey string, filePath string) {
 type SetActiveTranscodingModel struct {
 	FileId string `json:"uploadId"`
 	Qualities []string `json:"qualities"`
-	ApiKey string `json:"apiKey"`
+	ApiKeyId string `json:"apiKeyId"`
 }
 
 
@@ -454,7 +737,7 @@ func SetActiveTranscodingUploadId(activeTranscodingModel SetActiveTranscodingMod
 		return err
 	}
 
-	cmd := r.Set(ctx, fmt.Sprintf("transcoding:%s", activeTranscodingModel.ApiKey), data, time.Duration(0))
+	cmd := r.Set(ctx, fmt.Sprintf("transcoding:%s", activeTranscodingModel.ApiKeyId), data, time.Duration(0))
 
 	result, err := cmd.Result()
 
@@ -468,9 +751,9 @@ func SetActiveTranscodingUploadId(activeTranscodingModel SetActiveTranscodingMod
 	return nil
 }
 
-func RemoveActiveTranscodingKeys(apiKey string, r *redis.Client) error {
+func RemoveActiveTranscodingKeys(apiKeyId string, r *redis.Client) error {
 
-	cmd := r.Del(context.Background(), fmt.Sprintf("transcoding:%s", apiKey))
+	cmd := r.Del(context.Background(), fmt.Sprintf("transcoding:%s", apiKeyId))
 
 	_, err := cmd.Result()
 
@@ -0,0 +1,322 @@
+package services
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// DefaultUploadTokenTtl is the lifetime of upload tokens minted without one,
+// MaxUploadTokenTtl caps what callers can ask for.
+const (
+	DefaultUploadTokenTtl = 15 * time.Minute
+	MaxUploadTokenTtl     = time.Hour
+)
+
+var (
+	ErrInvalidUploadToken = errors.New("invalid upload token")
+	ErrUploadTokenExpired = errors.New("upload token expired")
+	ErrMimeTypeDenied     = errors.New("file type not allowed by the upload token")
+	ErrFolderDenied       = errors.New("folder not allowed by the upload token")
+	ErrUploadTokenUsed    = errors.New("upload token already used for another file")
+	ErrUploadTokenFileId  = errors.New("fileId is required with an upload token")
+)
+
+// UploadTokenClaims are the constraints signed into an upload token. Tokens
+// let browsers upload directly without holding the API key that minted them.
+type UploadTokenClaims struct {
+	ApplicationId string `json:"applicationId"`
+	UserId        string `json:"userId"`
+	// MaxSize is the largest upload allowed in bytes, unlimited when 0.
+	MaxSize int64 `json:"maxSize,omitempty"`
+	// MimeTypes are the allowed types, "image/*" allows a whole family.
+	// Every type is allowed when empty.
+	MimeTypes []string `json:"mimeTypes,omitempty"`
+	// Folder is where uploads land under ./media, the root when empty.
+	Folder string `json:"folder,omitempty"`
+	// AllowedOrigins are inherited from the minting key.
+	AllowedOrigins []string `json:"allowedOrigins,omitempty"`
+	// FileId binds the token to one upload, to the first one made with it
+	// when empty.
+	FileId    string `json:"fileId,omitempty"`
+	ExpiresAt int64  `json:"expiresAt"`
+	// Signature identifies a verified token, it is not part of the payload.
+	Signature string `json:"-"`
+}
+
+var folderSegment = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// ValidateUploadFolder accepts folders made of up to four plain segments,
+// like "avatars" or "users/42".
+func ValidateUploadFolder(folder string) error {
+
+	if folder == "" {
+		return nil
+	}
+
+	segments := strings.Split(folder, "/")
+
+	if len(segments) > 4 {
+		return fmt.Errorf("folder %s is nested too deep", folder)
+	}
+
+	for _, segment := range segments {
+		if !folderSegment.MatchString(segment) {
+			return fmt.Errorf("invalid folder %s", folder)
+		}
+	}
+
+	return nil
+}
+
+// UploadMimeType is the MIME type of an upload by extension, without
+// parameters.
+func UploadMimeType(ext string) string {
+
+	mimeType := mime.TypeByExtension("." + strings.TrimPrefix(ext, "."))
+
+	mimeType, _, _ = strings.Cut(mimeType, ";")
+
+	return mimeType
+}
+
+// AllowsMimeType matches a MIME type against the allowed types of the token.
+func (c UploadTokenClaims) AllowsMimeType(mimeType string) bool {
+
+	if len(c.MimeTypes) == 0 {
+		return true
+	}
+
+	for _, allowed := range c.MimeTypes {
+
+		if strings.EqualFold(allowed, mimeType) {
+			return true
+		}
+
+		if family, ok := strings.CutSuffix(allowed, "/*"); ok && strings.HasPrefix(mimeType, family+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// UploadFolder resolves the folder a request asks for against the token,
+// requests without a folder use the token's.
+func (c UploadTokenClaims) UploadFolder(requested string) (string, error) {
+
+	if requested == "" || requested == c.Folder {
+		return c.Folder, nil
+	}
+
+	return "", ErrFolderDenied
+}
+
+// APIKey is the upload only key a token stands in for.
+func (c UploadTokenClaims) APIKey() ValidUserIDAndAppIDModel {
+	return ValidUserIDAndAppIDModel{
+		UserId:         c.UserId,
+		ApplicationId:  c.ApplicationId,
+		Scopes:         []string{ScopeUpload},
+		AllowedOrigins: c.AllowedOrigins,
+		ExpiresAt:      c.ExpiresAt,
+		MaxUploadSize:  c.MaxSize,
+	}
+}
+
+func uploadTokenSecret() ([]byte, error) {
+
+	secret := os.Getenv("UPLOAD_TOKEN_SECRET")
+
+	if secret == "" {
+		return nil, fmt.Errorf("UPLOAD_TOKEN_SECRET is not set")
+	}
+
+	return []byte(secret), nil
+}
+
+func signUploadToken(secret []byte, payload string) string {
+
+	mac := hmac.New(sha256.New, secret)
+
+	mac.Write([]byte(payload))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// NewUploadToken signs claims into a "<payload>.<signature>" token, both
+// parts base64url encoded.
+func NewUploadToken(claims UploadTokenClaims) (string, error) {
+
+	secret, err := uploadTokenSecret()
+
+	if err != nil {
+		return "", err
+	}
+
+	for _, mimeType := range claims.MimeTypes {
+		if _, _, err := mime.ParseMediaType(mimeType); err != nil && !strings.HasSuffix(mimeType, "/*") {
+			return "", fmt.Errorf("invalid MIME type %s", mimeType)
+		}
+	}
+
+	if err := ValidateUploadFolder(claims.Folder); err != nil {
+		return "", err
+	}
+
+	if claims.FileId != "" {
+		if _, err := SafeUploadPath("", claims.FileId); err != nil {
+			return "", err
+		}
+	}
+
+	data, err := json.Marshal(claims)
+
+	if err != nil {
+		return "", err
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(data)
+
+	return payload + "." + signUploadToken(secret, payload), nil
+}
+
+func VerifyUploadToken(token string) (UploadTokenClaims, error) {
+
+	var claims UploadTokenClaims
+
+	secret, err := uploadTokenSecret()
+
+	if err != nil {
+		return claims, err
+	}
+
+	payload, signature, ok := strings.Cut(token, ".")
+
+	if !ok || !hmac.Equal([]byte(signature), []byte(signUploadToken(secret, payload))) {
+		return claims, ErrInvalidUploadToken
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+
+	if err != nil {
+		return claims, ErrInvalidUploadToken
+	}
+
+	err = json.Unmarshal(data, &claims)
+
+	if err != nil {
+		return claims, ErrInvalidUploadToken
+	}
+
+	if time.Now().UnixMilli() >= claims.ExpiresAt {
+		return claims, ErrUploadTokenExpired
+	}
+
+	claims.Signature = signature
+
+	return claims, nil
+}
+
+func uploadTokenUseKey(signature string) string {
+	return fmt.Sprintf("uploadtoken:%s", signature)
+}
+
+// ClaimUploadToken binds a token to the file of its first upload until it
+// expires. Every chunk of that file may use the token, no other file can.
+func (s *MediaService) ClaimUploadToken(claims UploadTokenClaims, fileId string) error {
+
+	if fileId == "" {
+		return ErrUploadTokenFileId
+	}
+
+	if claims.FileId != "" && claims.FileId != fileId {
+		return ErrUploadTokenUsed
+	}
+
+	ttl := time.Until(time.UnixMilli(claims.ExpiresAt))
+
+	if ttl <= 0 {
+		return ErrUploadTokenExpired
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	key := uploadTokenUseKey(claims.Signature)
+
+	claimed, err := s.Redis.SetNX(ctx, key, fileId, ttl).Result()
+
+	if err != nil || claimed {
+		return err
+	}
+
+	bound, err := s.Redis.Get(ctx, key).Result()
+
+	if err == redis.Nil {
+		return ErrUploadTokenExpired
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if bound != fileId {
+		return ErrUploadTokenUsed
+	}
+
+	return nil
+}
+
+// SpendUploadToken ends a token with the upload it is bound to, later
+// requests are rejected even for the same file.
+func (s *MediaService) SpendUploadToken(claims UploadTokenClaims) error {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	return s.Redis.Set(ctx, uploadTokenUseKey(claims.Signature), "", redis.KeepTTL).Err()
+}
+
+type uploadTokenContextKey struct{}
+
+// WithUploadToken stores the verified upload token of a request in its context.
+func WithUploadToken(ctx context.Context, claims UploadTokenClaims) context.Context {
+	return context.WithValue(ctx, uploadTokenContextKey{}, claims)
+}
+
+// UploadTokenFromContext returns the upload token a request was authenticated
+// with, if any.
+func UploadTokenFromContext(ctx context.Context) (UploadTokenClaims, bool) {
+	claims, ok := ctx.Value(uploadTokenContextKey{}).(UploadTokenClaims)
+	return claims, ok
+}
+
+// SafeUploadPath joins a folder and a file name under ./media, rejecting names
+// that would escape it.
+func SafeUploadPath(folder string, fileName string) (string, error) {
+
+	if fileName == "" || strings.ContainsAny(fileName, `/\`) || strings.Contains(fileName, "..") {
+		return "", fmt.Errorf("invalid file name %s", fileName)
+	}
+
+	if err := ValidateUploadFolder(folder); err != nil {
+		return "", err
+	}
+
+	return path.Join(folder, fileName), nil
+}
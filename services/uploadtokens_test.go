@@ -0,0 +1,206 @@
+package services
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUploadTokenSignAndVerify(t *testing.T) {
+
+	t.Setenv("UPLOAD_TOKEN_SECRET", "test-secret")
+
+	claims := UploadTokenClaims{
+		ApplicationId: "app",
+		UserId:        "user",
+		MaxSize:       1024,
+		MimeTypes:     []string{"image/*"},
+		Folder:        "avatars",
+		FileId:        "avatar.png",
+		ExpiresAt:     time.Now().Add(time.Minute).UnixMilli(),
+	}
+
+	token, err := NewUploadToken(claims)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload, signature, _ := strings.Cut(token, ".")
+
+	verified, err := VerifyUploadToken(token)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if verified.ApplicationId != "app" || verified.FileId != "avatar.png" || verified.MaxSize != 1024 || verified.Signature != signature {
+		t.Errorf("verified claims %+v", verified)
+	}
+
+	expired := claims
+	expired.ExpiresAt = time.Now().Add(-time.Second).UnixMilli()
+
+	expiredToken, err := NewUploadToken(expired)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := base64.RawURLEncoding.DecodeString(payload)
+	forged := strings.Replace(string(data), `"maxSize":1024`, `"maxSize":0`, 1)
+
+	tests := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{"expired", expiredToken, ErrUploadTokenExpired},
+		{"tampered payload", base64.RawURLEncoding.EncodeToString([]byte(forged)) + "." + signature, ErrInvalidUploadToken},
+		{"tampered signature", payload + "." + strings.Repeat("A", len(signature)), ErrInvalidUploadToken},
+		{"missing signature", payload, ErrInvalidUploadToken},
+		{"payload not base64", "!!!." + signUploadToken([]byte("test-secret"), "!!!"), ErrInvalidUploadToken},
+		{"payload not json", "bm90IGpzb24." + signUploadToken([]byte("test-secret"), "bm90IGpzb24"), ErrInvalidUploadToken},
+		{"empty", "", ErrInvalidUploadToken},
+	}
+
+	for _, test := range tests {
+		if _, err := VerifyUploadToken(test.token); !errors.Is(err, test.err) {
+			t.Errorf("%s: error %v, want %v", test.name, err, test.err)
+		}
+	}
+
+	t.Setenv("UPLOAD_TOKEN_SECRET", "another-secret")
+
+	if _, err := VerifyUploadToken(token); !errors.Is(err, ErrInvalidUploadToken) {
+		t.Errorf("token verified with another secret: %v", err)
+	}
+
+	t.Setenv("UPLOAD_TOKEN_SECRET", "")
+
+	if _, err := NewUploadToken(claims); err == nil {
+		t.Error("token signed without a secret")
+	}
+}
+
+func TestNewUploadTokenValidatesClaims(t *testing.T) {
+
+	t.Setenv("UPLOAD_TOKEN_SECRET", "test-secret")
+
+	tests := []struct {
+		name   string
+		claims UploadTokenClaims
+		valid  bool
+	}{
+		{"plain", UploadTokenClaims{MimeTypes: []string{"image/png", "video/*"}, Folder: "users/42"}, true},
+		{"invalid MIME type", UploadTokenClaims{MimeTypes: []string{"image/"}}, false},
+		{"invalid folder", UploadTokenClaims{Folder: "../etc"}, false},
+		{"file id with a path", UploadTokenClaims{FileId: "a/b.png"}, false},
+	}
+
+	for _, test := range tests {
+		if _, err := NewUploadToken(test.claims); (err == nil) != test.valid {
+			t.Errorf("%s: error %v, want valid %v", test.name, err, test.valid)
+		}
+	}
+}
+
+func TestUploadTokenAllowsMimeType(t *testing.T) {
+
+	tests := []struct {
+		allowed  []string
+		mimeType string
+		allows   bool
+	}{
+		{nil, "application/pdf", true},
+		{[]string{"image/png"}, "image/png", true},
+		{[]string{"IMAGE/PNG"}, "image/png", true},
+		{[]string{"image/png"}, "image/jpeg", false},
+		{[]string{"image/*"}, "image/jpeg", true},
+		{[]string{"image/*"}, "video/mp4", false},
+		{[]string{"image/*"}, "imagex/png", false},
+		{[]string{"video/mp4", "image/*"}, "image/gif", true},
+		{[]string{"image/png"}, "", false},
+	}
+
+	for _, test := range tests {
+		if allows := (UploadTokenClaims{MimeTypes: test.allowed}).AllowsMimeType(test.mimeType); allows != test.allows {
+			t.Errorf("%q allows %q = %v, want %v", test.allowed, test.mimeType, allows, test.allows)
+		}
+	}
+}
+
+func TestUploadTokenUploadFolder(t *testing.T) {
+
+	tests := []struct {
+		folder    string
+		requested string
+		resolved  string
+		err       error
+	}{
+		{"", "", "", nil},
+		{"avatars", "", "avatars", nil},
+		{"avatars", "avatars", "avatars", nil},
+		{"avatars", "other", "", ErrFolderDenied},
+		{"", "other", "", ErrFolderDenied},
+	}
+
+	for _, test := range tests {
+
+		resolved, err := UploadTokenClaims{Folder: test.folder}.UploadFolder(test.requested)
+
+		if resolved != test.resolved || !errors.Is(err, test.err) {
+			t.Errorf("folder %q requested %q = %q, %v, want %q, %v", test.folder, test.requested, resolved, err, test.resolved, test.err)
+		}
+	}
+}
+
+func TestValidateUploadFolder(t *testing.T) {
+
+	tests := []struct {
+		folder string
+		valid  bool
+	}{
+		{"", true},
+		{"avatars", true},
+		{"users/42", true},
+		{"a/b/c/d", true},
+		{"a/b/c/d/e", false},
+		{"../media", false},
+		{"/avatars", false},
+		{"avatars/", false},
+		{"users//42", false},
+		{"with space", false},
+	}
+
+	for _, test := range tests {
+		if err := ValidateUploadFolder(test.folder); (err == nil) != test.valid {
+			t.Errorf("ValidateUploadFolder(%q) = %v, want valid %v", test.folder, err, test.valid)
+		}
+	}
+}
+
+func TestClaimUploadTokenRejectsBeforeRedis(t *testing.T) {
+
+	media := &MediaService{}
+	live := time.Now().Add(time.Minute).UnixMilli()
+
+	tests := []struct {
+		name   string
+		claims UploadTokenClaims
+		fileId string
+		err    error
+	}{
+		{"no file id", UploadTokenClaims{ExpiresAt: live}, "", ErrUploadTokenFileId},
+		{"bound to another file", UploadTokenClaims{FileId: "a.png", ExpiresAt: live}, "b.png", ErrUploadTokenUsed},
+		{"expired", UploadTokenClaims{ExpiresAt: time.Now().Add(-time.Second).UnixMilli()}, "a.png", ErrUploadTokenExpired},
+	}
+
+	for _, test := range tests {
+		if err := media.ClaimUploadToken(test.claims, test.fileId); !errors.Is(err, test.err) {
+			t.Errorf("%s: error %v, want %v", test.name, err, test.err)
+		}
+	}
+}
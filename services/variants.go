@@ -0,0 +1,439 @@
+package services
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os/exec"
+	"strings"
+
+	"github.com/nfnt/resize"
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+)
+
+// Fit modes for image variant profiles.
+const (
+	// FitContain scales the image down so it fits inside the bounds, keeping its aspect ratio.
+	FitContain = "contain"
+	// FitStretch scales the image to exactly MaxWidth x MaxHeight.
+	FitStretch = "stretch"
+	// FitCover crops the image to the aspect of MaxWidth x MaxHeight around its
+	// focal point, then scales it to exactly that size.
+	FitCover = "cover"
+)
+
+// ImageVariantProfile describes one output produced by ResizeImages.
+// Zero bounds are unconstrained, an empty format keeps the source format
+// and a zero quality uses the encoder default. Profiles with the "mp4"
+// format only apply to animated inputs.
+type ImageVariantProfile struct {
+	Name          string `json:"name"`
+	MaxWidth      int    `json:"maxWidth"`
+	MaxHeight     int    `json:"maxHeight"`
+	Fit           string `json:"fit"`
+	Format        string `json:"format"`
+	Quality       int    `json:"quality"`
+	StripMetadata bool   `json:"stripMetadata"`
+	Watermark     bool   `json:"watermark"`
+}
+
+// MaxImageVariantSide caps the bounds of a profile, the variant is decoded
+// into memory at its full size.
+const MaxImageVariantSide = 8192
+
+// DefaultImageVariantProfiles are used when neither the request nor the
+// application defines its own profiles.
+var DefaultImageVariantProfiles = []ImageVariantProfile{
+	{Name: "720p", MaxHeight: 720, Fit: FitContain, StripMetadata: true},
+	{Name: "480p", MaxHeight: 480, Fit: FitContain, StripMetadata: true},
+	{Name: "360p", MaxHeight: 360, Fit: FitContain, StripMetadata: true},
+}
+
+func (p ImageVariantProfile) Validate() error {
+
+	if p.Name == "" || strings.ContainsAny(p.Name, "./\\ ") {
+		return fmt.Errorf("invalid profile name %q", p.Name)
+	}
+
+	if p.MaxWidth < 0 || p.MaxHeight < 0 {
+		return fmt.Errorf("profile %s has negative bounds", p.Name)
+	}
+
+	if p.MaxWidth > MaxImageVariantSide || p.MaxHeight > MaxImageVariantSide {
+		return fmt.Errorf("profile %s has bounds above %d", p.Name, MaxImageVariantSide)
+	}
+
+	switch p.Fit {
+	case "", FitContain:
+		if p.MaxWidth == 0 && p.MaxHeight == 0 {
+			return fmt.Errorf("profile %s needs maxWidth or maxHeight", p.Name)
+		}
+	case FitStretch, FitCover:
+		if p.MaxWidth == 0 || p.MaxHeight == 0 {
+			return fmt.Errorf("profile %s needs both maxWidth and maxHeight for fit %s", p.Name, p.Fit)
+		}
+	default:
+		return fmt.Errorf("profile %s has unknown fit %q", p.Name, p.Fit)
+	}
+
+	if p.Format != "" && p.Format != "mp4" && !IsEncodableImageFormat(p.Format) {
+		return fmt.Errorf("profile %s has unsupported format %q", p.Name, p.Format)
+	}
+
+	if p.Quality < 0 || p.Quality > 100 {
+		return fmt.Errorf("profile %s has quality outside 0-100", p.Name)
+	}
+
+	return nil
+}
+
+func ValidateImageVariantProfiles(profiles []ImageVariantProfile) error {
+
+	seen := map[string]bool{}
+
+	for _, profile := range profiles {
+		if err := profile.Validate(); err != nil {
+			return err
+		}
+
+		if seen[profile.Name] {
+			return fmt.Errorf("duplicate profile name %s", profile.Name)
+		}
+
+		seen[profile.Name] = true
+	}
+
+	return nil
+}
+
+// NormalizeImageFormat maps file extensions and format names onto the
+// names returned by image.Decode.
+func NormalizeImageFormat(format string) string {
+	format = strings.ToLower(strings.TrimPrefix(format, "."))
+
+	if format == "jpg" {
+		return "jpeg"
+	}
+
+	return format
+}
+
+// ImageFormatForExtension returns the decodable image format for a file
+// extension, or an error when the extension is not an image we handle.
+func ImageFormatForExtension(ext string) (string, error) {
+
+	format := NormalizeImageFormat(ext)
+
+	switch format {
+	case "jpeg", "png", "gif", "bmp", "webp":
+		return format, nil
+	case "tif", "tiff":
+		return "tiff", nil
+	}
+
+	return "", fmt.Errorf("unsupported image extension %s", ext)
+}
+
+func IsEncodableImageFormat(format string) bool {
+	switch NormalizeImageFormat(format) {
+	case "jpeg", "png", "gif", "bmp", "tiff":
+		return true
+	}
+	return false
+}
+
+// DefaultOutputFormat is the variant format used for a source format when the
+// profile does not set one. Formats we can only decode fall back to png.
+func DefaultOutputFormat(sourceFormat string) string {
+
+	if IsEncodableImageFormat(sourceFormat) {
+		return sourceFormat
+	}
+
+	return "png"
+}
+
+// DecodeImage decodes any registered image format, applies the EXIF
+// orientation and reports the format name.
+func DecodeImage(data []byte) (image.Image, string, error) {
+
+	img, format, err := image.Decode(bytes.NewReader(data))
+
+	if err != nil {
+		return nil, format, err
+	}
+
+	if format == "jpeg" {
+		img = ApplyOrientation(img, ImageOrientation(data))
+	}
+
+	return img, format, nil
+}
+
+func EncodeImage(w io.Writer, img image.Image, format string, quality int) error {
+
+	switch NormalizeImageFormat(format) {
+	case "jpeg":
+		var opts *jpeg.Options
+		if quality > 0 {
+			opts = &jpeg.Options{Quality: quality}
+		}
+		return jpeg.Encode(w, img, opts)
+	case "png":
+		return png.Encode(w, img)
+	case "gif":
+		return gif.Encode(w, img, nil)
+	case "bmp":
+		return bmp.Encode(w, img)
+	case "tiff":
+		return tiff.Encode(w, img, &tiff.Options{Compression: tiff.Deflate})
+	}
+
+	return fmt.Errorf("unsupported output format %s", format)
+}
+
+// VariantDimensions returns the output size for a width x height source.
+// Contained images are never scaled up.
+func VariantDimensions(width int, height int, profile ImageVariantProfile) (int, int) {
+
+	if profile.Fit == FitStretch || profile.Fit == FitCover {
+		return profile.MaxWidth, profile.MaxHeight
+	}
+
+	scale := 1.0
+
+	if profile.MaxWidth > 0 && float64(profile.MaxWidth)/float64(width) < scale {
+		scale = float64(profile.MaxWidth) / float64(width)
+	}
+
+	if profile.MaxHeight > 0 && float64(profile.MaxHeight)/float64(height) < scale {
+		scale = float64(profile.MaxHeight) / float64(height)
+	}
+
+	if scale >= 1 {
+		return width, height
+	}
+
+	newWidth := int(float64(width)*scale + 0.5)
+	newHeight := int(float64(height)*scale + 0.5)
+
+	if newWidth == 0 {
+		newWidth = 1
+	}
+	if newHeight == 0 {
+		newHeight = 1
+	}
+
+	return newWidth, newHeight
+}
+
+// ResizeForProfile scales img according to the profile's bounds and fit.
+// The focal point is only used by the cover fit.
+func ResizeForProfile(img image.Image, profile ImageVariantProfile, focal FocalPoint) image.Image {
+
+	if profile.Fit == FitCover {
+		return CoverResize(img, profile.MaxWidth, profile.MaxHeight, focal)
+	}
+
+	bounds := img.Bounds()
+
+	width, height := VariantDimensions(bounds.Dx(), bounds.Dy(), profile)
+
+	if width == bounds.Dx() && height == bounds.Dy() {
+		return img
+	}
+
+	return resize.Resize(uint(width), uint(height), img, resize.Lanczos3)
+}
+
+// DecodeAnimatedGIF returns the decoded GIF when data holds more than one frame.
+func DecodeAnimatedGIF(data []byte) (*gif.GIF, bool) {
+
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+
+	if err != nil || len(g.Image) < 2 {
+		return nil, false
+	}
+
+	return g, true
+}
+
+// ResizeAnimatedGIF composites every frame onto the full canvas, honouring
+// the frame disposal methods, and resizes it. Frame timing and the loop
+// count are preserved. Cover profiles crop every frame around the focal
+// point and a non-nil watermark is drawn on every frame.
+func ResizeAnimatedGIF(g *gif.GIF, profile ImageVariantProfile, focal FocalPoint, watermark *WatermarkConfig) (*gif.GIF, error) {
+
+	canvasRect := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	canvas := image.NewRGBA(canvasRect)
+
+	crop := canvasRect
+	width, height := VariantDimensions(canvasRect.Dx(), canvasRect.Dy(), profile)
+
+	if profile.Fit == FitCover {
+		crop = CropForAspect(canvasRect, width, height, focal)
+	}
+
+	out := &gif.GIF{
+		LoopCount: g.LoopCount,
+		Config: image.Config{
+			ColorModel: g.Config.ColorModel,
+			Width:      width,
+			Height:     height,
+		},
+		BackgroundIndex: g.BackgroundIndex,
+	}
+
+	for i, frame := range g.Image {
+
+		var previous *image.RGBA
+
+		disposal := byte(0)
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+
+		if disposal == gif.DisposalPrevious {
+			previous = image.NewRGBA(canvasRect)
+			draw.Draw(previous, canvasRect, canvas, image.Point{}, draw.Src)
+		}
+
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+
+		var resized image.Image = resize.Resize(uint(width), uint(height), canvas.SubImage(crop), resize.Lanczos3)
+
+		if watermark != nil {
+			var err error
+
+			resized, err = ApplyWatermark(resized, *watermark)
+
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		paletted := image.NewPaletted(image.Rect(0, 0, width, height), frame.Palette)
+		draw.FloydSteinberg.Draw(paletted, paletted.Bounds(), resized, image.Point{})
+
+		out.Image = append(out.Image, paletted)
+		out.Delay = append(out.Delay, g.Delay[i])
+		out.Disposal = append(out.Disposal, gif.DisposalBackground)
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+
+	return out, nil
+}
+
+// ConvertAnimatedToMP4 transcodes the crop area of an animated image into a
+// muted, web friendly MP4 of the given size, which is usually far smaller
+// than the source GIF.
+func ConvertAnimatedToMP4(inputPath string, outputPath string, crop image.Rectangle, width int, height int, watermark *WatermarkConfig) error {
+
+	// yuv420p needs even dimensions
+	width -= width % 2
+	height -= height % 2
+
+	if width < 2 {
+		width = 2
+	}
+	if height < 2 {
+		height = 2
+	}
+
+	filter := fmt.Sprintf("crop=%d:%d:%d:%d,scale=%d:%d", crop.Dx(), crop.Dy(), crop.Min.X, crop.Min.Y, width, height)
+
+	if watermark != nil {
+		filter = fmt.Sprintf("[in]%s[scaled];%s", filter, WatermarkFilter(*watermark, "scaled"))
+	}
+
+	cmd := exec.Command("ffmpeg", "-y", "-i", inputPath,
+		"-movflags", "+faststart",
+		"-pix_fmt", "yuv420p",
+		"-an",
+		"-vf", filter,
+		outputPath)
+
+	stderr := bytes.Buffer{}
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+
+	if err != nil {
+		return fmt.Errorf("ffmpeg: %v: %s", err, stderr.String())
+	}
+
+	return nil
+}
+
+// jpegMetadataSegments returns the raw APP1 (EXIF/XMP), APP2 (ICC) and APP13
+// (IPTC) segments of a JPEG file, markers included.
+func jpegMetadataSegments(data []byte) [][]byte {
+
+	var segments [][]byte
+
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return segments
+	}
+
+	i := 2
+
+	for i+4 <= len(data) {
+		if data[i] != 0xFF {
+			break
+		}
+
+		marker := data[i+1]
+
+		// start of scan, no more metadata after this point
+		if marker == 0xDA || marker == 0xD9 {
+			break
+		}
+
+		length := int(binary.BigEndian.Uint16(data[i+2 : i+4]))
+
+		if length < 2 || i+2+length > len(data) {
+			break
+		}
+
+		if marker == 0xE1 || marker == 0xE2 || marker == 0xED {
+			segments = append(segments, data[i:i+2+length])
+		}
+
+		i += 2 + length
+	}
+
+	return segments
+}
+
+// insertJPEGSegments places segments right after the SOI marker of an encoded JPEG.
+func insertJPEGSegments(encoded []byte, segments [][]byte) []byte {
+
+	if len(segments) == 0 || len(encoded) < 2 {
+		return encoded
+	}
+
+	out := bytes.Buffer{}
+	out.Write(encoded[:2])
+
+	for _, segment := range segments {
+		out.Write(segment)
+	}
+
+	out.Write(encoded[2:])
+
+	return out.Bytes()
+}
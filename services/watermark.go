@@ -0,0 +1,320 @@
+package services
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/nfnt/resize"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// Watermark positions.
+const (
+	WatermarkTopLeft     = "top-left"
+	WatermarkTopRight    = "top-right"
+	WatermarkBottomLeft  = "bottom-left"
+	WatermarkBottomRight = "bottom-right"
+	WatermarkCenter      = "center"
+)
+
+// WatermarkConfig is the per-application "watermark" setting. Scale is the
+// watermark width relative to the output width, Margin is in output pixels
+// and ImagePath is relative to ./media.
+type WatermarkConfig struct {
+	Type      string  `json:"type"`
+	ImagePath string  `json:"imagePath"`
+	Text      string  `json:"text"`
+	Color     string  `json:"color"`
+	Position  string  `json:"position"`
+	Margin    int     `json:"margin"`
+	Opacity   float64 `json:"opacity"`
+	Scale     float64 `json:"scale"`
+}
+
+func (c WatermarkConfig) Validate() error {
+
+	switch c.Type {
+	case "image":
+		if c.ImagePath == "" || strings.Contains(c.ImagePath, "..") {
+			return fmt.Errorf("image watermark needs a valid imagePath")
+		}
+	case "text":
+		if c.Text == "" {
+			return fmt.Errorf("text watermark needs text")
+		}
+	default:
+		return fmt.Errorf("unknown watermark type %q", c.Type)
+	}
+
+	switch c.Position {
+	case "", WatermarkTopLeft, WatermarkTopRight, WatermarkBottomLeft, WatermarkBottomRight, WatermarkCenter:
+	default:
+		return fmt.Errorf("unknown watermark position %q", c.Position)
+	}
+
+	if c.Opacity < 0 || c.Opacity > 1 {
+		return fmt.Errorf("watermark opacity must be between 0 and 1")
+	}
+
+	if c.Scale < 0 || c.Scale > 1 {
+		return fmt.Errorf("watermark scale must be between 0 and 1")
+	}
+
+	if c.Margin < 0 {
+		return fmt.Errorf("watermark margin must not be negative")
+	}
+
+	if _, err := parseHexColor(c.textColor()); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (c WatermarkConfig) position() string {
+	if c.Position == "" {
+		return WatermarkBottomRight
+	}
+	return c.Position
+}
+
+func (c WatermarkConfig) opacity() float64 {
+	if c.Opacity == 0 {
+		return 0.5
+	}
+	return c.Opacity
+}
+
+func (c WatermarkConfig) scale() float64 {
+	if c.Scale == 0 {
+		return 0.2
+	}
+	return c.Scale
+}
+
+func (c WatermarkConfig) textColor() string {
+	if c.Color == "" {
+		return "#ffffff"
+	}
+	return c.Color
+}
+
+func parseHexColor(hex string) (color.NRGBA, error) {
+
+	var c color.NRGBA
+
+	if len(hex) != 7 || hex[0] != '#' {
+		return c, fmt.Errorf("invalid color %q, expected #rrggbb", hex)
+	}
+
+	_, err := fmt.Sscanf(hex, "#%02x%02x%02x", &c.R, &c.G, &c.B)
+
+	if err != nil {
+		return c, fmt.Errorf("invalid color %q, expected #rrggbb", hex)
+	}
+
+	c.A = 0xff
+
+	return c, nil
+}
+
+// watermarkOrigin returns the top left corner of a w x h watermark on a
+// width x height output.
+func watermarkOrigin(position string, width int, height int, w int, h int, margin int) image.Point {
+
+	switch position {
+	case WatermarkTopLeft:
+		return image.Pt(margin, margin)
+	case WatermarkTopRight:
+		return image.Pt(width-w-margin, margin)
+	case WatermarkBottomLeft:
+		return image.Pt(margin, height-h-margin)
+	case WatermarkCenter:
+		return image.Pt((width-w)/2, (height-h)/2)
+	}
+
+	return image.Pt(width-w-margin, height-h-margin)
+}
+
+var (
+	watermarkFont     *opentype.Font
+	watermarkFontErr  error
+	watermarkFontOnce sync.Once
+)
+
+func renderWatermarkText(text string, width int, textColor color.NRGBA) (image.Image, error) {
+
+	watermarkFontOnce.Do(func() {
+		watermarkFont, watermarkFontErr = opentype.Parse(goregular.TTF)
+	})
+
+	if watermarkFontErr != nil {
+		return nil, watermarkFontErr
+	}
+
+	// measure at a reference size, then pick the size that gives the wanted width
+	face, err := opentype.NewFace(watermarkFont, &opentype.FaceOptions{Size: 100, DPI: 72})
+
+	if err != nil {
+		return nil, err
+	}
+
+	measured := font.MeasureString(face, text).Ceil()
+	face.Close()
+
+	if measured == 0 {
+		return nil, fmt.Errorf("watermark text has no width")
+	}
+
+	size := 100 * float64(width) / float64(measured)
+
+	face, err = opentype.NewFace(watermarkFont, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull})
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer face.Close()
+
+	metrics := face.Metrics()
+
+	rgba := image.NewRGBA(image.Rect(0, 0, font.MeasureString(face, text).Ceil(), (metrics.Ascent + metrics.Descent).Ceil()))
+
+	drawer := &font.Drawer{
+		Dst:  rgba,
+		Src:  image.NewUniform(textColor),
+		Face: face,
+		Dot:  fixed.Point26_6{X: 0, Y: metrics.Ascent},
+	}
+
+	drawer.DrawString(text)
+
+	return rgba, nil
+}
+
+// ApplyWatermark draws the watermark over a copy of img.
+func ApplyWatermark(img image.Image, config WatermarkConfig) (image.Image, error) {
+
+	bounds := img.Bounds()
+	width := int(float64(bounds.Dx()) * config.scale())
+
+	if width < 1 {
+		return img, nil
+	}
+
+	var mark image.Image
+
+	switch config.Type {
+	case "image":
+		data, err := os.ReadFile(fmt.Sprintf("./media/%s", config.ImagePath))
+
+		if err != nil {
+			return nil, err
+		}
+
+		logo, _, err := DecodeImage(data)
+
+		if err != nil {
+			return nil, err
+		}
+
+		mark = resize.Resize(uint(width), 0, logo, resize.Lanczos3)
+	case "text":
+		textColor, err := parseHexColor(config.textColor())
+
+		if err != nil {
+			return nil, err
+		}
+
+		mark, err = renderWatermarkText(config.Text, width, textColor)
+
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown watermark type %q", config.Type)
+	}
+
+	out := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(out, out.Bounds(), img, bounds.Min, draw.Src)
+
+	markBounds := mark.Bounds()
+	origin := watermarkOrigin(config.position(), bounds.Dx(), bounds.Dy(), markBounds.Dx(), markBounds.Dy(), config.Margin)
+
+	mask := image.NewUniform(color.Alpha{A: uint8(config.opacity() * 255)})
+
+	draw.DrawMask(out, image.Rectangle{Min: origin, Max: origin.Add(markBounds.Size())}, mark, markBounds.Min, mask, image.Point{}, draw.Over)
+
+	return out, nil
+}
+
+// quoteFilterValue quotes a filter option value for a filter graph. ffmpeg
+// unquotes it twice, once parsing the graph and once the filter options, and
+// in both a quoted string runs up to the next quote, whatever it holds, so
+// quotes are written as '\'' and the whole is quoted twice.
+func quoteFilterValue(value string) string {
+
+	quote := func(value string) string {
+		return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+	}
+
+	return quote(quote(value))
+}
+
+// watermarkPositionExpr returns ffmpeg x/y expressions for the position,
+// given the names of the frame and watermark dimensions in the filter.
+func watermarkPositionExpr(position string, margin int, frameW string, frameH string, markW string, markH string) (string, string) {
+
+	left := fmt.Sprint(margin)
+	top := fmt.Sprint(margin)
+	right := fmt.Sprintf("%s-%s-%d", frameW, markW, margin)
+	bottom := fmt.Sprintf("%s-%s-%d", frameH, markH, margin)
+
+	switch position {
+	case WatermarkTopLeft:
+		return left, top
+	case WatermarkTopRight:
+		return right, top
+	case WatermarkBottomLeft:
+		return left, bottom
+	case WatermarkCenter:
+		return fmt.Sprintf("(%s-%s)/2", frameW, markW), fmt.Sprintf("(%s-%s)/2", frameH, markH)
+	}
+
+	return right, bottom
+}
+
+// WatermarkFilter returns an ffmpeg -vf filter graph burning the watermark
+// into the frames of the input label, sized relative to the frame.
+func WatermarkFilter(config WatermarkConfig, input string) string {
+
+	if config.Type == "text" {
+		x, y := watermarkPositionExpr(config.position(), config.Margin, "w", "h", "tw", "th")
+
+		// drawtext has no width target, approximate with an average glyph width of 0.55em
+		fontSize := fmt.Sprintf("w*%.4f/%.2f", config.scale(), 0.55*float64(len([]rune(config.Text))))
+
+		// without expansion the text is drawn as written, % and \ included
+		filter := fmt.Sprintf("[%s]drawtext=expansion=none:text=%s:fontcolor=%s@%.2f:fontsize=%s:x=%s:y=%s",
+			input, quoteFilterValue(config.Text), strings.TrimPrefix(config.textColor(), "#"), config.opacity(), fontSize, x, y)
+
+		if fontFile := os.Getenv("WATERMARK_FONT"); fontFile != "" {
+			filter += fmt.Sprintf(":fontfile=%s", quoteFilterValue(fontFile))
+		}
+
+		return filter
+	}
+
+	x, y := watermarkPositionExpr(config.position(), config.Margin, "W", "H", "w", "h")
+
+	return fmt.Sprintf("movie=%s,format=rgba,colorchannelmixer=aa=%.2f[wm];[wm][%s]scale2ref=w=main_w*%.4f:h=ow/a[wm][base];[base][wm]overlay=%s:%s",
+		quoteFilterValue(fmt.Sprintf("./media/%s", config.ImagePath)), config.opacity(), input, config.scale(), x, y)
+}
@@ -0,0 +1,47 @@
+package services
+
+import (
+	"strings"
+	"testing"
+)
+
+// unquote reads a value the way ffmpeg's av_get_token does: quoted runs are
+// taken as they are and a backslash outside quotes takes the next character.
+func unquote(value string) string {
+
+	var out strings.Builder
+
+	quoted := false
+
+	for i := 0; i < len(value); i++ {
+		switch {
+		case value[i] == '\'':
+			quoted = !quoted
+		case value[i] == '\\' && !quoted && i+1 < len(value):
+			i++
+			out.WriteByte(value[i])
+		default:
+			out.WriteByte(value[i])
+		}
+	}
+
+	return out.String()
+}
+
+func TestQuoteFilterValue(t *testing.T) {
+
+	for _, value := range []string{
+		"© Josh",
+		"it's mine",
+		`C:\fonts\'odd'.ttf`,
+		"a:b,c;d[e]f=g 100%",
+		"''",
+	} {
+		quoted := quoteFilterValue(value)
+
+		// once for the graph, once for the filter options
+		if got := unquote(unquote(quoted)); got != value {
+			t.Fatalf("quoteFilterValue(%q) = %s, ffmpeg reads %q", value, quoted, got)
+		}
+	}
+}
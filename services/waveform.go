@@ -0,0 +1,427 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// waveformSampleRate is the rate the audio is decoded at before computing peaks.
+const waveformSampleRate = 44100
+
+// Waveform channel modes.
+const (
+	WaveformMono   = "mono"
+	WaveformStereo = "stereo"
+)
+
+// WaveformOptions configure the peak data. Bits is the resolution of the
+// peaks, 8 or 16, and Png adds a rendering of PngWidth x PngHeight pixels.
+type WaveformOptions struct {
+	SamplesPerPixel int    `json:"samplesPerPixel"`
+	Channels        string `json:"channels"`
+	Bits            int    `json:"bits"`
+	Png             bool   `json:"png"`
+	PngWidth        int    `json:"pngWidth"`
+	PngHeight       int    `json:"pngHeight"`
+	Color           string `json:"color"`
+}
+
+func (o WaveformOptions) Validate() error {
+
+	if o.SamplesPerPixel < 0 || (o.SamplesPerPixel > 0 && o.SamplesPerPixel < 32) || o.SamplesPerPixel > 1<<16 {
+		return fmt.Errorf("samplesPerPixel must be between 32 and 65536")
+	}
+
+	switch o.Channels {
+	case "", WaveformMono, WaveformStereo:
+	default:
+		return fmt.Errorf("unknown waveform channel mode %q", o.Channels)
+	}
+
+	if o.Bits != 0 && o.Bits != 8 && o.Bits != 16 {
+		return fmt.Errorf("waveform bits must be 8 or 16")
+	}
+
+	if o.PngWidth < 0 || o.PngWidth > 8192 || o.PngHeight < 0 || o.PngHeight > 2048 {
+		return fmt.Errorf("waveform png must be at most 8192x2048")
+	}
+
+	if o.Color != "" {
+		if _, err := parseHexColor(o.Color); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (o WaveformOptions) withDefaults() WaveformOptions {
+
+	if o.SamplesPerPixel == 0 {
+		o.SamplesPerPixel = 256
+	}
+
+	if o.Channels == "" {
+		o.Channels = WaveformMono
+	}
+
+	if o.Bits == 0 {
+		o.Bits = 8
+	}
+
+	if o.PngWidth == 0 {
+		o.PngWidth = 1800
+	}
+
+	if o.PngHeight == 0 {
+		o.PngHeight = 280
+	}
+
+	if o.Color == "" {
+		o.Color = "#3b82f6"
+	}
+
+	return o
+}
+
+// WaveformData is the audiowaveform JSON format version 2, as read by
+// peaks.js and wavesurfer. Data holds a min and max per channel per pixel.
+type WaveformData struct {
+	Version         int   `json:"version"`
+	Channels        int   `json:"channels"`
+	SampleRate      int   `json:"sample_rate"`
+	SamplesPerPixel int   `json:"samples_per_pixel"`
+	Bits            int   `json:"bits"`
+	Length          int   `json:"length"`
+	Data            []int `json:"data"`
+}
+
+// ComputePeaks reads interleaved signed 16-bit little endian PCM and reduces
+// every samplesPerPixel frames to a min and max per channel.
+func ComputePeaks(r io.Reader, channels int, samplesPerPixel int, bits int) (WaveformData, error) {
+
+	waveform := WaveformData{
+		Version:         2,
+		Channels:        channels,
+		SampleRate:      waveformSampleRate,
+		SamplesPerPixel: samplesPerPixel,
+		Bits:            bits,
+		Data:            []int{},
+	}
+
+	mins := make([]int, channels)
+	maxs := make([]int, channels)
+
+	reset := func() {
+		for c := range mins {
+			mins[c] = math.MaxInt16
+			maxs[c] = math.MinInt16
+		}
+	}
+
+	flush := func() {
+		for c := range mins {
+			lo, hi := mins[c], maxs[c]
+
+			if bits == 8 {
+				lo, hi = lo>>8, hi>>8
+			}
+
+			waveform.Data = append(waveform.Data, lo, hi)
+		}
+		waveform.Length++
+	}
+
+	reset()
+
+	reader := bufio.NewReaderSize(r, 64*1024)
+	frame := make([]byte, 2*channels)
+	count := 0
+
+	for {
+		_, err := io.ReadFull(reader, frame)
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+
+		if err != nil {
+			return waveform, err
+		}
+
+		for c := 0; c < channels; c++ {
+			sample := int(int16(binary.LittleEndian.Uint16(frame[2*c:])))
+
+			if sample < mins[c] {
+				mins[c] = sample
+			}
+
+			if sample > maxs[c] {
+				maxs[c] = sample
+			}
+		}
+
+		count++
+
+		if count == samplesPerPixel {
+			flush()
+			reset()
+			count = 0
+		}
+	}
+
+	if count > 0 {
+		flush()
+	}
+
+	return waveform, nil
+}
+
+// RenderWaveform draws the peaks on a transparent width x height image, one
+// lane per channel, resampling the pixels of the data to the image width.
+func RenderWaveform(waveform WaveformData, width int, height int, fill color.Color) image.Image {
+
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+
+	if waveform.Length == 0 || waveform.Channels == 0 {
+		return img
+	}
+
+	full := 32768.0
+
+	if waveform.Bits == 8 {
+		full = 128.0
+	}
+
+	laneHeight := height / waveform.Channels
+
+	for c := 0; c < waveform.Channels; c++ {
+
+		center := float64(c*laneHeight) + float64(laneHeight)/2
+		half := float64(laneHeight) / 2
+
+		for x := 0; x < width; x++ {
+
+			from := x * waveform.Length / width
+			to := (x + 1) * waveform.Length / width
+
+			if to <= from {
+				to = from + 1
+			}
+
+			lo, hi := math.MaxInt32, math.MinInt32
+
+			for i := from; i < to && i < waveform.Length; i++ {
+				index := (i*waveform.Channels + c) * 2
+
+				if waveform.Data[index] < lo {
+					lo = waveform.Data[index]
+				}
+
+				if waveform.Data[index+1] > hi {
+					hi = waveform.Data[index+1]
+				}
+			}
+
+			top := int(math.Floor(center - float64(hi)/full*half))
+			bottom := int(math.Ceil(center - float64(lo)/full*half))
+
+			// silence still gets a one pixel line
+			if bottom <= top {
+				bottom = top + 1
+			}
+
+			for y := top; y < bottom; y++ {
+				img.Set(x, y, fill)
+			}
+		}
+	}
+
+	return img
+}
+
+var ErrNoAudioStream = errors.New("media has no audio stream")
+
+// HasAudioStream reports whether ffprobe finds an audio stream in the file.
+func HasAudioStream(inputPath string) (bool, error) {
+
+	cmd := exec.Command("ffprobe", "-v", "error",
+		"-select_streams", "a",
+		"-show_entries", "stream=index",
+		"-of", "csv=p=0",
+		inputPath)
+
+	out, err := cmd.Output()
+
+	if err != nil {
+		return false, err
+	}
+
+	return strings.TrimSpace(string(out)) != "", nil
+}
+
+// decodeWaveform decodes the audio of inputPath to PCM with ffmpeg and
+// streams it into ComputePeaks.
+func decodeWaveform(inputPath string, options WaveformOptions) (WaveformData, error) {
+
+	channels := 1
+
+	if options.Channels == WaveformStereo {
+		channels = 2
+	}
+
+	cmd := exec.Command("ffmpeg", "-v", "error",
+		"-i", inputPath,
+		"-vn",
+		"-ac", fmt.Sprint(channels),
+		"-ar", fmt.Sprint(waveformSampleRate),
+		"-f", "s16le",
+		"-acodec", "pcm_s16le",
+		"pipe:1")
+
+	stderr := bytes.Buffer{}
+	cmd.Stderr = &stderr
+
+	stdout, err := cmd.StdoutPipe()
+
+	if err != nil {
+		return WaveformData{}, err
+	}
+
+	err = cmd.Start()
+
+	if err != nil {
+		return WaveformData{}, err
+	}
+
+	waveform, err := ComputePeaks(stdout, channels, options.SamplesPerPixel, options.Bits)
+
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return waveform, err
+	}
+
+	err = cmd.Wait()
+
+	if err != nil {
+		return waveform, fmt.Errorf("ffmpeg: %v: %s", err, stderr.String())
+	}
+
+	return waveform, nil
+}
+
+// GenerateWaveform writes the peak data of the audio track of inputPath, and
+// optionally its PNG rendering, next to the other derived files and records
+// them as "waveform" variants of the upload.
+func (s *TranscoderService) GenerateWaveform(inputPath string, options WaveformOptions) ([]ResizedImageUrlAndSizeModel, error) {
+
+	err := options.Validate()
+
+	if err != nil {
+		return nil, err
+	}
+
+	options = options.withDefaults()
+
+	hasAudio, err := HasAudioStream(inputPath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !hasAudio {
+		return nil, ErrNoAudioStream
+	}
+
+	waveform, err := decodeWaveform(inputPath, options)
+
+	if err != nil {
+		return nil, err
+	}
+
+	fileId := mediaFileId(inputPath)
+	outputDir := fmt.Sprintf("./media/%s", fileId)
+
+	err = os.MkdirAll(outputDir, 0755)
+
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(waveform)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.WriteFile(fmt.Sprintf("%s/waveform.json", outputDir), data, 0644)
+
+	if err != nil {
+		return nil, err
+	}
+
+	outputs := []ResizedImageUrlAndSizeModel{{
+		Name:   "waveform-json",
+		Url:    fmt.Sprintf("https://kaykatjd.com/media/%s/waveform.json", fileId),
+		Size:   int64(len(data)),
+		Width:  waveform.Length,
+		Format: "json",
+	}}
+
+	if options.Png {
+		fill, _ := parseHexColor(options.Color)
+
+		buffer := bytes.Buffer{}
+
+		err = png.Encode(&buffer, RenderWaveform(waveform, options.PngWidth, options.PngHeight, fill))
+
+		if err != nil {
+			return nil, err
+		}
+
+		err = os.WriteFile(fmt.Sprintf("%s/waveform.png", outputDir), buffer.Bytes(), 0644)
+
+		if err != nil {
+			return nil, err
+		}
+
+		outputs = append(outputs, ResizedImageUrlAndSizeModel{
+			Name:   "waveform-png",
+			Url:    fmt.Sprintf("https://kaykatjd.com/media/%s/waveform.png", fileId),
+			Size:   int64(buffer.Len()),
+			Width:  options.PngWidth,
+			Height: options.PngHeight,
+			Format: "png",
+		})
+	}
+
+	log.Printf("Created waveform for %s with %d pixels", inputPath, waveform.Length)
+
+	uploadId, err := s.uploadIdForPath(inputPath)
+
+	if err != nil || uploadId == "" {
+		return outputs, err
+	}
+
+	err = s.Media.DeleteVariantRows(uploadId, "waveform")
+
+	if err != nil {
+		return outputs, err
+	}
+
+	return outputs, s.Media.WriteVariantsToDB(uploadId, "waveform", outputs)
+}